@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"fly-user-env/lib"
+)
+
+// RunSelfTest checks that this machine is correctly configured before it serves traffic: it
+// loads the storage config from the FLY_STORAGE_* environment variables, as the server does,
+// runs every self-test check and writes one line per check to out.
+// It reports whether every check that ran passed.
+func RunSelfTest(args []string, out io.Writer) (bool, error) {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	skip := flags.String("skip", "", "Comma-separated checks to skip: storage, lease, db, juicefs, cleanup")
+	asJSON := flags.Bool("json", false, "Write the results as JSON")
+	if err := flags.Parse(args); err != nil {
+		return false, err
+	}
+
+	if err := lib.SetupLoggingFromEnv(); err != nil {
+		return false, err
+	}
+	cfg, err := lib.NewSystemConfigFromEnv()
+	if err != nil {
+		return false, err
+	}
+	if cfg == nil {
+		return false, fmt.Errorf("FLY_STORAGE_BUCKET and FLY_STORAGE_ENDPOINT are required")
+	}
+
+	workDir, err := os.MkdirTemp("", "fly-user-env-selftest-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var skipped []string
+	for _, name := range strings.Split(*skip, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			skipped = append(skipped, name)
+		}
+	}
+	results, ok, err := lib.RunSelfTest(context.Background(), lib.SelfTestChecks(cfg, workDir), skipped)
+	if err != nil {
+		return false, err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return ok, enc.Encode(map[string]interface{}{"ok": ok, "checks": results})
+	}
+	for _, r := range results {
+		line := fmt.Sprintf("%-4s %-8s %s", strings.ToUpper(r.Status), r.Name, r.Duration.Round(time.Millisecond))
+		if r.Status == lib.SelfTestSkip {
+			line = fmt.Sprintf("%-4s %-8s", strings.ToUpper(r.Status), r.Name)
+		}
+		if r.Detail != "" {
+			line += "  " + r.Detail
+		}
+		fmt.Fprintln(out, line)
+	}
+	return ok, nil
+}
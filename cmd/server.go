@@ -3,59 +3,219 @@
 package cmd
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"fly-user-env/lib"
 )
 
+// cleanupTask is a named cleanup operation
+type cleanupTask struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
 // ServerCleanup represents a cleanup operation that can be deferred
 type ServerCleanup struct {
-	mu     sync.Mutex
-	tasks  []func() error
-	done   bool
-	errors []error
+	// Timeout bounds the whole cleanup sequence when non-zero. Tasks get a context ending at the
+	// deadline, and any still running when it passes are abandoned so the process can exit.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	tasks   []cleanupTask
+	done    bool
+	pending []string // names of the tasks not yet finished, in execution order
+	errors  []error
 }
 
-// Add adds a cleanup task to be executed
-func (c *ServerCleanup) Add(task func() error) {
+// Add adds a named cleanup task to be executed
+func (c *ServerCleanup) Add(name string, task func(ctx context.Context) error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if !c.done {
-		c.tasks = append(c.tasks, task)
+		c.tasks = append(c.tasks, cleanupTask{name: name, run: task})
 	}
 }
 
-// Execute runs all cleanup tasks in reverse order
-func (c *ServerCleanup) Execute() {
+// Execute runs all cleanup tasks in reverse order, returning an error if they did not finish
+// within Timeout. Only the first call runs the tasks, so it is safe to call again from a panic
+// handler; a call made while the tasks are running returns without waiting for them.
+func (c *ServerCleanup) Execute() error {
+	if c.Timeout <= 0 {
+		c.run(context.Background())
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		c.run(ctx)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		pending := c.Pending()
+		slog.Error("Shutdown deadline exceeded, exiting with cleanup pending", "timeout", c.Timeout, "pending", pending)
+		return fmt.Errorf("shutdown deadline of %s exceeded with %d cleanup tasks pending", c.Timeout, len(pending))
+	}
+}
+
+// run executes the tasks once, in reverse order (LIFO)
+func (c *ServerCleanup) run(ctx context.Context) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if c.done {
+		c.mu.Unlock()
 		return
 	}
 	c.done = true
-
-	// Execute tasks in reverse order (LIFO)
+	tasks := make([]cleanupTask, 0, len(c.tasks))
 	for i := len(c.tasks) - 1; i >= 0; i-- {
-		if err := c.tasks[i](); err != nil {
+		tasks = append(tasks, c.tasks[i])
+		c.pending = append(c.pending, c.tasks[i].name)
+	}
+	c.mu.Unlock()
+
+	for _, task := range tasks {
+		err := runCleanupTask(ctx, task)
+		c.mu.Lock()
+		c.pending = c.pending[1:]
+		if err != nil {
 			c.errors = append(c.errors, err)
-			log.Printf("Cleanup task failed: %v", err)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			slog.Warn("Cleanup task failed", "task", task.name, "error", err)
 		}
 	}
 }
 
+// runCleanupTask runs a task, turning a panic into an error so the remaining tasks still run
+func runCleanupTask(ctx context.Context, task cleanupTask) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("cleanup task %s panicked: %v", task.name, v)
+		}
+	}()
+	return task.run(ctx)
+}
+
+// HandlePanic runs the cleanup tasks before a panic crashes the process, so mounts, leases and
+// replication are released. It is installed as the lib panic handler.
+func (c *ServerCleanup) HandlePanic(v any) {
+	slog.Error("Panic, running cleanup before exiting", "panic", v)
+	if err := c.Execute(); err != nil {
+		slog.Error("Cleanup after panic did not complete", "error", err)
+	}
+}
+
+// Pending returns the names of the cleanup tasks that have not finished yet
+func (c *ServerCleanup) Pending() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.pending...)
+}
+
 // Errors returns any errors that occurred during cleanup
 func (c *ServerCleanup) Errors() []error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.errors
+	return append([]error(nil), c.errors...)
+}
+
+// routeFlags collects repeated --route PREFIX=ADDR flags
+type routeFlags []string
+
+func (f *routeFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *routeFlags) Set(value string) error {
+	if prefix, addr, ok := strings.Cut(value, "="); !ok || prefix == "" || addr == "" {
+		return fmt.Errorf("route %q must be PREFIX=ADDR", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// signalRouteFlags collects repeated --signal-route SIGNAL=TARGET[,TARGET...] flags
+type signalRouteFlags []string
+
+func (f *signalRouteFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *signalRouteFlags) Set(value string) error {
+	if _, _, err := lib.ParseSignalRoute(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// signalRoutes builds the signal routes from the --signal-route flags
+func (f signalRouteFlags) signalRoutes() (lib.SignalRoutes, error) {
+	routes := make(lib.SignalRoutes, len(f))
+	for _, value := range f {
+		sig, targets, err := lib.ParseSignalRoute(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := routes[sig]; ok {
+			return nil, fmt.Errorf("signal %v has more than one --signal-route", sig)
+		}
+		routes[sig] = targets
+	}
+	return routes, nil
+}
+
+// unsupervised reports a routed upstream that is not supervised as always running
+type unsupervised struct{}
+
+func (unsupervised) IsRunning() bool { return true }
+
+// dialProbe returns a readiness probe that passes once the target accepts connections
+func dialProbe(addr string) func(ctx context.Context) error {
+	network, address := "tcp", addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, address = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// parseCheckpointQuiesce parses the signals the supervised process is paused and resumed with
+// around checkpoints
+func parseCheckpointQuiesce(pause, resume string) (lib.CheckpointQuiesce, error) {
+	var q lib.CheckpointQuiesce
+	var err error
+	if q.PauseSignal, err = lib.ParseSignal(pause); err != nil {
+		return q, fmt.Errorf("invalid --checkpoint-pause-signal: %v", err)
+	}
+	if q.ResumeSignal, err = lib.ParseSignal(resume); err != nil {
+		return q, fmt.Errorf("invalid --checkpoint-resume-signal: %v", err)
+	}
+	return q, nil
 }
 
 // RunServer starts the server with the following responsibilities:
@@ -67,6 +227,15 @@ func (c *ServerCleanup) Errors() []error {
 // Required flags:
 //   - --listen: Address to listen on (default: 0.0.0.0:8080)
 //   - --target: Address to proxy to (required)
+//   - --request-id-header: Header carrying the request correlation ID (default X-Request-Id)
+//   - --remove-response-headers: Comma-separated upstream response headers to strip (e.g. Server)
+//   - --strip-headers: Comma-separated hop-by-hop headers to strip from proxied requests and responses
+//   - --rewrite-location: Rewrite redirects to the upstream's own address to the requested host
+//   - --route PREFIX=ADDR: Proxy requests under PREFIX to ADDR instead of --target (repeatable)
+//   - --flush-interval: Interval to flush proxied response bodies (default 0: only streamed and
+//     text/event-stream responses are flushed as written; -1ns flushes after every write)
+//   - --shutdown-timeout: Overall deadline for the shutdown sequence, after which the process
+//     exits with cleanup still pending (default 2m)
 //
 // Required environment variables:
 //   - CONTROLLER_TOKEN: Token for admin interface access
@@ -74,59 +243,287 @@ func (c *ServerCleanup) Errors() []error {
 // Optional environment variables for configuration:
 //   - FLY_STORAGE_BUCKET: S3 bucket name
 //   - FLY_STORAGE_ENDPOINT: S3 endpoint URL
-//   - FLY_STORAGE_ACCESS_KEY: S3 access key
-//   - FLY_STORAGE_SECRET_KEY: S3 secret key
+//   - FLY_STORAGE_ACCESS_KEY: S3 access key (optional, uses environment/role credentials if unset)
+//   - FLY_STORAGE_SECRET_KEY: S3 secret key (optional, uses environment/role credentials if unset)
+//   - FLY_STORAGE_SESSION_TOKEN: S3 session token for temporary credentials (optional)
 //   - FLY_STORAGE_REGION: S3 region (optional)
+//   - FLY_STORAGE_PATH_STYLE: false for virtual-host style bucket addressing, as AWS S3 prefers (optional, default true)
+//   - FLY_STORAGE_SKIP_REGION_CHECK: Use FLY_STORAGE_REGION as is, without checking it against the endpoint (optional)
+//   - FLY_STORAGE_SSE: Server-side encryption algorithm, AES256 or aws:kms (optional)
+//   - FLY_STORAGE_SSE_KMS_KEY_ID: KMS key ID for aws:kms encryption (optional)
+//   - FLY_ENV_ID: Environment ID; with no key prefix, storage paths go under envs/<id>/ (optional)
+//   - FLY_ENV_DIR: Directory holding the JuiceFS data (required for the juicefs stack)
+//   - FLY_JUICEFS_BINARY: Path of the juicefs binary (default juicefs from PATH)
+//   - FLY_JUICEFS_CHECKPOINT_DIR: Directory holding JuiceFS checkpoints (default inside the mount)
 //   - FLY_STACKS: Comma-separated list of stack components to enable
 //   - FLY_ENV_WAIT_FOR_CONFIG: If set, wait for config via HTTP endpoint
+//   - FLY_ENV_CONFIG_IN_STORAGE: If set, the FLY_STORAGE_* variables are only used to load
+//     the config from the storage bucket when no local config exists, and saved configs are
+//     mirrored there
+//   - FLY_ENV_STRICT_CONFIG: If set, fail startup when the config file exists but cannot be
+//     loaded (same as --strict-config)
+//   - FLY_LOG_LEVEL: Minimum log level: error, warn, info or debug (default info)
+//   - FLY_ENV_DIR_MODE, FLY_ENV_FILE_MODE: Octal permission modes of created directories and
+//     state files (default 0755 and 0644)
+//   - FLY_ENV_CONFIG_FILE_MODE: Octal permission mode of the config file, which holds
+//     storage credentials (default 0600)
+//   - FLY_LOG_PREFIX: Environment identifier attached to every log line (default FLY_ENV_ID,
+//     FLY_APP_NAME/FLY_MACHINE_ID, or the hostname)
 //
-// Returns an error if the service fails to start, and a cleanup function that should be called on shutdown.
-func RunServer() (error, *ServerCleanup, *lib.Supervisor) {
+// Returns an error if the service fails to start, a cleanup function that should be called on
+// shutdown, and the control instance that received signals are forwarded through.
+func RunServer() (error, *ServerCleanup, *lib.Control) {
 	cleanup := &ServerCleanup{}
+	// rule: a panic in any of our goroutines releases resources before the process crashes
+	lib.SetPanicHandler(cleanup.HandlePanic)
 
 	listenAddr := flag.String("listen", "0.0.0.0:8080", "Address to listen on")
 	targetAddr := flag.String("target", "", "Address to proxy to")
+	requestIDHeader := flag.String("request-id-header", lib.DefaultRequestIDHeader, "Header carrying the request correlation ID")
+	removeHeaders := flag.String("remove-response-headers", "", "Comma-separated upstream response headers to strip")
+	stripHeaders := flag.String("strip-headers", "", "Comma-separated hop-by-hop headers to strip from proxied requests and responses")
+	rewriteLocation := flag.Bool("rewrite-location", false, "Rewrite redirects to the upstream's own address to the requested host")
+	flushInterval := flag.Duration("flush-interval", 0, "Interval to flush proxied response bodies to the client; -1ns flushes after every write")
+	shedLatency := flag.Duration("shed-latency", 0, "Backend p99 latency above which a fraction of proxied requests is rejected with 503 (0 disables load shedding)")
+	shedFraction := flag.Float64("shed-fraction", lib.DefaultShedFraction, "Fraction of proxied requests rejected while the backend p99 latency exceeds --shed-latency, below 1")
+	shedWindow := flag.Int("shed-window", lib.DefaultShedWindow, "Number of recent backend latencies the p99 for load shedding is computed over")
+	backendH2C := flag.Bool("backend-h2c", false, "Speak HTTP/2 without TLS (h2c) to the proxied backends and accept h2c from clients, e.g. for gRPC")
+	maxIdleConns := flag.Int("max-idle-conns", 0, "Idle connections kept open to all proxied backends (0 for the default of 100, negative for no limit)")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 0, "Idle connections kept open to each proxied backend (0 for the default of 32, negative for no limit)")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", 0, "How long an idle backend connection is kept open (0 for the default of 90s, negative for no timeout)")
+	dialTimeout := flag.Duration("dial-timeout", 0, "How long connecting to a proxied backend may take before the request fails with 502 (0 for the default of 5s, negative for no timeout)")
+	unavailableStatus := flag.Int("unavailable-status", 0, "Status code served while the supervised process is not running (0 for 503)")
+	unavailableContentType := flag.String("unavailable-content-type", "", "Content type of the response served while the supervised process is not running (default text/plain)")
+	unavailableBodyFile := flag.String("unavailable-body-file", "", "File holding the response body served while the supervised process is not running, e.g. a \"starting up\" page")
+	unavailableRetryAfter := flag.Int("unavailable-retry-after", 0, "Retry-After seconds sent while the supervised process is not running (0 for the default of 5, negative to omit the header)")
+	strictConfig := flag.Bool("strict-config", os.Getenv("FLY_ENV_STRICT_CONFIG") != "", "Fail startup when the config file exists but cannot be loaded, instead of starting unconfigured")
+	shell := flag.Bool("shell", false, "Run the supervised command through sh -c, joining its arguments into one command line")
+	restartJitter := flag.Float64("restart-jitter", 0, "Fraction of the restart delay by which each restart of the process is randomized, between 0 and 1")
+	maxRestarts := flag.Int("max-restarts", 0, "Consecutive restarts of a process exiting within a minute of starting before it is left stopped (0 for unlimited)")
+	logLines := flag.Int("log-lines", 0, "Recent lines of the supervised process's output kept for GET /stack/supervisor/logs (0 to keep none)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", lib.DefaultAdminConfig().ShutdownTimeout, "Overall deadline for the shutdown sequence")
+	shutdownOperation := flag.String("shutdown-during-checkpoint", lib.ShutdownWaitForOperation, "How shutdown treats a checkpoint or restore in progress: wait for it to finish (up to --shutdown-timeout) or abort and roll it back")
+	controlRate := flag.Float64("control-rate", 0, "Requests per second each mutating control API endpoint accepts before answering 429 (0 for no limit)")
+	controlBurst := flag.Int("control-burst", lib.DefaultControlBurst, "Requests an idle control API endpoint accepts at once under --control-rate or --control-read-rate")
+	controlReadRate := flag.Float64("control-read-rate", 0, "Requests per second each read-only control API endpoint accepts (0 for no limit)")
+	checkpointPause := flag.String("checkpoint-pause-signal", "", "Signal sent to the supervised process before every checkpoint so it stops writing, e.g. SIGSTOP (empty to not pause it)")
+	checkpointResume := flag.String("checkpoint-resume-signal", "SIGCONT", "Signal sent to the supervised process once a checkpoint is done, with --checkpoint-pause-signal")
+	healthPath := flag.String("health-path", lib.DefaultHealthPath, "Path of the health endpoint on the admin host")
+	metricsPath := flag.String("metrics-path", lib.DefaultMetricsPath, "Path of the metrics endpoint on the admin host")
+	metricsListen := flag.String("metrics-listen", "", "Also serve --metrics-path, without the controller token, on this address, e.g. 127.0.0.1:9091; nothing else is served there (empty to disable)")
+	healthOnAppHost := flag.Bool("health-on-app-host", false, "Also answer --health-path and --metrics-path on the app's hosts, without the controller token, instead of proxying them to the app")
+	configTimeout := flag.Duration("config-timeout", lib.DefaultConfigTimeout, "Overall deadline for applying a config POST, after which partial setup is rolled back (negative for no deadline)")
+	tokenGrace := flag.Duration("token-grace", lib.DefaultTokenGrace, "How long the previous CONTROLLER_TOKEN is still accepted after the token is reloaded with SIGHUP or POST /token/reload (negative for no overlap)")
+	setupGuidance := flag.Bool("setup-guidance", true, "Report how to configure the server in its status while it is unconfigured")
+	reconcileInterval := flag.Duration("reconcile-interval", lib.DefaultReconcileInterval, "How often stacks that stopped working after setup are checked for and restarted (negative to disable)")
+	reconcileLease := flag.String("reconcile-lease", lib.ReconcileLeaseNever, "What the reconciliation loop does once the lease was lost: never leaves the environment fenced, reacquire sets every stack up again once the lease is free")
+	activeTar := flag.Bool("debug-active-tar", false, "Serve GET /stack/juicefs/active.tar, streaming the live JuiceFS active directory for debugging; it exposes user data")
+	activeTarMax := flag.Int64("debug-active-tar-max-mib", lib.DefaultActiveTarMaxMiB, "Largest active directory, in MiB, GET /stack/juicefs/active.tar streams (negative for no limit)")
+	readyWebhook := flag.String("ready-webhook", "", "URL POSTed the status and environment ID each time the environment becomes ready (empty to disable)")
+	readyWebhookRetries := flag.Int("ready-webhook-retries", lib.DefaultReadyWebhookRetries, "How many times a failed --ready-webhook call is retried (negative to disable retries)")
+	readyWebhookBackoff := flag.Duration("ready-webhook-backoff", lib.DefaultReadyWebhookBackoff, "Wait before the first --ready-webhook retry, doubling after each")
+	startAfterSetup := flag.Bool("start-after-setup", false, "Do not start the supervised process until a config has been applied and its stacks are set up")
+	var routes routeFlags
+	flag.Var(&routes, "route", "Proxy requests under a path prefix to another upstream, as PREFIX=ADDR (repeatable)")
+	var signalRoutes signalRouteFlags
+	flag.Var(&signalRoutes, "signal-route", "Forward a signal the server receives only to the listed processes, as SIGNAL=TARGET[,TARGET...] where a target is app or a stack running its own process (repeatable)")
 	flag.Parse()
 
+	if err := lib.SetupLoggingFromEnv(); err != nil {
+		return err, cleanup, nil
+	}
+	if err := lib.SetFileModesFromEnv(); err != nil {
+		return err, cleanup, nil
+	}
+
 	if *targetAddr == "" {
 		return fmt.Errorf("--target flag is required"), cleanup, nil
 	}
+	if *restartJitter < 0 || *restartJitter > 1 {
+		return fmt.Errorf("--restart-jitter must be between 0 and 1"), cleanup, nil
+	}
+	if *maxRestarts < 0 {
+		return fmt.Errorf("--max-restarts must not be negative"), cleanup, nil
+	}
+	if *logLines < 0 {
+		return fmt.Errorf("--log-lines must not be negative"), cleanup, nil
+	}
+	pool := lib.ConnPoolConfig{MaxIdleConns: *maxIdleConns, MaxIdleConnsPerHost: *maxIdleConnsPerHost, IdleConnTimeout: *idleConnTimeout}
+	if err := pool.Validate(); err != nil {
+		return fmt.Errorf("invalid connection pool flags: %v", err), cleanup, nil
+	}
+	unavailable := lib.UnavailableResponse{StatusCode: *unavailableStatus, ContentType: *unavailableContentType, RetryAfter: *unavailableRetryAfter}
+	if *unavailableBodyFile != "" {
+		body, err := os.ReadFile(*unavailableBodyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read --unavailable-body-file: %v", err), cleanup, nil
+		}
+		unavailable.Body = string(body)
+	}
+	if err := unavailable.Validate(); err != nil {
+		return fmt.Errorf("invalid unavailable response flags: %v", err), cleanup, nil
+	}
+	shed := lib.LoadShedConfig{Threshold: *shedLatency, Fraction: *shedFraction, Window: *shedWindow}
+	if err := shed.Validate(); err != nil {
+		return fmt.Errorf("invalid load shedding flags: %v", err), cleanup, nil
+	}
 
 	args := flag.Args()
 	if len(args) == 0 {
 		return fmt.Errorf("command to supervise is required"), cleanup, nil
 	}
 
-	token := os.Getenv("CONTROLLER_TOKEN")
+	token, err := lib.SecretEnv("CONTROLLER_TOKEN")
+	if err != nil {
+		return err, cleanup, nil
+	}
 	if token == "" {
-		return fmt.Errorf("CONTROLLER_TOKEN environment variable is required for controller access"), cleanup, nil
+		return fmt.Errorf("CONTROLLER_TOKEN or CONTROLLER_TOKEN_FILE environment variable is required for controller access"), cleanup, nil
 	}
 
 	// Get default config
 	config := lib.DefaultAdminConfig()
+	config.ShutdownTimeout = *shutdownTimeout
+	config.RestartJitter = *restartJitter
+	config.MaxRestarts = *maxRestarts
+	config.Shell = *shell
+	cleanup.Timeout = config.ShutdownTimeout
 
+	// rule: the process starts only once the stacks it writes into are ready, e.g. the JuiceFS active directory
+	var control *lib.Control
 	supervisor := lib.NewSupervisor(args, lib.SupervisorConfig{
-		TimeoutStop:  config.TimeoutStop,
-		RestartDelay: config.RestartDelay,
+		TimeoutStop:    config.TimeoutStop,
+		RestartDelay:   config.RestartDelay,
+		RestartJitter:  config.RestartJitter,
+		MaxRestarts:    config.MaxRestarts,
+		Shell:          config.Shell,
+		LogLines:       *logLines,
+		ReadinessProbe: dialProbe(*targetAddr),
+		PreStart: func(ctx context.Context) error {
+			return control.WaitForStart(ctx)
+		},
 	})
 
 	// Create control instance
-	control := lib.NewControl(*targetAddr, "fly-app-controller", token, "tmp", supervisor)
+	control = lib.NewControl(*targetAddr, "fly-app-controller", token, "tmp", supervisor)
+	if err := checkStartupConfig(control, *strictConfig); err != nil {
+		return err, cleanup, nil
+	}
+	control.SetConfigTimeout(*configTimeout)
+	control.SetStartAfterSetup(*startAfterSetup)
+	control.SetSetupGuidance(*setupGuidance)
+	control.SetActiveTar(lib.ActiveTarConfig{Enabled: *activeTar, MaxMiB: *activeTarMax})
+	control.SetTokenSource(func() (string, error) {
+		return lib.SecretEnv("CONTROLLER_TOKEN")
+	}, *tokenGrace)
+	if *checkpointPause != "" {
+		quiesce, err := parseCheckpointQuiesce(*checkpointPause, *checkpointResume)
+		if err != nil {
+			return err, cleanup, nil
+		}
+		if err := control.SetCheckpointQuiesce(quiesce); err != nil {
+			return err, cleanup, nil
+		}
+	}
+	if len(signalRoutes) > 0 {
+		routes, err := signalRoutes.signalRoutes()
+		if err != nil {
+			return err, cleanup, nil
+		}
+		if err := control.SetSignalRoutes(routes); err != nil {
+			return err, cleanup, nil
+		}
+	}
+	if err := control.SetHealthEndpoints(lib.HealthEndpoints{HealthPath: *healthPath, MetricsPath: *metricsPath, OnAppHost: *healthOnAppHost}); err != nil {
+		return fmt.Errorf("invalid health endpoint flags: %v", err), cleanup, nil
+	}
+	if err := control.SetRateLimit(lib.ControlRateLimit{Rate: *controlRate, Burst: *controlBurst, ReadRate: *controlReadRate}); err != nil {
+		return fmt.Errorf("invalid control rate limit flags: %v", err), cleanup, nil
+	}
+	if err := control.SetShutdownOperationPolicy(*shutdownOperation); err != nil {
+		return fmt.Errorf("invalid --shutdown-during-checkpoint: %v", err), cleanup, nil
+	}
+	if err := control.SetReconcile(lib.ReconcileConfig{Interval: *reconcileInterval, Lease: *reconcileLease}); err != nil {
+		return fmt.Errorf("invalid --reconcile-lease: %v", err), cleanup, nil
+	}
+	if err := control.SetReadyWebhook(lib.ReadyWebhookConfig{URL: *readyWebhook, Retries: *readyWebhookRetries, Backoff: *readyWebhookBackoff}); err != nil {
+		return fmt.Errorf("invalid --ready-webhook: %v", err), cleanup, nil
+	}
 
-	proxy, err := lib.New(*targetAddr, supervisor)
+	rewrite := lib.HeaderRewrite{RewriteLocation: *rewriteLocation}
+	for _, name := range strings.Split(*removeHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			rewrite.Remove = append(rewrite.Remove, name)
+		}
+	}
+	for _, name := range strings.Split(*stripHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			rewrite.Strip = append(rewrite.Strip, name)
+		}
+	}
+	newProxy := func(addr string, status lib.StatusProvider) (*lib.Proxy, error) {
+		p, err := lib.New(addr, status)
+		if err != nil {
+			return nil, err
+		}
+		p.SetRequestIDHeader(*requestIDHeader)
+		p.SetHeaderRewrite(rewrite)
+		p.SetFlushInterval(*flushInterval)
+		p.SetLoadShedding(shed)
+		p.SetMetrics(control.ProxyMetrics())
+		if err := p.SetBackendH2C(*backendH2C); err != nil {
+			return nil, err
+		}
+		if err := p.SetConnPool(pool); err != nil {
+			return nil, err
+		}
+		if err := p.SetDialTimeout(*dialTimeout); err != nil {
+			return nil, err
+		}
+		if err := p.SetUnavailableResponse(unavailable); err != nil {
+			return nil, err
+		}
+		p.SetReconfigureProvider(control)
+		p.SetMaintenanceProvider(control)
+		p.SetDrainProvider(control)
+		return p, nil
+	}
+
+	// rule: the default target is only served once its process and every critical stack are ready
+	proxy, err := newProxy(*targetAddr, lib.NewReadinessGate(supervisor, control))
 	if err != nil {
 		return fmt.Errorf("failed to create proxy: %v", err), cleanup, nil
 	}
+	if err := control.SetProxy(proxy); err != nil {
+		return fmt.Errorf("failed to apply configured proxy target: %v", err), cleanup, nil
+	}
+
+	// rule: only the default target follows the supervised process and config target overrides
+	router := lib.NewRouter(proxy)
+	for _, r := range routes {
+		prefix, addr, _ := strings.Cut(r, "=")
+		routeProxy, err := newProxy(addr, unsupervised{})
+		if err != nil {
+			return fmt.Errorf("failed to create proxy for route %s: %v", prefix, err), cleanup, nil
+		}
+		if err := router.Handle(prefix, routeProxy); err != nil {
+			return err, cleanup, nil
+		}
+		slog.Info("Routing path prefix", "prefix", prefix, "target", addr)
+	}
 
+	// rule: the admin interface is matched first, so allowed_hosts never locks out the controller.
+	// Health checks answered on the app host come before allowed_hosts too: they address the machine directly.
+	proxied := control.AppHostHealth(control.HostFilter(router))
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host := r.Host
 		if strings.EqualFold(host, "fly-app-controller") {
-			log.Printf("[supervisor] Routing to admin interface for host: %s", host)
+			slog.Debug("Routing to admin interface", "host", host)
 			control.ServeHTTP(w, r)
 			return
 		}
-		log.Printf("[supervisor] Routing to proxy for host: %s", host)
-		proxy.ServeHTTP(w, r)
+		slog.Debug("Routing to proxy", "host", host)
+		proxied.ServeHTTP(w, r)
 	})
 
 	mux := http.NewServeMux()
@@ -136,53 +533,146 @@ func RunServer() (error, *ServerCleanup, *lib.Supervisor) {
 		Addr:    *listenAddr,
 		Handler: mux,
 	}
+	if *backendH2C {
+		// rule: gRPC clients need HTTP/2 end to end, so the listener accepts h2c alongside HTTP/1.1
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	// Add server shutdown to cleanup
-	cleanup.Add(func() error {
+	cleanup.Add("http server", func(ctx context.Context) error {
 		return server.Close()
 	})
 
-	log.Printf("Starting supervisor on %s, proxying to %s", *listenAddr, *targetAddr)
+	// rule: control shutdown runs before the server closes so leases are handed off first
+	cleanup.Add("control", func(ctx context.Context) error {
+		return control.Shutdown(ctx)
+	})
+
+	// rule: SIGHUP reloads the controller token, e.g. after CONTROLLER_TOKEN_FILE was replaced, instead of stopping the server
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		defer lib.RecoverPanic("token reload")
+		for range reload {
+			if _, err := control.ReloadToken(); err != nil {
+				slog.Error("Failed to reload controller token", "error", err)
+			}
+		}
+	}()
+	cleanup.Add("token reload", func(ctx context.Context) error {
+		signal.Stop(reload)
+		return nil
+	})
+
+	if *metricsListen != "" {
+		metricsServer, err := startMetricsListener(*metricsListen, control.MetricsHandler())
+		if err != nil {
+			return err, cleanup, nil
+		}
+		cleanup.Add("metrics server", func(ctx context.Context) error {
+			return metricsServer.Close()
+		})
+	}
+
+	slog.Info("Starting supervisor", "listen", *listenAddr, "target", *targetAddr)
 
 	// Start server in a goroutine
 	go func() {
+		defer lib.RecoverPanic("http server")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("HTTP server error: %v", err)
+			slog.Error("HTTP server error", "error", err)
+		}
+	}()
+
+	// rule: the process starts in the background, since its PreStart hook holds it until the stacks are ready
+	go func() {
+		defer lib.RecoverPanic("process start")
+		if err := supervisor.StartProcess(); err != nil {
+			slog.Error("Failed to start supervised process", "error", err)
+		}
+	}()
+
+	return nil, cleanup, control
+}
+
+// startMetricsListener serves handler on a dedicated metrics address. The address is bound before
+// returning, so a taken port fails startup instead of only being logged.
+func startMetricsListener(addr string, handler http.Handler) (*http.Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --metrics-listen %q: %v", addr, err)
+	}
+	// rule: the metrics listener has no token, so binding it to every interface is allowed but called out
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		slog.Warn("Metrics are served without authentication on every interface; bind --metrics-listen to localhost or a private address", "listen", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		defer lib.RecoverPanic("metrics server")
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server error", "error", err)
 		}
 	}()
+	slog.Info("Serving metrics", "listen", ln.Addr().String())
+	return server, nil
+}
 
-	return nil, cleanup, supervisor
+// checkStartupConfig fails startup in strict mode when the config could not be loaded.
+// rule: a missing config file is not an error; only one that exists but is broken stops startup
+func checkStartupConfig(control *lib.Control, strict bool) error {
+	err := control.ConfigError()
+	if err == nil {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("refusing to start with an unusable config: %w", err)
+	}
+	slog.Warn("Starting unconfigured: the config could not be loaded", "error", err)
+	return nil
 }
 
 // RunServerAndWait starts the server and waits for shutdown signals.
 // This is the main entry point for the server command.
 func RunServerAndWait() error {
-	err, cleanup, supervisor := RunServer()
+	err, cleanup, control := RunServer()
 	if err != nil {
 		return err
 	}
+	defer lib.RecoverPanic("main loop")
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal, also forwarding the signals routed with --signal-route
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, control.RoutedSignals()...)...)
 
 	for {
 		sig := <-sigChan
-		log.Printf("Received signal: %v, forwarding to supervised process", sig)
-		if supervisor != nil {
-			supervisor.ForwardSignal(sig)
+		stop := sig == syscall.SIGINT || sig == syscall.SIGTERM
+		// rule: an unrouted stop signal reaches the app through Shutdown, once new traffic is drained
+		if !stop || slices.Contains(control.RoutedSignals(), sig) {
+			slog.Info("Received signal, forwarding it", "signal", sig)
+			if err := control.ForwardSignal(sig); err != nil {
+				slog.Warn("Failed to forward signal", "signal", sig, "error", err)
+			}
 		}
-		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+		if stop {
 			break
 		}
 	}
 
-	log.Printf("Shutting down...")
-	cleanup.Execute()
+	slog.Info("Shutting down", "timeout", cleanup.Timeout)
+	if err := cleanup.Execute(); err != nil {
+		return err
+	}
 	if errs := cleanup.Errors(); len(errs) > 0 {
-		log.Printf("Cleanup completed with %d errors", len(errs))
+		slog.Warn("Cleanup completed with errors", "errors", len(errs))
 		return fmt.Errorf("cleanup completed with %d errors", len(errs))
 	}
-	log.Printf("Cleanup completed successfully")
+	slog.Info("Cleanup completed successfully")
 	return nil
 }
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fly-user-env/lib"
+)
+
+func TestServerCleanupHonorsDeadline(t *testing.T) {
+	cleanup := &ServerCleanup{Timeout: 100 * time.Millisecond}
+	var ran []string
+	cleanup.Add("first", func(ctx context.Context) error {
+		ran = append(ran, "first")
+		return nil
+	})
+	// A stuck task that ignores its context
+	stuck := make(chan struct{})
+	defer close(stuck)
+	cleanup.Add("stuck", func(ctx context.Context) error {
+		<-stuck
+		return nil
+	})
+	cleanup.Add("last", func(ctx context.Context) error {
+		ran = append(ran, "last")
+		return nil
+	})
+
+	start := time.Now()
+	if err := cleanup.Execute(); err == nil {
+		t.Fatal("Expected an error once the deadline passed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected cleanup to give up at the deadline, took %s", elapsed)
+	}
+	if pending := cleanup.Pending(); !slices.Equal(pending, []string{"stuck", "first"}) {
+		t.Errorf("Expected the stuck and following tasks to be pending, got %v", pending)
+	}
+	if !slices.Equal(ran, []string{"last"}) {
+		t.Errorf("Expected tasks to run in reverse order until the stuck one, got %v", ran)
+	}
+
+	// Tasks run only once
+	if err := cleanup.Execute(); err != nil {
+		t.Errorf("Expected a repeated Execute to be a no-op, got %v", err)
+	}
+}
+
+func TestServerCleanupRunsOnPanic(t *testing.T) {
+	cleanup := &ServerCleanup{Timeout: time.Second}
+	var ran []string
+	cleanup.Add("first", func(ctx context.Context) error {
+		ran = append(ran, "first")
+		return nil
+	})
+	cleanup.Add("broken", func(ctx context.Context) error {
+		panic("cleanup bug")
+	})
+	lib.SetPanicHandler(cleanup.HandlePanic)
+	defer lib.SetPanicHandler(nil)
+
+	// The panic is re-raised once cleanup has run
+	func() {
+		defer func() {
+			if v := recover(); v != "boom" {
+				t.Errorf("Expected the panic to be re-raised, got %v", v)
+			}
+		}()
+		func() {
+			defer lib.RecoverPanic("test")
+			panic("boom")
+		}()
+	}()
+
+	if !slices.Equal(ran, []string{"first"}) {
+		t.Errorf("Expected cleanup to run past the panicking task, got %v", ran)
+	}
+	if errs := cleanup.Errors(); len(errs) != 1 {
+		t.Errorf("Expected the panicking task to be reported as an error, got %v", errs)
+	}
+}
+
+func TestStrictConfigFailsStartupOnCorruptConfig(t *testing.T) {
+	for _, name := range []string{"FLY_STORAGE_BUCKET", "FLY_STORAGE_ENDPOINT", "FLY_ENV_CONFIG_IN_STORAGE", "FLY_ENV_WAIT_FOR_CONFIG"} {
+		t.Setenv(name, "")
+	}
+	defer func(attempts int) { lib.ConfigLoadAttempts = attempts }(lib.ConfigLoadAttempts)
+	lib.ConfigLoadAttempts = 1
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"storage": {"bucket": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	control := lib.NewControlWithConfig("localhost:8080", "fly-app-controller", "token", nil, configPath, dir)
+	if err := checkStartupConfig(control, true); err == nil || !strings.Contains(err.Error(), "failed to parse config") {
+		t.Errorf("Expected strict mode to fail startup on a corrupt config, got %v", err)
+	}
+	if err := checkStartupConfig(control, false); err != nil {
+		t.Errorf("Expected lenient mode to start unconfigured, got %v", err)
+	}
+
+	// A genuinely absent config is not an error, even in strict mode
+	absent := lib.NewControlWithConfig("localhost:8080", "fly-app-controller", "token", nil, filepath.Join(dir, "missing.json"), dir)
+	if err := checkStartupConfig(absent, true); err != nil {
+		t.Errorf("Expected a missing config to be allowed, got %v", err)
+	}
+}
@@ -1,17 +1,17 @@
 module fly-user-env
 
-go 1.22
+go 1.24
 
 toolchain go1.24.0
 
 require (
+	github.com/aws/aws-sdk-go v1.55.7
 	github.com/benbjohnson/litestream v0.3.14-0.20241108221848-d1b40b0e7639
 	github.com/stretchr/testify v1.10.0
 )
 
 require (
 	filippo.io/age v1.1.1 // indirect
-	github.com/aws/aws-sdk-go v1.55.7 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// DefaultActiveTarMaxMiB bounds the files streamed by GET /stack/juicefs/active.tar when not configured
+const DefaultActiveTarMaxMiB = 1024
+
+// errActiveTarTooLarge is returned when the active directory grows past the limit while streaming
+var errActiveTarTooLarge = errors.New("active directory exceeds the size limit")
+
+// ActiveTarConfig configures GET /stack/juicefs/active.tar, which streams a tar of the live JuiceFS
+// active directory for debugging. Unlike a checkpoint it is not a snapshot: files changing while
+// they are streamed may be captured in a mixed state.
+type ActiveTarConfig struct {
+	// Enabled serves the endpoint; it exposes user data, so it is off unless asked for
+	Enabled bool
+	// MaxMiB bounds the total size of the files streamed. Zero uses DefaultActiveTarMaxMiB and a
+	// negative value removes the limit.
+	MaxMiB int64
+}
+
+// maxBytes returns the size limit in bytes, or a negative value for no limit
+func (cfg ActiveTarConfig) maxBytes() int64 {
+	switch {
+	case cfg.MaxMiB < 0:
+		return -1
+	case cfg.MaxMiB == 0:
+		return DefaultActiveTarMaxMiB << 20
+	default:
+		return cfg.MaxMiB << 20
+	}
+}
+
+// SetActiveTar enables or disables streaming the JuiceFS active directory as a tar
+func (c *Control) SetActiveTar(cfg ActiveTarConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activeTar = cfg
+}
+
+// handleActiveTar streams the active directory of the JuiceFS component as a tar
+func (c *Control) handleActiveTar(j *JuiceFSComponent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fail := func(status int, body map[string]interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(body)
+		}
+		c.mu.RLock()
+		cfg := c.activeTar
+		c.mu.RUnlock()
+		if !cfg.Enabled {
+			fail(http.StatusForbidden, map[string]interface{}{"error": "streaming the active directory is disabled; start the server with --debug-active-tar"})
+			return
+		}
+		if !j.Ready() {
+			fail(http.StatusConflict, map[string]interface{}{"error": "component not ready"})
+			return
+		}
+
+		// rule: an oversized directory is refused before anything is sent, so the client gets a clear error rather than a cut-off tar
+		limit := cfg.maxBytes()
+		size, err := diskUsage(j.activeDir)
+		if err != nil {
+			fail(http.StatusInternalServerError, map[string]interface{}{"error": fmt.Sprintf("failed to measure active directory: %v", err)})
+			return
+		}
+		if limit >= 0 && size > limit {
+			fail(http.StatusRequestEntityTooLarge, map[string]interface{}{
+				"error":      fmt.Sprintf("active directory holds %d bytes, more than the %d byte limit", size, limit),
+				"size_bytes": size,
+				"max_bytes":  limit,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", `attachment; filename="active.tar"`)
+		if err := writeDirTar(r.Context(), w, j.activeDir, limit); err != nil {
+			// The status is already sent; the client sees a tar without its end marker
+			logWarnf("Streaming the active directory stopped: %v", err)
+		}
+	}
+}
+
+// writeDirTar writes a tar of the directories, regular files and symlinks under dir, stopping
+// once the files written exceed limit bytes unless it is negative. Entries removed while walking
+// are skipped, and symlinks are stored rather than followed.
+func writeDirTar(ctx context.Context, w io.Writer, dir string, limit int64) error {
+	tw := tar.NewWriter(w)
+	var written int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		link := ""
+		switch {
+		case info.Mode().IsRegular(), info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if !info.Mode().IsRegular() {
+			return tw.WriteHeader(hdr)
+		}
+
+		if limit >= 0 && written+hdr.Size > limit {
+			return fmt.Errorf("%w of %d bytes at %s", errActiveTarTooLarge, limit, hdr.Name)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		// A file that grew since it was listed is cut at its listed size; one that shrank fails the tar
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return fmt.Errorf("failed to stream %s: %w", hdr.Name, err)
+		}
+		written += hdr.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
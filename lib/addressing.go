@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// virtualHostBucketPattern matches bucket names usable as a DNS label under TLS: dotted names
+// would not match the endpoint's wildcard certificate
+var virtualHostBucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// pathStyle reports whether requests address the bucket in the path (endpoint/bucket/key) rather
+// than the hostname (bucket.endpoint/key). Path-style is the default, as Tigris and MinIO expect.
+func (cfg *ObjectStorageConfig) pathStyle() bool {
+	return cfg.PathStyle == nil || *cfg.PathStyle
+}
+
+// validateAddressing checks that the bucket and endpoint can be addressed virtual-host style
+// when path-style addressing is turned off
+func (cfg *ObjectStorageConfig) validateAddressing() error {
+	if cfg.pathStyle() {
+		return nil
+	}
+	if !virtualHostBucketPattern.MatchString(cfg.Bucket) {
+		return fmt.Errorf("bucket %q cannot be addressed virtual-host style: set path_style or use a lowercase name without dots", cfg.Bucket)
+	}
+	if u, err := url.Parse(cfg.Endpoint); err != nil || u.Host == "" {
+		return fmt.Errorf("endpoint %q must be a URL with a host for virtual-host style addressing", cfg.Endpoint)
+	}
+	return nil
+}
+
+// juicefsBucketURL returns the bucket URL passed to `juicefs format`. JuiceFS infers the
+// addressing style from it: the bucket in the hostname selects virtual-host style.
+func (cfg *ObjectStorageConfig) juicefsBucketURL() string {
+	if cfg.pathStyle() {
+		return cfg.Endpoint + "/" + cfg.Bucket
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return cfg.Endpoint + "/" + cfg.Bucket
+	}
+	u.Host = cfg.Bucket + "." + u.Host
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u.String()
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	original := []byte(`{"version": 1, "storage": {"bucket": "old", "endpoint": "e"}}`)
+	if err := os.WriteFile(configPath, original, 0644); err != nil {
+		t.Fatalf("Failed to write original config: %v", err)
+	}
+
+	// Simulate a crash between writing the temporary file and renaming it
+	crash := errors.New("crashed before rename")
+	renameFile = func(oldpath, newpath string) error { return crash }
+	defer func() { renameFile = os.Rename }()
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", dir, nil)
+	control.config = &SystemConfig{Version: 1, Storage: ObjectStorageConfig{Bucket: "new", Endpoint: "e"}}
+	if err := control.saveConfig(); !errors.Is(err, crash) {
+		t.Fatalf("Expected interrupted save to fail, got %v", err)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if string(data) != string(original) {
+		t.Errorf("Original config was modified: %s", data)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read data dir: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() != "config.json" {
+			t.Errorf("Unexpected leftover file %s", e.Name())
+		}
+	}
+
+	// Once writes succeed again the new config replaces the old one
+	renameFile = os.Rename
+	if err := control.saveConfig(); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := control.loadConfig(); err != nil {
+		t.Fatalf("Failed to load saved config: %v", err)
+	}
+	if control.config.Storage.Bucket != "new" {
+		t.Errorf("Expected bucket %q, got %q", "new", control.config.Storage.Bucket)
+	}
+}
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// SetAutoRestart enables or disables automatic restart of the supervised process at runtime.
+// It is meant for debugging a crashing process: with restarts disabled, the process stays
+// stopped after it exits so the failure can be inspected without tearing down the environment.
+func (c *Control) SetAutoRestart(enabled bool) error {
+	if c.supervisor == nil {
+		return errNoSupervisor
+	}
+	c.supervisor.SetAutoRestart(enabled)
+	logInfof("Automatic process restart enabled: %v", enabled)
+	c.events.Record(EventAutoRestartChanged, "control", "", map[string]string{"enabled": strconv.FormatBool(enabled)})
+	c.NotifyStatusChange()
+	return nil
+}
+
+// handleAutoRestart reports or toggles automatic restart of the supervised process
+func (c *Control) handleAutoRestart(w http.ResponseWriter, r *http.Request) {
+	if c.supervisor == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errNoSupervisor.Error()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			if err == nil {
+				err = fmt.Errorf("enabled is required")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		c.SetAutoRestart(*req.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": c.supervisor.AutoRestart()})
+}
@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// autosaveTimeout bounds the shutdown checkpoint when the shutdown context has no earlier deadline
+const autosaveTimeout = 30 * time.Second
+
+// autosavePrefix prefixes the IDs of checkpoints created automatically on shutdown
+const autosavePrefix = "autosave-"
+
+// currentCheckpoint points at the checkpoint holding the environment's latest saved state
+type currentCheckpoint struct {
+	CheckpointID string    `json:"checkpoint_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// currentCheckpointPath returns the path of the persisted current checkpoint pointer
+func (c *Control) currentCheckpointPath() string {
+	return filepath.Join(c.dataDir, "current.json")
+}
+
+// saveCurrentCheckpoint persists the pointer to the checkpoint with the given ID
+func (c *Control) saveCurrentCheckpoint(id string) error {
+	data, err := json.Marshal(currentCheckpoint{CheckpointID: id, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal current checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(c.currentCheckpointPath(), data, FileMode); err != nil {
+		return fmt.Errorf("failed to write current checkpoint: %w", err)
+	}
+	return nil
+}
+
+// loadCurrentCheckpoint returns the persisted current checkpoint pointer, or nil if there is none
+func (c *Control) loadCurrentCheckpoint() (*currentCheckpoint, error) {
+	data, err := os.ReadFile(c.currentCheckpointPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current checkpoint: %w", err)
+	}
+	var current currentCheckpoint
+	if err := json.Unmarshal(data, &current); err != nil {
+		return nil, fmt.Errorf("failed to parse current checkpoint: %w", err)
+	}
+	return &current, nil
+}
+
+// autosave checkpoints every checkpointable component if autosave_on_shutdown is enabled,
+// flushes replication and records the checkpoint as current. It returns the checkpoint ID,
+// or "" if nothing was saved.
+func (c *Control) autosave(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config == nil || !c.config.AutosaveOnShutdown {
+		return "", nil
+	}
+	// rule: a suspended environment is already checkpointed under its suspend token
+	if c.suspension != nil {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, autosaveTimeout)
+	defer cancel()
+	ctx = withCheckpointTag(ctx)
+
+	id := fmt.Sprintf("%s%d", autosavePrefix, time.Now().UnixNano())
+	var created []CheckpointableComponent
+	for _, comp := range c.components {
+		cc, ok := comp.(CheckpointableComponent)
+		if !ok {
+			continue
+		}
+		if _, err := cc.CreateCheckpoint(ctx, id); err != nil {
+			// Don't leave a partial checkpoint that a later boot could mistake for a complete one
+			for _, done := range created {
+				if cd, ok := done.(CheckpointDeleter); ok {
+					if err := cd.DeleteCheckpoint(ctx, id); err != nil {
+						logWarnf("Failed to delete partial autosave checkpoint of %s: %v", done.Name(), err)
+					}
+				}
+			}
+			return "", fmt.Errorf("failed to checkpoint %s: %w", cc.Name(), err)
+		}
+		created = append(created, cc)
+	}
+	if len(created) == 0 {
+		return "", nil
+	}
+
+	// Flush replication last so the checkpoints themselves are durable
+	for _, comp := range c.components {
+		if rs, ok := comp.(ReplicationSyncer); ok {
+			if err := rs.SyncReplication(ctx); err != nil {
+				return "", fmt.Errorf("failed to flush replication of %s: %w", rs.Name(), err)
+			}
+		}
+	}
+
+	if err := c.saveCurrentCheckpoint(id); err != nil {
+		return "", err
+	}
+	c.events.Record(EventCheckpointCreated, "control", "autosave on shutdown", map[string]string{"checkpoint_id": id})
+	logInfof("Saved shutdown checkpoint %s", id)
+	return id, nil
+}
+
+// Auto-restore policies accepted in SystemConfig.AutoRestore
+const (
+	AutoRestoreLatest  = "latest"
+	AutoRestoreCurrent = "current"
+	AutoRestoreNamed   = "named"
+)
+
+// validateAutoRestore checks that the auto-restore policy is known and complete
+func (cfg *SystemConfig) validateAutoRestore() error {
+	switch cfg.AutoRestore {
+	case "", AutoRestoreLatest, AutoRestoreCurrent:
+		return nil
+	case AutoRestoreNamed:
+		if cfg.AutoRestoreID == "" {
+			return fmt.Errorf("auto_restore %q requires auto_restore_id", AutoRestoreNamed)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported auto_restore policy %q (expected %q, %q or %q)",
+			cfg.AutoRestore, AutoRestoreLatest, AutoRestoreCurrent, AutoRestoreNamed)
+	}
+}
+
+// latestAutosave returns the newest shutdown checkpoint listed by any component, or "" if there is none
+func (c *Control) latestAutosave(ctx context.Context) (string, error) {
+	latest, latestTime := "", int64(0)
+	for _, comp := range c.components {
+		cl, ok := comp.(CheckpointLister)
+		if !ok {
+			continue
+		}
+		ids, err := cl.ListCheckpoints(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to list checkpoints of %s: %w", cl.Name(), err)
+		}
+		for _, id := range ids {
+			ts, err := strconv.ParseInt(strings.TrimPrefix(id, autosavePrefix), 10, 64)
+			if !strings.HasPrefix(id, autosavePrefix) || err != nil {
+				continue
+			}
+			if ts > latestTime {
+				latest, latestTime = id, ts
+			}
+		}
+	}
+	return latest, nil
+}
+
+// autoRestoreTarget returns the checkpoint selected by the auto-restore policy, or "" if there is none
+func (c *Control) autoRestoreTarget(ctx context.Context, cfg *SystemConfig) (string, error) {
+	switch cfg.AutoRestore {
+	case AutoRestoreLatest:
+		return c.latestAutosave(ctx)
+	case AutoRestoreCurrent:
+		current, err := c.loadCurrentCheckpoint()
+		if err != nil || current == nil {
+			return "", err
+		}
+		return current.CheckpointID, nil
+	case AutoRestoreNamed:
+		return cfg.AutoRestoreID, nil
+	default:
+		return "", nil
+	}
+}
+
+// autoRestore restores the checkpoint selected by the auto-restore policy once components are set up,
+// so the environment resumes where it left off
+func (c *Control) autoRestore(ctx context.Context, cfg *SystemConfig) error {
+	if cfg.AutoRestore == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, err := c.autoRestoreTarget(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to select checkpoint to auto-restore: %w", err)
+	}
+	// rule: a fresh environment has nothing to resume, and a checkpoint missing from any component is never half-restored
+	if id == "" {
+		logInfof("No checkpoint to auto-restore (policy %s)", cfg.AutoRestore)
+		return nil
+	}
+	if present, ok := c.checkpointExists(ctx, id); !ok {
+		logWarnf("Not auto-restoring checkpoint %s: not present in all components %v", id, present)
+		return nil
+	}
+
+	var checkpointables []CheckpointableComponent
+	for _, comp := range c.components {
+		if cc, ok := comp.(CheckpointableComponent); ok {
+			checkpointables = append(checkpointables, cc)
+		}
+	}
+	if _, err := c.verifyCheckpointConsistency(ctx, cfg.CheckpointConsistency, checkpointables, id); err != nil {
+		logWarnf("Not auto-restoring checkpoint %s: %v", id, err)
+		return nil
+	}
+	if err := restoreAll(ctx, checkpointables, id); err != nil {
+		return fmt.Errorf("failed to auto-restore checkpoint %s: %w", id, err)
+	}
+	c.events.Record(EventCheckpointRestored, "control", "auto-restore on startup", map[string]string{"checkpoint_id": id})
+	logInfof("Auto-restored checkpoint %s (policy %s)", id, cfg.AutoRestore)
+	return nil
+}
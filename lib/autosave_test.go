@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestShutdownAutosave(t *testing.T) {
+	var ops []string
+	comp := &memCheckpointComponent{active: "work in progress", checkpoints: map[string]string{}, ops: &ops}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, comp)
+
+	// Nothing is saved unless the option is on
+	control.config = &SystemConfig{}
+	if id, err := control.autosave(context.Background()); err != nil || id != "" {
+		t.Fatalf("Expected no autosave when disabled, got %q (%v)", id, err)
+	}
+
+	control.config = &SystemConfig{AutosaveOnShutdown: true}
+	if err := control.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+
+	current, err := control.loadCurrentCheckpoint()
+	if err != nil || current == nil {
+		t.Fatalf("Expected the shutdown checkpoint to be recorded, got %v (%v)", current, err)
+	}
+	if !strings.HasPrefix(current.CheckpointID, autosavePrefix) {
+		t.Errorf("Expected an autosave checkpoint ID, got %q", current.CheckpointID)
+	}
+	if comp.checkpoints[current.CheckpointID] != "work in progress" {
+		t.Errorf("Expected the checkpoint to hold the state at shutdown, got %v", comp.checkpoints)
+	}
+	if strings.Join(ops, ",") != "checkpoint,sync" {
+		t.Errorf("Expected the checkpoint to be flushed, got %v", ops)
+	}
+
+	events := control.Events().Recent(1)
+	if len(events) == 0 || events[len(events)-1].Fields["checkpoint_id"] != current.CheckpointID {
+		t.Errorf("Expected a checkpoint event for %s, got %+v", current.CheckpointID, events)
+	}
+}
+
+func TestAutoRestoreOnStartup(t *testing.T) {
+	dataDir := t.TempDir()
+	var ops []string
+	comp := &memCheckpointComponent{active: "work in progress", checkpoints: map[string]string{}, ops: &ops}
+
+	// An older checkpoint that auto-restore must not pick
+	comp.checkpoints[autosavePrefix+"1"] = "stale"
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", dataDir, nil, comp)
+	control.config = &SystemConfig{AutosaveOnShutdown: true}
+	if err := control.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	current, err := control.loadCurrentCheckpoint()
+	if err != nil || current == nil {
+		t.Fatalf("Expected a current checkpoint, got %v (%v)", current, err)
+	}
+
+	for _, cfg := range []SystemConfig{
+		{AutoRestore: AutoRestoreLatest},
+		{AutoRestore: AutoRestoreCurrent},
+		{AutoRestore: AutoRestoreNamed, AutoRestoreID: current.CheckpointID},
+	} {
+		t.Run(cfg.AutoRestore, func(t *testing.T) {
+			// Simulate a restart: the component comes up empty while its checkpoints survive
+			checkpoints := map[string]string{autosavePrefix + "1": "stale", current.CheckpointID: "work in progress"}
+			restarted := &memCheckpointComponent{checkpoints: checkpoints, ops: &ops}
+			control := NewControl("localhost:8080", "fly-app-controller", "test-token", dataDir, nil, restarted)
+			cfg.Stacks = []string{"missing"}
+			if err := cfg.validateAutoRestore(); err != nil {
+				t.Fatalf("Unexpected validation error: %v", err)
+			}
+			if err := control.setupComponents(context.Background(), &cfg); err != nil {
+				t.Fatalf("Failed to set up with auto-restore: %v", err)
+			}
+			if restarted.active != "work in progress" {
+				t.Errorf("Expected the saved state to be restored, got %q", restarted.active)
+			}
+		})
+	}
+
+	// A fresh environment has nothing to restore and starts normally
+	fresh := &memCheckpointComponent{checkpoints: map[string]string{}, ops: &ops}
+	control = NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, fresh)
+	for _, policy := range []string{AutoRestoreLatest, AutoRestoreCurrent} {
+		if err := control.setupComponents(context.Background(), &SystemConfig{Stacks: []string{"missing"}, AutoRestore: policy}); err != nil {
+			t.Errorf("Expected %s auto-restore to skip a fresh environment, got %v", policy, err)
+		}
+	}
+
+	if err := (&SystemConfig{AutoRestore: AutoRestoreNamed}).validateAutoRestore(); err == nil {
+		t.Error("Expected an error for a named policy without an ID")
+	}
+	if err := (&SystemConfig{AutoRestore: "oldest"}).validateAutoRestore(); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// CheckpointInfo describes a checkpoint and where it sits in the lineage of the environment
+type CheckpointInfo struct {
+	ID string `json:"id"`
+	// Parent is the checkpoint the environment was last at, created or restored, when this one was
+	// created. It may no longer exist, e.g. once restored, since a restore consumes its checkpoint.
+	Parent string `json:"parent,omitempty"`
+	// Children are the existing checkpoints recording this one as their parent
+	Children  []string  `json:"children"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CheckpointDescriber represents a checkpoint lister that records the lineage of each checkpoint
+// when creating it
+type CheckpointDescriber interface {
+	CheckpointLister
+	// DescribeCheckpoint returns the parent and creation time recorded with the complete checkpoint
+	// with the given ID, and its size
+	DescribeCheckpoint(ctx context.Context, id string) (CheckpointInfo, error)
+}
+
+// checkpointHeadFile names the file next to the active directory recording the checkpoint the
+// active directory was last at. rule: it stays out of the checkpoints directory, which holds
+// nothing but checkpoints and their markers.
+const checkpointHeadFile = ".checkpoint-head"
+
+// checkpointHead is the checkpoint the environment was last at, which the next checkpoint
+// records as its parent
+type checkpointHead struct {
+	CheckpointID string `json:"checkpoint_id"`
+	// Parent is the head's own parent, kept so recreating the head checkpoint keeps its lineage
+	Parent string `json:"parent,omitempty"`
+}
+
+// loadHead returns the recorded head, or an empty one if none was recorded or it cannot be read
+func (j *JuiceFSComponent) loadHead() checkpointHead {
+	var head checkpointHead
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(j.activeDir), checkpointHeadFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarnf("Failed to read the checkpoint lineage head: %v", err)
+		}
+		return head
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		logWarnf("Failed to parse the checkpoint lineage head: %v", err)
+		return checkpointHead{}
+	}
+	return head
+}
+
+// saveHead records the head. rule: the lineage only describes checkpoints, so failing to record
+// it is logged rather than failing the checkpoint or restore that moved it
+func (j *JuiceFSComponent) saveHead(head checkpointHead) {
+	data, err := json.Marshal(head)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(filepath.Dir(j.activeDir), checkpointHeadFile), data, FileMode)
+	}
+	if err != nil {
+		logWarnf("Failed to record the checkpoint lineage head: %v", err)
+	}
+}
+
+// DescribeCheckpoint returns the parent and creation time recorded in the checkpoint's completion
+// marker and the size of its directory. A checkpoint created before parents were recorded has
+// none, and one whose marker holds no creation time is dated by the marker itself.
+func (j *JuiceFSComponent) DescribeCheckpoint(ctx context.Context, id string) (CheckpointInfo, error) {
+	exists, err := j.HasCheckpoint(ctx, id)
+	if err != nil {
+		return CheckpointInfo{}, err
+	}
+	if !exists {
+		return CheckpointInfo{}, fmt.Errorf("checkpoint %s not found", id)
+	}
+	marker, written, err := j.readCheckpointMarker(id)
+	if err != nil {
+		return CheckpointInfo{}, fmt.Errorf("failed to read checkpoint marker: %w", err)
+	}
+	size, err := diskUsage(filepath.Join(j.checkpointsDir(), id))
+	if err != nil {
+		return CheckpointInfo{}, fmt.Errorf("failed to measure checkpoint %s: %w", id, err)
+	}
+	created := marker.CompletedAt
+	if created.IsZero() {
+		created = written.UTC()
+	}
+	return CheckpointInfo{ID: id, Parent: marker.Parent, SizeBytes: size, CreatedAt: created}, nil
+}
+
+// checkpointGraph returns the lineage of the component's complete checkpoints, oldest first, with
+// the children of each among them
+func checkpointGraph(ctx context.Context, cd CheckpointDescriber) ([]CheckpointInfo, error) {
+	ids, err := cd.ListCheckpoints(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	nodes := make([]CheckpointInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := cd.DescribeCheckpoint(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		info.Children = []string{}
+		nodes = append(nodes, info)
+	}
+	slices.SortFunc(nodes, func(a, b CheckpointInfo) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	index := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		index[node.ID] = i
+	}
+	for _, node := range nodes {
+		if i, ok := index[node.Parent]; ok && node.Parent != "" {
+			nodes[i].Children = append(nodes[i].Children, node.ID)
+		}
+	}
+	return nodes, nil
+}
+
+// handleCheckpointGraph reports the checkpoint lineage of each component that records one, keyed
+// by stack name, so a client can see which checkpoints others descend from before deleting one
+func (c *Control) handleCheckpointGraph(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.config == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not configured"})
+		return
+	}
+
+	graphs := make(map[string][]CheckpointInfo)
+	for _, comp := range c.components {
+		cd, ok := comp.(CheckpointDescriber)
+		if !ok {
+			continue
+		}
+		nodes, err := checkpointGraph(r.Context(), cd)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Failed to read the checkpoint lineage of %s: %v", cd.Name(), err)})
+			return
+		}
+		graphs[cd.Name()] = nodes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"checkpoints": graphs})
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// How a restore treats a checkpoint whose components were not taken at the same logical point
+const (
+	// CheckpointConsistencyOff restores without comparing consistency tags (the default)
+	CheckpointConsistencyOff = "off"
+	// CheckpointConsistencyWarn logs and records a mismatch, then restores anyway
+	CheckpointConsistencyWarn = "warn"
+	// CheckpointConsistencyRefuse fails the restore before any component is touched
+	CheckpointConsistencyRefuse = "refuse"
+)
+
+// ErrCheckpointInconsistent is returned when the components' checkpoints under one ID carry
+// different consistency tags, e.g. because they were created by separate stack checkpoints
+var ErrCheckpointInconsistent = errors.New("checkpoint is inconsistent across components")
+
+// ConsistencyTagger represents a checkpointable component recording the consistency tag of the
+// checkpoint operation that created each checkpoint in the checkpoint's metadata. Every component
+// checkpointed by one operation records the same tag, so checkpoints sharing an ID but taken at
+// different points can be told apart.
+type ConsistencyTagger interface {
+	CheckpointableComponent
+	// CheckpointTag returns the tag recorded with the checkpoint, or "" if none was recorded,
+	// e.g. for a checkpoint created before tags were
+	CheckpointTag(ctx context.Context, id string) (string, error)
+}
+
+// checkpointTagKey is the context key of the consistency tag of a checkpoint operation
+type checkpointTagKey struct{}
+
+// withCheckpointTag returns a context carrying a new consistency tag, which every component
+// checkpointed under it records
+func withCheckpointTag(ctx context.Context) context.Context {
+	return context.WithValue(ctx, checkpointTagKey{}, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// checkpointTag returns the consistency tag of the checkpoint operation ctx belongs to, or ""
+func checkpointTag(ctx context.Context) string {
+	tag, _ := ctx.Value(checkpointTagKey{}).(string)
+	return tag
+}
+
+// validateCheckpointConsistency checks that the checkpoint consistency mode is known
+func (cfg *SystemConfig) validateCheckpointConsistency() error {
+	switch cfg.CheckpointConsistency {
+	case "", CheckpointConsistencyOff, CheckpointConsistencyWarn, CheckpointConsistencyRefuse:
+		return nil
+	default:
+		return fmt.Errorf("unsupported checkpoint_consistency %q (expected %q, %q or %q)",
+			cfg.CheckpointConsistency, CheckpointConsistencyOff, CheckpointConsistencyWarn, CheckpointConsistencyRefuse)
+	}
+}
+
+// checkpointTags returns the consistency tag each tagging component recorded with the checkpoint
+func checkpointTags(ctx context.Context, checkpointables []CheckpointableComponent, id string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, cc := range checkpointables {
+		ct, ok := cc.(ConsistencyTagger)
+		if !ok {
+			continue
+		}
+		tag, err := ct.CheckpointTag(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read consistency tag of %s: %w", cc.Name(), err)
+		}
+		tags[cc.Name()] = tag
+	}
+	return tags, nil
+}
+
+// verifyCheckpointConsistency compares the consistency tags the components recorded with the
+// checkpoint, as the checkpoint_consistency mode asks. Components without a tag are not compared.
+// Under CheckpointConsistencyRefuse a mismatch returns ErrCheckpointInconsistent along with the tags.
+func (c *Control) verifyCheckpointConsistency(ctx context.Context, mode string, checkpointables []CheckpointableComponent, id string) (map[string]string, error) {
+	if mode == "" || mode == CheckpointConsistencyOff {
+		return nil, nil
+	}
+	tags, err := checkpointTags(ctx, checkpointables, id)
+	if err != nil {
+		return nil, err
+	}
+	first := ""
+	consistent := true
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		if first == "" {
+			first = tag
+		} else if tag != first {
+			consistent = false
+		}
+	}
+	if consistent {
+		return tags, nil
+	}
+	if mode == CheckpointConsistencyRefuse {
+		return tags, fmt.Errorf("%w: %s has consistency tags %v", ErrCheckpointInconsistent, id, tags)
+	}
+	logWarnf("Checkpoint %s was not taken at one point across components (consistency tags %v), restoring anyway", id, tags)
+	c.events.Record(EventCheckpointInconsistent, "control", "", map[string]string{"checkpoint_id": id})
+	return tags, nil
+}
+
+// checkpointMarker is the content of a JuiceFS checkpoint's completion marker. Markers written
+// before tags were hold only the completion time and read as untagged and without a parent.
+type checkpointMarker struct {
+	CompletedAt    time.Time `json:"completed_at"`
+	ConsistencyTag string    `json:"consistency_tag,omitempty"`
+	// Parent is the checkpoint the environment was last at when this one was created
+	Parent string `json:"parent,omitempty"`
+}
+
+// newCheckpointMarker returns the completion marker of a checkpoint created under ctx with the given parent
+func newCheckpointMarker(ctx context.Context, parent string) ([]byte, error) {
+	return json.Marshal(checkpointMarker{CompletedAt: time.Now().UTC(), ConsistencyTag: checkpointTag(ctx), Parent: parent})
+}
+
+// readCheckpointMarker returns the completion marker of the checkpoint with the given ID and when
+// it was written. A marker that is not JSON, as written before tags were, reads as empty.
+func (j *JuiceFSComponent) readCheckpointMarker(id string) (checkpointMarker, time.Time, error) {
+	var marker checkpointMarker
+	path := filepath.Join(j.checkpointsDir(), id) + checkpointCompleteSuffix
+	info, err := os.Stat(path)
+	if err != nil {
+		return marker, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return marker, time.Time{}, err
+	}
+	if json.Unmarshal(data, &marker) != nil {
+		marker = checkpointMarker{}
+	}
+	return marker, info.ModTime(), nil
+}
+
+// CheckpointTag returns the consistency tag recorded in the checkpoint's completion marker
+func (j *JuiceFSComponent) CheckpointTag(ctx context.Context, id string) (string, error) {
+	if id == "" || filepath.Base(id) != id {
+		return "", nil
+	}
+	marker, _, err := j.readCheckpointMarker(id)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint marker: %w", err)
+	}
+	return marker.ConsistencyTag, nil
+}
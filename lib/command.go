@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Command returns the command the supervisor starts
+func (s *Supervisor) Command() []string {
+	s.process.RLock()
+	defer s.process.RUnlock()
+	return slices.Clone(s.command)
+}
+
+// validateCommand checks that the executable of a command exists, returning its path
+func (s *Supervisor) validateCommand(command []string) (string, error) {
+	if len(command) == 0 || command[0] == "" {
+		return "", fmt.Errorf("command must not be empty")
+	}
+	name := command[0]
+	if s.config.Shell {
+		// rule: with a shell the executable is the first word of the joined command line
+		fields := strings.Fields(strings.Join(command, " "))
+		if len(fields) == 0 {
+			return "", fmt.Errorf("command must not be empty")
+		}
+		name = fields[0]
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("command %q not found: %w", name, err)
+	}
+	return path, nil
+}
+
+// SetCommand replaces the command the supervisor starts. A running process is stopped and the new
+// command started in its place; a stopped process starts with the new command the next time it
+// starts. It returns an error, leaving the command unchanged, if the executable does not exist.
+func (s *Supervisor) SetCommand(command []string) error {
+	path, err := s.validateCommand(command)
+	if err != nil {
+		return err
+	}
+	command = slices.Clone(command)
+
+	s.process.Lock()
+	s.command = command
+	if s.template != nil {
+		// A preconfigured command keeps its environment, directory and output wiring
+		template := *s.template
+		template.Path = path
+		template.Args = command
+		s.template = &template
+	}
+	// A preconfigured command that never started would otherwise be used for the next start
+	if s.process.cmd != nil && s.process.cmd.Process == nil {
+		s.process.cmd = nil
+	}
+	running := s.process.running
+	s.process.Unlock()
+
+	if !running {
+		logInfof("Supervised command changed to %v; it runs on the next start", command)
+		return nil
+	}
+	if err := s.StopProcess(); err != nil {
+		return fmt.Errorf("failed to stop the old process: %w", err)
+	}
+	if err := s.StartProcess(); err != nil {
+		return fmt.Errorf("failed to start the new command: %w", err)
+	}
+	return nil
+}
+
+// SetCommand replaces the supervised command, e.g. to run a newly deployed app binary, without
+// touching the stacks: the mount, database replication and lease stay up while the old process is
+// stopped and the new one started. Nothing is persisted: a restarted server runs its argv again.
+func (c *Control) SetCommand(command []string) error {
+	if c.supervisor == nil {
+		return errNoSupervisor
+	}
+	if err := c.supervisor.SetCommand(command); err != nil {
+		return err
+	}
+	logInfof("Supervised command changed to %v", command)
+	c.events.Record(EventCommandChanged, "control", strings.Join(command, " "), nil)
+	c.NotifyStatusChange()
+	return nil
+}
+
+// handleCommand reports or replaces the supervised command
+func (c *Control) handleCommand(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if c.supervisor == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errNoSupervisor.Error()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Command []string `json:"command"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		if _, err := c.supervisor.validateCommand(req.Command); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if err := c.SetCommand(req.Command); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	default:
+		w.Header().Del("Content-Type")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"command": c.supervisor.Command(),
+		"running": c.supervisor.IsRunning(),
+	})
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// compactBusyTimeout is how long compaction waits for the mount's own transactions to finish
+const compactBusyTimeout = 30 * time.Second
+
+// CompactResult reports the on-disk size of a database, including its WAL, around a compaction
+type CompactResult struct {
+	BeforeBytes int64 `json:"before_bytes"`
+	AfterBytes  int64 `json:"after_bytes"`
+}
+
+// dbSize returns the size of the database file and its WAL
+func (dm *DBManager) dbSize() (int64, error) {
+	var total int64
+	for _, path := range []string{dm.DBPath, dm.DBPath + "-wal"} {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// Compact rebuilds the database with VACUUM to reclaim the space of deleted rows, truncates the
+// WAL and syncs the result to the replica. Other connections, such as the JuiceFS mount's, keep
+// working: SQLite's locking makes them wait for the rebuild to finish.
+func (dm *DBManager) Compact(ctx context.Context) (CompactResult, error) {
+	var result CompactResult
+	before, err := dm.dbSize()
+	if err != nil {
+		return result, fmt.Errorf("failed to measure database: %w", err)
+	}
+	result.BeforeBytes = before
+
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		return result, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", compactBusyTimeout.Milliseconds())); err != nil {
+		return result, fmt.Errorf("failed to set busy timeout: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+		return result, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+
+	// rule: while Litestream replicates, it runs the checkpoint itself so the rebuilt pages reach its
+	// shadow WAL first; a checkpoint behind its back would break the generation
+	if err := dm.checkpointWAL(ctx, conn); err != nil {
+		return result, err
+	}
+
+	after, err := dm.dbSize()
+	if err != nil {
+		return result, fmt.Errorf("failed to measure database: %w", err)
+	}
+	result.AfterBytes = after
+	logInfof("Compacted database %s from %d to %d bytes", dm.name(), before, after)
+	return result, nil
+}
+
+// checkpointWAL checkpoints and truncates the WAL after a compaction, through Litestream while it
+// replicates, holding dm.mu so replication cannot stop in between
+func (dm *DBManager) checkpointWAL(ctx context.Context, conn *sql.Conn) error {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	if dm.replicating {
+		if err := dm.lsDB.Checkpoint(ctx, litestream.CheckpointModeTruncate); err != nil {
+			return fmt.Errorf("failed to checkpoint database: %w", err)
+		}
+		return dm.sync(ctx)
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+	return nil
+}
+
+// Compact compacts the metadata database of the mounted volume
+func (j *JuiceFSComponent) Compact(ctx context.Context) (CompactResult, error) {
+	j.mu.RLock()
+	ready, dm := j.isReady, j.dbManager
+	j.mu.RUnlock()
+	if !ready || dm == nil {
+		return CompactResult{}, errComponentNotReady
+	}
+	return dm.Compact(ctx)
+}
+
+// handleCompact returns a handler compacting the database of the given component
+func (c *Control) handleCompact(cp Compactor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if c.config == nil || !slices.Contains(c.config.Stacks, cp.Name()) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": errStackNotEnabled.Error() + ": " + cp.Name()})
+			return
+		}
+		result, err := cp.Compact(r.Context())
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errComponentNotReady) {
+				status = http.StatusConflict
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("failed to compact %s: %v", cp.Name(), err)})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":          "compacted",
+			"stack":           cp.Name(),
+			"before_bytes":    result.BeforeBytes,
+			"after_bytes":     result.AfterBytes,
+			"reclaimed_bytes": result.BeforeBytes - result.AfterBytes,
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// LoggedComponent represents a component that keeps a buffer of its recent output, served at
+// GET /stack/{name}/logs
+type LoggedComponent interface {
+	// RecentLogs returns the buffered lines, oldest first. ok is false when the component keeps
+	// no buffer, e.g. because its settings disabled it.
+	RecentLogs() (lines []string, ok bool)
+}
+
+// logRing keeps the most recent lines written by one or more output streams
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int // index in lines the next line is stored at
+	count int // lines stored, up to len(lines)
+}
+
+// newLogRing creates a ring keeping the given number of lines, or nil when size is not positive
+func newLogRing(size int) *logRing {
+	if size <= 0 {
+		return nil
+	}
+	return &logRing{lines: make([]string, size)}
+}
+
+// add stores a line, dropping the oldest once the ring is full
+func (r *logRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	r.count = min(r.count+1, len(r.lines))
+}
+
+// Lines returns the stored lines, oldest first
+func (r *logRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := make([]string, 0, r.count)
+	for i := range r.count {
+		lines = append(lines, r.lines[(r.next-r.count+i+len(r.lines))%len(r.lines)])
+	}
+	return lines
+}
+
+// writer returns a writer splitting one output stream into lines stored in the ring. Each stream
+// needs its own writer so a partial line of one is not joined with output of another.
+func (r *logRing) writer() io.Writer {
+	return &logRingWriter{ring: r}
+}
+
+// logRingWriter splits an output stream into lines for a logRing
+type logRingWriter struct {
+	mu      sync.Mutex
+	ring    *logRing
+	partial []byte // output after the last newline
+}
+
+func (w *logRingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		w.ring.add(string(bytes.TrimRight(data[:i], "\r")))
+		data = data[i+1:]
+	}
+	// rule: output without newlines is cut into lines rather than buffered without bound, like mount output
+	for len(data) >= maxMountLogLine {
+		w.ring.add(string(data[:maxMountLogLine]))
+		data = data[maxMountLogLine:]
+	}
+	w.partial = append(w.partial[:0], data...)
+	return len(p), nil
+}
+
+// handleLogs serves the recent output of a component
+func handleLogs(name string, lc LoggedComponent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lines, ok := lc.RecentLogs()
+		if !ok {
+			handleNoLogs(name)(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "lines": lines})
+	}
+}
+
+// handleNoLogs answers a logs request for a component that never keeps logs
+func handleNoLogs(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%s keeps no logs", name)})
+	}
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Setup retry defaults
+const (
+	DefaultSetupAttempts    = 3
+	DefaultSetupBackoff     = time.Second
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = time.Minute
+)
+
+// ErrCircuitOpen is returned by the Setup of a retrying component while its circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// RetryPolicy configures how a component wrapped by WithRetry retries its Setup. For each
+// setting zero uses the default.
+type RetryPolicy struct {
+	// Attempts is how many times Setup is tried per call
+	Attempts int
+	// Backoff is the wait before the first retry, doubling after each attempt up to MaxBackoff
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries; zero leaves it uncapped
+	MaxBackoff time.Duration
+	// RetryCleanup also retries Cleanup, with the same attempts and backoff
+	RetryCleanup bool
+	// BreakerThreshold is how many consecutive failed attempts open the circuit breaker, after
+	// which Setup fails at once until BreakerCooldown has passed; negative disables the breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// RetryingComponent wraps a StackComponent with retry-with-backoff and a circuit breaker around
+// Setup. Name and Status pass through, as do HTTP routes when the wrapped component serves them;
+// other optional interfaces, such as checkpoints, are not passed through.
+type RetryingComponent struct {
+	StackComponent
+	policy RetryPolicy
+
+	mu        sync.Mutex // protects failures and openUntil
+	failures  int        // consecutive failed attempts
+	openUntil time.Time  // the breaker is open until then
+}
+
+// WithRetry wraps component so its Setup is retried according to policy
+func WithRetry(component StackComponent, policy RetryPolicy) *RetryingComponent {
+	if policy.Attempts <= 0 {
+		policy.Attempts = DefaultSetupAttempts
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = DefaultSetupBackoff
+	}
+	if policy.BreakerThreshold == 0 {
+		policy.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if policy.BreakerCooldown <= 0 {
+		policy.BreakerCooldown = DefaultBreakerCooldown
+	}
+	return &RetryingComponent{StackComponent: component, policy: policy}
+}
+
+// Unwrap returns the wrapped component
+func (r *RetryingComponent) Unwrap() StackComponent {
+	return r.StackComponent
+}
+
+// Setup sets up the wrapped component, retrying failures with backoff
+func (r *RetryingComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	return r.retry(ctx, "setup", true, func() error {
+		return r.StackComponent.Setup(ctx, cfg, juicefsPath)
+	})
+}
+
+// Cleanup cleans up the wrapped component, retrying failures if the policy asks for it
+func (r *RetryingComponent) Cleanup(ctx context.Context) error {
+	if !r.policy.RetryCleanup {
+		return r.StackComponent.Cleanup(ctx)
+	}
+	return r.retry(ctx, "cleanup", false, func() error {
+		return r.StackComponent.Cleanup(ctx)
+	})
+}
+
+// Status returns the wrapped component's status, noting an open circuit breaker
+func (r *RetryingComponent) Status(ctx context.Context) map[string]interface{} {
+	status := r.StackComponent.Status(ctx)
+	r.mu.Lock()
+	open := time.Now().Before(r.openUntil)
+	r.mu.Unlock()
+	if !open {
+		return status
+	}
+	status = maps.Clone(status)
+	if status == nil {
+		status = make(map[string]interface{})
+	}
+	status["circuit_open"] = true
+	return status
+}
+
+// ServeHTTP passes requests to the wrapped component when it serves HTTP routes
+func (r *RetryingComponent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h, ok := r.StackComponent.(http.Handler); ok {
+		h.ServeHTTP(w, req)
+		return
+	}
+	http.Error(w, "Not found", http.StatusNotFound)
+}
+
+// retry runs op until it succeeds, the attempts are used up or the circuit breaker opens. Only
+// guarded (setup) attempts count towards and are stopped by the breaker.
+func (r *RetryingComponent) retry(ctx context.Context, what string, guarded bool, op func() error) error {
+	name := r.Name()
+	backoff := r.policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if guarded {
+			if until, open := r.breakerOpen(); open {
+				return fmt.Errorf("%s of %s: %w until %s", what, name, ErrCircuitOpen, until.Format(time.RFC3339))
+			}
+		}
+		if err = op(); err == nil {
+			if guarded {
+				r.recordResult(true)
+			}
+			if attempt > 1 {
+				logInfof("Component %s %s succeeded on attempt %d", name, what, attempt)
+			}
+			return nil
+		}
+		if guarded && r.recordResult(false) {
+			logErrorf("Component %s failed %d consecutive setup attempts: circuit breaker open for %v", name, r.policy.BreakerThreshold, r.policy.BreakerCooldown)
+			return fmt.Errorf("%s of %s: %w after attempt %d: %w", what, name, ErrCircuitOpen, attempt, err)
+		}
+		if attempt >= r.policy.Attempts || ctx.Err() != nil {
+			return fmt.Errorf("%s of %s failed after %d attempts: %w", what, name, attempt, err)
+		}
+		logWarnf("Component %s %s failed (attempt %d of %d), retrying in %v: %v", name, what, attempt, r.policy.Attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s of %s: %w", what, name, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// breakerOpen reports whether the circuit breaker is open, and until when
+func (r *RetryingComponent) breakerOpen() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.openUntil, time.Now().Before(r.openUntil)
+}
+
+// recordResult counts a setup attempt and reports whether its failure opened the breaker.
+// rule: once the cooldown passes a single attempt is let through; its failure reopens the breaker at once
+func (r *RetryingComponent) recordResult(ok bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		r.failures = 0
+		r.openUntil = time.Time{}
+		return false
+	}
+	r.failures++
+	if r.policy.BreakerThreshold < 0 || r.failures < r.policy.BreakerThreshold {
+		return false
+	}
+	r.openUntil = time.Now().Add(r.policy.BreakerCooldown)
+	return true
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// flakyComponent fails its first failures setups
+type flakyComponent struct {
+	namedHTTPComponent
+	failures int
+	attempts int
+}
+
+func (f *flakyComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return errors.New("dependency unavailable")
+	}
+	f.setup = true
+	return nil
+}
+
+func (f *flakyComponent) Status(ctx context.Context) map[string]interface{} {
+	return map[string]interface{}{"attempts": f.attempts}
+}
+
+func TestWithRetrySetsUpFlakyComponent(t *testing.T) {
+	flaky := &flakyComponent{namedHTTPComponent: namedHTTPComponent{name: "flaky"}, failures: 2}
+	component := WithRetry(flaky, RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+
+	if err := component.Setup(context.Background(), &ObjectStorageConfig{}, ""); err != nil {
+		t.Fatalf("Expected setup to succeed after retries: %v", err)
+	}
+	if flaky.attempts != 3 || !flaky.setup {
+		t.Errorf("Expected 3 attempts ending in success, got %d (setup=%v)", flaky.attempts, flaky.setup)
+	}
+	if component.Name() != "flaky" || component.Status(context.Background())["attempts"] != 3 {
+		t.Errorf("Expected name and status to pass through, got %q %v", component.Name(), component.Status(context.Background()))
+	}
+
+	// The wrapped component's routes are served through the control
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, component)
+	control.config = &SystemConfig{Stacks: []string{"flaky"}}
+	control.setupRoutes()
+	req := httptest.NewRequest("GET", "/stack/flaky/info", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "flaky /info" {
+		t.Errorf("Expected the wrapped component's route, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestWithRetryOpensCircuitBreaker(t *testing.T) {
+	broken := &flakyComponent{namedHTTPComponent: namedHTTPComponent{name: "broken"}, failures: 100}
+	component := WithRetry(broken, RetryPolicy{Attempts: 5, Backoff: time.Millisecond, BreakerThreshold: 2, BreakerCooldown: time.Hour})
+
+	err := component.Setup(context.Background(), &ObjectStorageConfig{}, "")
+	if !errors.Is(err, ErrCircuitOpen) || broken.attempts != 2 {
+		t.Fatalf("Expected the breaker to open after 2 attempts, got %d attempts: %v", broken.attempts, err)
+	}
+	if err := component.Setup(context.Background(), &ObjectStorageConfig{}, ""); !errors.Is(err, ErrCircuitOpen) || broken.attempts != 2 {
+		t.Errorf("Expected setup to fail fast while the breaker is open, got %d attempts: %v", broken.attempts, err)
+	}
+	if component.Status(context.Background())["circuit_open"] != true {
+		t.Error("Expected the open breaker in the status")
+	}
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// MaxConfigHistory bounds how many config versions may be kept
+	MaxConfigHistory = 1000
+	// redactedSecret replaces credentials in config history copies
+	redactedSecret = "REDACTED"
+)
+
+// validateConfigHistory checks the number of config versions kept
+func (cfg *SystemConfig) validateConfigHistory() error {
+	if cfg.ConfigHistory < 0 || cfg.ConfigHistory > MaxConfigHistory {
+		return fmt.Errorf("config_history must be between 0 and %d", MaxConfigHistory)
+	}
+	return nil
+}
+
+// redactedConfig returns the config serialized with its secret credentials replaced; the access
+// key is an identifier rather than a secret and is kept so the history shows which key was used
+func redactedConfig(cfg *SystemConfig) ([]byte, error) {
+	redacted := *cfg
+	if redacted.Storage.SecretKey != "" {
+		redacted.Storage.SecretKey = redactedSecret
+	}
+	if redacted.Storage.SessionToken != "" {
+		redacted.Storage.SessionToken = redactedSecret
+	}
+	return json.MarshalIndent(&redacted, "", "  ")
+}
+
+// configHistoryKey names a config version; names sort in the order the versions were saved
+func configHistoryKey(cfg *ObjectStorageConfig, at time.Time) string {
+	return path.Join(cfg.layout().configHistory(), at.UTC().Format("20060102T150405.000000000Z")+".json")
+}
+
+// recordConfigHistory uploads a redacted copy of cfg to the config history and deletes the
+// versions beyond the retention limit
+func recordConfigHistory(ctx context.Context, cfg *SystemConfig) error {
+	data, err := redactedConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	sess, err := cfg.Storage.newSession()
+	if err != nil {
+		return err
+	}
+	client := s3.New(sess)
+	bucket := aws.String(cfg.Storage.Bucket)
+
+	key := configHistoryKey(&cfg.Storage, time.Now())
+	input := &s3.PutObjectInput{
+		Bucket:      bucket,
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if cfg.Storage.SSE != "" {
+		input.ServerSideEncryption = aws.String(cfg.Storage.SSE)
+		if cfg.Storage.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(cfg.Storage.SSEKMSKeyID)
+		}
+	}
+	if _, err := client.PutObjectWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to write config history %s: %w", key, err)
+	}
+
+	var keys []string
+	prefix := cfg.Storage.layout().configHistory()
+	err = client.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{Bucket: bucket, Prefix: aws.String(prefix)},
+		func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+	if err != nil {
+		return fmt.Errorf("failed to list config history: %w", err)
+	}
+	slices.Sort(keys)
+	for len(keys) > cfg.ConfigHistory {
+		if _, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String(keys[0])}); err != nil {
+			return fmt.Errorf("failed to prune config history %s: %w", keys[0], err)
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
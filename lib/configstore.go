@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ConfigStore persists the serialized system config outside the local data directory
+type ConfigStore interface {
+	// Load returns the stored config, or an error wrapping fs.ErrNotExist if none is stored
+	Load(ctx context.Context) ([]byte, error)
+	// Save replaces the stored config
+	Save(ctx context.Context, data []byte) error
+}
+
+// S3ConfigStore persists the system config in the configured object storage bucket
+type S3ConfigStore struct {
+	client *s3.S3
+	bucket string
+	key    string
+	sse    string
+	kmsKey string
+}
+
+// NewS3ConfigStore creates a config store for the bucket and key prefix in cfg
+func NewS3ConfigStore(cfg *ObjectStorageConfig) (*S3ConfigStore, error) {
+	sess, err := cfg.newSession()
+	if err != nil {
+		return nil, err
+	}
+	return &S3ConfigStore{
+		client: s3.New(sess),
+		bucket: cfg.Bucket,
+		key:    cfg.layout().config(),
+		sse:    cfg.SSE,
+		kmsKey: cfg.SSEKMSKeyID,
+	}, nil
+}
+
+// Load reads the stored config. It returns an error wrapping fs.ErrNotExist if no config is stored.
+func (s *S3ConfigStore) Load(ctx context.Context) ([]byte, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("no config stored at s3://%s/%s: %w", s.bucket, s.key, fs.ErrNotExist)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config from storage: %w", err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(out.Body, MaxConfigFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config from storage: %w", err)
+	}
+	if int64(len(data)) > MaxConfigFileSize {
+		return nil, fmt.Errorf("stored config exceeds maximum size of %d bytes", MaxConfigFileSize)
+	}
+	return data, nil
+}
+
+// Save writes the config to storage
+func (s *S3ConfigStore) Save(ctx context.Context, data []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+		if s.kmsKey != "" {
+			input.SSEKMSKeyId = aws.String(s.kmsKey)
+		}
+	}
+	if _, err := s.client.PutObjectWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to write config to storage: %w", err)
+	}
+	return nil
+}
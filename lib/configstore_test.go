@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockS3 is a minimal path-style S3 object server
+type mockS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	written map[string]time.Time   // time of the last write to each object
+	headers map[string]http.Header // request headers of the last write to each object
+	// readOnly rejects writes and deletes as with credentials lacking write permission
+	readOnly bool
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.readOnly && (r.Method == http.MethodPut || r.Method == http.MethodDelete) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		if bucket := strings.Trim(r.URL.Path, "/"); strings.Contains(bucket, "/") {
+			if _, ok := m.objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.objects[r.URL.Path] = data
+		if m.written == nil {
+			m.written = make(map[string]time.Time)
+		}
+		m.written[r.URL.Path] = time.Now()
+		if m.headers != nil {
+			m.headers[r.URL.Path] = r.Header.Clone()
+		}
+	case http.MethodGet:
+		if bucket := strings.Trim(r.URL.Path, "/"); !strings.Contains(bucket, "/") {
+			m.list(w, bucket, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+			return
+		}
+		data, ok := m.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(m.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list writes a ListObjects (v1) response for the objects in bucket under prefix
+func (m *mockS3) list(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	type object struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []commonPrefix
+	}{Name: bucket, Prefix: prefix}
+
+	seen := make(map[string]bool)
+	for name, data := range m.objects {
+		key, ok := strings.CutPrefix(name, "/"+bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+				}
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, object{Key: key, Size: len(data), LastModified: m.written[name].UTC().Format(time.RFC3339Nano)})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	sort.Slice(result.CommonPrefixes, func(i, j int) bool { return result.CommonPrefixes[i].Prefix < result.CommonPrefixes[j].Prefix })
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestConfigStoreRoundTrip(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	// Save a config that is mirrored to storage
+	dir := t.TempDir()
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", dir, nil)
+	control.config = &SystemConfig{
+		Version: CurrentConfigVersion,
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/app/",
+		},
+		Stacks:           []string{"leaser"},
+		PersistToStorage: true,
+	}
+	if err := control.saveConfig(); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if _, ok := s3.objects["/test-bucket/app/fly-user-env/config.json"]; !ok {
+		t.Fatalf("Expected config in storage, got objects %v", s3.objects)
+	}
+
+	// A recreated machine with no local config bootstraps from storage
+	t.Setenv("FLY_ENV_CONFIG_IN_STORAGE", "1")
+	t.Setenv("FLY_STORAGE_BUCKET", "test-bucket")
+	t.Setenv("FLY_STORAGE_ENDPOINT", server.URL)
+	t.Setenv("FLY_STORAGE_ACCESS_KEY", "key")
+	t.Setenv("FLY_STORAGE_SECRET_KEY", "secret")
+	t.Setenv("FLY_STORAGE_KEY_PREFIX", "/app/")
+	t.Setenv("FLY_STACKS", "none")
+
+	freshDir := t.TempDir()
+	restored := NewControl("localhost:8080", "fly-app-controller", "test-token", freshDir, nil)
+	if restored.err != nil {
+		t.Fatalf("Unexpected error: %v", restored.err)
+	}
+	if restored.config == nil {
+		t.Fatal("Expected config to be loaded from storage")
+	}
+	if restored.config.Storage.Bucket != "test-bucket" || len(restored.config.Stacks) != 1 || restored.config.Stacks[0] != "leaser" {
+		t.Errorf("Unexpected config loaded from storage: %+v", restored.config)
+	}
+	if _, err := os.Stat(filepath.Join(freshDir, "config.json")); err != nil {
+		t.Errorf("Expected config from storage to be cached locally: %v", err)
+	}
+
+	// With nothing stored the control stays unconfigured
+	empty := &mockS3{objects: make(map[string][]byte)}
+	emptyServer := httptest.NewServer(empty)
+	defer emptyServer.Close()
+	t.Setenv("FLY_STORAGE_ENDPOINT", emptyServer.URL)
+	unconfigured := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	if unconfigured.err != nil || unconfigured.config != nil {
+		t.Errorf("Expected unconfigured control, got config %+v, err %v", unconfigured.config, unconfigured.err)
+	}
+}
+
+func TestConfigHistoryKeepsRedactedVersions(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	control.config = &SystemConfig{
+		Version: CurrentConfigVersion,
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/app/",
+		},
+		ConfigHistory: 2,
+	}
+	history := func() []string {
+		s3.mu.Lock()
+		defer s3.mu.Unlock()
+		var keys []string
+		for key := range s3.objects {
+			if strings.HasPrefix(key, "/test-bucket/app/fly-user-env/config-history/") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	for i, target := range []string{"a:1", "b:2", "c:3"} {
+		control.config.Target = target
+		if err := control.saveConfig(); err != nil {
+			t.Fatalf("Failed to save config: %v", err)
+		}
+		if got, want := len(history()), min(i+1, 2); got != want {
+			t.Fatalf("Expected %d config versions after change %d, got %d", want, i+1, got)
+		}
+	}
+
+	keys := history()
+	var oldest, newest SystemConfig
+	if err := json.Unmarshal(s3.objects[keys[0]], &oldest); err != nil {
+		t.Fatalf("Failed to parse config version: %v", err)
+	}
+	if err := json.Unmarshal(s3.objects[keys[1]], &newest); err != nil {
+		t.Fatalf("Failed to parse config version: %v", err)
+	}
+	if oldest.Target != "b:2" || newest.Target != "c:3" {
+		t.Errorf("Expected the two newest versions to be kept, got %q and %q", oldest.Target, newest.Target)
+	}
+	if newest.Storage.SecretKey != redactedSecret || newest.Storage.AccessKey != "key" {
+		t.Errorf("Expected the secret key to be redacted, got %+v", newest.Storage)
+	}
+	if control.config.Storage.SecretKey != "secret" {
+		t.Error("Expected redaction not to touch the live config")
+	}
+}
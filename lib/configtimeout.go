@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultConfigTimeout bounds a config POST, from component setup through leadership and auto-restore
+	DefaultConfigTimeout = 10 * time.Minute
+	// configRollbackTimeout bounds the cleanup of components left half set up by a timed-out config POST
+	configRollbackTimeout = time.Minute
+)
+
+// SetConfigTimeout sets the overall deadline for applying a config POST. Zero uses
+// DefaultConfigTimeout and a negative value removes the deadline.
+func (c *Control) SetConfigTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configTimeout = d
+}
+
+// configContext derives the context component setup runs under for a config POST
+func (c *Control) configContext(parent context.Context) (context.Context, context.CancelFunc, time.Duration) {
+	c.mu.RLock()
+	timeout := c.configTimeout
+	c.mu.RUnlock()
+	if timeout < 0 {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, 0
+	}
+	if timeout == 0 {
+		timeout = DefaultConfigTimeout
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return ctx, cancel, timeout
+}
+
+// rollbackSetup cleans up the components of a setup cancelled by the config timeout, so no
+// mount, replication or lease is left running half configured
+func (c *Control) rollbackSetup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), configRollbackTimeout)
+	defer cancel()
+	return c.Cleanup(ctx)
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Idle connection pool defaults for the proxy's backend transport
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// ConnPoolConfig bounds the idle connections the proxy keeps open to its backend. For each
+// setting zero uses the default and a negative value removes the limit, keeping idle
+// connections for as long as the backend allows.
+type ConnPoolConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// Validate checks the pool settings
+func (cfg ConnPoolConfig) Validate() error {
+	if cfg.IdleConnTimeout > 0 && cfg.IdleConnTimeout < time.Second {
+		return fmt.Errorf("idle connection timeout must be at least 1s, or negative for no timeout")
+	}
+	return nil
+}
+
+// apply sets the pool limits on a transport
+func (cfg ConnPoolConfig) apply(transport *http.Transport) {
+	transport.MaxIdleConns = DefaultMaxIdleConns
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	} else if cfg.MaxIdleConns < 0 {
+		transport.MaxIdleConns = 0 // no limit
+	}
+
+	// rule: the transport treats a zero per-host limit as 2, not unlimited, so no limit is spelled MaxInt
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	} else if cfg.MaxIdleConnsPerHost < 0 {
+		transport.MaxIdleConnsPerHost = math.MaxInt
+	}
+
+	transport.IdleConnTimeout = DefaultIdleConnTimeout
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	} else if cfg.IdleConnTimeout < 0 {
+		transport.IdleConnTimeout = 0 // no timeout
+	}
+}
+
+// SetConnPool sets the idle connection limits of the backend transport.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetConnPool(cfg ConnPoolConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pool = cfg
+	return p.setupProxy()
+}
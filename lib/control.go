@@ -3,20 +3,28 @@ package lib
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	// For types.NoSuchKey
 )
 
 // StackComponent represents a component in our stack that needs setup/cleanup
 type StackComponent interface {
+	// Name returns the stack name of the component, as used in the config and in routes
+	Name() string
 	// Setup initializes the component with the given config
 	Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error
 	// Cleanup performs any necessary cleanup when the component is no longer needed
@@ -28,29 +36,145 @@ type StackComponent interface {
 // CheckpointableComponent represents a component that supports checkpoint and restore operations
 type CheckpointableComponent interface {
 	StackComponent
-	// CreateCheckpoint creates a checkpoint with the given ID and returns a checkpoint identifier
+	// CreateCheckpoint creates a checkpoint with the given ID and returns a checkpoint identifier.
+	// Repeating a call that succeeded is a no-op; an ID already used otherwise fails with ErrCheckpointExists.
 	CreateCheckpoint(ctx context.Context, id string) (string, error)
 	// RestoreToCheckpoint restores the component to the state at the given checkpoint ID
 	RestoreToCheckpoint(ctx context.Context, id string) error
 }
 
+// ErrCheckpointExists is returned by CreateCheckpoint when the ID is already used by a different checkpoint
+var ErrCheckpointExists = errors.New("checkpoint already exists")
+
+// ErrCheckpointIncomplete is returned by RestoreToCheckpoint for a checkpoint whose creation was interrupted
+var ErrCheckpointIncomplete = errors.New("checkpoint is incomplete")
+
+// CheckpointInspector represents a checkpointable component that can report whether a checkpoint exists
+type CheckpointInspector interface {
+	CheckpointableComponent
+	// HasCheckpoint reports whether the checkpoint with the given ID exists
+	HasCheckpoint(ctx context.Context, id string) (bool, error)
+}
+
+// CheckpointLister represents a checkpointable component that can list its checkpoints
+type CheckpointLister interface {
+	CheckpointableComponent
+	// ListCheckpoints returns the IDs of the existing checkpoints
+	ListCheckpoints(ctx context.Context) ([]string, error)
+}
+
+// IncompleteCheckpointLister represents a checkpoint lister that can also list checkpoints whose
+// creation was interrupted, which are never restored but can be deleted
+type IncompleteCheckpointLister interface {
+	CheckpointLister
+	// ListIncompleteCheckpoints returns the IDs of the incomplete checkpoints
+	ListIncompleteCheckpoints(ctx context.Context) ([]string, error)
+}
+
+// CheckpointDeleter represents a checkpointable component that can delete a checkpoint
+type CheckpointDeleter interface {
+	CheckpointableComponent
+	// DeleteCheckpoint removes the checkpoint with the given ID
+	DeleteCheckpoint(ctx context.Context, id string) error
+}
+
+// ReplicationSyncer represents a component that replicates state to object storage and can flush it on demand
+type ReplicationSyncer interface {
+	StackComponent
+	// SyncReplication blocks until pending changes are durable in object storage
+	SyncReplication(ctx context.Context) error
+}
+
+// ReadinessChecker represents a component whose state cannot be checkpointed or restored until it
+// has finished starting, e.g. until its mount is ready
+type ReadinessChecker interface {
+	StackComponent
+	// Ready reports whether the component has finished starting
+	Ready() bool
+}
+
+// Restartable represents a component that can be restarted on its own, without reconfiguring the environment
+type Restartable interface {
+	StackComponent
+	// Restart stops and starts the component's processes, keeping its configuration and data
+	Restart(ctx context.Context) error
+}
+
+// StatsProvider represents a component reporting statistics about the storage it manages
+type StatsProvider interface {
+	StackComponent
+	// Stats gathers the component's statistics on demand, which may be expensive
+	Stats(ctx context.Context) (interface{}, error)
+}
+
+// Compactor represents a component whose database can be compacted to reclaim space
+type Compactor interface {
+	StackComponent
+	// Compact rebuilds the database and syncs it to its replica, reporting the size before and after
+	Compact(ctx context.Context) (CompactResult, error)
+}
+
+// StateRestorer represents a component with local databases that are restored from their replicas
+// before any stack is set up, so no stack starts on state another one has yet to restore
+type StateRestorer interface {
+	StackComponent
+	// RestoreState restores the component's missing local databases from their replicas and
+	// verifies their integrity, without starting replication or anything that uses them
+	RestoreState(ctx context.Context, cfg *ObjectStorageConfig) error
+}
+
+// StartGate represents a component the supervised process must wait for before it first starts,
+// e.g. because the app writes into a directory the component provides
+type StartGate interface {
+	StackComponent
+	// StartReady reports whether the process may start
+	StartReady() bool
+}
+
+// CredentialRefresher represents a component holding long-lived storage clients that must be
+// rebuilt when credentials rotate
+type CredentialRefresher interface {
+	StackComponent
+	// RefreshCredentials rebuilds the component's storage clients using the given config
+	RefreshCredentials(ctx context.Context, cfg *ObjectStorageConfig) error
+}
+
 // DBManagerComponent implements StackComponent and CheckpointableComponent
 // rule: DBManagerComponent is not checkpointable for now, so these methods are no-ops
 
 type DBManagerComponent struct {
 	dbManager *DBManager
 	dataDir   string
+	settings  DBConfig
+	following *follower // restores the replica while on standby, nil otherwise
+	// standbyInterval is how often the replica is restored on standby; zero uses the default
+	standbyInterval time.Duration
 }
 
 func NewDBManagerComponent(dataDir string) *DBManagerComponent {
 	return &DBManagerComponent{dataDir: dataDir}
 }
 
+// Name returns the stack name of the DB manager component
+func (d *DBManagerComponent) Name() string {
+	return "db"
+}
+
+// Configure sets the db settings. It must be called before Setup.
+func (d *DBManagerComponent) Configure(settings DBConfig) {
+	d.settings = settings
+}
+
 func (d *DBManagerComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
-	log.Printf("DBManagerComponent.Setup: dataDir=%s", d.dataDir)
+	logDebugf("DBManagerComponent.Setup: dataDir=%s", d.dataDir)
 	d.dbManager = NewDBManager(cfg, d.dataDir)
-	log.Printf("DBManagerComponent.Setup: DBPath=%s", d.dbManager.DBPath)
-	if err := d.dbManager.Initialize(); err != nil {
+	d.dbManager.Upload = d.settings
+	d.dbManager.Intervals = d.settings.ReplicationIntervals
+	logDebugf("DBManagerComponent.Setup: DBPath=%s", d.dbManager.DBPath)
+	if _, err := d.dbManager.RestoreFromReplica(ctx); err != nil {
+		return fmt.Errorf("failed to restore database: %w", err)
+	}
+	if err := d.dbManager.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 	if err := d.dbManager.StartReplication(); err != nil {
@@ -59,13 +183,77 @@ func (d *DBManagerComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig
 	return nil
 }
 
+// RestoreState restores a missing database from its replica and verifies it
+func (d *DBManagerComponent) RestoreState(ctx context.Context, cfg *ObjectStorageConfig) error {
+	dm := NewDBManager(cfg, d.dataDir)
+	if _, err := dm.RestoreFromReplica(ctx); err != nil {
+		return fmt.Errorf("failed to restore database: %w", err)
+	}
+	return dm.VerifyIntegrity(ctx)
+}
+
 func (d *DBManagerComponent) Cleanup(ctx context.Context) error {
+	// A standby only follows the replica; replication never started
+	if d.following != nil {
+		d.following.stop()
+		d.following = nil
+		return nil
+	}
 	if d.dbManager != nil {
 		return d.dbManager.StopReplication()
 	}
 	return nil
 }
 
+func (d *DBManagerComponent) RefreshCredentials(ctx context.Context, cfg *ObjectStorageConfig) error {
+	if d.dbManager != nil {
+		return d.dbManager.RefreshCredentials(cfg)
+	}
+	return nil
+}
+
+// Restart restarts replication of the database
+func (d *DBManagerComponent) Restart(ctx context.Context) error {
+	if d.dbManager == nil {
+		return fmt.Errorf("database not set up")
+	}
+	return d.dbManager.Restart()
+}
+
+// Healthy reports an error if the database is not being replicated
+func (d *DBManagerComponent) Healthy(ctx context.Context) error {
+	if d.dbManager == nil {
+		return fmt.Errorf("database not set up")
+	}
+	if !d.dbManager.Replicating() {
+		return fmt.Errorf("replication not running")
+	}
+	return nil
+}
+
+// Fence stops replication so the database is no longer written to storage
+func (d *DBManagerComponent) Fence(ctx context.Context) error {
+	if d.dbManager == nil {
+		return nil
+	}
+	return d.dbManager.StopReplication()
+}
+
+func (d *DBManagerComponent) SyncReplication(ctx context.Context) error {
+	if d.dbManager != nil {
+		return d.dbManager.Sync(ctx)
+	}
+	return nil
+}
+
+// ReplicationPosition returns the position of the database durable in its replica
+func (d *DBManagerComponent) ReplicationPosition() (ReplicationPosition, error) {
+	if d.dbManager == nil {
+		return ReplicationPosition{}, errReplicationStopped
+	}
+	return d.dbManager.Position()
+}
+
 // No-op: DBManagerComponent is not checkpointable for now
 func (d *DBManagerComponent) CreateCheckpoint(ctx context.Context, id string) (string, error) {
 	return id, nil
@@ -76,6 +264,11 @@ func (d *DBManagerComponent) RestoreToCheckpoint(ctx context.Context, id string)
 	return nil
 }
 
+// No-op: DBManagerComponent is not checkpointable for now, so every checkpoint can be restored
+func (d *DBManagerComponent) HasCheckpoint(ctx context.Context, id string) (bool, error) {
+	return true, nil
+}
+
 // abs returns the absolute value of a duration
 func abs(d time.Duration) time.Duration {
 	if d < 0 {
@@ -90,15 +283,102 @@ type ObjectStorageConfig struct {
 	Endpoint  string `json:"endpoint"`
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
-	Region    string `json:"region"`
+	// SessionToken is the optional session token for temporary (STS) credentials.
+	// When AccessKey, SecretKey and SessionToken are all empty, credentials come from the environment/role.
+	SessionToken string `json:"session_token,omitempty"`
+	// Region is the storage region; "auto" suits Tigris and R2 and is resolved from the hostname
+	// of AWS S3 endpoints
+	Region string `json:"region"`
+	// SkipRegionCheck uses Region exactly as configured, for endpoints the region check misjudges
+	SkipRegionCheck bool `json:"skip_region_check,omitempty"`
+	// PathStyle selects path-style addressing (endpoint/bucket/key) when true or unset, and
+	// virtual-host style (bucket.endpoint/key), as AWS S3 prefers, when false
+	PathStyle *bool  `json:"path_style,omitempty"`
 	KeyPrefix string `json:"key_prefix"`
+	// EnvID identifies the environment in logs and status. When KeyPrefix is empty or "/", a
+	// configured EnvID also places the environment's objects under envs/<env_id>/.
+	EnvID string `json:"env_id,omitempty"`
+	// KeyLayout is the version of the scheme deriving each component's object keys from the key
+	// prefix; zero uses DefaultKeyLayout. See the README for the keys of each version.
+	KeyLayout int    `json:"key_layout,omitempty"`
 	EnvDir    string `json:"env_dir"`
+	// SSE is the server-side encryption algorithm for objects written to storage: "AES256" or "aws:kms".
+	// It is applied to Litestream replication and the stored config; see the README for other components.
+	SSE string `json:"sse,omitempty"`
+	// SSEKMSKeyID is the KMS key used when SSE is "aws:kms"; empty uses the bucket's default key
+	SSEKMSKeyID string `json:"sse_kms_key_id,omitempty"`
+	// RequestTimeoutSeconds bounds each storage request; zero uses DefaultStorageRequestTimeout
+	RequestTimeoutSeconds int `json:"request_timeout_seconds,omitempty"`
+	// MaxRetries is how many times a failed storage request is retried; zero uses
+	// DefaultStorageMaxRetries and a negative value disables retries
+	MaxRetries int `json:"max_retries,omitempty"`
+	// RetryBackoffMillis is the wait before the first retry, doubling after each attempt; zero uses
+	// DefaultStorageRetryBackoff
+	RetryBackoffMillis int `json:"retry_backoff_ms,omitempty"`
 }
 
+// CurrentConfigVersion is the newest config schema version this build understands
+const CurrentConfigVersion = 1
+
+// MaxConfigFileSize bounds how many bytes are read from the config file
+var MaxConfigFileSize int64 = 1 << 20
+
+// ConfigLoadAttempts and ConfigLoadRetryBackoff bound retries of the config load at startup,
+// for a config file that is present but cannot be read or parsed yet (e.g. a provisioner is
+// still writing it). The backoff doubles after each attempt.
+var (
+	ConfigLoadAttempts     = 5
+	ConfigLoadRetryBackoff = 200 * time.Millisecond
+)
+
+// configLoadWait pauses between config load attempts
+var configLoadWait = time.Sleep
+
 // SystemConfig represents the overall system configuration
 type SystemConfig struct {
+	Version int                 `json:"version"` // Schema version; unversioned configs are treated as version 1
 	Storage ObjectStorageConfig `json:"storage"`
-	Stacks  []string            `json:"stacks"` // List of stack components to enable
+	Stacks  []string            `json:"stacks"`           // List of stack components to enable
+	Target  string              `json:"target,omitempty"` // Overrides the proxy target address when set
+	JuiceFS JuiceFSConfig       `json:"juicefs"`          // Settings for the juicefs stack
+	DB      DBConfig            `json:"db"`               // Settings for the db stack
+	Sync    SyncConfig          `json:"sync"`             // Settings for the sync stack
+	Leaser  LeaserConfig        `json:"leaser"`           // Settings for the leaser stack
+	Warmer  WarmerConfig        `json:"warmer"`           // Settings for the warmer stack
+	// Critical marks whether a failure of each stack fails the whole environment; stacks are critical unless set to false
+	Critical map[string]bool `json:"critical,omitempty"`
+	// PersistToStorage also saves the config to the storage bucket so a recreated machine can bootstrap from it
+	PersistToStorage bool `json:"persist_to_storage,omitempty"`
+	// AutosaveOnShutdown checkpoints all components during a graceful shutdown and records the
+	// checkpoint as current so the next boot can restore it
+	AutosaveOnShutdown bool `json:"autosave_on_shutdown,omitempty"`
+	// AutoRestore selects a checkpoint to restore once components are set up: "latest" (the newest
+	// shutdown checkpoint), "current" (the persisted current checkpoint pointer) or "named"
+	// (AutoRestoreID). Empty disables auto-restore.
+	AutoRestore string `json:"auto_restore,omitempty"`
+	// AutoRestoreID is the checkpoint restored when AutoRestore is "named"
+	AutoRestoreID string `json:"auto_restore_id,omitempty"`
+	// ConfigHistory keeps this many redacted copies of the config in storage, one per change, for
+	// audit and rollback. Zero disables the history.
+	ConfigHistory int `json:"config_history,omitempty"`
+	// Standby starts the machine as a warm standby: the stacks follow the active machine's state
+	// without acquiring the lease or serving traffic, until it is promoted with POST /promote
+	Standby bool `json:"standby,omitempty"`
+	// AllowedHosts lists the Host values the proxy serves; requests for any other host are
+	// rejected with 421. Empty allows every host.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+	// DataQuota limits the local disk used by env_dir, evicting old checkpoints when it fills up
+	DataQuota DataQuotaConfig `json:"data_quota"`
+	// Components holds the settings of stacks without a section of their own above, such as
+	// components added by a program embedding this package, keyed by stack name. Each is passed
+	// as is to the component's ConfigureComponent before it is set up.
+	Components map[string]json.RawMessage `json:"components,omitempty"`
+	// AllowEmptyCheckpoints makes a checkpoint or restore succeed as a no-op when no component is
+	// checkpointable, e.g. a leaser-only environment, instead of failing with 400
+	AllowEmptyCheckpoints bool `json:"allow_empty_checkpoints,omitempty"`
+	// CheckpointConsistency is how a restore treats components whose checkpoints under the ID were
+	// taken by different checkpoint operations: "off" (the default), "warn" or "refuse"
+	CheckpointConsistency string `json:"checkpoint_consistency,omitempty"`
 }
 
 // AdminConfig holds configuration for the admin interface.
@@ -110,13 +390,30 @@ type AdminConfig struct {
 	// RestartDelay is the time to wait before restarting a failed process.
 	// Defaults to 100ms if not set (matching systemd's default).
 	RestartDelay time.Duration `yaml:"restart_delay"`
+
+	// RestartJitter is the fraction of RestartDelay by which each restart delay is randomized.
+	// Defaults to 0, a fixed delay.
+	RestartJitter float64 `yaml:"restart_jitter"`
+
+	// MaxRestarts caps consecutive restarts of a process that keeps exiting soon after starting.
+	// Defaults to 0, unlimited.
+	MaxRestarts int `yaml:"max_restarts"`
+
+	// Shell runs the supervised command through "sh -c". Defaults to false, executing it directly.
+	Shell bool `yaml:"shell"`
+
+	// ShutdownTimeout bounds the whole shutdown sequence (checkpointing, lease handoff, component
+	// cleanup and stopping the process), so the process exits before the platform force-kills it.
+	// Defaults to 2 minutes, leaving room for TimeoutStop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 }
 
 // DefaultAdminConfig returns a new AdminConfig with default values.
 func DefaultAdminConfig() AdminConfig {
 	return AdminConfig{
-		TimeoutStop:  90 * time.Second,
-		RestartDelay: time.Second,
+		TimeoutStop:     90 * time.Second,
+		RestartDelay:    time.Second,
+		ShutdownTimeout: 2 * time.Minute,
 	}
 }
 
@@ -143,19 +440,36 @@ func DefaultControlConfig() ControlConfig {
 // DefaultSystemConfig returns a new SystemConfig with default values
 func DefaultSystemConfig() SystemConfig {
 	return SystemConfig{
+		Version: CurrentConfigVersion,
 		Storage: DefaultObjectStorageConfig(),
 		Stacks:  []string{"leaser", "juicefs"},
 	}
 }
 
+// validateVersion defaults an unversioned config to version 1 and rejects versions newer than this build understands
+func (cfg *SystemConfig) validateVersion() error {
+	if cfg.Version == 0 {
+		cfg.Version = 1
+	}
+	if cfg.Version < 0 || cfg.Version > CurrentConfigVersion {
+		return fmt.Errorf("unsupported config version %d (this build supports up to version %d)", cfg.Version, CurrentConfigVersion)
+	}
+	return nil
+}
+
 // DefaultObjectStorageConfig returns a new ObjectStorageConfig with default values
 func DefaultObjectStorageConfig() ObjectStorageConfig {
 	return ObjectStorageConfig{
-		Region:    "auto",
+		Region:    DefaultRegion,
 		KeyPrefix: "/",
 	}
 }
 
+// TargetSetter is an interface for updating the address requests are proxied to
+type TargetSetter interface {
+	SetTarget(addr string) error
+}
+
 // ControlHTTP represents a component that provides HTTP endpoints
 type ControlHTTP interface {
 	StackComponent
@@ -166,32 +480,100 @@ type ControlHTTP interface {
 // Control manages the control interface and object storage configuration
 // and provides methods for configuring and monitoring the system.
 type Control struct {
-	mu             sync.RWMutex
-	config         *SystemConfig
-	configPath     string
-	dataDir        string
-	targetAddr     string
-	controllerAddr string
-	token          string
-	supervisor     *Supervisor
-	components     []StackComponent
-	err            error
-	mux            *http.ServeMux
+	mu              sync.RWMutex
+	config          *SystemConfig
+	configPath      string
+	dataDir         string
+	targetAddr      string
+	controllerAddr  string
+	tokens          *controllerTokens
+	supervisor      *Supervisor // nil when running without a supervised process (config-only mode)
+	components      []StackComponent
+	err             error
+	mux             *http.ServeMux
+	reconfiguring   atomic.Bool
+	draining        atomic.Bool
+	fenced          atomic.Bool // set once the lease is lost, until the next setup
+	setupComplete   atomic.Bool // set once the stacks of the current config are set up
+	startAfterSetup bool        // hold the supervised process until setupComplete
+	standby         atomic.Bool // set while running as a warm standby, until promoted
+	envConfigured   bool
+	waitForConfig   bool // FLY_ENV_WAIT_FOR_CONFIG or FLY_ENV_CONFIG_IN_STORAGE: the config arrives after startup
+	proxy           TargetSetter
+	events          *EventLog
+	metrics         *ProxyMetrics // counters of the proxies in front of the app, exposed at /metrics
+	statusChanges   notifier
+	maintenance     MaintenanceState
+	setupErrors     map[string]error   // setup failures of non-critical stacks, reported as unhealthy
+	suspension      *suspension        // set while suspended
+	operation       operationTracker   // the checkpoint or restore in progress, settled by Shutdown
+	operations      *OperationRegistry // long-running operations in progress, listed and cancelled at /operations
+	storage         *storageMonitor    // probes object storage reachability while configured
+	quota           *quotaMonitor      // enforces the data quota while configured with one
+	configStore     ConfigStore        // bootstraps the config from object storage; nil unless FLY_ENV_CONFIG_IN_STORAGE is set
+	configSource    string             // where the current config came from, one of the ConfigSource constants
+	configTimeout   time.Duration      // deadline for applying a config POST; zero uses DefaultConfigTimeout
+	limiter         *rateLimiter       // per-endpoint rate limits of the control API
+	healthEndpoints HealthEndpoints    // where the health and metrics endpoints are served
+	// reconciler repairs stacks that stopped working, if enabled; it is swapped without c.mu,
+	// which a checkpoint holds throughout, so Shutdown can stop it while one is in progress
+	reconciler atomic.Pointer[reconciler]
+	// readyWebhook calls the readiness webhook, if configured; swapped without c.mu like reconciler
+	readyWebhook atomic.Pointer[readyWebhook]
+	// checkpointQuiesce is how the supervised app is paused around checkpoints
+	checkpointQuiesce CheckpointQuiesce
+	// signalRoutes is which processes the signals received by the server are forwarded to
+	signalRoutes SignalRoutes
+	// activeTar configures streaming the JuiceFS active directory for debugging
+	activeTar ActiveTarConfig
+	// noSetupGuidance leaves SetupGuidance out of the status of an unconfigured server
+	noSetupGuidance bool
+	startedAt       time.Time
 }
 
+// Config sources reported in SystemStatus
+const (
+	ConfigSourceEnv     = "env"
+	ConfigSourceFile    = "file"
+	ConfigSourceStorage = "storage"
+	ConfigSourceAPI     = "api"
+)
+
+const (
+	// statusStreamPollInterval is how often status streams check for changes not signalled by events
+	statusStreamPollInterval = time.Second
+	// statusStreamKeepalive is how often status streams send a keepalive comment
+	statusStreamKeepalive = 15 * time.Second
+	// configStoreTimeout bounds reads and writes of the config in object storage
+	configStoreTimeout = 30 * time.Second
+)
+
 // NewSystemConfigFromEnv creates a new SystemConfig from environment variables
 func NewSystemConfigFromEnv() (*SystemConfig, error) {
 	// Check for required storage environment variables
 	bucket := os.Getenv("FLY_STORAGE_BUCKET")
 	endpoint := os.Getenv("FLY_STORAGE_ENDPOINT")
-	accessKey := os.Getenv("FLY_STORAGE_ACCESS_KEY")
-	secretKey := os.Getenv("FLY_STORAGE_SECRET_KEY")
 
 	// If any of the required storage variables are missing, return nil
-	if bucket == "" || endpoint == "" || accessKey == "" || secretKey == "" {
+	// rule: keys are optional so credentials can come from the environment/role
+	if bucket == "" || endpoint == "" {
 		return nil, nil
 	}
 
+	// Credentials may also be read from files named by the matching *_FILE variables
+	accessKey, err := SecretEnv("FLY_STORAGE_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := SecretEnv("FLY_STORAGE_SECRET_KEY")
+	if err != nil {
+		return nil, err
+	}
+	sessionToken, err := SecretEnv("FLY_STORAGE_SESSION_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
 	// Start with default config
 	cfg := DefaultSystemConfig()
 
@@ -200,18 +582,65 @@ func NewSystemConfigFromEnv() (*SystemConfig, error) {
 	cfg.Storage.Endpoint = endpoint
 	cfg.Storage.AccessKey = accessKey
 	cfg.Storage.SecretKey = secretKey
+	cfg.Storage.SessionToken = sessionToken
+	cfg.Storage.SSE = os.Getenv("FLY_STORAGE_SSE")
+	cfg.Storage.SSEKMSKeyID = os.Getenv("FLY_STORAGE_SSE_KMS_KEY_ID")
+	if err := cfg.Storage.validateCredentials(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Storage.validateEncryption(); err != nil {
+		return nil, err
+	}
 
 	// Optional storage configuration
 	if region := os.Getenv("FLY_STORAGE_REGION"); region != "" {
 		cfg.Storage.Region = region
 	}
+	cfg.Storage.SkipRegionCheck = os.Getenv("FLY_STORAGE_SKIP_REGION_CHECK") != ""
+	if v := os.Getenv("FLY_STORAGE_PATH_STYLE"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FLY_STORAGE_PATH_STYLE %q: %w", v, err)
+		}
+		cfg.Storage.PathStyle = &pathStyle
+	}
+	if err := cfg.Storage.validateAddressing(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Storage.validateRegion(); err != nil {
+		return nil, err
+	}
 	if keyPrefix := os.Getenv("FLY_STORAGE_KEY_PREFIX"); keyPrefix != "" {
 		cfg.Storage.KeyPrefix = keyPrefix
 	}
+	cfg.Storage.EnvID = os.Getenv("FLY_ENV_ID")
+	if layout := os.Getenv("FLY_STORAGE_KEY_LAYOUT"); layout != "" {
+		version, err := strconv.Atoi(layout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FLY_STORAGE_KEY_LAYOUT %q: %w", layout, err)
+		}
+		cfg.Storage.KeyLayout = version
+		if err := cfg.Storage.validateKeyLayout(); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Storage.EnvDir = os.Getenv("FLY_ENV_DIR")
+	cfg.JuiceFS.Binary = os.Getenv("FLY_JUICEFS_BINARY")
+	cfg.JuiceFS.CheckpointDir = os.Getenv("FLY_JUICEFS_CHECKPOINT_DIR")
 
 	// Get stacks from environment variable
 	if stacks := os.Getenv("FLY_STACKS"); stacks != "" {
 		cfg.Stacks = strings.Split(stacks, ",")
+		if err := cfg.validateStacks(); err != nil {
+			return nil, fmt.Errorf("invalid FLY_STACKS: %w", err)
+		}
+	}
+	cfg.Standby = os.Getenv("FLY_ENV_STANDBY") != ""
+	if hosts := os.Getenv("FLY_ALLOWED_HOSTS"); hosts != "" {
+		cfg.AllowedHosts = strings.Split(hosts, ",")
+		if err := cfg.validateAllowedHosts(); err != nil {
+			return nil, err
+		}
 	}
 
 	return &cfg, nil
@@ -227,27 +656,62 @@ func NewControlWithConfig(targetAddr, controllerAddr, token string, supervisor *
 	c := &Control{
 		targetAddr:     targetAddr,
 		controllerAddr: controllerAddr,
-		token:          token,
+		tokens:         &controllerTokens{current: token, grace: DefaultTokenGrace},
 		configPath:     configPath,
 		dataDir:        dataDir,
 		supervisor:     supervisor,
 		components:     components,
 		mux:            http.NewServeMux(),
+		limiter:        newRateLimiter(ControlRateLimit{}),
+		events:         NewEventLog(DefaultEventLogSize),
+		operations:     NewOperationRegistry(),
+		metrics:        NewProxyMetrics(),
+		startedAt:      time.Now(),
 	}
 
-	// Set up initial routes (before config)
-	c.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			c.handleStatus(w, r)
-		} else if r.Method == http.MethodPost {
-			c.handleConfig(w, r)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if supervisor != nil {
+		supervisor.SetEventLog(c.events)
+	}
+	for _, comp := range components {
+		if er, ok := comp.(EventRecorder); ok {
+			er.SetEventLog(c.events)
 		}
-	})
+		if rec, ok := comp.(OperationRecorder); ok {
+			rec.SetOperationRegistry(c.operations)
+		}
+		if lc, ok := comp.(*LeaserComponent); ok {
+			lc.SetLeaseLostHandler(c.fence)
+		}
+	}
+
+	// Set up initial routes (before config)
+	c.registerBaseRoutes(c.mux)
+
+	// rule: maintenance mode survives a restart of this process but not a full reconfigure
+	if err := c.loadMaintenance(); err != nil {
+		logWarnf("Failed to load maintenance state: %v", err)
+	}
 
 	// Check if we should wait for config
 	waitForConfig := os.Getenv("FLY_ENV_WAIT_FOR_CONFIG") != ""
+	c.waitForConfig = waitForConfig
+
+	// rule: with FLY_ENV_CONFIG_IN_STORAGE set, the FLY_STORAGE_* variables only locate the stored config
+	if os.Getenv("FLY_ENV_CONFIG_IN_STORAGE") != "" {
+		bootstrap, err := NewSystemConfigFromEnv()
+		if err == nil && bootstrap == nil {
+			err = fmt.Errorf("FLY_ENV_CONFIG_IN_STORAGE requires FLY_STORAGE_BUCKET and FLY_STORAGE_ENDPOINT")
+		}
+		if err == nil {
+			c.configStore, err = NewS3ConfigStore(&bootstrap.Storage)
+		}
+		if err != nil {
+			c.err = fmt.Errorf("failed to set up config storage: %w", err)
+			return c
+		}
+		waitForConfig = true
+		c.waitForConfig = true
+	}
 
 	// Try to load config from environment first
 	if !waitForConfig {
@@ -260,9 +724,12 @@ func NewControlWithConfig(targetAddr, controllerAddr, token string, supervisor *
 				return c
 			}
 			c.config = envConfig
+			c.envConfigured = true
+			c.configSource = ConfigSourceEnv
+			c.startStorageMonitor(&envConfig.Storage)
 			// Set up components with environment config
 			if err := c.setupComponents(context.Background(), envConfig); err != nil {
-				log.Printf("Failed to setup components from environment config: %v", err)
+				logErrorf("Failed to setup components from environment config: %v", err)
 			}
 			c.setupRoutes()
 			return c
@@ -270,9 +737,14 @@ func NewControlWithConfig(targetAddr, controllerAddr, token string, supervisor *
 	}
 
 	// Try to load existing config file
-	if err := c.loadConfig(); err != nil {
-		log.Printf("No existing config found: %v", err)
+	if err := c.loadConfigWithRetry(); errors.Is(err, fs.ErrNotExist) {
+		logInfof("No existing config found: %v", err)
+	} else if err != nil {
+		// An unreadable or incompatible config must not be silently replaced
+		logWarnf("Failed to load config: %v", err)
+		c.err = err
 	} else {
+		c.startStorageMonitor(&c.config.Storage)
 		c.setupRoutes()
 	}
 
@@ -283,27 +755,99 @@ func NewControlWithConfig(targetAddr, controllerAddr, token string, supervisor *
 func (c *Control) setupRoutes() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.mux = c.routes()
+}
 
-	// Create a new mux
-	c.mux = http.NewServeMux()
+// routes returns a new mux with every route of a configured system; the caller must hold c.mu
+func (c *Control) routes() *http.ServeMux {
+	mux := http.NewServeMux()
 
 	// Register component routes
+	synced := make(map[string]bool)
+	checkpointRoutes := make(map[string]bool)
+	logRoutes := make(map[string]bool)
 	for _, comp := range c.components {
+		name := comp.Name()
 		if httpComp, ok := comp.(ControlHTTP); ok {
-			name := getComponentName(comp)
-			if name != "" {
-				c.mux.Handle("/stack/"+name+"/", http.StripPrefix("/stack/"+name, httpComp))
+			mux.Handle("/stack/"+name+"/", http.StripPrefix("/stack/"+name, httpComp))
+		}
+		if rc, ok := comp.(Restartable); ok {
+			mux.HandleFunc("POST /stack/"+name+"/restart", c.handleRestart(rc))
+		}
+		if sp, ok := comp.(StatsProvider); ok {
+			mux.HandleFunc("GET /stack/"+name+"/stats", c.handleStats(sp))
+		}
+		if !logRoutes[name] {
+			if lc, ok := comp.(LoggedComponent); ok {
+				mux.HandleFunc("GET /stack/"+name+"/logs", handleLogs(name, lc))
+			} else {
+				mux.HandleFunc("GET /stack/"+name+"/logs", handleNoLogs(name))
+			}
+			logRoutes[name] = true
+		}
+		if cp, ok := comp.(Compactor); ok {
+			mux.HandleFunc("POST /stack/"+name+"/compact", c.handleCompact(cp))
+		}
+		if j, ok := comp.(*JuiceFSComponent); ok {
+			mux.HandleFunc("GET /stack/"+name+"/active.tar", c.handleActiveTar(j))
+		}
+		if rs, ok := comp.(ReplicationSyncer); ok && !synced[name] {
+			mux.HandleFunc("POST /stack/"+name+"/sync", c.handleSync(rs))
+			synced[name] = true
+		}
+		if !checkpointRoutes[name] {
+			if cc, ok := comp.(CheckpointableComponent); ok {
+				mux.HandleFunc("POST /stack/"+name+"/checkpoint", c.handleStackCheckpoint(cc))
+			} else {
+				mux.HandleFunc("POST /stack/"+name+"/checkpoint", handleNotCheckpointable(name))
 			}
+			checkpointRoutes[name] = true
 		}
 	}
 
 	// Register other routes
-	c.mux.HandleFunc("/checkpoint", c.handleCheckpoint)
-	c.mux.HandleFunc("/restore", c.handleRestore)
-	c.mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/checkpoint", c.handleCheckpoint)
+	mux.HandleFunc("GET /checkpoint/{id}", c.handleCheckpointExists)
+	mux.HandleFunc("GET /checkpoints", c.handleListCheckpoints)
+	mux.HandleFunc("GET /checkpoints/graph", c.handleCheckpointGraph)
+	mux.HandleFunc("/restore", c.handleRestore)
+	mux.HandleFunc("/suspend", c.handleSuspend)
+	mux.HandleFunc("/resume", c.handleResume)
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/debug", c.handleDebug)
+	mux.HandleFunc("POST /promote", c.handlePromote)
+	mux.HandleFunc("POST /migrate", c.handleMigrate)
+	c.registerBaseRoutes(mux)
+	return mux
+}
+
+// registerBaseRoutes registers the routes available whether or not the system is configured;
+// the caller must hold c.mu or not be serving yet
+func (c *Control) registerBaseRoutes(mux *http.ServeMux) {
+	healthPath, metricsPath := c.healthEndpoints.paths()
+	mux.Handle("/events", c.events)
+	mux.HandleFunc("GET "+metricsPath, c.handleMetrics)
+	mux.HandleFunc("/status/stream", c.handleStatusStream)
+	mux.HandleFunc("/maintenance", c.handleMaintenance)
+	mux.HandleFunc("/drain", c.handleDrain)
+	mux.HandleFunc("/supervisor/autorestart", c.handleAutoRestart)
+	mux.HandleFunc("GET /supervisor/history", c.handleHistory)
+	mux.HandleFunc("/supervisor/policy", c.handleRestartPolicy)
+	mux.HandleFunc("/supervisor/command", c.handleCommand)
+	// rule: the supervised process is not a stack, but its logs are served alongside the stacks'
+	// so every log buffer is under one path
+	if c.supervisor != nil {
+		mux.HandleFunc("GET /stack/supervisor/logs", handleLogs("supervisor", c.supervisor))
+	}
+	mux.HandleFunc("/stacks", c.handleStacks)
+	mux.HandleFunc(healthPath, c.handleHealthz)
+	mux.HandleFunc("POST /config/validate", c.handleValidateConfig)
+	mux.HandleFunc("POST /token/reload", c.handleTokenReload)
+	mux.HandleFunc("GET /operations", c.handleOperations)
+	mux.HandleFunc("POST /operations/{id}/cancel", c.handleCancelOperation)
 
 	// Handle root path based on method
-	c.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			c.handleStatus(w, r)
 		} else if r.Method == http.MethodPost {
@@ -314,25 +858,110 @@ func (c *Control) setupRoutes() {
 	})
 }
 
+// validate checks a config submitted through the API before it is applied
+func (cfg *SystemConfig) validate() error {
+	if err := cfg.validateVersion(); err != nil {
+		return err
+	}
+	if cfg.Storage.Bucket == "" || cfg.Storage.Endpoint == "" {
+		return fmt.Errorf("Missing required fields")
+	}
+	if err := cfg.validateStacks(); err != nil {
+		return err
+	}
+	if err := cfg.validateComponents(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateCredentials(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateEncryption(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateEnvID(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateKeyLayout(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateRegion(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateAddressing(); err != nil {
+		return err
+	}
+	if err := cfg.Storage.validateClient(); err != nil {
+		return err
+	}
+	if err := cfg.DB.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Leaser.validate(); err != nil {
+		return err
+	}
+	if err := cfg.JuiceFS.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Warmer.validate(); err != nil {
+		return err
+	}
+	if err := cfg.validateConfigHistory(); err != nil {
+		return err
+	}
+	if err := cfg.validateAllowedHosts(); err != nil {
+		return err
+	}
+	if err := cfg.DataQuota.validate(); err != nil {
+		return err
+	}
+	if err := cfg.validateCheckpointConsistency(); err != nil {
+		return err
+	}
+	return cfg.validateAutoRestore()
+}
+
+// decodeConfig decodes a config submitted through the API over cfg.
+// rule: a misspelled field would otherwise be dropped silently and surface as a confusing missing
+// field, so unknown fields are rejected by name; config files are read leniently so an older build
+// can still start from a newer file
+func decodeConfig(r io.Reader, cfg *SystemConfig) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Errorf("unrecognized config field %s", field)
+		}
+		return err
+	}
+	return nil
+}
+
 func (c *Control) handleConfig(w http.ResponseWriter, r *http.Request) {
 	// Start with default config
 	cfgData := DefaultSystemConfig()
 
 	// Decode the request body into our config
-	if err := json.NewDecoder(r.Body).Decode(&cfgData); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeConfig(r.Body, &cfgData); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
 	// Validate required fields
-	if cfgData.Storage.Bucket == "" || cfgData.Storage.Endpoint == "" ||
-		cfgData.Storage.AccessKey == "" || cfgData.Storage.SecretKey == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+	if err := cfgData.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// rule: only one reconfiguration may run at a time
+	if !c.beginReconfigure() {
+		http.Error(w, "Reconfiguration already in progress", http.StatusConflict)
 		return
 	}
+	defer c.endReconfigure()
 
 	// Store the configurations
 	c.config = &cfgData
+	c.configSource = ConfigSourceAPI
 
 	// Save config to file
 	if err := c.saveConfig(); err != nil {
@@ -340,61 +969,283 @@ func (c *Control) handleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := c.SetMaintenance(MaintenanceState{}); err != nil {
+		logWarnf("Failed to clear maintenance mode: %v", err)
+	}
+
 	// Set up components
-	if err := c.setupComponents(r.Context(), &cfgData); err != nil {
+	setupCtx, cancel, timeout := c.configContext(r.Context())
+	defer cancel()
+	setupCtx, op := c.operations.Start(setupCtx, "setup", "setup of "+strings.Join(cfgData.Stacks, ", "))
+	defer op.End()
+	if err := c.setupComponents(setupCtx, &cfgData); err != nil {
+		// rule: a cancelled setup is rolled back like a timed out one
+		if operationCancelled(setupCtx) {
+			logErrorf("Configuration cancelled: %v", err)
+			msg := "Configuration cancelled: setup was stopped and the components set up so far were cleaned up"
+			if cleanupErr := c.rollbackSetup(); cleanupErr != nil {
+				logErrorf("Failed to roll back cancelled setup: %v", cleanupErr)
+				msg = fmt.Sprintf("Configuration cancelled: setup was stopped but cleaning up failed: %v", cleanupErr)
+			}
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+		// rule: a setup cut short by the config timeout is rolled back so nothing keeps running half configured
+		if errors.Is(setupCtx.Err(), context.DeadlineExceeded) {
+			logErrorf("Configuration timed out after %s: %v", timeout, err)
+			msg := fmt.Sprintf("Configuration timed out after %s: setup was cancelled and the components set up so far were cleaned up", timeout)
+			if cleanupErr := c.rollbackSetup(); cleanupErr != nil {
+				logErrorf("Failed to roll back timed out setup: %v", cleanupErr)
+				msg = fmt.Sprintf("Configuration timed out after %s: setup was cancelled but cleaning up failed: %v", timeout, cleanupErr)
+			}
+			http.Error(w, msg, http.StatusGatewayTimeout)
+			return
+		}
 		http.Error(w, fmt.Sprintf("Failed to set up components: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Set up routes after components are configured
 	c.setupRoutes()
+	c.startStorageMonitor(&cfgData.Storage)
 
+	if err := c.applyTarget(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update proxy target: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	c.NotifyStatusChange()
+	c.events.Record(EventConfigChanged, "control", "configuration applied", map[string]string{"stacks": strings.Join(cfgData.Stacks, ",")})
 	w.WriteHeader(http.StatusOK)
 }
 
-func (c *Control) handleStatus(w http.ResponseWriter, r *http.Request) {
+// Events returns the control's event log
+func (c *Control) Events() *EventLog {
+	return c.events
+}
+
+// ProxyMetrics returns the response counters exposed at /metrics, for the proxies to record into
+func (c *Control) ProxyMetrics() *ProxyMetrics {
+	return c.metrics
+}
+
+// SetProxy sets the proxy whose target follows the configured target address
+func (c *Control) SetProxy(proxy TargetSetter) error {
+	c.mu.Lock()
+	c.proxy = proxy
+	c.mu.Unlock()
+	return c.applyTarget()
+}
+
+// applyTarget points the proxy at the configured target, if both are set
+func (c *Control) applyTarget() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	status := struct {
-		Configured bool     `json:"configured"`
-		Running    bool     `json:"running"`
-		Stacks     []string `json:"stacks"`
-	}{
-		Configured: c.config != nil,
-		Running:    c.supervisor != nil && c.supervisor.IsRunning(),
-		Stacks:     nil, // Will be empty slice when not configured
+	if c.proxy == nil || c.config == nil || c.config.Target == "" || c.config.Target == c.targetAddr {
+		return nil
 	}
-
-	if status.Configured {
-		status.Stacks = c.config.Stacks
+	if err := c.proxy.SetTarget(c.config.Target); err != nil {
+		return err
 	}
+	c.targetAddr = c.config.Target
+	return nil
+}
+
+// beginReconfigure marks a reconfiguration as in progress, returning false if one already is
+func (c *Control) beginReconfigure() bool {
+	return c.reconfiguring.CompareAndSwap(false, true)
+}
+
+// endReconfigure marks the current reconfiguration as finished
+func (c *Control) endReconfigure() {
+	c.reconfiguring.Store(false)
+}
+
+// Reconfiguring returns true while a new configuration is being applied
+func (c *Control) Reconfiguring() bool {
+	return c.reconfiguring.Load()
+}
+
+func (c *Control) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Status())
+}
 
+// handleDebug reports process resource usage for leak investigation
+func (c *Control) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	json.NewEncoder(w).Encode(CurrentResourceUsage())
+}
+
+// SystemStatus is the aggregate status of the environment, as returned by GET /status
+type SystemStatus struct {
+	Configured bool `json:"configured"`
+	Running    bool `json:"running"`
+	Draining   bool `json:"draining,omitempty"`
+	// EnvID is the configured environment ID, or the one derived from the machine
+	EnvID string `json:"env_id"`
+	// Fenced is set once the lease was lost and the write-capable stacks were stopped
+	Fenced bool `json:"fenced,omitempty"`
+	// Standby is set while the machine is a warm standby waiting to be promoted
+	Standby bool `json:"standby,omitempty"`
+	// AutoRestartDisabled is set while the supervised process is left stopped when it exits
+	AutoRestartDisabled bool     `json:"autorestart_disabled,omitempty"`
+	Stacks              []string `json:"stacks"`
+	// ProxyOnly is set when the config lists no stacks, so only the supervised app is proxied to
+	ProxyOnly bool `json:"proxy_only,omitempty"`
+	// ConfigSource is where the current config came from: env, file, storage or api
+	ConfigSource  string        `json:"config_source,omitempty"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Resources     ResourceUsage `json:"resources"`
+	// Components is the status reported by each enabled stack, keyed by stack name
+	Components map[string]map[string]interface{} `json:"components,omitempty"`
+	// Health is the runtime health of each enabled stack
+	Health map[string]ComponentHealth `json:"health,omitempty"`
+	// Storage is the cached result of the background object storage reachability probe
+	Storage *StorageReachability `json:"storage,omitempty"`
+	// StartLatency is how long the supervised process took from launch to ready, across restarts
+	StartLatency *StartLatency `json:"start_latency,omitempty"`
+	// Setup tells how to configure the server, only while it is unconfigured
+	Setup *SetupGuidance `json:"setup,omitempty"`
+}
+
+// Status returns the aggregate status of the environment
+func (c *Control) Status() SystemStatus {
+	return c.currentStatus()
 }
 
-func (c *Control) Status() interface{} {
+// currentStatus builds the current status of the control interface
+func (c *Control) currentStatus() SystemStatus {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	status := struct {
-		Configured bool     `json:"configured"`
-		Running    bool     `json:"running"`
-		Stacks     []string `json:"stacks"`
-	}{
-		Configured: c.config != nil,
-		Running:    c.supervisor != nil && c.supervisor.IsRunning(),
-		Stacks:     nil, // Will be empty slice when not configured
+	status := SystemStatus{
+		Configured:    c.config != nil,
+		Running:       c.supervisor != nil && c.supervisor.IsRunning(),
+		Draining:      c.Draining(),
+		EnvID:         EnvIDFromEnv(),
+		Fenced:        c.Fenced(),
+		Standby:       c.Standby(),
+		Stacks:        nil, // Will be empty slice when not configured
+		UptimeSeconds: int64(time.Since(c.startedAt).Seconds()),
+		Resources:     CurrentResourceUsage(),
 	}
 
 	if status.Configured {
+		ctx := context.Background()
 		status.Stacks = c.config.Stacks
+		status.ProxyOnly = len(c.config.Stacks) == 0
+		status.ConfigSource = c.configSource
+		if c.config.Storage.EnvID != "" {
+			status.EnvID = c.config.Storage.EnvID
+		}
+		status.Health = c.componentHealth(ctx)
+		status.Components = c.componentStatus(ctx)
+	} else if !c.noSetupGuidance {
+		status.Setup = c.setupGuidance()
+	}
+	if c.storage != nil {
+		reachability := c.storage.Reachability()
+		status.Storage = &reachability
+	}
+	if c.supervisor != nil {
+		status.AutoRestartDisabled = !c.supervisor.AutoRestart()
+		if latency := c.supervisor.StartLatency(); latency.Count > 0 {
+			status.StartLatency = &latency
+		}
 	}
 
 	return status
 }
 
+// componentStatus collects the status of each enabled stack
+func (c *Control) componentStatus(ctx context.Context) map[string]map[string]interface{} {
+	available := c.getAvailableComponents()
+	components := make(map[string]map[string]interface{}, len(c.config.Stacks))
+	for _, stack := range c.config.Stacks {
+		if comp, ok := available[stack]; ok {
+			components[stack] = comp.Status(ctx)
+		}
+	}
+	return components
+}
+
+// NotifyStatusChange wakes status stream subscribers so they push the current status
+func (c *Control) NotifyStatusChange() {
+	c.statusChanges.notify()
+}
+
+// handleStatusStream pushes the status as server-sent events whenever it changes
+func (c *Control) handleStatusStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changes, cancelChanges := c.statusChanges.subscribe()
+	defer cancelChanges()
+	events, cancelEvents := c.events.Subscribe()
+	defer cancelEvents()
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// rule: resource counts, uptime and probe times change constantly, so they are excluded when deciding whether status changed
+	var last SystemStatus
+	sent := false
+	push := func() error {
+		status := c.currentStatus()
+		compare := status
+		compare.Resources = ResourceUsage{}
+		compare.UptimeSeconds = 0
+		if status.Storage != nil {
+			storage := *status.Storage
+			storage.LastSuccess = nil
+			compare.Storage = &storage
+		}
+		if sent && reflect.DeepEqual(compare, last) {
+			return nil
+		}
+		last, sent = compare, true
+		return sse.send("status", status)
+	}
+
+	poll := time.NewTicker(statusStreamPollInterval)
+	defer poll.Stop()
+	keepalive := time.NewTicker(statusStreamKeepalive)
+	defer keepalive.Stop()
+
+	if err := push(); err != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case <-changes:
+			err = push()
+		case <-events:
+			err = push()
+		case <-poll.C:
+			err = push()
+		case <-keepalive.C:
+			err = sse.comment("keepalive")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (c *Control) GetStorageConfig() *ObjectStorageConfig {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -462,23 +1313,64 @@ func (c *Control) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if len(checkpointables) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No checkpointable components available"})
+		c.handleNothingToCheckpoint(w, req.CheckpointID)
 		return
 	}
-
+	// rule: a checkpoint or restore during a mount window would rename a directory that is not mounted yet
+	if notReady := unready(checkpointables); len(notReady) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      "component not ready",
+			"components": notReady,
+		})
+		return
+	}
+
+	resume, err := c.quiesceForCheckpoint()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	defer resume()
+
+	ctx, end := c.beginOperation(r.Context(), "checkpoint", "checkpoint "+req.CheckpointID)
+	defer end()
+	ctx = withCheckpointTag(ctx)
 	results := make(map[string]string)
+	var created []CheckpointableComponent
 	for _, cc := range checkpointables {
-		id, err := cc.CreateCheckpoint(r.Context(), req.CheckpointID)
+		var id string
+		err := ctx.Err()
+		if err == nil {
+			setOperationProgress(ctx, "checkpointing %s", cc.Name())
+			id, err = cc.CreateCheckpoint(ctx, req.CheckpointID)
+		}
 		if err != nil {
+			err = operationErr(ctx, err)
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrCheckpointExists):
+				status = http.StatusConflict
+			case errors.Is(err, errAbortedForShutdown), errors.Is(err, ErrOperationCancelled):
+				status = http.StatusServiceUnavailable
+				if errors.Is(err, ErrOperationCancelled) {
+					status = http.StatusConflict
+				}
+				// rule: a checkpoint aborted by shutdown or cancelled is removed where it was already created, so no partial checkpoint remains
+				deleteCheckpoints(context.WithoutCancel(ctx), created, req.CheckpointID)
+			}
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(status)
 			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
-		results[fmt.Sprintf("%T", cc)] = id
+		results[cc.Name()] = id
+		created = append(created, cc)
 	}
+	c.events.Record(EventCheckpointCreated, "control", "", map[string]string{"checkpoint_id": req.CheckpointID})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -488,6 +1380,121 @@ func (c *Control) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// CheckpointExists reports, per checkpointable component, whether the checkpoint with the given ID
+// exists, and whether it exists in all of them. Components that cannot report on their checkpoints
+// are treated as missing it so a restore is never attempted on an unknown state.
+func (c *Control) CheckpointExists(ctx context.Context, id string) (map[string]bool, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.checkpointExists(ctx, id)
+}
+
+// checkpointExists implements CheckpointExists; the caller must hold c.mu
+func (c *Control) checkpointExists(ctx context.Context, id string) (map[string]bool, bool) {
+	var checkpointables []CheckpointableComponent
+	for _, comp := range c.components {
+		if cc, ok := comp.(CheckpointableComponent); ok {
+			checkpointables = append(checkpointables, cc)
+		}
+	}
+	return checkpointPresence(ctx, checkpointables, id)
+}
+
+// checkpointPresence reports which of the components have the checkpoint, and whether all do
+func checkpointPresence(ctx context.Context, checkpointables []CheckpointableComponent, id string) (map[string]bool, bool) {
+	present := make(map[string]bool)
+	everywhere := true
+	for _, cc := range checkpointables {
+		name := cc.Name()
+		exists := false
+		if ci, ok := cc.(CheckpointInspector); ok {
+			var err error
+			if exists, err = ci.HasCheckpoint(ctx, id); err != nil {
+				logWarnf("Failed to check checkpoint %s in %s: %v", id, name, err)
+				exists = false
+			}
+		}
+		present[name] = exists
+		everywhere = everywhere && exists
+	}
+	return present, everywhere && len(present) > 0
+}
+
+// handleCheckpointExists reports whether a checkpoint exists across all checkpointable components
+func (c *Control) handleCheckpointExists(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	configured := c.config != nil
+	c.mu.RUnlock()
+	if !configured {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not configured"})
+		return
+	}
+
+	id := r.PathValue("id")
+	components, exists := c.CheckpointExists(r.Context(), id)
+	w.Header().Set("Content-Type", "application/json")
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"checkpoint_id": id,
+		"exists":        exists,
+		"components":    components,
+	})
+}
+
+// handleListCheckpoints lists the complete checkpoints of each component that can list them;
+// with include_incomplete=true it also lists those whose creation was interrupted
+func (c *Control) handleListCheckpoints(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.config == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not configured"})
+		return
+	}
+	includeIncomplete := r.URL.Query().Get("include_incomplete") == "true"
+
+	checkpoints := make(map[string][]string)
+	incomplete := make(map[string][]string)
+	for _, comp := range c.components {
+		cl, ok := comp.(CheckpointLister)
+		if !ok {
+			continue
+		}
+		name := cl.Name()
+		ids, err := cl.ListCheckpoints(r.Context())
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Failed to list checkpoints of %s: %v", name, err)})
+			return
+		}
+		checkpoints[name] = ids
+		if icl, ok := cl.(IncompleteCheckpointLister); ok && includeIncomplete {
+			ids, err := icl.ListIncompleteCheckpoints(r.Context())
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Failed to list incomplete checkpoints of %s: %v", name, err)})
+				return
+			}
+			incomplete[name] = ids
+		}
+	}
+
+	resp := map[string]interface{}{"checkpoints": checkpoints}
+	if includeIncomplete {
+		resp["incomplete"] = incomplete
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // handleRestore restores all checkpointable components to the specified checkpoint
 func (c *Control) handleRestore(w http.ResponseWriter, r *http.Request) {
 	c.mu.Lock()
@@ -502,6 +1509,8 @@ func (c *Control) handleRestore(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		CheckpointID string `json:"checkpoint_id"`
+		// Components names the components to restore; empty restores every checkpointable component
+		Components []string `json:"components"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -523,63 +1532,351 @@ func (c *Control) handleRestore(w http.ResponseWriter, r *http.Request) {
 			checkpointables = append(checkpointables, cc)
 		}
 	}
+	if len(req.Components) > 0 {
+		selected, err := c.selectCheckpointables(checkpointables, req.Components)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		checkpointables = selected
+	}
 	if len(checkpointables) == 0 {
+		c.handleNothingToCheckpoint(w, req.CheckpointID)
+		return
+	}
+	// rule: a checkpoint or restore during a mount window would rename a directory that is not mounted yet
+	if notReady := unready(checkpointables); len(notReady) > 0 {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No checkpointable components available"})
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      "component not ready",
+			"components": notReady,
+		})
+		return
+	}
+
+	// Prepare: refuse to touch any component unless every one being restored has the checkpoint
+	if present, ok := checkpointPresence(r.Context(), checkpointables, req.CheckpointID); !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      fmt.Sprintf("Checkpoint %s is not present in all components", req.CheckpointID),
+			"components": present,
+		})
+		return
+	}
+
+	// rule: an inconsistent checkpoint is refused before the operation begins, so nothing is touched
+	if tags, err := c.verifyCheckpointConsistency(r.Context(), c.config.CheckpointConsistency, checkpointables, req.CheckpointID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrCheckpointInconsistent) {
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "consistency_tags": tags})
 		return
 	}
 
+	ctx, end := c.beginOperation(r.Context(), "restore", "restore of "+req.CheckpointID)
+	defer end()
+	if err := restoreAll(ctx, checkpointables, req.CheckpointID); err != nil {
+		err = operationErr(ctx, err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errAbortedForShutdown):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, ErrOperationCancelled):
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	fields := map[string]string{"checkpoint_id": req.CheckpointID}
+	resp := map[string]interface{}{
+		"status":        "success",
+		"checkpoint_id": req.CheckpointID,
+	}
+	if len(req.Components) > 0 {
+		names := make([]string, 0, len(checkpointables))
+		for _, cc := range checkpointables {
+			names = append(names, cc.Name())
+		}
+		fields["components"] = strings.Join(names, ",")
+		resp["components"] = names
+	}
+	c.events.Record(EventCheckpointRestored, "control", "", fields)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// selectCheckpointables returns the checkpointable components named in a restore request, in
+// restore order. Every name must be an available component that is checkpointable.
+func (c *Control) selectCheckpointables(checkpointables []CheckpointableComponent, names []string) ([]CheckpointableComponent, error) {
+	available := c.getAvailableComponents()
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("component %q is listed more than once", name)
+		}
+		comp, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown component %q", name)
+		}
+		if _, ok := comp.(CheckpointableComponent); !ok {
+			return nil, fmt.Errorf("%s is not checkpointable", name)
+		}
+	}
+	var selected []CheckpointableComponent
 	for _, cc := range checkpointables {
-		if err := cc.RestoreToCheckpoint(r.Context(), req.CheckpointID); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			return
+		if slices.Contains(names, cc.Name()) {
+			selected = append(selected, cc)
 		}
 	}
+	return selected, nil
+}
 
+// handleNothingToCheckpoint answers a checkpoint or restore when no component is checkpointable:
+// a no-op success when the config allows empty checkpoints, otherwise 400. The caller must hold c.mu.
+func (c *Control) handleNothingToCheckpoint(w http.ResponseWriter, id string) {
 	w.Header().Set("Content-Type", "application/json")
+	if !c.config.AllowEmptyCheckpoints {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No checkpointable components available"})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":        "success",
-		"checkpoint_id": req.CheckpointID,
+		"checkpoint_id": id,
+		"results":       map[string]string{},
+		"noop":          true,
 	})
 }
 
-// Cleanup performs cleanup of all components
+// unready returns the names of the components that have not finished starting
+func unready(checkpointables []CheckpointableComponent) []string {
+	var names []string
+	for _, cc := range checkpointables {
+		if rc, ok := cc.(ReadinessChecker); ok && !rc.Ready() {
+			names = append(names, cc.Name())
+		}
+	}
+	return names
+}
+
+// rollbackKeeper is implemented by components that keep the rollback checkpoint of a successful
+// restore as a checkpoint the restore can be undone with, instead of deleting it
+type rollbackKeeper interface {
+	keepRollback(ctx context.Context, rollbackID string) error
+}
+
+// restoreAll restores every component to the checkpoint with the given ID, or none of them.
+// Each component's current state is saved as a rollback checkpoint before it is restored; if any
+// restore fails, the components already restored are returned to their saved state.
+func restoreAll(ctx context.Context, checkpointables []CheckpointableComponent, id string) error {
+	rollbackID := fmt.Sprintf(".rollback-%d", time.Now().UnixNano())
+
+	// rollback returns the first n components to their saved state; failed is the index of a
+	// component whose restore failed and so still holds the checkpoint, or -1
+	rollback := func(n, failed int) {
+		// rule: a rollback runs to completion even when the restore was cancelled
+		ctx := context.WithoutCancel(ctx)
+		for i := n - 1; i >= 0; i-- {
+			cc := checkpointables[i]
+			if i != failed {
+				// Put the restored state back as the checkpoint it was restored from
+				if _, err := cc.CreateCheckpoint(ctx, id); err != nil {
+					logErrorf("Rollback of %s: failed to preserve checkpoint %s: %v", cc.Name(), id, err)
+					continue
+				}
+			}
+			if err := cc.RestoreToCheckpoint(ctx, rollbackID); err != nil {
+				logErrorf("Rollback of %s: failed to restore previous state: %v", cc.Name(), err)
+			}
+		}
+	}
+
+	for i, cc := range checkpointables {
+		if err := ctx.Err(); err != nil {
+			rollback(i, -1)
+			return fmt.Errorf("restore cancelled before %s, rolled back all components: %w", cc.Name(), err)
+		}
+		setOperationProgress(ctx, "restoring %s (%d of %d)", cc.Name(), i+1, len(checkpointables))
+		if _, err := cc.CreateCheckpoint(ctx, rollbackID); err != nil {
+			rollback(i, -1)
+			return fmt.Errorf("failed to save state of %s before restore: %w", cc.Name(), err)
+		}
+		if err := cc.RestoreToCheckpoint(ctx, id); err != nil {
+			rollback(i+1, i)
+			return fmt.Errorf("failed to restore %s, rolled back all components: %w", cc.Name(), err)
+		}
+	}
+
+	// Discard the saved state now that every component is restored
+	for _, cc := range checkpointables {
+		// rule: a component that keeps its pre-restore state does so from the rollback checkpoint,
+		// since its active state was already moved there
+		if rk, ok := cc.(rollbackKeeper); ok {
+			if err := rk.keepRollback(ctx, rollbackID); err != nil {
+				logWarnf("Failed to keep pre-restore state of %s: %v", cc.Name(), err)
+			}
+			continue
+		}
+		if cd, ok := cc.(CheckpointDeleter); ok {
+			if err := cd.DeleteCheckpoint(ctx, rollbackID); err != nil {
+				logWarnf("Failed to delete rollback checkpoint of %s: %v", cc.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// RefreshCredentials applies rotated credentials from newCfg to the current configuration
+// and rebuilds the storage clients of every component that holds them
+func (c *Control) RefreshCredentials(ctx context.Context, newCfg *ObjectStorageConfig) error {
+	if err := newCfg.validateCredentials(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.config == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("not configured")
+	}
+	c.config.Storage.AccessKey = newCfg.AccessKey
+	c.config.Storage.SecretKey = newCfg.SecretKey
+	c.config.Storage.SessionToken = newCfg.SessionToken
+	// rule: the components get a copy, since the config may be replaced once the lock is released
+	storage := c.config.Storage
+	components := c.components
+	envConfigured := c.envConfigured
+	c.mu.Unlock()
+
+	// rule: environment-sourced configuration is never written to disk, which would conflict on the next start
+	if !envConfigured {
+		if err := c.saveConfig(); err != nil {
+			return fmt.Errorf("failed to save refreshed credentials: %w", err)
+		}
+	}
+
+	for _, comp := range components {
+		if cr, ok := comp.(CredentialRefresher); ok {
+			if err := cr.RefreshCredentials(ctx, &storage); err != nil {
+				return fmt.Errorf("failed to refresh credentials for %s: %w", comp.Name(), err)
+			}
+		}
+	}
+	c.startStorageMonitor(&storage)
+	return nil
+}
+
+// Cleanup performs cleanup of all components, returning every failure joined together.
+// rule: a failing component does not stop the others from being cleaned up, so it cannot leak their resources
 func (c *Control) Cleanup(ctx context.Context) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Clean up components in reverse order
+	var errs []error
 	for i := len(c.components) - 1; i >= 0; i-- {
 		component := c.components[i]
 		if err := component.Cleanup(ctx); err != nil {
-			return fmt.Errorf("failed to cleanup component: %w", err)
+			logErrorf("Failed to cleanup %s: %v", component.Name(), err)
+			errs = append(errs, fmt.Errorf("failed to cleanup %s: %w", component.Name(), err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-// Shutdown gracefully shuts down the control server
+// Shutdown gracefully shuts down the control server, in an order that neither releases the lease
+// while the app may still write nor holds it longer than needed:
+//  1. new proxied requests are refused (drain), while in-flight ones complete
+//  2. the app is stopped, then its state is checkpointed if autosave is on and every replicated
+//     stack is flushed to object storage
+//  3. the lease is released, so a replacement can take over right away
+//  4. the stacks are cleaned up, stopping replication and unmounting
+//
+// A step that fails is logged and the sequence continues.
 func (c *Control) Shutdown(ctx context.Context) error {
-	// First cleanup all components
-	if err := c.Cleanup(ctx); err != nil {
-		return fmt.Errorf("failed to cleanup components: %w", err)
-	}
+	// rule: a checkpoint or restore in progress ends before anything is torn down, so none is left half done
+	c.settleOperation(ctx)
+
+	// rule: the reconciliation loop stops before the teardown, cancelling a repair in progress, so nothing is repaired while being torn down
+	c.reconciler.Swap(nil).close()
+	c.readyWebhook.Swap(nil).close()
+
+	c.Drain()
 
-	// Then stop the supervisor if it exists
+	// rule: the app stops before its state is saved and the lease released, so nothing it writes afterwards is lost or races a replacement
+	var errs []error
 	if c.supervisor != nil {
 		if err := c.supervisor.StopProcess(); err != nil {
-			return fmt.Errorf("failed to stop supervisor: %w", err)
+			errs = append(errs, fmt.Errorf("failed to stop supervisor: %w", err))
 		}
 	}
+	// rule: save state before handing off leases so a replacement never starts from an older checkpoint
+	if _, err := c.autosave(ctx); err != nil {
+		logErrorf("Shutdown checkpoint failed: %v", err)
+	}
+	c.mu.RLock()
+	cfg := c.config
+	c.mu.RUnlock()
+	if cfg != nil {
+		if err := c.flushStacks(ctx, cfg); err != nil {
+			logErrorf("Shutdown flush failed: %v", err)
+		}
+	}
+
+	// rule: hand off leases before slower component cleanups so a replacement can acquire leadership promptly
+	if err := c.handoffLeases(ctx); err != nil {
+		logWarnf("Lease handoff failed: %v", err)
+	}
+
+	c.mu.Lock()
+	storage := c.storage
+	c.storage = nil
+	quota := c.quota
+	c.quota = nil
+	c.mu.Unlock()
+	storage.close()
+	quota.close()
+
+	// Then cleanup all components, even if some failed
+	if err := c.Cleanup(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// LeaseHolder represents a component holding a lease that it hands off on shutdown
+type LeaseHolder interface {
+	StackComponent
+	// Handoff releases the lease so a replacement machine can acquire it without waiting for it to expire
+	Handoff(ctx context.Context) error
+}
 
+// handoffLeases releases the leases held by any lease holding components
+func (c *Control) handoffLeases(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, comp := range c.components {
+		if lc, ok := comp.(LeaseHolder); ok {
+			if err := lc.Handoff(ctx); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (l *LeaserComponent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("LeaserComponent.ServeHTTP: path=%s, method=%s", r.URL.Path, r.Method)
+	logDebugf("LeaserComponent.ServeHTTP: path=%s, method=%s", r.URL.Path, r.Method)
 	switch r.Method {
 	case http.MethodPost:
 		if r.URL.Path == "/release" {
@@ -592,53 +1889,177 @@ func (l *LeaserComponent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		if r.URL.Path == "/renew" {
+			lease, err := l.RenewLease(r.Context())
+			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, errNoLease) {
+					status = http.StatusConflict
+				}
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"epoch":      lease.Epoch,
+				"expires_at": l.validUntil(lease),
+			})
+			return
+		}
 		http.Error(w, "Not found", http.StatusNotFound)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-// getComponentName returns the name of a component based on its type
-func getComponentName(comp StackComponent) string {
-	switch comp.(type) {
-	case *DBManagerComponent:
-		return "db"
-	case *LeaserComponent:
-		return "leaser"
-	case *JuiceFSComponent:
-		return "juicefs"
-	default:
-		return ""
+func (c *Control) setupComponents(ctx context.Context, cfg *SystemConfig) (err error) {
+	setupErrors := make(map[string]error)
+	c.fenced.Store(false)
+	c.setupComplete.Store(false)
+	defer func() {
+		c.mu.Lock()
+		c.setupErrors = setupErrors
+		c.mu.Unlock()
+		// rule: the quota is enforced even after a failed setup, so a full disk can still be recovered from
+		c.startQuotaMonitor(cfg)
+		if err == nil && !cfg.Standby {
+			c.setupComplete.Store(true)
+			c.NotifyStatusChange()
+		}
+	}()
+
+	if cfg.Standby {
+		return c.setupStandby(ctx, cfg)
+	}
+	c.standby.Store(false)
+	// rule: an empty stacks list is supported rather than rejected, but logged, as it may be a mistake
+	if len(cfg.Stacks) == 0 {
+		logInfof("No stacks configured, running proxy-only without storage components")
 	}
-}
 
-func (c *Control) setupComponents(ctx context.Context, cfg *SystemConfig) error {
 	// Set up only the specified components
-	for _, stackName := range cfg.Stacks {
+	restored := false
+	for _, stackName := range leaserFirst(cfg.Stacks) {
+		// rule: a cancelled setup stops instead of skipping the remaining stacks as non-critical failures
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("setup cancelled before component %s: %w", stackName, err)
+		}
 		component, ok := c.getAvailableComponents()[stackName]
 		if !ok {
 			return fmt.Errorf("unknown stack component: %s", stackName)
 		}
-		log.Printf("Setting up component %s with dataDir: %s", stackName, c.dataDir)
-		if err := component.Setup(ctx, &cfg.Storage, "juicefs"); err != nil {
+		lc, isLeaser := component.(*LeaserComponent)
+		// rule: once leadership is held every database is restored and verified before any stack is
+		// set up, so JuiceFS never mounts, and no stack replicates, while another is still restoring
+		if !isLeaser && !restored {
+			if err := c.restoreStates(ctx, cfg, setupErrors); err != nil {
+				return err
+			}
+			restored = true
+		}
+		if _, failed := setupErrors[stackName]; failed {
+			continue
+		}
+		logDebugf("Setting up component %s with dataDir: %s", stackName, c.dataDir)
+		setOperationProgress(ctx, "setting up %s", stackName)
+		err := configureComponent(component, cfg)
+		if err == nil {
+			err = component.Setup(ctx, &cfg.Storage, cfg.JuiceFS.binary())
+		}
+		if err != nil {
+			// rule: a non-critical stack that fails to set up is reported as unhealthy instead of failing the environment
+			if !cfg.isCritical(stackName) && !isLeaser {
+				logWarnf("Non-critical component %s failed to set up: %v", stackName, err)
+				setupErrors[stackName] = err
+				continue
+			}
 			return fmt.Errorf("failed to setup component: %w", err)
 		}
+		// rule: no other stack is set up until leadership is held, so two machines never write to shared storage at once
+		if isLeaser {
+			if err := lc.AcquireLeadership(ctx); err != nil {
+				return fmt.Errorf("failed to setup component: %w", err)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("setup cancelled: %w", err)
 	}
 
+	return c.autoRestore(ctx, cfg)
+}
+
+// configureComponent applies the component's own section of the config before it is set up
+func configureComponent(component StackComponent, cfg *SystemConfig) error {
+	switch comp := component.(type) {
+	case *JuiceFSComponent:
+		comp.Configure(cfg.JuiceFS)
+	case *DBManagerComponent:
+		comp.Configure(cfg.DB)
+	case *SyncComponent:
+		comp.Configure(cfg.Sync)
+	case *LeaserComponent:
+		comp.Configure(cfg.Leaser)
+	case *WarmerComponent:
+		comp.Configure(cfg.Warmer)
+		comp.configureJuiceFS(cfg.JuiceFS)
+	case ComponentConfigurer:
+		if err := comp.ConfigureComponent(cfg.Components[comp.Name()]); err != nil {
+			return fmt.Errorf("invalid components.%s settings: %w", comp.Name(), err)
+		}
+	}
+	return nil
+}
+
+// restoreStates restores the local databases of every configured stack, recording the failures of
+// non-critical stacks so they are not set up
+func (c *Control) restoreStates(ctx context.Context, cfg *SystemConfig, setupErrors map[string]error) error {
+	for _, stackName := range cfg.Stacks {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("setup cancelled before restoring component %s: %w", stackName, err)
+		}
+		sr, ok := c.getAvailableComponents()[stackName].(StateRestorer)
+		if !ok {
+			continue
+		}
+		err := configureComponent(sr, cfg)
+		if err == nil {
+			err = sr.RestoreState(ctx, &cfg.Storage)
+		}
+		if err != nil {
+			if !cfg.isCritical(stackName) {
+				logWarnf("Non-critical component %s failed to restore: %v", stackName, err)
+				setupErrors[stackName] = err
+				continue
+			}
+			return fmt.Errorf("failed to restore component %s: %w", stackName, err)
+		}
+	}
 	return nil
 }
 
+// leaserFirst returns the stacks in setup order: the leaser first, the others as configured
+func leaserFirst(stacks []string) []string {
+	ordered := make([]string, 0, len(stacks))
+	for _, name := range stacks {
+		if name == "leaser" {
+			ordered = append(ordered, name)
+		}
+	}
+	for _, name := range stacks {
+		if name != "leaser" {
+			ordered = append(ordered, name)
+		}
+	}
+	return ordered
+}
+
+// getAvailableComponents returns the components keyed by their stack name
 func (c *Control) getAvailableComponents() map[string]StackComponent {
 	components := make(map[string]StackComponent)
 	for _, component := range c.components {
-		switch comp := component.(type) {
-		case *DBManagerComponent:
-			components["db"] = comp
-		case *LeaserComponent:
-			components["leaser"] = comp
-		case *JuiceFSComponent:
-			components["juicefs"] = comp
-		}
+		components[component.Name()] = component
 	}
 	return components
 }
@@ -647,10 +2068,18 @@ func (c *Control) loadConfig() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Read config file
-	data, err := os.ReadFile(c.configPath)
+	data, err := c.readConfigFile()
+	fromStorage := false
+	// rule: a recreated machine bootstraps its config from object storage when no local file exists
+	if errors.Is(err, fs.ErrNotExist) && c.configStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), configStoreTimeout)
+		defer cancel()
+		if data, err = c.configStore.Load(ctx); err == nil {
+			fromStorage = true
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return err
 	}
 
 	// Parse config
@@ -658,13 +2087,88 @@ func (c *Control) loadConfig() error {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return fmt.Errorf("failed to parse config: %w", err)
 	}
+	if err := cfg.validateVersion(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", c.configPath, err)
+	}
+	if err := cfg.validateStacks(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", c.configPath, err)
+	}
+	if err := cfg.DB.validate(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", c.configPath, err)
+	}
+	if err := cfg.Leaser.validate(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", c.configPath, err)
+	}
+	if err := cfg.JuiceFS.validate(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", c.configPath, err)
+	}
+	if err := cfg.validateAutoRestore(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", c.configPath, err)
+	}
+
+	// Keep a local copy of a config bootstrapped from storage
+	if fromStorage {
+		logInfof("Loaded config from object storage")
+		if err := os.MkdirAll(filepath.Dir(c.configPath), DirMode); err != nil {
+			logWarnf("Failed to create config directory: %v", err)
+		} else if err := writeFileAtomic(c.configPath, data, ConfigFileMode); err != nil {
+			logWarnf("Failed to cache config from storage: %v", err)
+		}
+	}
 
 	// Store configs
 	c.config = &cfg
+	c.configSource = ConfigSourceFile
+	if fromStorage {
+		c.configSource = ConfigSourceStorage
+	}
 
 	return nil
 }
 
+// loadConfigWithRetry loads the config, retrying failures that may clear once a concurrent
+// writer finishes. A missing file is not retried: the server then starts unconfigured.
+func (c *Control) loadConfigWithRetry() error {
+	backoff := ConfigLoadRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.loadConfig()
+		if err == nil || attempt >= ConfigLoadAttempts || !isTransientConfigError(err) {
+			return err
+		}
+		logWarnf("Failed to load config (attempt %d of %d), retrying in %v: %v", attempt, ConfigLoadAttempts, backoff, err)
+		configLoadWait(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransientConfigError reports whether a config load failed on a file that exists but could
+// not be read or parsed, as opposed to a missing file or a complete but invalid config
+func isTransientConfigError(err error) bool {
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	var pathErr *fs.PathError
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &pathErr) || errors.As(err, &syntaxErr)
+}
+
+// readConfigFile reads the local config file, refusing anything larger than MaxConfigFileSize
+func (c *Control) readConfigFile() ([]byte, error) {
+	f, err := os.Open(c.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, MaxConfigFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if int64(len(data)) > MaxConfigFileSize {
+		return nil, fmt.Errorf("config file %s exceeds maximum size of %d bytes", c.configPath, MaxConfigFileSize)
+	}
+	return data, nil
+}
+
 func (c *Control) saveConfig() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -674,7 +2178,7 @@ func (c *Control) saveConfig() error {
 	}
 
 	// Create data directory if it doesn't exist
-	if err := os.MkdirAll(c.dataDir, 0755); err != nil {
+	if err := os.MkdirAll(c.dataDir, DirMode); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
 
@@ -685,13 +2189,44 @@ func (c *Control) saveConfig() error {
 	}
 
 	// Write config file
-	if err := os.WriteFile(c.configPath, data, 0644); err != nil {
+	if err := writeFileAtomic(c.configPath, data, ConfigFileMode); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
+	// Mirror the config to object storage
+	if c.config.PersistToStorage || c.configStore != nil {
+		store := c.configStore
+		if c.config.PersistToStorage {
+			if store, err = NewS3ConfigStore(&c.config.Storage); err != nil {
+				return err
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), configStoreTimeout)
+		defer cancel()
+		if err := store.Save(ctx, data); err != nil {
+			return err
+		}
+	}
+
+	// rule: the history is an audit trail, so failing to record it never blocks a config change
+	if c.config.ConfigHistory > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), configStoreTimeout)
+		defer cancel()
+		if err := recordConfigHistory(ctx, c.config); err != nil {
+			logWarnf("Failed to record config history: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// ConfigError returns the error that left the control unconfigured at startup, such as a config
+// file that exists but cannot be parsed or validated. It is nil when the config loaded or was
+// genuinely absent.
+func (c *Control) ConfigError() error {
+	return c.err
+}
+
 func (c *Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Check for configuration error
 	if c.err != nil {
@@ -706,13 +2241,16 @@ func (c *Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	expected := "Bearer " + c.token
-	if auth != expected {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !c.tokens.accepts(token) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	if c.rateLimited(w, r) {
+		return
+	}
+
 	// Let the mux handle the request
 	c.mux.ServeHTTP(w, r)
 }
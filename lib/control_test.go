@@ -1,10 +1,22 @@
 package lib
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -110,3 +122,2031 @@ func TestControlMethodNotAllowed(t *testing.T) {
 		t.Errorf("Expected status 405, got %d", resp.StatusCode)
 	}
 }
+
+func TestSystemStatusStream(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	ts := httptest.NewServer(control)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/status/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open status stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	statuses := make(chan SystemStatus, 4)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var status SystemStatus
+				if json.Unmarshal([]byte(data), &status) == nil {
+					statuses <- status
+				}
+			}
+		}
+		close(statuses)
+	}()
+
+	next := func() SystemStatus {
+		select {
+		case status, ok := <-statuses:
+			if !ok {
+				t.Fatal("Status stream closed unexpectedly")
+			}
+			return status
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for status event")
+		}
+		return SystemStatus{}
+	}
+
+	if initial := next(); initial.Configured {
+		t.Error("Expected initial status to be unconfigured")
+	}
+
+	control.mu.Lock()
+	control.config = &SystemConfig{Stacks: []string{"leaser"}}
+	control.mu.Unlock()
+	control.NotifyStatusChange()
+
+	if changed := next(); !changed.Configured {
+		t.Error("Expected pushed status to be configured")
+	}
+
+	// Disconnecting must release the subscription
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for control.statusChanges.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := control.statusChanges.count(); n != 0 {
+		t.Errorf("Expected no status subscribers after disconnect, got %d", n)
+	}
+}
+
+func TestControlRejectsFutureConfigVersion(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	data := fmt.Sprintf(`{"version": %d, "storage": {"bucket": "b", "endpoint": "e"}}`, CurrentConfigVersion+1)
+	if err := os.WriteFile(configPath, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	control := NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	if control.err == nil || !strings.Contains(control.err.Error(), "unsupported config version") {
+		t.Fatalf("Expected unsupported version error, got %v", control.err)
+	}
+	if control.config != nil {
+		t.Error("Expected a too-new config not to be loaded")
+	}
+}
+
+func TestControlRejectsUnknownConfigFields(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"stacks": [], "storage": {"buckett": "b", "endpoint": "e"}}`
+	for _, path := range []string{"/", "/config/validate"} {
+		w := post(path, body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `unrecognized config field "buckett"`) {
+			t.Errorf("%s: expected 400 naming the misspelled field, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	if control.config != nil {
+		t.Error("Expected a config with an unknown field not to be applied")
+	}
+}
+
+func TestControlRejectsDuplicateStacks(t *testing.T) {
+	db := &slowSetupComponent{name: "db"}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, db)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"stacks": ["db", "db"], "storage": {"bucket": "b", "endpoint": "e"}}`))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `stack "db" is listed more than once`) {
+		t.Fatalf("Expected 400 naming the duplicated stack, got %d: %s", w.Code, w.Body.String())
+	}
+	if db.setup.Load() || control.config != nil {
+		t.Error("Expected a config with a duplicated stack not to be applied")
+	}
+
+	t.Setenv("FLY_STORAGE_BUCKET", "b")
+	t.Setenv("FLY_STORAGE_ENDPOINT", "http://localhost:1")
+	t.Setenv("FLY_STACKS", "db,db")
+	if _, err := NewSystemConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "FLY_STACKS") {
+		t.Errorf("Expected duplicated FLY_STACKS to be rejected, got %v", err)
+	}
+}
+
+func TestControlRetriesPartiallyWrittenConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	valid := `{"version": 1, "storage": {"bucket": "b", "endpoint": "e"}}`
+
+	waits, completeAfter := 0, 2
+	defer func(wait func(time.Duration)) { configLoadWait = wait }(configLoadWait)
+	configLoadWait = func(time.Duration) {
+		waits++
+		// The provisioner finishes writing the file while the load is retried
+		if waits == completeAfter {
+			if err := os.WriteFile(configPath, []byte(valid), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A missing file is not retried
+	control := NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	if control.err != nil || control.config != nil || waits != 0 {
+		t.Fatalf("Expected a missing config to start unconfigured without retries, got %v after %d waits", control.err, waits)
+	}
+
+	if err := os.WriteFile(configPath, []byte(valid[:20]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	control = NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	if control.err != nil || control.config == nil {
+		t.Fatalf("Expected the config to load once complete, got %v", control.err)
+	}
+	if waits != 2 {
+		t.Errorf("Expected 2 retries, got %d", waits)
+	}
+	if control.config.Storage.Bucket != "b" {
+		t.Errorf("Expected the complete config to be loaded, got %+v", control.config.Storage)
+	}
+
+	// A file that never becomes valid fails after the configured attempts
+	waits, completeAfter = 0, 0
+	if err := os.WriteFile(configPath, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	control = NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	if control.err == nil || control.config != nil {
+		t.Fatalf("Expected an unparseable config to fail, got %+v", control.config)
+	}
+	if waits != ConfigLoadAttempts-1 {
+		t.Errorf("Expected %d retries, got %d", ConfigLoadAttempts-1, waits)
+	}
+}
+
+func TestControlUnversionedConfigDefaultsToV1(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"storage": {"bucket": "b", "endpoint": "e"}}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	control := NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	if control.err != nil {
+		t.Fatalf("Unexpected error: %v", control.err)
+	}
+	if control.config == nil || control.config.Version != 1 {
+		t.Fatalf("Expected unversioned config to load as version 1, got %+v", control.config)
+	}
+}
+
+func TestControlStatusUnmarshalsIntoSystemStatus(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	config := `{"version": 1, "storage": {"bucket": "b", "endpoint": "e"}, "stacks": ["juicefs"]}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	control := NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir, NewJuiceFSComponent())
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Every field of the response is part of the SystemStatus contract
+	var status SystemStatus
+	dec := json.NewDecoder(w.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status into SystemStatus: %v", err)
+	}
+	if !status.Configured || status.Running || !slices.Equal(status.Stacks, []string{"juicefs"}) {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if status.ConfigSource != ConfigSourceFile {
+		t.Errorf("Expected config source %q, got %q", ConfigSourceFile, status.ConfigSource)
+	}
+	if status.UptimeSeconds < 0 {
+		t.Errorf("Expected a non-negative uptime, got %d", status.UptimeSeconds)
+	}
+	if ready, ok := status.Components["juicefs"]["ready"]; !ok || ready != false {
+		t.Errorf("Expected juicefs component status, got %v", status.Components)
+	}
+	if _, ok := status.Health["juicefs"]; !ok {
+		t.Errorf("Expected juicefs health, got %v", status.Health)
+	}
+}
+
+func TestControlConfigFileIsPrivate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	configPath := filepath.Join(dir, "config.json")
+	control := NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	control.config = &SystemConfig{Storage: ObjectStorageConfig{AccessKey: "key", SecretKey: "secret"}}
+	if err := control.saveConfig(); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected the config file holding credentials to be 0600, got %o", mode)
+	}
+
+	t.Setenv("FLY_ENV_CONFIG_FILE_MODE", "0640")
+	defer func(mode os.FileMode) { ConfigFileMode = mode }(ConfigFileMode)
+	if err := SetFileModesFromEnv(); err != nil {
+		t.Fatalf("Failed to set modes: %v", err)
+	}
+	if err := control.saveConfig(); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if info, err := os.Stat(configPath); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the configured mode 0640, got %v (%v)", info.Mode().Perm(), err)
+	}
+
+	t.Setenv("FLY_ENV_CONFIG_FILE_MODE", "rw-r-----")
+	if err := SetFileModesFromEnv(); err == nil {
+		t.Error("Expected an error for a non-octal mode")
+	}
+}
+
+func TestControlRejectsOversizedConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	data := bytes.Repeat([]byte(" "), int(MaxConfigFileSize)+1)
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	control := NewControlWithConfig("localhost:8080", "fly-app-controller", "test-token", nil, configPath, dir)
+	if control.err == nil || !strings.Contains(control.err.Error(), "exceeds maximum size") {
+		t.Fatalf("Expected oversized config error, got %v", control.err)
+	}
+}
+
+func TestControlCheckpointResultKeys(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(basePath, "juicefs", "checkpoints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs, NewDBManagerComponent(t.TempDir()))
+	control.config = &SystemConfig{Stacks: []string{"juicefs", "db"}}
+	control.setupRoutes()
+
+	req := httptest.NewRequest("POST", "/checkpoint", strings.NewReader(`{"checkpoint_id": "cp-1"}`))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Results map[string]string `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Results) != 2 || resp.Results["juicefs"] == "" {
+		t.Errorf("Expected results keyed by stack name, got %v", resp.Results)
+	}
+	if _, ok := resp.Results["db"]; !ok {
+		t.Errorf("Expected a db result, got %v", resp.Results)
+	}
+}
+
+func TestControlCheckpointWaitsForReadiness(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(basePath, "juicefs", "checkpoints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The mount has not reported ready yet
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/checkpoint", "/restore"} {
+		w := post(path, `{"checkpoint_id": "cp-1"}`)
+		if w.Code != http.StatusConflict {
+			t.Fatalf("%s: expected status 409, got %d: %s", path, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Error      string   `json:"error"`
+			Components []string `json:"components"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Error != "component not ready" || len(resp.Components) != 1 || resp.Components[0] != "juicefs" {
+			t.Errorf("%s: expected a not ready error naming juicefs, got %+v", path, resp)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(basePath, "juicefs", "checkpoints", "cp-1")); !os.IsNotExist(err) {
+		t.Errorf("Expected no checkpoint to be created, got %v", err)
+	}
+
+	juicefs.mu.Lock()
+	juicefs.isReady = true
+	juicefs.mu.Unlock()
+	if w := post("/checkpoint", `{"checkpoint_id": "cp-1"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the checkpoint to succeed once ready, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestControlCheckpointIsIdempotent(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointsDir := filepath.Join(basePath, "juicefs", "checkpoints")
+	for _, dir := range []string{activeDir, filepath.Join(checkpointsDir, "other")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	markCheckpointComplete(t, filepath.Join(checkpointsDir, "other"))
+	if err := os.WriteFile(filepath.Join(activeDir, "data.txt"), []byte("state"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+
+	checkpoint := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/checkpoint", strings.NewReader(`{"checkpoint_id": "`+id+`"}`))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// A retried request succeeds without checkpointing the now-empty active directory again
+	for i := 0; i < 2; i++ {
+		if w := checkpoint("cp-1"); w.Code != http.StatusOK {
+			t.Fatalf("Attempt %d: expected status 200, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(checkpointsDir, "cp-1", "data.txt"))
+	if err != nil || string(data) != "state" {
+		t.Errorf("Expected checkpoint to keep the original state, got %q (%v)", data, err)
+	}
+
+	// An ID already used by a checkpoint this component did not create conflicts
+	if w := checkpoint("other"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Once restored, the ID can be checkpointed again
+	if err := juicefs.RestoreToCheckpoint(context.Background(), "cp-1"); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if w := checkpoint("cp-1"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestControlCheckpointsSingleStack(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(filepath.Join(basePath, "juicefs", "checkpoints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data.txt"), []byte("state"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	var ops []string
+	other := &memCheckpointComponent{active: "db state", checkpoints: map[string]string{}, ops: &ops}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs, other, NewLeaserComponent())
+	control.config = &SystemConfig{Stacks: []string{"juicefs", "missing", "leaser"}}
+	control.setupRoutes()
+
+	checkpoint := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/stack/"+name+"/checkpoint", strings.NewReader(`{"checkpoint_id": "cp-1"}`))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	w := checkpoint("juicefs")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Stack  string `json:"stack"`
+		Result string `json:"result"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Stack != "juicefs" || resp.Result != "cp-1" {
+		t.Errorf("Expected the juicefs result, got %+v", resp)
+	}
+	if data, err := os.ReadFile(filepath.Join(basePath, "juicefs", "checkpoints", "cp-1", "data.txt")); err != nil || string(data) != "state" {
+		t.Errorf("Expected the active directory in the checkpoint, got %q (%v)", data, err)
+	}
+	if len(ops) != 0 || other.active != "db state" || len(other.checkpoints) != 0 {
+		t.Errorf("Expected the other component to be untouched, got ops %v, active %q, checkpoints %v", ops, other.active, other.checkpoints)
+	}
+
+	if w := checkpoint("leaser"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for a component without checkpoints, got %d: %s", w.Code, w.Body.String())
+	}
+	control.config.Stacks = []string{"missing"}
+	if w := checkpoint("juicefs"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a disabled stack, got %d", w.Code)
+	}
+}
+
+// missingCheckpointComponent is a checkpointable component that never has any checkpoint
+type missingCheckpointComponent struct{}
+
+func (m *missingCheckpointComponent) Name() string {
+	return "missing"
+}
+
+func (m *missingCheckpointComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	return nil
+}
+
+func (m *missingCheckpointComponent) Cleanup(ctx context.Context) error {
+	return nil
+}
+
+func (m *missingCheckpointComponent) Status(ctx context.Context) map[string]interface{} {
+	return nil
+}
+
+func (m *missingCheckpointComponent) CreateCheckpoint(ctx context.Context, id string) (string, error) {
+	return id, nil
+}
+
+func (m *missingCheckpointComponent) RestoreToCheckpoint(ctx context.Context, id string) error {
+	return nil
+}
+
+func (m *missingCheckpointComponent) HasCheckpoint(ctx context.Context, id string) (bool, error) {
+	return false, nil
+}
+
+// markCheckpointComplete writes the completion marker of a checkpoint directory created by a test
+func markCheckpointComplete(t *testing.T, checkpointDir string) {
+	t.Helper()
+	if err := os.WriteFile(checkpointDir+checkpointCompleteSuffix, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControlCheckpointExists(t *testing.T) {
+	basePath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(basePath, "juicefs", "checkpoints", "cp-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	markCheckpointComplete(t, filepath.Join(basePath, "juicefs", "checkpoints", "cp-1"))
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: filepath.Join(basePath, "juicefs", "active")}
+	missing := &missingCheckpointComponent{}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs, missing)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+
+	components, exists := control.CheckpointExists(context.Background(), "cp-1")
+	if exists {
+		t.Error("Expected checkpoint not to exist everywhere")
+	}
+	if !components["juicefs"] {
+		t.Errorf("Expected checkpoint to exist in juicefs, got %v", components)
+	}
+	if present, ok := components["missing"]; !ok || present {
+		t.Errorf("Expected checkpoint to be missing from the other component, got %v", components)
+	}
+
+	req := httptest.NewRequest("GET", "/checkpoint/cp-1", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Exists     bool            `json:"exists"`
+		Components map[string]bool `json:"components"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Exists || len(resp.Components) != 2 {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+
+	// With only the juicefs component the checkpoint is present everywhere
+	control = NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	if _, exists := control.CheckpointExists(context.Background(), "cp-1"); !exists {
+		t.Error("Expected checkpoint to exist everywhere")
+	}
+	if _, exists := control.CheckpointExists(context.Background(), "cp-2"); exists {
+		t.Error("Expected unknown checkpoint not to exist")
+	}
+}
+
+// failingRestoreComponent has every checkpoint but fails to restore any of them
+type failingRestoreComponent struct {
+	missingCheckpointComponent
+	restores []string
+}
+
+func (f *failingRestoreComponent) HasCheckpoint(ctx context.Context, id string) (bool, error) {
+	return true, nil
+}
+
+func (f *failingRestoreComponent) RestoreToCheckpoint(ctx context.Context, id string) error {
+	f.restores = append(f.restores, id)
+	if strings.HasPrefix(id, ".rollback-") {
+		return nil
+	}
+	return fmt.Errorf("restore failed")
+}
+
+func TestControlRestoreRollsBack(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointDir := filepath.Join(basePath, "juicefs", "checkpoints", "cp-1")
+	for _, dir := range []string{activeDir, checkpointDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data.txt"), []byte("current"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, "data.txt"), []byte("checkpoint"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	markCheckpointComplete(t, checkpointDir)
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	failing := &failingRestoreComponent{}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs, failing)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+
+	req := httptest.NewRequest("POST", "/restore", strings.NewReader(`{"checkpoint_id": "cp-1"}`))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The first component is back to its state before the restore
+	data, err := os.ReadFile(filepath.Join(activeDir, "data.txt"))
+	if err != nil || string(data) != "current" {
+		t.Errorf("Expected active directory to be rolled back, got %q (%v)", data, err)
+	}
+	data, err = os.ReadFile(filepath.Join(checkpointDir, "data.txt"))
+	if err != nil || string(data) != "checkpoint" {
+		t.Errorf("Expected checkpoint to be preserved, got %q (%v)", data, err)
+	}
+	if len(failing.restores) != 2 || failing.restores[0] != "cp-1" {
+		t.Errorf("Expected failed restore followed by rollback, got %v", failing.restores)
+	}
+	entries, err := os.ReadDir(filepath.Join(basePath, "juicefs", "checkpoints"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The original checkpoint directory and its completion marker
+	if len(entries) != 2 {
+		t.Errorf("Expected only the original checkpoint to remain, got %d entries", len(entries))
+	}
+	if ids, err := juicefs.ListCheckpoints(context.Background()); err != nil || len(ids) != 1 || ids[0] != "cp-1" {
+		t.Errorf("Expected the original checkpoint to still be complete, got %v (%v)", ids, err)
+	}
+}
+
+// dbCheckpointComponent stands in for the db stack in checkpoint tests
+type dbCheckpointComponent struct {
+	memCheckpointComponent
+}
+
+func (d *dbCheckpointComponent) Name() string {
+	return "db"
+}
+
+func TestControlRestoresSelectedComponents(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointDir := filepath.Join(basePath, "juicefs", "checkpoints", "cp-1")
+	for _, dir := range []string{activeDir, checkpointDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data.txt"), []byte("current"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, "data.txt"), []byte("checkpoint"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	markCheckpointComplete(t, checkpointDir)
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	var ops []string
+	db := &dbCheckpointComponent{memCheckpointComponent{active: "live", checkpoints: map[string]string{"cp-1": "old"}, ops: &ops}}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs, db, NewLeaserComponent())
+	control.config = &SystemConfig{Stacks: []string{"juicefs", "db"}}
+	control.setupRoutes()
+	restore := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/restore", strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown, non-checkpointable and repeated components are rejected before anything is touched
+	for _, components := range []string{`["juicefs", "nope"]`, `["leaser"]`, `["juicefs", "juicefs"]`} {
+		if w := restore(`{"checkpoint_id": "cp-1", "components": ` + components + `}`); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", components, w.Code, w.Body.String())
+		}
+	}
+
+	w := restore(`{"checkpoint_id": "cp-1", "components": ["juicefs"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the filesystem restore to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(activeDir, "data.txt")); err != nil || string(data) != "checkpoint" {
+		t.Errorf("Expected the filesystem to be restored, got %q (%v)", data, err)
+	}
+	if db.active != "live" || db.checkpoints["cp-1"] != "old" || len(ops) != 0 {
+		t.Errorf("Expected the db to be left as is, got active %q, checkpoints %v, ops %v", db.active, db.checkpoints, ops)
+	}
+	var resp struct {
+		Components []string `json:"components"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !slices.Equal(resp.Components, []string{"juicefs"}) {
+		t.Errorf("Expected the response to name the restored components, got %v", resp.Components)
+	}
+}
+
+// taggedCheckpointComponent records the consistency tag of each checkpoint it creates
+type taggedCheckpointComponent struct {
+	dbCheckpointComponent
+	tags map[string]string
+}
+
+func (c *taggedCheckpointComponent) CreateCheckpoint(ctx context.Context, id string) (string, error) {
+	c.tags[id] = checkpointTag(ctx)
+	return c.dbCheckpointComponent.CreateCheckpoint(ctx, id)
+}
+
+func (c *taggedCheckpointComponent) CheckpointTag(ctx context.Context, id string) (string, error) {
+	return c.tags[id], nil
+}
+
+func TestControlVerifiesCheckpointConsistency(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	for _, dir := range []string{activeDir, filepath.Join(basePath, "juicefs", "checkpoints")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	var ops []string
+	db := &taggedCheckpointComponent{
+		dbCheckpointComponent{memCheckpointComponent{active: "live", checkpoints: map[string]string{}, ops: &ops}},
+		map[string]string{},
+	}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs, db)
+	control.config = &SystemConfig{Stacks: []string{"juicefs", "db"}, CheckpointConsistency: CheckpointConsistencyRefuse}
+	control.setupRoutes()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// Deliberately mismatched: the two components checkpointed "mixed" in separate operations
+	ctx := context.Background()
+	if _, err := juicefs.CreateCheckpoint(context.WithValue(ctx, checkpointTagKey{}, "1"), "mixed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateCheckpoint(context.WithValue(ctx, checkpointTagKey{}, "2"), "mixed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data.txt"), []byte("current"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := post("/restore", `{"checkpoint_id": "mixed"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "inconsistent") {
+		t.Fatalf("Expected the mismatched checkpoint to be refused with 409, got %d: %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(activeDir, "data.txt")); string(data) != "current" {
+		t.Errorf("Expected a refused restore to leave the filesystem alone, got %q", data)
+	}
+
+	// One checkpoint operation tags every component alike, so it restores
+	if w := post("/checkpoint", `{"checkpoint_id": "together"}`); w.Code != http.StatusOK {
+		t.Fatalf("Checkpoint failed with %d: %s", w.Code, w.Body.String())
+	}
+	if tag, _ := juicefs.CheckpointTag(ctx, "together"); tag == "" || tag != db.tags["together"] {
+		t.Errorf("Expected both components to record the same tag, got %q and %q", tag, db.tags["together"])
+	}
+	if w := post("/restore", `{"checkpoint_id": "together"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the consistent checkpoint to restore, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Under warn the mismatch is flagged but restored
+	control.config.CheckpointConsistency = CheckpointConsistencyWarn
+	if w := post("/restore", `{"checkpoint_id": "mixed"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the warned restore to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	flagged := false
+	for _, e := range control.Events().Recent(0) {
+		flagged = flagged || (e.Type == EventCheckpointInconsistent && e.Fields["checkpoint_id"] == "mixed")
+	}
+	if !flagged {
+		t.Error("Expected a checkpoint_inconsistent event for the mismatched checkpoint")
+	}
+}
+
+// namedHTTPComponent is a component with its own routes that records whether it was set up
+type namedHTTPComponent struct {
+	missingCheckpointComponent
+	name  string
+	setup bool
+}
+
+func (n *namedHTTPComponent) Name() string {
+	return n.name
+}
+
+func (n *namedHTTPComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	n.setup = true
+	return nil
+}
+
+func (n *namedHTTPComponent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s %s", n.name, r.URL.Path)
+}
+
+func TestControlRoutesComponentsByName(t *testing.T) {
+	first := &namedHTTPComponent{name: "first"}
+	second := &namedHTTPComponent{name: "second"}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, first, second)
+
+	cfg := &SystemConfig{Stacks: []string{"second"}}
+	if err := control.setupComponents(context.Background(), cfg); err != nil {
+		t.Fatalf("Failed to set up components: %v", err)
+	}
+	if first.setup || !second.setup {
+		t.Errorf("Expected only the named stack to be set up, got first=%v second=%v", first.setup, second.setup)
+	}
+	if err := control.setupComponents(context.Background(), &SystemConfig{Stacks: []string{"third"}}); err == nil {
+		t.Error("Expected an error for an unknown stack name")
+	}
+
+	control.config = cfg
+	control.setupRoutes()
+	for _, name := range []string{"first", "second"} {
+		req := httptest.NewRequest("GET", "/stack/"+name+"/info", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		if want := name + " /info"; w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("Expected %q from /stack/%s/info, got %d %q", want, name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestControlListsStacks(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil,
+		NewDBManagerComponent(t.TempDir()), NewLeaserComponent(), NewJuiceFSComponent())
+	control.config = &SystemConfig{Stacks: []string{"db"}}
+
+	req := httptest.NewRequest("GET", "/stacks", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Stacks []StackInfo `json:"stacks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := []StackInfo{
+		{Name: "db", Enabled: true, Checkpointable: true, Restartable: true, HealthCheck: true},
+		{Name: "leaser", HTTP: true, HealthCheck: true},
+		{Name: "juicefs", Checkpointable: true, Restartable: true, HealthCheck: true},
+	}
+	if !slices.Equal(resp.Stacks, want) {
+		t.Errorf("Expected stacks %+v, got %+v", want, resp.Stacks)
+	}
+}
+
+// slowSetupComponent is a component whose setup can block until its context is cancelled
+type slowSetupComponent struct {
+	missingCheckpointComponent
+	name    string
+	block   bool
+	setup   atomic.Bool
+	cleaned atomic.Bool
+}
+
+func (s *slowSetupComponent) Name() string {
+	return s.name
+}
+
+func (s *slowSetupComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	s.setup.Store(true)
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *slowSetupComponent) Cleanup(ctx context.Context) error {
+	s.cleaned.Store(true)
+	return nil
+}
+
+func TestControlProxyOnly(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	}))
+	defer app.Close()
+	unused := &slowSetupComponent{name: "fast"}
+	control := NewControl(app.Listener.Addr().String(), "fly-app-controller", "test-token", t.TempDir(), nil, unused)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"stacks": [], "storage": {"bucket": "b", "endpoint": "e"}}`))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected an empty stacks list to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	status := control.Status()
+	if !status.Configured || !status.ProxyOnly || len(status.Components) != 0 {
+		t.Errorf("Expected a configured proxy-only status without components, got %+v", status)
+	}
+	if healthy, _ := control.Health(context.Background()); !healthy {
+		t.Error("Expected a proxy-only environment to be healthy")
+	}
+	if !control.setupComplete.Load() || unused.setup.Load() {
+		t.Errorf("Expected setup to be complete without setting up any component, got setup=%v", unused.setup.Load())
+	}
+
+	proxy, err := New(control.targetAddr, &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "app" {
+		t.Errorf("Expected the app to be proxied to, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigTimeoutRollsBackSetup(t *testing.T) {
+	fast := &slowSetupComponent{name: "fast"}
+	slow := &slowSetupComponent{name: "slow", block: true}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, fast, slow)
+	control.SetConfigTimeout(50 * time.Millisecond)
+
+	body := `{"stacks": ["fast", "slow"], "storage": {"bucket": "b", "endpoint": "e"}}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	control.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "timed out after 50ms") {
+		t.Fatalf("Expected 504 naming the timeout, got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the config POST to return soon after the timeout, took %s", elapsed)
+	}
+	if !fast.setup.Load() || !slow.setup.Load() {
+		t.Fatal("Expected both components to have started setting up")
+	}
+	if !fast.cleaned.Load() || !slow.cleaned.Load() {
+		t.Errorf("Expected the partial setup to be cleaned up, got fast=%v slow=%v", fast.cleaned.Load(), slow.cleaned.Load())
+	}
+	if control.reconfiguring.Load() {
+		t.Error("Expected reconfiguration to be over after the timeout")
+	}
+}
+
+// slowCheckpointComponent is a component whose checkpoints block until released or cancelled
+type slowCheckpointComponent struct {
+	missingCheckpointComponent
+	name        string
+	entered     chan struct{} // closed when a checkpoint starts, if set
+	release     chan struct{} // closes to let a checkpoint finish, if set
+	mu          sync.Mutex
+	checkpoints map[string]bool
+	cleaned     bool
+}
+
+func (s *slowCheckpointComponent) Name() string {
+	return s.name
+}
+
+func (s *slowCheckpointComponent) CreateCheckpoint(ctx context.Context, id string) (string, error) {
+	if s.entered != nil {
+		close(s.entered)
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[id] = true
+	return id, nil
+}
+
+func (s *slowCheckpointComponent) DeleteCheckpoint(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.checkpoints, id)
+	return nil
+}
+
+func (s *slowCheckpointComponent) Cleanup(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleaned = true
+	return nil
+}
+
+func TestShutdownDuringCheckpoint(t *testing.T) {
+	for _, policy := range []string{ShutdownWaitForOperation, ShutdownAbortOperation} {
+		t.Run(policy, func(t *testing.T) {
+			fast := &slowCheckpointComponent{name: "fast", checkpoints: make(map[string]bool)}
+			slow := &slowCheckpointComponent{name: "slow", checkpoints: make(map[string]bool),
+				entered: make(chan struct{}), release: make(chan struct{})}
+			control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, fast, slow)
+			control.config = &SystemConfig{Stacks: []string{"fast", "slow"}}
+			control.setupRoutes()
+			if err := control.SetShutdownOperationPolicy(policy); err != nil {
+				t.Fatalf("Failed to set policy: %v", err)
+			}
+
+			responses := make(chan *httptest.ResponseRecorder, 1)
+			go func() {
+				req := httptest.NewRequest("POST", "/checkpoint", strings.NewReader(`{"checkpoint_id": "cp-1"}`))
+				req.Host = "fly-app-controller"
+				req.Header.Set("Authorization", "Bearer test-token")
+				w := httptest.NewRecorder()
+				control.ServeHTTP(w, req)
+				responses <- w
+			}()
+			<-slow.entered
+
+			shutdown := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				shutdown <- control.Shutdown(ctx)
+			}()
+			if policy == ShutdownWaitForOperation {
+				time.Sleep(100 * time.Millisecond)
+				slow.mu.Lock()
+				cleaned := slow.cleaned
+				slow.mu.Unlock()
+				if cleaned {
+					t.Fatal("Expected components not to be cleaned up while the checkpoint is in progress")
+				}
+				close(slow.release)
+			}
+
+			w := <-responses
+			if err := <-shutdown; err != nil {
+				t.Fatalf("Shutdown failed: %v", err)
+			}
+			if !fast.cleaned || !slow.cleaned {
+				t.Error("Expected shutdown to clean up the components after the checkpoint")
+			}
+			if policy == ShutdownWaitForOperation {
+				if w.Code != http.StatusOK || !fast.checkpoints["cp-1"] || !slow.checkpoints["cp-1"] {
+					t.Errorf("Expected the checkpoint to complete, got %d %s (fast=%v slow=%v)", w.Code, w.Body.String(), fast.checkpoints, slow.checkpoints)
+				}
+				return
+			}
+			if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "aborted for shutdown") {
+				t.Errorf("Expected 503 for the aborted checkpoint, got %d: %s", w.Code, w.Body.String())
+			}
+			if len(fast.checkpoints) != 0 || len(slow.checkpoints) != 0 {
+				t.Errorf("Expected the partial checkpoint to be rolled back, got fast=%v slow=%v", fast.checkpoints, slow.checkpoints)
+			}
+		})
+	}
+}
+
+// cleanupComponent records its cleanup and fails it with err when set
+type cleanupComponent struct {
+	namedHTTPComponent
+	err     error
+	cleaned bool
+}
+
+func (c *cleanupComponent) Cleanup(ctx context.Context) error {
+	c.cleaned = true
+	return c.err
+}
+
+func TestShutdownCleansUpEveryComponent(t *testing.T) {
+	errFirst, errThird := errors.New("first stuck"), errors.New("third stuck")
+	first := &cleanupComponent{namedHTTPComponent: namedHTTPComponent{name: "first"}, err: errFirst}
+	second := &cleanupComponent{namedHTTPComponent: namedHTTPComponent{name: "second"}}
+	third := &cleanupComponent{namedHTTPComponent: namedHTTPComponent{name: "third"}, err: errThird}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, first, second, third)
+
+	err := control.Shutdown(context.Background())
+	if !first.cleaned || !second.cleaned || !third.cleaned {
+		t.Errorf("Expected every component to be cleaned up, got first=%v second=%v third=%v", first.cleaned, second.cleaned, third.cleaned)
+	}
+	if !errors.Is(err, errFirst) || !errors.Is(err, errThird) {
+		t.Fatalf("Expected both failures to be reported, got %v", err)
+	}
+	for _, name := range []string{"failed to cleanup first", "failed to cleanup third"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected %q in %q", name, err)
+		}
+	}
+}
+
+// orderedComponent records each shutdown step it takes part in
+type orderedComponent struct {
+	namedHTTPComponent
+	record func(step string)
+}
+
+func (o *orderedComponent) SyncReplication(ctx context.Context) error {
+	o.record("flush")
+	return nil
+}
+
+func (o *orderedComponent) Handoff(ctx context.Context) error {
+	o.record("release lease")
+	return nil
+}
+
+func (o *orderedComponent) Cleanup(ctx context.Context) error {
+	o.record("unmount")
+	return nil
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var mu sync.Mutex
+	var steps []string
+	var control *Control
+	supervisor := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{TimeoutStop: 5 * time.Second})
+	if err := supervisor.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	defer supervisor.StopProcess()
+	record := func(step string) {
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, fmt.Sprintf("%s (draining %v, app running %v)", step, control.Draining(), supervisor.IsRunning()))
+	}
+	comp := &orderedComponent{namedHTTPComponent: namedHTTPComponent{name: "ordered"}, record: record}
+	control = NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), supervisor, comp)
+	control.config = &SystemConfig{Stacks: []string{"ordered"}}
+
+	if err := control.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"flush (draining true, app running false)",
+		"release lease (draining true, app running false)",
+		"unmount (draining true, app running false)",
+	}
+	if !slices.Equal(steps, want) {
+		t.Errorf("Expected shutdown steps %q, got %q", want, steps)
+	}
+}
+
+func TestControlRateLimit(t *testing.T) {
+	now := time.Now()
+	rateLimitNow = func() time.Time { return now }
+	defer func() { rateLimitNow = time.Now }()
+
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	if err := control.SetRateLimit(ControlRateLimit{Rate: 0.5, Burst: 3}); err != nil {
+		t.Fatalf("SetRateLimit failed: %v", err)
+	}
+
+	request := func(method, path string, i int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"checkpoint_id": fmt.Sprintf("cp-%d", i)})
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// A burst of checkpoints is accepted, the rest of the storm is rejected
+	for i := range 6 {
+		w := request("POST", "/checkpoint", i)
+		if i < 3 && w.Code == http.StatusTooManyRequests {
+			t.Errorf("Expected checkpoint %d within the burst to be accepted, got 429", i)
+		}
+		if i >= 3 {
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("Expected checkpoint %d to be rate limited, got %d: %s", i, w.Code, w.Body.String())
+			} else if got := w.Header().Get("Retry-After"); got != "2" {
+				t.Errorf("Expected Retry-After 2, got %q", got)
+			}
+		}
+	}
+
+	// Other endpoints and read-only requests have their own limits
+	if w := request("POST", "/restore", 0); w.Code == http.StatusTooManyRequests {
+		t.Error("Expected /restore not to share the checkpoint bucket")
+	}
+	for range 10 {
+		if w := request("GET", "/status", 0); w.Code == http.StatusTooManyRequests {
+			t.Fatal("Expected read-only endpoints not to be limited")
+		}
+	}
+
+	// Tokens refill at the configured rate
+	now = now.Add(2 * time.Second)
+	if w := request("POST", "/checkpoint", 6); w.Code == http.StatusTooManyRequests {
+		t.Error("Expected a checkpoint to be accepted once a token refilled")
+	}
+	if w := request("POST", "/checkpoint", 7); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the next checkpoint to be rate limited, got %d", w.Code)
+	}
+
+	if err := control.SetRateLimit(ControlRateLimit{Rate: -1}); err == nil {
+		t.Error("Expected a negative rate to be rejected")
+	}
+}
+
+// signalLogComponent checkpoints once the supervised app has logged that it paused, recording the
+// checkpoint in the same log
+type signalLogComponent struct {
+	missingCheckpointComponent
+	log string
+}
+
+func (s *signalLogComponent) CreateCheckpoint(ctx context.Context, id string) (string, error) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, _ := os.ReadFile(s.log); strings.Contains(string(data), "pause") {
+			break
+		}
+	}
+	f, err := os.OpenFile(s.log, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, "checkpoint "+id)
+	return id, err
+}
+
+func TestCheckpointQuiescesApp(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "signals.log")
+	if err := os.WriteFile(log, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf(`trap 'echo pause >> %[1]s' USR1; trap 'echo resume >> %[1]s' USR2; echo started >> %[1]s; while :; do sleep 0.01; done`, log)
+	s := NewSupervisor([]string{"sh", "-c", script}, SupervisorConfig{TimeoutStop: 5 * time.Second})
+	defer s.StopProcess()
+	cc := &signalLogComponent{log: log}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), s, cc)
+	control.config = &SystemConfig{Stacks: []string{"missing"}}
+	control.setupRoutes()
+	if err := control.SetCheckpointQuiesce(CheckpointQuiesce{PauseSignal: syscall.SIGUSR1, ResumeSignal: syscall.SIGUSR2}); err != nil {
+		t.Fatalf("SetCheckpointQuiesce failed: %v", err)
+	}
+
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	readLog := func() []string {
+		data, _ := os.ReadFile(log)
+		return strings.Fields(strings.ReplaceAll(string(data), "checkpoint ", "checkpoint:"))
+	}
+	// Wait for the traps to be installed
+	for deadline := time.Now().Add(5 * time.Second); len(readLog()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest("POST", "/checkpoint", strings.NewReader(`{"checkpoint_id": "cp1"}`))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected checkpoint to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	want := []string{"started", "pause", "checkpoint:cp1", "resume"}
+	for deadline := time.Now().Add(5 * time.Second); len(readLog()) < len(want) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := readLog(); !slices.Equal(got, want) {
+		t.Errorf("Expected the pause and resume signals to bracket the checkpoint, got %v", got)
+	}
+}
+
+// orderedDB records when the database stack restores and sets up
+type orderedDB struct {
+	*DBManagerComponent
+	log *[]string
+}
+
+func (o *orderedDB) RestoreState(ctx context.Context, cfg *ObjectStorageConfig) error {
+	*o.log = append(*o.log, "restore db")
+	return o.DBManagerComponent.RestoreState(ctx, cfg)
+}
+
+func (o *orderedDB) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	*o.log = append(*o.log, "setup db")
+	return o.DBManagerComponent.Setup(ctx, cfg, juicefsPath)
+}
+
+// orderedMount records when it restores and mounts, checking the app database is restored by then
+type orderedMount struct {
+	namedHTTPComponent
+	log      *[]string
+	dbPath   string
+	dbLoaded bool
+}
+
+func (o *orderedMount) RestoreState(ctx context.Context, cfg *ObjectStorageConfig) error {
+	*o.log = append(*o.log, "restore juicefs")
+	return nil
+}
+
+func (o *orderedMount) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	*o.log = append(*o.log, "mount juicefs")
+	_, err := os.Stat(o.dbPath)
+	o.dbLoaded = err == nil
+	return nil
+}
+
+func TestSetupRestoresStateBeforeMounting(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	storage := ObjectStorageConfig{Bucket: "test-bucket", Endpoint: server.URL, AccessKey: "key", SecretKey: "secret", Region: "auto", KeyPrefix: "/env/"}
+	ctx := context.Background()
+
+	// Another machine replicated the app database before this one was recreated
+	previous := NewDBManager(&storage, t.TempDir())
+	if err := previous.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := previous.StartReplication(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", previous.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('replicated')`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := previous.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := previous.StopReplication(); err != nil {
+		t.Fatal(err)
+	}
+
+	var log []string
+	dataDir := t.TempDir()
+	appDB := &orderedDB{DBManagerComponent: NewDBManagerComponent(dataDir), log: &log}
+	mount := &orderedMount{namedHTTPComponent: namedHTTPComponent{name: "juicefs"}, log: &log, dbPath: NewDBManager(&storage, dataDir).DBPath}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, mount, appDB)
+
+	// JuiceFS is listed first, but the app database is restored before anything mounts
+	cfg := &SystemConfig{Storage: storage, Stacks: []string{"juicefs", "db"}}
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer appDB.Cleanup(ctx)
+
+	want := []string{"restore juicefs", "restore db", "mount juicefs", "setup db"}
+	if !slices.Equal(log, want) {
+		t.Errorf("Expected setup order %v, got %v", want, log)
+	}
+	if !mount.dbLoaded {
+		t.Error("Expected the app database to be restored from the replica before JuiceFS mounted")
+	}
+	db, err = sql.Open("sqlite3", appDB.dbManager.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var v string
+	if err := db.QueryRow(`SELECT v FROM t`).Scan(&v); err != nil || v != "replicated" {
+		t.Errorf("Expected the restored data, got %q (%v)", v, err)
+	}
+}
+
+func TestControlTokenReload(t *testing.T) {
+	now := time.Now()
+	tokenNow = func() time.Time { return now }
+	defer func() { tokenNow = time.Now }()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("old-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONTROLLER_TOKEN_FILE", tokenFile)
+	control := NewControl("localhost:8080", "fly-app-controller", "old-token", t.TempDir(), nil)
+	control.SetTokenSource(func() (string, error) { return SecretEnv("CONTROLLER_TOKEN") }, time.Minute)
+
+	status := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// An unchanged file is not a rotation
+	if changed, err := control.ReloadToken(); err != nil || changed {
+		t.Fatalf("Expected reloading an unchanged token to do nothing, got %v, %v", changed, err)
+	}
+	if code := status("GET", "/stacks", "new-token"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the new token to be rejected before the reload, got %d", code)
+	}
+
+	// The reload is requested with the old token; both are accepted during the grace window
+	if err := os.WriteFile(tokenFile, []byte("new-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := status("POST", "/token/reload", "old-token"); code != http.StatusOK {
+		t.Fatalf("Expected the reload to succeed, got %d", code)
+	}
+	for _, token := range []string{"old-token", "new-token"} {
+		if code := status("GET", "/stacks", token); code != http.StatusOK {
+			t.Errorf("Expected %s to be accepted during the grace window, got %d", token, code)
+		}
+	}
+
+	// After the grace window only the new token is accepted
+	now = now.Add(time.Minute)
+	if code := status("GET", "/stacks", "old-token"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the old token to be rejected after the grace window, got %d", code)
+	}
+	if code := status("GET", "/stacks", "new-token"); code != http.StatusOK {
+		t.Errorf("Expected the new token to be accepted, got %d", code)
+	}
+
+	// An empty token file keeps the current token
+	if err := os.WriteFile(tokenFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := control.ReloadToken(); err == nil {
+		t.Error("Expected reloading an empty token to fail")
+	}
+	if code := status("GET", "/stacks", "new-token"); code != http.StatusOK {
+		t.Errorf("Expected the new token to stay valid after a failed reload, got %d", code)
+	}
+}
+
+// blockingSetupComponent is a stack whose setup waits until it is released
+type blockingSetupComponent struct {
+	namedHTTPComponent
+	release chan struct{}
+}
+
+func (b *blockingSetupComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	<-b.release
+	return nil
+}
+
+func TestProcessStartsAfterConfigAndSetup(t *testing.T) {
+	stack := &blockingSetupComponent{namedHTTPComponent: namedHTTPComponent{name: "storage"}, release: make(chan struct{})}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, stack)
+	control.SetStartAfterSetup(true)
+	s := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{
+		TimeoutStop: 5 * time.Second,
+		PreStart:    control.WaitForStart,
+	})
+	defer s.StopProcess()
+
+	started := make(chan error, 1)
+	go func() { started <- s.StartProcess() }()
+	time.Sleep(200 * time.Millisecond)
+	if s.IsRunning() {
+		t.Fatal("Expected the process not to start while unconfigured")
+	}
+
+	// The config is applied, but its stacks are still being set up
+	cfg := &SystemConfig{Stacks: []string{"storage"}}
+	control.mu.Lock()
+	control.config = cfg
+	control.mu.Unlock()
+	setupDone := make(chan error, 1)
+	go func() { setupDone <- control.setupComponents(context.Background(), cfg) }()
+	time.Sleep(200 * time.Millisecond)
+	if s.IsRunning() {
+		t.Fatal("Expected the process not to start while the stacks are being set up")
+	}
+
+	close(stack.release)
+	if err := <-setupDone; err != nil {
+		t.Fatalf("Failed to set up components: %v", err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Failed to start process: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the process to start once the stacks are set up")
+	}
+	if !s.IsRunning() {
+		t.Error("Expected the process to be running")
+	}
+}
+
+func TestCancelOperationInProgress(t *testing.T) {
+	fast := &slowSetupComponent{name: "fast"}
+	slow := &slowSetupComponent{name: "slow", block: true}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, fast, slow)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+	list := func() []Operation {
+		var resp struct {
+			Operations []Operation `json:"operations"`
+		}
+		if err := json.NewDecoder(call("GET", "/operations", "").Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Operations
+	}
+
+	configured := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		configured <- call("POST", "/", `{"stacks": ["fast", "slow"], "storage": {"bucket": "b", "endpoint": "e"}}`)
+	}()
+
+	// The setup is listed while it waits on the slow stack
+	var ops []Operation
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ops = list(); len(ops) == 1 && ops[0].Progress == "setting up slow" {
+			break
+		}
+	}
+	if len(ops) != 1 || ops[0].Kind != "setup" || ops[0].Progress != "setting up slow" {
+		t.Fatalf("Expected the setup in progress to be listed, got %+v", ops)
+	}
+
+	if w := call("POST", "/operations/unknown-1/cancel", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 cancelling an unknown operation, got %d", w.Code)
+	}
+	if w := call("POST", "/operations/"+ops[0].ID+"/cancel", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the cancel to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case w := <-configured:
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "cancelled") {
+			t.Errorf("Expected the config POST to report the cancel, got %d: %s", w.Code, w.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the cancelled setup to stop")
+	}
+	if !fast.cleaned.Load() || !slow.cleaned.Load() {
+		t.Errorf("Expected the cancelled setup to be rolled back, got fast=%v slow=%v", fast.cleaned.Load(), slow.cleaned.Load())
+	}
+	if ops := list(); len(ops) != 0 {
+		t.Errorf("Expected no operations once the setup ended, got %+v", ops)
+	}
+	if events := control.Events().Recent(0); !slices.ContainsFunc(events, func(e Event) bool { return e.Type == EventOperationCancelled }) {
+		t.Error("Expected the cancel to be recorded as an event")
+	}
+}
+
+func TestCheckpointWithoutCheckpointableComponents(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, NewLeaserComponent())
+	call := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"checkpoint_id": "cp-1"}`))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// By default a leaser-only environment rejects checkpoints and restores
+	control.config = &SystemConfig{Stacks: []string{"leaser"}}
+	control.setupRoutes()
+	for _, path := range []string{"/checkpoint", "/restore"} {
+		if w := call(path); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No checkpointable components") {
+			t.Errorf("%s: expected 400 without checkpointable components, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	// Allowed, both succeed without doing anything
+	control.config = &SystemConfig{Stacks: []string{"leaser"}, AllowEmptyCheckpoints: true}
+	for _, path := range []string{"/checkpoint", "/restore"} {
+		w := call(path)
+		var resp struct {
+			Status       string `json:"status"`
+			CheckpointID string `json:"checkpoint_id"`
+			Noop         bool   `json:"noop"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || resp.Status != "success" || resp.CheckpointID != "cp-1" || !resp.Noop {
+			t.Errorf("%s: expected a no-op success, got %d %+v", path, w.Code, resp)
+		}
+	}
+}
+
+// settingsComponent reads its settings from the components block of the config
+type settingsComponent struct {
+	namedHTTPComponent
+	settings struct {
+		Level int `json:"level"`
+	}
+	configured bool
+}
+
+func (s *settingsComponent) ConfigureComponent(settings json.RawMessage) error {
+	s.configured = true
+	if settings == nil {
+		return nil
+	}
+	return json.Unmarshal(settings, &s.settings)
+}
+
+func TestComponentSettingsBlock(t *testing.T) {
+	custom := &settingsComponent{namedHTTPComponent: namedHTTPComponent{name: "custom"}}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, custom)
+
+	cfg := DefaultSystemConfig()
+	body := `{"stacks": ["custom"], "storage": {"bucket": "b", "endpoint": "e"}, "components": {"custom": {"level": 3}}}`
+	if err := decodeConfig(strings.NewReader(body), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.setupComponents(context.Background(), &cfg); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if !custom.configured || custom.settings.Level != 3 {
+		t.Errorf("Expected the component to be configured from its block, got %+v", custom.settings)
+	}
+
+	// Invalid settings fail the component's setup
+	cfg.Components["custom"] = json.RawMessage(`{"level": "high"}`)
+	if err := control.setupComponents(context.Background(), &cfg); err == nil || !strings.Contains(err.Error(), "components.custom") {
+		t.Errorf("Expected invalid settings to fail setup naming the block, got %v", err)
+	}
+
+	// Stacks with their own section are not configured twice
+	cfg.Components = map[string]json.RawMessage{"juicefs": json.RawMessage(`{}`)}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "use the juicefs section") {
+		t.Errorf("Expected a components block for juicefs to be rejected, got %v", err)
+	}
+}
+
+func TestComponentLogsEndpoint(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\nif [ \"$1\" = mount ]; then for last; do :; done; echo \"juicefs is ready at $last\" >&2\n" +
+		"  echo \"juicefs <INFO>: serving\" >&2; exec sleep 60\nfi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	jfs := NewJuiceFSComponent()
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+
+	supervisor := NewSupervisor([]string{"sh", "-c", "echo started; echo warming up >&2; exec sleep 60"}, SupervisorConfig{LogLines: 10})
+	if err := supervisor.StartProcess(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.StopProcess()
+
+	db := &namedHTTPComponent{name: "db"}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), supervisor, jfs, db)
+	cfg := &SystemConfig{
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/",
+			EnvDir:    filepath.Join(dir, "env"),
+		},
+		Stacks:  []string{"juicefs", "db"},
+		JuiceFS: JuiceFSConfig{Binary: binary, MinFreeSpaceMiB: -1},
+	}
+	control.config = cfg
+	if err := control.setupComponents(context.Background(), cfg); err != nil {
+		t.Fatalf("Failed to set up juicefs: %v", err)
+	}
+	defer jfs.Cleanup(context.Background())
+	control.setupRoutes()
+
+	logs := func(name string) (int, []string) {
+		req := httptest.NewRequest("GET", "/stack/"+name+"/logs", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		var body struct {
+			Lines []string `json:"lines"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Lines
+	}
+	waitForLines := func(name string, want []string) {
+		t.Helper()
+		var lines []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			var code int
+			if code, lines = logs(name); code != http.StatusOK {
+				t.Fatalf("Expected %s logs, got %d", name, code)
+			}
+			if slices.Equal(lines, want) {
+				return
+			}
+		}
+		t.Errorf("Expected %s logs %q, got %q", name, want, lines)
+	}
+
+	waitForLines("juicefs", []string{"juicefs is ready at " + jfs.mountDir, "juicefs <INFO>: serving"})
+	var output []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		// Stdout and stderr are copied separately, so their lines may arrive in either order
+		if _, output = logs("supervisor"); len(output) == 2 {
+			break
+		}
+	}
+	if !slices.Contains(output, "started") || !slices.Contains(output, "warming up") {
+		t.Errorf("Expected the supervised process output in its logs, got %q", output)
+	}
+
+	// A component without a log buffer has no logs
+	if code, _ := logs("db"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a component without logs, got %d", code)
+	}
+}
+
+// signalRecorder is a stack running its own process that records the signals forwarded to it
+type signalRecorder struct {
+	namedHTTPComponent
+	mu      sync.Mutex
+	signals []os.Signal
+}
+
+func (s *signalRecorder) ForwardSignal(sig os.Signal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signals = append(s.signals, sig)
+	return nil
+}
+
+func TestSignalRoutes(t *testing.T) {
+	dir := t.TempDir()
+	script := fmt.Sprintf("trap 'touch %[1]s/usr1' USR1; trap 'touch %[1]s/usr2' USR2; touch %[1]s/ready; while :; do sleep 0.01; done", dir)
+	supervisor := NewSupervisor([]string{"sh", "-c", script}, SupervisorConfig{TimeoutStop: time.Second})
+	if err := supervisor.StartProcess(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.StopProcess()
+	waitForFile := func(name string) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	if !waitForFile("ready") {
+		t.Fatal("Supervised process did not start")
+	}
+
+	sidecar := &signalRecorder{namedHTTPComponent: namedHTTPComponent{name: "sidecar"}}
+	db := &namedHTTPComponent{name: "db"}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), supervisor, sidecar, db)
+	if err := control.SetSignalRoutes(SignalRoutes{syscall.SIGUSR1: {"db"}}); err == nil {
+		t.Error("Expected a route to a stack without a process of its own to be rejected")
+	}
+	if err := control.SetSignalRoutes(SignalRoutes{syscall.SIGUSR1: {"sidecar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if routed := control.RoutedSignals(); !slices.Equal(routed, []os.Signal{syscall.SIGUSR1}) {
+		t.Errorf("Expected USR1 to be listened for, got %v", routed)
+	}
+
+	// The routed signal reaches the sidecar only
+	if err := control.ForwardSignal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	// An unrouted signal still goes to the supervised process only
+	if err := control.ForwardSignal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForFile("usr2") {
+		t.Error("Expected the unrouted signal to reach the supervised process")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "usr1")); err == nil {
+		t.Error("Expected the signal routed to the sidecar not to reach the supervised process")
+	}
+	sidecar.mu.Lock()
+	defer sidecar.mu.Unlock()
+	if !slices.Equal(sidecar.signals, []os.Signal{syscall.SIGUSR1}) {
+		t.Errorf("Expected the sidecar to receive only USR1, got %v", sidecar.signals)
+	}
+}
+
+func TestSetupGuidanceOnlyWhileUnconfigured(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, &namedHTTPComponent{name: "db"})
+	status := func() map[string]json.RawMessage {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Invalid status %q: %v", w.Body.String(), err)
+		}
+		return body
+	}
+
+	body := status()
+	var setup SetupGuidance
+	if err := json.Unmarshal(body["setup"], &setup); err != nil {
+		t.Fatalf("Expected setup guidance while unconfigured, got %s", body["setup"])
+	}
+	if setup.Configure != "POST /" || setup.Validate != "POST /config/validate" || !slices.Equal(setup.Available, []string{"db"}) {
+		t.Errorf("Unexpected setup guidance %+v", setup)
+	}
+	if string(body["configured"]) != "false" {
+		t.Errorf("Expected configured to stay false, got %s", body["configured"])
+	}
+
+	// Disabled, the status keeps its previous shape
+	control.SetSetupGuidance(false)
+	if _, ok := status()["setup"]; ok {
+		t.Error("Expected no setup guidance once disabled")
+	}
+	control.SetSetupGuidance(true)
+
+	control.config = &SystemConfig{Stacks: []string{"db"}}
+	control.setupRoutes()
+	if _, ok := status()["setup"]; ok {
+		t.Error("Expected no setup guidance once configured")
+	}
+}
+
+// endpointComponent records the storage endpoint of each setup and fails setups against failOn
+type endpointComponent struct {
+	mu        sync.Mutex
+	endpoints []string
+	failOn    string
+}
+
+func (e *endpointComponent) Name() string {
+	return "endpoint"
+}
+
+func (e *endpointComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.endpoints = append(e.endpoints, cfg.Endpoint)
+	if cfg.Endpoint == e.failOn {
+		return fmt.Errorf("cannot reach %s", cfg.Endpoint)
+	}
+	return nil
+}
+
+func (e *endpointComponent) Cleanup(ctx context.Context) error {
+	return nil
+}
+
+func (e *endpointComponent) Status(ctx context.Context) map[string]interface{} {
+	return nil
+}
+
+func TestControlMigratesStorage(t *testing.T) {
+	oldS3 := &mockS3{objects: make(map[string][]byte)}
+	oldServer := httptest.NewServer(oldS3)
+	defer oldServer.Close()
+	newS3 := &mockS3{objects: make(map[string][]byte)}
+	newServer := httptest.NewServer(newS3)
+	defer newServer.Close()
+	storage := func(endpoint, prefix string) ObjectStorageConfig {
+		return ObjectStorageConfig{Bucket: "test-bucket", Endpoint: endpoint, AccessKey: "key", SecretKey: "secret", Region: "auto", KeyPrefix: prefix}
+	}
+	ctx := context.Background()
+
+	// A long sync interval leaves the last write to the migration's flush
+	db := NewDBManagerComponent(t.TempDir())
+	other := &endpointComponent{}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, db, other)
+	oldCfg := &SystemConfig{
+		Storage: storage(oldServer.URL, "/app/"),
+		Stacks:  []string{"db", "endpoint"},
+		DB:      DBConfig{ReplicationIntervals: ReplicationIntervals{SyncIntervalSeconds: 3600}},
+	}
+	if err := control.setupComponents(ctx, oldCfg); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	defer control.Cleanup(ctx)
+	control.config = oldCfg
+	control.setupRoutes()
+
+	conn, err := sql.Open("sqlite3", db.dbManager.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(`CREATE TABLE t (name TEXT); INSERT INTO t VALUES ('before')`); err != nil {
+		t.Fatalf("Failed to write row: %v", err)
+	}
+	conn.Close()
+	oldS3.mu.Lock()
+	oldS3.objects["/test-bucket/app/sync/notes.txt"] = []byte("mirrored")
+	oldS3.objects["/test-bucket/juicefs/chunks/0"] = []byte("chunk")
+	oldS3.mu.Unlock()
+
+	migrate := func(cfg SystemConfig) *httptest.ResponseRecorder {
+		body, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/migrate", bytes.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+	newCfg := *oldCfg
+	newCfg.Storage = storage(newServer.URL, "/moved/")
+
+	// A failed switch sets the old config up again
+	other.failOn = newServer.URL
+	if w := migrate(newCfg); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "cannot reach") {
+		t.Fatalf("Expected the migration to fail, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := control.config.Storage.Endpoint; got != oldServer.URL {
+		t.Errorf("Expected the old config to stay applied, got endpoint %s", got)
+	}
+	if last := other.endpoints[len(other.endpoints)-1]; last != oldServer.URL {
+		t.Errorf("Expected the stack to be set up against the old storage again, got %s", last)
+	}
+	if healthy, health := control.Health(ctx); !healthy {
+		t.Errorf("Expected the environment to be healthy after the rollback, got %+v", health)
+	}
+
+	other.failOn = ""
+	w := migrate(newCfg)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the migration to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp MigrationResult
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Seeded == 0 {
+		t.Errorf("Expected seeded objects to be reported, got %+v (%v)", resp, err)
+	}
+	if got := control.Status(); got.Draining || control.config.Storage.Endpoint != newServer.URL {
+		t.Errorf("Expected the new config applied and draining over, got draining=%v endpoint=%s", got.Draining, control.config.Storage.Endpoint)
+	}
+	newS3.mu.Lock()
+	notes, chunk := string(newS3.objects["/test-bucket/moved/sync/notes.txt"]), string(newS3.objects["/test-bucket/juicefs/chunks/0"])
+	newS3.mu.Unlock()
+	if notes != "mirrored" || chunk != "chunk" {
+		t.Errorf("Expected the objects to be seeded under the new prefix and the volume kept in place, got %q and %q", notes, chunk)
+	}
+
+	// Nothing written before the migration is lost: a fresh machine restores it from the new storage
+	fresh := NewDBManager(&newCfg.Storage, t.TempDir())
+	if restored, err := fresh.RestoreFromReplica(ctx); err != nil || !restored {
+		t.Fatalf("Expected a restore from the new storage, got %v (%v)", restored, err)
+	}
+	conn, err = sql.Open("sqlite3", fresh.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var got string
+	if err := conn.QueryRow(`SELECT name FROM t`).Scan(&got); err != nil || got != "before" {
+		t.Errorf("Expected the row written before the migration to be restored, got %q (%v)", got, err)
+	}
+}
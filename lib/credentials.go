@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// awsEnv returns the AWS environment variables for external tools such as the JuiceFS binary.
+// Credentials are omitted when none are configured so the tool falls back to the environment/role.
+func (cfg *ObjectStorageConfig) awsEnv() []string {
+	env := []string{
+		"AWS_ENDPOINT_URL=" + cfg.Endpoint,
+		"AWS_REGION=" + cfg.region(),
+	}
+	if cfg.AccessKey != "" {
+		env = append(env,
+			"AWS_ACCESS_KEY_ID="+cfg.AccessKey,
+			"AWS_SECRET_ACCESS_KEY="+cfg.SecretKey,
+		)
+	}
+	if cfg.SessionToken != "" {
+		env = append(env, "AWS_SESSION_TOKEN="+cfg.SessionToken)
+	}
+	return env
+}
+
+// clientKeys returns the static keys to configure on Litestream clients.
+// rule: Litestream clients only accept static keys, so session credentials are exported to the
+// process environment and the clients are left keyless to use the AWS SDK default credential chain
+func (cfg *ObjectStorageConfig) clientKeys() (accessKey, secretKey string, err error) {
+	if cfg.SessionToken == "" {
+		return cfg.AccessKey, cfg.SecretKey, nil
+	}
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     cfg.AccessKey,
+		"AWS_SECRET_ACCESS_KEY": cfg.SecretKey,
+		"AWS_SESSION_TOKEN":     cfg.SessionToken,
+	} {
+		if err := os.Setenv(key, value); err != nil {
+			return "", "", fmt.Errorf("failed to export %s: %w", key, err)
+		}
+	}
+	return "", "", nil
+}
+
+// validateCredentials checks that static keys are either both set or both empty
+func (cfg *ObjectStorageConfig) validateCredentials() error {
+	if (cfg.AccessKey == "") != (cfg.SecretKey == "") {
+		return fmt.Errorf("access_key and secret_key must be set together")
+	}
+	if cfg.SessionToken != "" && cfg.AccessKey == "" {
+		return fmt.Errorf("session_token requires access_key and secret_key")
+	}
+	return nil
+}
+
+// newReplicaClient creates a Litestream S3 replica client for the given config
+func newReplicaClient(cfg *ObjectStorageConfig) (*lss3.ReplicaClient, error) {
+	accessKey, secretKey, err := cfg.clientKeys()
+	if err != nil {
+		return nil, err
+	}
+	client := lss3.NewReplicaClient()
+	client.Bucket = cfg.Bucket
+	client.Endpoint = cfg.Endpoint
+	client.AccessKeyID = accessKey
+	client.SecretAccessKey = secretKey
+	client.Region = cfg.region()
+	client.ForcePathStyle = cfg.pathStyle()
+	return client, nil
+}
+
+// newS3Leaser creates a Litestream S3 leaser for the given config
+func newS3Leaser(cfg *ObjectStorageConfig) (*lss3.Leaser, error) {
+	accessKey, secretKey, err := cfg.clientKeys()
+	if err != nil {
+		return nil, err
+	}
+	leaser := lss3.NewLeaser()
+	leaser.Bucket = cfg.Bucket
+	leaser.Endpoint = cfg.Endpoint
+	leaser.AccessKeyID = accessKey
+	leaser.SecretAccessKey = secretKey
+	leaser.Region = cfg.region()
+	leaser.ForcePathStyle = cfg.pathStyle()
+	return leaser, nil
+}
@@ -0,0 +1,359 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+func TestSessionTokenPropagation(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	cfg := &ObjectStorageConfig{
+		Bucket:       "bucket",
+		Endpoint:     "https://storage.example.com",
+		AccessKey:    "temp-access-key",
+		SecretKey:    "temp-secret-key",
+		SessionToken: "temp-session-token",
+		Region:       "auto",
+	}
+
+	client, err := newReplicaClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create replica client: %v", err)
+	}
+	if client.AccessKeyID != "" || client.SecretAccessKey != "" {
+		t.Error("Expected replica client to use the default credential chain for session credentials")
+	}
+
+	leaser, err := newS3Leaser(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create leaser: %v", err)
+	}
+	if leaser.AccessKeyID != "" || leaser.SecretAccessKey != "" {
+		t.Error("Expected leaser to use the default credential chain for session credentials")
+	}
+
+	if got := os.Getenv("AWS_SESSION_TOKEN"); got != cfg.SessionToken {
+		t.Errorf("Expected AWS_SESSION_TOKEN %q, got %q", cfg.SessionToken, got)
+	}
+	if got := os.Getenv("AWS_ACCESS_KEY_ID"); got != cfg.AccessKey {
+		t.Errorf("Expected AWS_ACCESS_KEY_ID %q, got %q", cfg.AccessKey, got)
+	}
+
+	if !slices.Contains(cfg.awsEnv(), "AWS_SESSION_TOKEN="+cfg.SessionToken) {
+		t.Error("Expected JuiceFS environment to include AWS_SESSION_TOKEN")
+	}
+}
+
+func TestStaticAndRoleCredentials(t *testing.T) {
+	static := &ObjectStorageConfig{AccessKey: "access", SecretKey: "secret"}
+	client, err := newReplicaClient(static)
+	if err != nil {
+		t.Fatalf("Failed to create replica client: %v", err)
+	}
+	if client.AccessKeyID != "access" || client.SecretAccessKey != "secret" {
+		t.Error("Expected static keys on replica client")
+	}
+	if slices.ContainsFunc(static.awsEnv(), func(e string) bool { return e == "AWS_SESSION_TOKEN=" }) {
+		t.Error("Expected no empty session token in environment")
+	}
+
+	role := &ObjectStorageConfig{}
+	if err := role.validateCredentials(); err != nil {
+		t.Errorf("Expected empty credentials to be valid, got %v", err)
+	}
+	for _, e := range role.awsEnv() {
+		if e == "AWS_ACCESS_KEY_ID=" {
+			t.Error("Expected no empty access key in environment")
+		}
+	}
+
+	partial := &ObjectStorageConfig{AccessKey: "access"}
+	if err := partial.validateCredentials(); err == nil {
+		t.Error("Expected error when only access key is set")
+	}
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDBManagerComponent(dir)
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", dir, nil, db)
+	control.config = &SystemConfig{
+		Storage: ObjectStorageConfig{Bucket: "bucket", Endpoint: "https://storage.example.com", AccessKey: "old-key", SecretKey: "old-secret"},
+		Stacks:  []string{"db"},
+	}
+	db.dbManager = NewDBManager(&control.config.Storage, dir)
+
+	clientKey := func() string {
+		return db.dbManager.litestreamDB().Replicas[0].Client.(*lss3.ReplicaClient).AccessKeyID
+	}
+	if got := clientKey(); got != "old-key" {
+		t.Fatalf("Expected initial replica key %q, got %q", "old-key", got)
+	}
+
+	err := control.RefreshCredentials(context.Background(), &ObjectStorageConfig{AccessKey: "new-key", SecretKey: "new-secret"})
+	if err != nil {
+		t.Fatalf("RefreshCredentials failed: %v", err)
+	}
+	if got := clientKey(); got != "new-key" {
+		t.Errorf("Expected refreshed replica key %q, got %q", "new-key", got)
+	}
+	if control.config.Storage.Bucket != "bucket" {
+		t.Error("Expected non-credential storage settings to be preserved")
+	}
+}
+
+// keyedLeaser is an in-memory leaser remembering the access key it was opened with
+type keyedLeaser struct {
+	*memLeaser
+	key string
+}
+
+func TestRefreshCredentialsWhileRenewing(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	leaser.open = func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+		return &keyedLeaser{memLeaser: &memLeaser{store: store, owner: owner, timeout: timeout}, key: cfg.AccessKey}, nil
+	}
+	leaser.RenewInterval = time.Millisecond
+	server := httptest.NewServer(&mockS3{objects: make(map[string][]byte)})
+	defer server.Close()
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser)
+	control.config = &SystemConfig{
+		Storage: ObjectStorageConfig{Bucket: "bucket", Endpoint: server.URL, Region: "auto", AccessKey: "key-0", SecretKey: "secret"},
+		Stacks:  []string{"leaser"},
+	}
+	ctx := context.Background()
+	if err := control.setupComponents(ctx, control.config); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer leaser.Cleanup(ctx)
+
+	// Renewal keeps running while the leaser is replaced under it
+	for i := 1; i <= 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := control.RefreshCredentials(ctx, &ObjectStorageConfig{AccessKey: key, SecretKey: "secret"}); err != nil {
+			t.Fatalf("RefreshCredentials failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := leaser.leaser().(*keyedLeaser).key; got != "key-20" {
+		t.Errorf("Expected the leaser to use the latest key, got %q", got)
+	}
+	renewals := leaser.metrics.renewals.Load()
+	time.Sleep(20 * time.Millisecond)
+	if leaser.HeldLease() == nil || leaser.metrics.renewals.Load() == renewals {
+		t.Error("Expected the lease to be held and renewed with the refreshed leaser")
+	}
+}
+
+func TestRefreshCredentialsRemountsJuiceFS(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys")
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\necho \"$AWS_ACCESS_KEY_ID\" >> " + keysFile + "\n" +
+		"for last; do :; done\necho \"juicefs is ready at $last\" >&2\nexec sleep 60\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub juicefs: %v", err)
+	}
+
+	storage := ObjectStorageConfig{Bucket: "bucket", Endpoint: "https://storage.example.com", AccessKey: "old-key", SecretKey: "old-secret"}
+	jfs := &JuiceFSComponent{
+		config:      &storage,
+		juicefsPath: binary,
+		mountDir:    t.TempDir(),
+		dbPath:      filepath.Join(t.TempDir(), "juicefs.sqlite"),
+	}
+	ctx := context.Background()
+	if err := jfs.mount(ctx); err != nil {
+		t.Fatalf("Failed to mount: %v", err)
+	}
+	defer jfs.Cleanup(ctx)
+	first := jfs.supervisor
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	control.config = &SystemConfig{Storage: storage, Stacks: []string{"juicefs"}}
+	if err := control.RefreshCredentials(ctx, &ObjectStorageConfig{AccessKey: "new-key", SecretKey: "new-secret"}); err != nil {
+		t.Fatalf("RefreshCredentials failed: %v", err)
+	}
+
+	if jfs.supervisor == first {
+		t.Error("Expected the mount to be restarted")
+	}
+	data, err := os.ReadFile(keysFile)
+	if err != nil {
+		t.Fatalf("Failed to read the mount keys: %v", err)
+	}
+	if keys := strings.Fields(string(data)); !slices.Equal(keys, []string{"old-key", "new-key"}) {
+		t.Errorf("Expected the remount to use the refreshed key, got %v", keys)
+	}
+	if jfs.config.Bucket != "bucket" || jfs.config == &control.config.Storage {
+		t.Error("Expected the remount to get a copy of the full refreshed storage config")
+	}
+}
+
+func TestStorageClientSettings(t *testing.T) {
+	cfg := &ObjectStorageConfig{
+		Bucket:                "bucket",
+		Endpoint:              "https://storage.example.com",
+		Region:                "auto",
+		RequestTimeoutSeconds: 5,
+		MaxRetries:            7,
+		RetryBackoffMillis:    250,
+	}
+
+	// Sessions for the config store, reachability monitor and replication uploads
+	sess, err := cfg.newSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if sess.Config.HTTPClient.Timeout != 5*time.Second {
+		t.Errorf("Expected a 5s request timeout, got %v", sess.Config.HTTPClient.Timeout)
+	}
+	retryer, ok := sess.Config.Retryer.(client.DefaultRetryer)
+	if !ok || retryer.NumMaxRetries != 7 || retryer.MinRetryDelay != 250*time.Millisecond {
+		t.Errorf("Expected 7 retries with a 250ms backoff, got %+v", sess.Config.Retryer)
+	}
+	replicaClient, err := newReplicaClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create replica client: %v", err)
+	}
+	if _, ok := withUploader(cfg, replicaClient, DBConfig{}).(*uploadReplicaClient); !ok {
+		t.Error("Expected replication uploads to use the configured session")
+	}
+
+	// Leaser requests carry the timeout in their context
+	leaser := NewLeaserComponent()
+	if err := leaser.Setup(context.Background(), cfg, ""); err != nil {
+		t.Fatalf("Failed to set up leaser: %v", err)
+	}
+	if tl, ok := leaser.Leaser.(*timeoutLeaser); !ok || tl.timeout != 5*time.Second {
+		t.Errorf("Expected the leaser to be bounded by the request timeout, got %#v", leaser.Leaser)
+	}
+
+	// JuiceFS gets the settings as mount flags
+	want := []string{"--get-timeout", "5", "--put-timeout", "5", "--io-retries", "7"}
+	if flags := cfg.juicefsMountFlags(); !slices.Equal(flags, want) {
+		t.Errorf("Expected mount flags %v, got %v", want, flags)
+	}
+
+	// Unset, the defaults apply and JuiceFS keeps its own
+	defaults := &ObjectStorageConfig{}
+	if defaults.requestTimeout() != DefaultStorageRequestTimeout || defaults.maxRetries() != DefaultStorageMaxRetries ||
+		defaults.retryBackoff() != DefaultStorageRetryBackoff {
+		t.Error("Expected default storage request settings")
+	}
+	if flags := defaults.juicefsMountFlags(); len(flags) != 0 {
+		t.Errorf("Expected no mount flags by default, got %v", flags)
+	}
+	if (&ObjectStorageConfig{MaxRetries: -1}).maxRetries() != 0 {
+		t.Error("Expected a negative max_retries to disable retries")
+	}
+}
+
+func TestStorageCredentialsFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret := func(name, value string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+			t.Fatalf("Failed to write secret: %v", err)
+		}
+		return path
+	}
+
+	t.Setenv("FLY_STORAGE_BUCKET", "test-bucket")
+	t.Setenv("FLY_STORAGE_ENDPOINT", "http://localhost:1")
+	t.Setenv("FLY_STORAGE_ACCESS_KEY", "")
+	t.Setenv("FLY_STORAGE_SESSION_TOKEN", "")
+	t.Setenv("FLY_STORAGE_ACCESS_KEY_FILE", writeSecret("access_key", "file-key\n"))
+	// The file wins over a plain variable set alongside it
+	t.Setenv("FLY_STORAGE_SECRET_KEY", "env-secret")
+	t.Setenv("FLY_STORAGE_SECRET_KEY_FILE", writeSecret("secret_key", "file-secret\n"))
+
+	cfg, err := NewSystemConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Storage.AccessKey != "file-key" || cfg.Storage.SecretKey != "file-secret" {
+		t.Errorf("Expected credentials from the files, got %q and %q", cfg.Storage.AccessKey, cfg.Storage.SecretKey)
+	}
+
+	// Without a file the plain variable is used
+	t.Setenv("FLY_STORAGE_SECRET_KEY_FILE", "")
+	if cfg, err = NewSystemConfigFromEnv(); err != nil || cfg.Storage.SecretKey != "env-secret" {
+		t.Errorf("Expected the secret key from the environment, got %+v (%v)", cfg, err)
+	}
+
+	// A missing file is an error rather than silently empty credentials
+	t.Setenv("FLY_STORAGE_SECRET_KEY_FILE", filepath.Join(dir, "missing"))
+	if _, err := NewSystemConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "FLY_STORAGE_SECRET_KEY_FILE") {
+		t.Errorf("Expected an error naming the missing secret file, got %v", err)
+	}
+}
+
+func TestStoragePathStylePropagates(t *testing.T) {
+	for _, pathStyle := range []bool{true, false} {
+		cfg := &ObjectStorageConfig{
+			Bucket:    "bucket",
+			Endpoint:  "https://s3.eu-west-1.amazonaws.com",
+			Region:    "eu-west-1",
+			PathStyle: &pathStyle,
+		}
+		if err := cfg.validateAddressing(); err != nil {
+			t.Fatalf("Expected a valid config, got %v", err)
+		}
+		sess, err := cfg.newSession()
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		if aws.BoolValue(sess.Config.S3ForcePathStyle) != pathStyle {
+			t.Errorf("Expected session path style %v", pathStyle)
+		}
+		replicaClient, err := newReplicaClient(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create replica client: %v", err)
+		}
+		if replicaClient.ForcePathStyle != pathStyle {
+			t.Errorf("Expected replica client path style %v", pathStyle)
+		}
+		leaser, err := newS3Leaser(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create leaser: %v", err)
+		}
+		if leaser.ForcePathStyle != pathStyle {
+			t.Errorf("Expected leaser path style %v", pathStyle)
+		}
+		want := "https://s3.eu-west-1.amazonaws.com/bucket"
+		if !pathStyle {
+			want = "https://bucket.s3.eu-west-1.amazonaws.com"
+		}
+		if got := cfg.juicefsBucketURL(); got != want {
+			t.Errorf("Expected JuiceFS bucket URL %s, got %s", want, got)
+		}
+	}
+
+	// Path style is the default
+	if !(&ObjectStorageConfig{}).pathStyle() {
+		t.Error("Expected path-style addressing by default")
+	}
+	// Dotted bucket names cannot be addressed virtual-host style over TLS
+	virtualHost := false
+	cfg := &ObjectStorageConfig{Bucket: "my.bucket", Endpoint: "https://s3.amazonaws.com", PathStyle: &virtualHost}
+	if err := cfg.validateAddressing(); err == nil {
+		t.Error("Expected a dotted bucket to be rejected for virtual-host style")
+	}
+}
@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultQuotaEvictPercent is the share of the data quota at which eviction starts when not configured
+	defaultQuotaEvictPercent = 90
+	// defaultQuotaInterval is how often the data directory size is checked when not configured
+	defaultQuotaInterval = time.Minute
+)
+
+// DataQuotaConfig limits the local disk used by env_dir, so old artifacts cannot grow until the
+// disk is full and every stack fails at once
+type DataQuotaConfig struct {
+	// MaxSizeMiB is the budget, in MiB, for env_dir and the local checkpoints. Zero disables the quota.
+	MaxSizeMiB int64 `json:"max_size_mib,omitempty"`
+	// EvictAtPercent is the share of the budget at which the oldest artifacts are evicted until
+	// usage is below it again. Zero uses the default of 90.
+	EvictAtPercent int `json:"evict_at_percent,omitempty"`
+	// IntervalSeconds is how often usage is checked. Zero uses the default of 60 seconds.
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+}
+
+// validate checks the data quota settings
+func (cfg DataQuotaConfig) validate() error {
+	if cfg.MaxSizeMiB < 0 {
+		return fmt.Errorf("data_quota.max_size_mib must not be negative")
+	}
+	if cfg.EvictAtPercent < 0 || cfg.EvictAtPercent > 100 {
+		return fmt.Errorf("data_quota.evict_at_percent must be between 0 and 100")
+	}
+	if cfg.IntervalSeconds < 0 {
+		return fmt.Errorf("data_quota.interval_seconds must not be negative")
+	}
+	return nil
+}
+
+// threshold returns the usage in bytes at which eviction starts
+func (cfg DataQuotaConfig) threshold() int64 {
+	percent := cfg.EvictAtPercent
+	if percent == 0 {
+		percent = defaultQuotaEvictPercent
+	}
+	return cfg.MaxSizeMiB << 20 * int64(percent) / 100
+}
+
+// interval returns how often usage is checked
+func (cfg DataQuotaConfig) interval() time.Duration {
+	if cfg.IntervalSeconds == 0 {
+		return defaultQuotaInterval
+	}
+	return time.Duration(cfg.IntervalSeconds) * time.Second
+}
+
+// ReclaimableArtifact is a local artifact the data quota may evict, such as an old checkpoint
+type ReclaimableArtifact struct {
+	// Name describes the artifact in logs and events
+	Name string
+	// CheckpointID is set when the artifact is a checkpoint, so checkpoints still needed are kept
+	CheckpointID string
+	// Path is the file or directory the artifact occupies
+	Path string
+	// Created orders artifacts for eviction, oldest first
+	Created time.Time
+	// Remove deletes the artifact
+	Remove func(ctx context.Context) error
+}
+
+// SpaceReclaimer is implemented by components keeping artifacts on local disk that can be
+// deleted without losing live data
+type SpaceReclaimer interface {
+	ReclaimableArtifacts(ctx context.Context) ([]ReclaimableArtifact, error)
+}
+
+// diskUsage returns the total size of the files under root. Like du -x, directories on other
+// filesystems, such as the JuiceFS mount, are skipped since their data is not on local disk.
+func diskUsage(root string) (int64, error) {
+	rootInfo, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	rootDev := deviceOf(rootInfo)
+	var total int64
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while walking, e.g. a checkpoint being deleted
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && deviceOf(info) != rootDev {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// deviceOf returns the device a file is on
+func deviceOf(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+// withinDir reports whether path is dir or inside it
+func withinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// enforceDataQuota evicts the oldest reclaimable artifacts while the data directory is over the
+// quota's eviction threshold, returning the usage afterwards. Only artifacts offered by a
+// SpaceReclaimer are evicted, never the current checkpoint or the one a suspension resumes from.
+func (c *Control) enforceDataQuota(ctx context.Context, cfg *SystemConfig) (int64, error) {
+	quota := cfg.DataQuota
+	envDir, err := filepath.Abs(cfg.Storage.EnvDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve env_dir: %w", err)
+	}
+	usage, err := diskUsage(envDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure env_dir: %w", err)
+	}
+
+	// rule: eviction holds c.mu so it never deletes a checkpoint a checkpoint or restore is using
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	protected := map[string]bool{}
+	if current, err := c.loadCurrentCheckpoint(); err != nil {
+		return usage, err
+	} else if current != nil {
+		protected[current.CheckpointID] = true
+	}
+	if c.suspension != nil {
+		protected[c.suspension.Token] = true
+	}
+
+	var artifacts []ReclaimableArtifact
+	for _, stackName := range cfg.Stacks {
+		sr, ok := c.getAvailableComponents()[stackName].(SpaceReclaimer)
+		if !ok {
+			continue
+		}
+		found, err := sr.ReclaimableArtifacts(ctx)
+		if err != nil {
+			return usage, fmt.Errorf("failed to list reclaimable artifacts of %s: %w", stackName, err)
+		}
+		artifacts = append(artifacts, found...)
+	}
+	sizes := make(map[string]int64, len(artifacts))
+	for _, a := range artifacts {
+		size, err := diskUsage(a.Path)
+		if err != nil {
+			return usage, fmt.Errorf("failed to measure %s: %w", a.Name, err)
+		}
+		sizes[a.Path] = size
+		// Artifacts outside env_dir, e.g. in a separate checkpoint directory, count towards the quota too
+		if !withinDir(a.Path, envDir) {
+			usage += size
+		}
+	}
+
+	threshold := quota.threshold()
+	if usage < threshold {
+		return usage, nil
+	}
+	slices.SortFunc(artifacts, func(a, b ReclaimableArtifact) int { return a.Created.Compare(b.Created) })
+	for _, a := range artifacts {
+		if usage < threshold {
+			break
+		}
+		if a.CheckpointID != "" && protected[a.CheckpointID] {
+			continue
+		}
+		if err := a.Remove(ctx); err != nil {
+			logWarnf("Failed to evict %s: %v", a.Name, err)
+			continue
+		}
+		usage -= sizes[a.Path]
+		logInfof("Evicted %s, freeing %d MiB, to stay within the %d MiB data quota", a.Name, sizes[a.Path]>>20, quota.MaxSizeMiB)
+		c.events.Record(EventDataEvicted, "control", a.Name, map[string]string{"bytes": fmt.Sprint(sizes[a.Path])})
+	}
+	if usage >= threshold {
+		logWarnf("Data directory uses %d MiB of its %d MiB quota and nothing more can be evicted", usage>>20, quota.MaxSizeMiB)
+	}
+	return usage, nil
+}
+
+// quotaMonitor enforces the data quota in the background
+type quotaMonitor struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// close stops the monitor and waits for an in-flight check to finish
+func (m *quotaMonitor) close() {
+	if m == nil {
+		return
+	}
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+// startQuotaMonitor replaces the quota monitor with one enforcing the quota in cfg, if any
+func (c *Control) startQuotaMonitor(cfg *SystemConfig) {
+	var monitor *quotaMonitor
+	if cfg != nil && cfg.DataQuota.MaxSizeMiB > 0 {
+		monitor = &quotaMonitor{stop: make(chan struct{}), done: make(chan struct{})}
+		go func() {
+			defer RecoverPanic("data quota monitor")
+			defer close(monitor.done)
+			ticker := time.NewTicker(cfg.DataQuota.interval())
+			defer ticker.Stop()
+			for {
+				if _, err := c.enforceDataQuota(context.Background(), cfg); err != nil {
+					logWarnf("Data quota check failed: %v", err)
+				}
+				select {
+				case <-monitor.stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	c.mu.Lock()
+	previous := c.quota
+	c.quota = monitor
+	c.mu.Unlock()
+	previous.close()
+}
@@ -3,23 +3,141 @@ package lib
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/benbjohnson/litestream"
-	lss3 "github.com/benbjohnson/litestream/s3"
 )
 
+// minUploadPartSize is the smallest multipart upload part S3 accepts
+const minUploadPartSize = s3manager.MinUploadPartSize
+
+// ReplicationIntervals tunes how often a database is replicated. Each replicated database takes
+// its own, so the JuiceFS metadata database can be tuned apart from the app database.
+type ReplicationIntervals struct {
+	// SyncIntervalSeconds is how often new WAL frames are uploaded. Zero uses Litestream's
+	// default of 1 second; longer intervals batch more changes into fewer uploads.
+	SyncIntervalSeconds int `json:"sync_interval_seconds,omitempty"`
+	// SnapshotIntervalSeconds is how often a full snapshot is uploaded. Zero only snapshots when a
+	// new generation starts or the 24-hour retention is enforced.
+	SnapshotIntervalSeconds int `json:"snapshot_interval_seconds,omitempty"`
+}
+
+// validate rejects negative intervals; name prefixes the field names in errors
+func (r ReplicationIntervals) validate(name string) error {
+	if r.SyncIntervalSeconds < 0 {
+		return fmt.Errorf("%s.sync_interval_seconds must not be negative", name)
+	}
+	if r.SnapshotIntervalSeconds < 0 {
+		return fmt.Errorf("%s.snapshot_interval_seconds must not be negative", name)
+	}
+	return nil
+}
+
+// syncInterval returns the effective WAL sync interval
+func (r ReplicationIntervals) syncInterval() time.Duration {
+	if r.SyncIntervalSeconds == 0 {
+		return litestream.DefaultSyncInterval
+	}
+	return time.Duration(r.SyncIntervalSeconds) * time.Second
+}
+
+// snapshotInterval returns the effective snapshot interval, or 0 if periodic snapshots are off
+func (r ReplicationIntervals) snapshotInterval() time.Duration {
+	return time.Duration(r.SnapshotIntervalSeconds) * time.Second
+}
+
+// apply sets the intervals on a replica
+func (r ReplicationIntervals) apply(replica *litestream.Replica) {
+	replica.SyncInterval = r.syncInterval()
+	replica.SnapshotInterval = r.snapshotInterval()
+}
+
+// DBConfig holds settings for the db stack
+type DBConfig struct {
+	ReplicationIntervals
+	// UploadConcurrency is the number of parts of a snapshot or WAL segment uploaded in parallel.
+	// Zero uses the default of 5.
+	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// UploadPartSizeMiB is the size of each multipart upload part in MiB. Every part in flight is
+	// buffered in memory, so an upload can hold up to UploadConcurrency parts of this size.
+	// Zero uses the default of 5 MiB, the smallest part S3 accepts.
+	UploadPartSizeMiB int `json:"upload_part_size_mib,omitempty"`
+}
+
+// validate rejects upload settings that S3 or the uploader cannot use
+func (cfg DBConfig) validate() error {
+	if err := cfg.ReplicationIntervals.validate("db"); err != nil {
+		return err
+	}
+	if cfg.UploadConcurrency < 0 {
+		return fmt.Errorf("db.upload_concurrency must not be negative")
+	}
+	if cfg.UploadPartSizeMiB < 0 {
+		return fmt.Errorf("db.upload_part_size_mib must not be negative")
+	}
+	if cfg.UploadPartSizeMiB != 0 && int64(cfg.UploadPartSizeMiB)<<20 < minUploadPartSize {
+		return fmt.Errorf("db.upload_part_size_mib must be at least %d", minUploadPartSize>>20)
+	}
+	return nil
+}
+
+// uploadConcurrency returns the effective number of parts uploaded in parallel
+func (cfg DBConfig) uploadConcurrency() int {
+	if cfg.UploadConcurrency == 0 {
+		return s3manager.DefaultUploadConcurrency
+	}
+	return cfg.UploadConcurrency
+}
+
+// uploadPartSize returns the effective multipart upload part size in bytes
+func (cfg DBConfig) uploadPartSize() int64 {
+	if cfg.UploadPartSizeMiB == 0 {
+		return s3manager.DefaultUploadPartSize
+	}
+	return int64(cfg.UploadPartSizeMiB) << 20
+}
+
+// tuned reports whether any upload setting differs from the defaults
+func (cfg DBConfig) tuned() bool {
+	return cfg.UploadConcurrency != 0 || cfg.UploadPartSizeMiB != 0
+}
+
 // DBManager handles SQLite database operations
 type DBManager struct {
 	config  *ObjectStorageConfig
 	dataDir string
 	DBPath  string         // path to the database file
+	Name    string         // name of the database in the replica path; defaults to the DBPath file name
 	lsDB    *litestream.DB // single instance for replication
+	Upload  DBConfig       // upload tuning applied to the replica client
+
+	// Intervals sets how often the database is synced and snapshotted to its replica
+	Intervals ReplicationIntervals
+
+	// RestoreCleanup lists additional local paths removed after the database is restored from its
+	// replica, besides the stale SQLite and Litestream files of a previous copy
+	RestoreCleanup []string
+
+	// mu guards lsDB and replicating. rule: it is held for reading while the Litestream instance is
+	// in use, so stopping replication, e.g. when fencing after the lease was lost, waits for a sync
+	// in progress instead of closing the instance under it
+	mu          sync.RWMutex
+	replicating bool
+	mkdirAll    func(path string, perm os.FileMode) error // creates directories; os.MkdirAll if nil
+	lastSync    atomic.Int64                              // unix nanoseconds of the last successful Sync
 }
 
+// errNoReplica is returned when there is no replicated state to restore a database from
+var errNoReplica = errors.New("no replicated generations found")
+
 // NewDBManager creates a new database manager instance
 func NewDBManager(config *ObjectStorageConfig, dataDir string) *DBManager {
 	return &DBManager{
@@ -31,23 +149,36 @@ func NewDBManager(config *ObjectStorageConfig, dataDir string) *DBManager {
 
 // Initialize ensures the database directory exists
 func (dm *DBManager) Initialize() error {
-	log.Printf("DBManager.Initialize: DBPath=%s", dm.DBPath)
+	return dm.InitializeContext(context.Background())
+}
+
+// InitializeContext ensures the database directory and file exist, giving up when ctx is done
+func (dm *DBManager) InitializeContext(ctx context.Context) error {
+	logDebugf("DBManager.Initialize: DBPath=%s", dm.DBPath)
 
 	// Always create the parent directory for DBPath
 	dbDir := filepath.Dir(dm.DBPath)
-	if err := os.MkdirAll(dbDir, 0755); err != nil {
+	mkdirAll := dm.mkdirAll
+	if mkdirAll == nil {
+		mkdirAll = os.MkdirAll
+	}
+	// rule: creating directories is idempotent, so a cancelled call may leave it to finish in the background
+	if err := runContext(ctx, func() error { return mkdirAll(dbDir, DirMode) }); err != nil {
 		return fmt.Errorf("failed to create database directory %s: %w", dbDir, err)
 	}
 
 	// Initialize SQLite database if it doesn't exist
 	if _, err := os.Stat(dm.DBPath); os.IsNotExist(err) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
 		db, err := sql.Open("sqlite3", dm.DBPath)
 		if err != nil {
 			return fmt.Errorf("failed to open database: %w", err)
 		}
 		defer db.Close()
 
-		if err := dm.initializeDB(db); err != nil {
+		if err := dm.initializeDB(ctx, db); err != nil {
 			return fmt.Errorf("failed to initialize database: %w", err)
 		}
 	}
@@ -55,32 +186,77 @@ func (dm *DBManager) Initialize() error {
 	return nil
 }
 
-// litestreamDB returns the active Litestream DB instance, creating it if necessary
+// runContext runs fn and waits for it to finish or for ctx to be done, whichever comes first.
+// fn keeps running after ctx is done, so it must be safe to abandon.
+func runContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// name returns the database name used in the replica path
+func (dm *DBManager) name() string {
+	if dm.Name != "" {
+		return dm.Name
+	}
+	return strings.TrimSuffix(filepath.Base(dm.DBPath), filepath.Ext(dm.DBPath))
+}
+
+// replicaPath returns the object key prefix holding the snapshots and WAL of the named database.
+// rule: each database replicates under its own prefix so databases sharing a bucket never collide
+func replicaPath(cfg *ObjectStorageConfig, name string) string {
+	return cfg.layout().replica(name)
+}
+
+// litestreamDB returns the active Litestream DB instance, creating it if necessary; the caller must hold dm.mu
 func (dm *DBManager) litestreamDB() *litestream.DB {
 	if dm.lsDB == nil {
 		lsdb := litestream.NewDB(dm.DBPath)
 
 		// Configure S3 replica client
-		client := lss3.NewReplicaClient()
-		client.Bucket = dm.config.Bucket
-		client.Endpoint = dm.config.Endpoint
-		client.AccessKeyID = dm.config.AccessKey
-		client.SecretAccessKey = dm.config.SecretKey
-		client.Region = dm.config.Region
-		client.ForcePathStyle = true // Use path-style addressing
+		client, err := newReplicaClient(dm.config)
+		if err != nil {
+			logErrorf("Failed to configure Litestream replica client: %v", err)
+			dm.lsDB = lsdb
+			return dm.lsDB
+		}
+		client.Path = replicaPath(dm.config, dm.name())
 
-		log.Printf("Configuring Litestream with endpoint=%s, access_key=%s, region=%s, path_style=%v",
-			client.Endpoint, client.AccessKeyID, client.Region, client.ForcePathStyle)
+		logDebugf("Configuring Litestream with endpoint=%s, access_key=%s, region=%s, path_style=%v, path=%s",
+			client.Endpoint, client.AccessKeyID, client.Region, client.ForcePathStyle, client.Path)
 
 		replica := litestream.NewReplica(lsdb, "s3")
-		replica.Client = client
+		replica.Client = withUploader(dm.config, client, dm.Upload)
+		dm.Intervals.apply(replica)
 		lsdb.Replicas = append(lsdb.Replicas, replica)
 		dm.lsDB = lsdb
 	}
 	return dm.lsDB
 }
 
+// Replicating reports whether replication is running
+func (dm *DBManager) Replicating() bool {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.replicating
+}
+
 func (dm *DBManager) StartReplication() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.startReplication()
+}
+
+// startReplication implements StartReplication; the caller must hold dm.mu
+func (dm *DBManager) startReplication() error {
 	lsdb := dm.litestreamDB()
 	if len(lsdb.Replicas) == 0 {
 		return fmt.Errorf("no replicas configured")
@@ -88,50 +264,274 @@ func (dm *DBManager) StartReplication() error {
 	if err := lsdb.Open(); err != nil {
 		return fmt.Errorf("failed to start replication: %w", err)
 	}
-	log.Printf("Started Litestream replication")
+	dm.replicating = true
+	logInfof("Started Litestream replication")
 	return nil
 }
 
 func (dm *DBManager) StopReplication() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.stopReplication()
+}
+
+// stopReplication implements StopReplication; the caller must hold dm.mu
+func (dm *DBManager) stopReplication() error {
+	if !dm.replicating {
+		return nil
+	}
 	lsdb := dm.litestreamDB()
+	// rule: Close stops replication even when its final sync fails, so it is never reported as running after
+	dm.replicating = false
 	if err := lsdb.Close(context.Background()); err != nil {
 		return fmt.Errorf("failed to stop replication: %w", err)
 	}
-	log.Printf("Stopped Litestream replication")
+	logInfof("Stopped Litestream replication")
+	return nil
+}
+
+// Restart stops replication, if running, and starts it again with a fresh Litestream instance
+func (dm *DBManager) Restart() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if err := dm.stopReplication(); err != nil {
+		return err
+	}
+	// rule: a closed Litestream DB cannot be reopened, so replication restarts on a new instance
+	dm.lsDB = nil
+	return dm.startReplication()
+}
+
+// Sync flushes pending database changes to the replicas
+func (dm *DBManager) Sync(ctx context.Context) error {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.sync(ctx)
+}
+
+// sync implements Sync; the caller must hold dm.mu
+func (dm *DBManager) sync(ctx context.Context) error {
+	if !dm.replicating {
+		return nil
+	}
+	lsdb := dm.lsDB
+	if err := lsdb.Sync(ctx); err != nil {
+		return fmt.Errorf("failed to sync database: %w", err)
+	}
+	for _, replica := range lsdb.Replicas {
+		if err := replica.Sync(ctx); err != nil {
+			return fmt.Errorf("failed to sync replica %s: %w", replica.Name(), err)
+		}
+	}
+	dm.lastSync.Store(time.Now().UnixNano())
 	return nil
 }
 
-func (dm *DBManager) initializeDB(db *sql.DB) error {
+// Position returns the position of the database durable in its replica, as of the last replica sync
+func (dm *DBManager) Position() (ReplicationPosition, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	if !dm.replicating {
+		return ReplicationPosition{}, errReplicationStopped
+	}
+	lsdb := dm.lsDB
+	if len(lsdb.Replicas) == 0 {
+		return ReplicationPosition{}, fmt.Errorf("no replicas configured")
+	}
+	pos := lsdb.Replicas[0].Pos()
+	return ReplicationPosition{Generation: pos.Generation, Index: pos.Index, Offset: pos.Offset}, nil
+}
+
+// Restore restores the latest replicated state of the database to outputPath, which must not exist
+func (dm *DBManager) Restore(ctx context.Context, outputPath string) error {
+	dm.mu.Lock()
+	lsdb := dm.litestreamDB()
+	dm.mu.Unlock()
+	if len(lsdb.Replicas) == 0 {
+		return fmt.Errorf("no replicas configured")
+	}
+	replica := lsdb.Replicas[0]
+
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = outputPath
+	generation, _, err := replica.CalcRestoreTarget(ctx, opt)
+	if err != nil {
+		return fmt.Errorf("failed to find restore target: %w", err)
+	}
+	if generation == "" {
+		return fmt.Errorf("%w for database %s", errNoReplica, dm.name())
+	}
+	opt.Generation = generation
+
+	if err := replica.Restore(ctx, opt); err != nil {
+		return fmt.Errorf("failed to restore database: %w", err)
+	}
+	logInfof("Restored database %s from generation %s to %s", dm.name(), generation, outputPath)
+	return nil
+}
+
+// RestoreFromReplica restores a missing database from its replica and removes the stale local files
+// of the previous copy. It reports whether the database was restored; an existing database, or one
+// that was never replicated, is left alone.
+func (dm *DBManager) RestoreFromReplica(ctx context.Context) (bool, error) {
+	if _, err := os.Stat(dm.DBPath); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to check database: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dm.DBPath), DirMode); err != nil {
+		return false, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	if err := dm.Restore(ctx, dm.DBPath); errors.Is(err, errNoReplica) {
+		logInfof("No replica of database %s to restore, starting empty", dm.name())
+		return false, nil
+	} else if err != nil {
+		return false, classifyStorageFailure("failed to restore "+dm.name()+" from its replica", err)
+	}
+
+	// rule: stale files must be gone before the restored database is opened or replicated
+	if err := dm.removeStaleFiles(); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// VerifyIntegrity runs SQLite's quick check on the database, failing if it reports corruption.
+// A database that does not exist yet passes.
+func (dm *DBManager) VerifyIntegrity(ctx context.Context) error {
+	if _, err := os.Stat(dm.DBPath); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRowContext(ctx, "PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("failed to check integrity of database %s: %w", dm.name(), err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("database %s is corrupt: %s", dm.name(), result)
+	}
+	return nil
+}
+
+// staleFiles returns the local paths left over from a previous copy of the database
+func (dm *DBManager) staleFiles() []string {
+	dir, base := filepath.Split(dm.DBPath)
+	paths := []string{
+		dm.DBPath + "-wal",
+		dm.DBPath + "-shm",
+		dm.DBPath + "-journal",
+		filepath.Join(dir, "."+base+litestream.MetaDirSuffix),
+	}
+	return append(paths, dm.RestoreCleanup...)
+}
+
+// removeStaleFiles removes the stale local files of a previous copy of the database.
+// Paths that are, or contain, the database itself are never removed.
+func (dm *DBManager) removeStaleFiles() error {
+	dbPath, err := filepath.Abs(dm.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve database path: %w", err)
+	}
+	for _, p := range dm.staleFiles() {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", p, err)
+		}
+		if rel, err := filepath.Rel(abs, dbPath); err == nil && !strings.HasPrefix(rel, "..") {
+			logInfof("Not removing %s after restore: it holds the restored database", p)
+			continue
+		}
+		if _, err := os.Lstat(abs); os.IsNotExist(err) {
+			continue
+		}
+		logInfof("Removing stale %s after restore", p)
+		if err := os.RemoveAll(abs); err != nil {
+			return fmt.Errorf("failed to remove stale %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// RefreshCredentials rebuilds the replica client with rotated credentials,
+// restarting replication if it was running
+func (dm *DBManager) RefreshCredentials(cfg *ObjectStorageConfig) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	wasReplicating := dm.replicating
+	if err := dm.stopReplication(); err != nil {
+		return err
+	}
+
+	dm.config = cfg
+	dm.lsDB = nil
+
+	if wasReplicating {
+		if err := dm.startReplication(); err != nil {
+			return err
+		}
+	}
+	logInfof("Refreshed Litestream credentials")
+	return nil
+}
+
+func (dm *DBManager) initializeDB(ctx context.Context, db *sql.DB) error {
 	// Set user version to ensure file exists
-	if _, err := db.Exec("PRAGMA user_version = 1;"); err != nil {
+	if _, err := db.ExecContext(ctx, "PRAGMA user_version = 1;"); err != nil {
 		return fmt.Errorf("failed to set user_version: %w", err)
 	}
 	return nil
 }
 
-// Status returns the current status of the DB manager
+// Status returns the current status of the DB manager. It is safe to call before the database
+// is initialized or replication is started.
 func (d *DBManager) Status(ctx context.Context) map[string]interface{} {
 	status := make(map[string]interface{})
+	status["db_path"] = d.DBPath
 
-	// Check if database file exists
-	if _, err := os.Stat(d.DBPath); err == nil {
+	// Check if database file exists, reporting its size to monitor growth
+	if info, err := os.Stat(d.DBPath); err == nil {
 		status["db_exists"] = true
+		status["db_size_bytes"] = info.Size()
+		status["db_modified_at"] = info.ModTime().UTC().Format(time.RFC3339)
+		// rule: large WAL and shm files indicate writes that have not been checkpointed into the database
+		for suffix, key := range map[string]string{"-wal": "wal_size_bytes", "-shm": "shm_size_bytes"} {
+			if info, err := os.Stat(d.DBPath + suffix); err == nil {
+				status[key] = info.Size()
+			}
+		}
 	} else {
 		status["db_exists"] = false
 		status["db_error"] = err.Error()
 	}
 
-	// Check if litestream is running
-	if d.litestreamDB() != nil {
-		status["litestream_running"] = true
+	// rule: status only inspects the Litestream instance, creating one would set up a replica client
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	status["litestream_running"] = d.replicating
+	if d.replicating && d.lsDB != nil {
+		if generation, err := d.lsDB.CurrentGeneration(); err == nil && generation != "" {
+			status["generation"] = generation
+		}
 		// Add replica statuses
 		replicas := make([]string, 0)
-		for _, replica := range d.litestreamDB().Replicas {
+		for _, replica := range d.lsDB.Replicas {
 			replicas = append(replicas, replica.Name())
 		}
 		status["replicas"] = replicas
-	} else {
-		status["litestream_running"] = false
+	}
+	if last := d.lastSync.Load(); last != 0 {
+		status["last_sync_at"] = time.Unix(0, last).UTC().Format(time.RFC3339)
+	}
+	status["sync_interval_seconds"] = int(d.Intervals.syncInterval() / time.Second)
+	status["snapshot_interval_seconds"] = d.Intervals.SnapshotIntervalSeconds
+	status["upload"] = map[string]interface{}{
+		"concurrency":     d.Upload.uploadConcurrency(),
+		"part_size_bytes": d.Upload.uploadPartSize(),
 	}
 
 	return status
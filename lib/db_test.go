@@ -0,0 +1,557 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDBManagersReplicateToSeparatePrefixes(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/env/",
+	}
+	ctx := context.Background()
+
+	// Replicate two databases sharing the bucket, each holding its own name
+	managers := make(map[string]*DBManager)
+	for _, name := range []string{"alpha", "beta"} {
+		dm := NewDBManager(cfg, t.TempDir())
+		dm.Name = name
+		if err := dm.Initialize(); err != nil {
+			t.Fatalf("Failed to initialize %s: %v", name, err)
+		}
+		if err := dm.StartReplication(); err != nil {
+			t.Fatalf("Failed to start replication for %s: %v", name, err)
+		}
+
+		db, err := sql.Open("sqlite3", dm.DBPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`CREATE TABLE t (name TEXT); INSERT INTO t VALUES (?)`, name); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		db.Close()
+
+		if err := dm.Sync(ctx); err != nil {
+			t.Fatalf("Failed to sync %s: %v", name, err)
+		}
+		if err := dm.StopReplication(); err != nil {
+			t.Fatalf("Failed to stop replication for %s: %v", name, err)
+		}
+		managers[name] = dm
+	}
+
+	// Every replicated object lives under exactly one database's prefix
+	counts := make(map[string]int)
+	s3.mu.Lock()
+	for key := range s3.objects {
+		switch {
+		case strings.HasPrefix(key, "/test-bucket/env/litestream/alpha/"):
+			counts["alpha"]++
+		case strings.HasPrefix(key, "/test-bucket/env/litestream/beta/"):
+			counts["beta"]++
+		default:
+			t.Errorf("Unexpected object outside the database prefixes: %s", key)
+		}
+	}
+	s3.mu.Unlock()
+	if counts["alpha"] == 0 || counts["beta"] == 0 {
+		t.Fatalf("Expected objects for both databases, got %v", counts)
+	}
+
+	// Each database restores its own data
+	for name, dm := range managers {
+		restored := filepath.Join(t.TempDir(), "restored.sqlite")
+		if err := dm.Restore(ctx, restored); err != nil {
+			t.Fatalf("Failed to restore %s: %v", name, err)
+		}
+		db, err := sql.Open("sqlite3", restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		err = db.QueryRow(`SELECT name FROM t`).Scan(&got)
+		db.Close()
+		if err != nil {
+			t.Fatalf("Failed to read restored %s: %v", name, err)
+		}
+		if got != name {
+			t.Errorf("Expected restored %s database to hold %q, got %q", name, name, got)
+		}
+	}
+}
+
+func TestRestoreFromReplicaRemovesStaleFiles(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/env/",
+	}
+	ctx := context.Background()
+
+	// Nothing is restored before the database was ever replicated
+	dir := t.TempDir()
+	dm := NewDBManager(cfg, dir)
+	if restored, err := dm.RestoreFromReplica(ctx); err != nil || restored {
+		t.Fatalf("Expected no restore without a replica, got %v (%v)", restored, err)
+	}
+
+	if err := dm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.StartReplication(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('replicated')`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := dm.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.StopReplication(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A machine that lost its database but kept stale local files restores from the replica
+	if err := os.Remove(dm.DBPath); err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, "db", "leftover")
+	stale := []string{
+		dm.DBPath + "-wal",
+		dm.DBPath + "-shm",
+		filepath.Join(dir, "db", ".app.sqlite-litestream", "generation"),
+		extra,
+	}
+	for _, p := range stale {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restoredDM := NewDBManager(cfg, dir)
+	// The database and its directory are configured for cleanup but must survive it
+	restoredDM.RestoreCleanup = []string{extra, restoredDM.DBPath, filepath.Dir(restoredDM.DBPath)}
+	restored, err := restoredDM.RestoreFromReplica(ctx)
+	if err != nil || !restored {
+		t.Fatalf("Expected database to be restored, got %v (%v)", restored, err)
+	}
+	for _, p := range stale {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected stale %s to be removed, got %v", p, err)
+		}
+	}
+
+	db, err = sql.Open("sqlite3", restoredDM.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var v string
+	if err := db.QueryRow(`SELECT v FROM t`).Scan(&v); err != nil || v != "replicated" {
+		t.Errorf("Expected restored data, got %q (%v)", v, err)
+	}
+
+	// An existing database is left alone
+	if restored, err := restoredDM.RestoreFromReplica(ctx); err != nil || restored {
+		t.Errorf("Expected existing database not to be restored, got %v (%v)", restored, err)
+	}
+}
+
+func TestDBManagerUploadSettings(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+	}
+	settings := DBConfig{UploadConcurrency: 8, UploadPartSizeMiB: 16}
+	if err := settings.validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	if err := (DBConfig{UploadPartSizeMiB: 1}).validate(); err == nil {
+		t.Error("Expected an error for a part size below the S3 minimum")
+	}
+
+	dm := NewDBManager(cfg, t.TempDir())
+	dm.Upload = settings
+	client, ok := dm.litestreamDB().Replicas[0].Client.(*uploadReplicaClient)
+	if !ok {
+		t.Fatalf("Expected the replica client to use tuned uploads, got %T", dm.litestreamDB().Replicas[0].Client)
+	}
+	if _, err := client.WriteSnapshot(context.Background(), "0123456789abcdef", 1, strings.NewReader("snapshot")); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	if client.uploader.Concurrency != 8 || client.uploader.PartSize != 16<<20 {
+		t.Errorf("Expected concurrency 8 and part size 16 MiB, got %d and %d", client.uploader.Concurrency, client.uploader.PartSize)
+	}
+
+	upload, _ := dm.Status(context.Background())["upload"].(map[string]interface{})
+	if upload["concurrency"] != 8 || upload["part_size_bytes"] != int64(16<<20) {
+		t.Errorf("Expected effective settings in status, got %v", upload)
+	}
+
+	// Untuned replicas report the defaults
+	defaults := NewDBManager(cfg, t.TempDir()).Status(context.Background())["upload"].(map[string]interface{})
+	if defaults["concurrency"] != 5 || defaults["part_size_bytes"] != int64(5<<20) {
+		t.Errorf("Expected default settings in status, got %v", defaults)
+	}
+}
+
+func TestDBManagerStatusReportsFileSizes(t *testing.T) {
+	cfg := &ObjectStorageConfig{Bucket: "test-bucket", Endpoint: "http://localhost:1", Region: "auto", KeyPrefix: "/"}
+	dm := NewDBManager(cfg, t.TempDir())
+
+	// Nothing is reported before the database is created
+	status := dm.Status(context.Background())
+	if status["db_exists"] != false || status["db_size_bytes"] != nil {
+		t.Fatalf("Expected no file sizes before initialization, got %v", status)
+	}
+
+	if err := dm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	initial, ok := dm.Status(context.Background())["db_size_bytes"].(int64)
+	if !ok {
+		t.Fatalf("Expected the database size in status, got %v", dm.Status(context.Background()))
+	}
+
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`PRAGMA journal_mode=WAL; CREATE TABLE t (v BLOB)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := db.Exec(`INSERT INTO t VALUES (randomblob(4096))`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Uncheckpointed writes show up in the WAL
+	status = dm.Status(context.Background())
+	if wal, _ := status["wal_size_bytes"].(int64); wal == 0 {
+		t.Errorf("Expected a non-empty WAL while writes are pending, got %v", status)
+	}
+	if _, ok := status["shm_size_bytes"].(int64); !ok {
+		t.Errorf("Expected the shm size in status, got %v", status)
+	}
+	if _, ok := status["db_modified_at"].(string); !ok {
+		t.Errorf("Expected the modification time in status, got %v", status)
+	}
+
+	// Closing checkpoints the WAL into the database
+	db.Close()
+	if size, _ := dm.Status(context.Background())["db_size_bytes"].(int64); size <= initial {
+		t.Errorf("Expected the database to grow from %d bytes after inserting rows, got %d", initial, size)
+	}
+}
+
+func TestDBManagerStatusBeforeAndAfterReplication(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+	}
+	ctx := context.Background()
+	dm := NewDBManager(cfg, t.TempDir())
+	if err := dm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := dm.Status(ctx)
+	for _, key := range []string{"db_path", "db_exists", "db_size_bytes", "litestream_running", "upload"} {
+		if _, ok := status[key]; !ok {
+			t.Errorf("Expected %q in status before replication, got %v", key, status)
+		}
+	}
+	for _, key := range []string{"generation", "replicas", "last_sync_at"} {
+		if _, ok := status[key]; ok {
+			t.Errorf("Expected no %q before replication, got %v", key, status)
+		}
+	}
+	if status["litestream_running"] != false || status["db_path"] != dm.DBPath {
+		t.Errorf("Unexpected status before replication: %v", status)
+	}
+	if dm.lsDB != nil {
+		t.Error("Expected status not to create a Litestream instance")
+	}
+
+	if err := dm.StartReplication(); err != nil {
+		t.Fatal(err)
+	}
+	defer dm.StopReplication()
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('x')`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := dm.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	status = dm.Status(ctx)
+	if status["litestream_running"] != true {
+		t.Errorf("Expected replication to be reported running, got %v", status)
+	}
+	if generation, _ := status["generation"].(string); generation == "" {
+		t.Errorf("Expected the current generation, got %v", status)
+	}
+	if replicas, _ := status["replicas"].([]string); len(replicas) != 1 {
+		t.Errorf("Expected one replica, got %v", status["replicas"])
+	}
+	if _, ok := status["last_sync_at"].(string); !ok {
+		t.Errorf("Expected the last sync time, got %v", status)
+	}
+}
+
+// Fencing stops replication on the lease renewal goroutine while requests may be syncing the
+// database or reading its status; run with -race to check they never touch it unguarded
+func TestFenceDuringSyncAndStatus(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+	}
+	ctx := context.Background()
+	db := NewDBManagerComponent(t.TempDir())
+	if err := db.Setup(ctx, cfg, ""); err != nil {
+		t.Fatalf("Failed to set up db: %v", err)
+	}
+	defer db.Cleanup(ctx)
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, db)
+	control.config = &SystemConfig{Stacks: []string{"db"}}
+	control.setupRoutes()
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var syncs atomic.Int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// rule: a sync either completes or reports replication stopped, never fails on a closed database
+				if w := request("POST", "/stack/db/sync"); w.Code != http.StatusOK && w.Code != http.StatusConflict {
+					t.Errorf("Expected the sync to succeed or report replication stopped, got %d: %s", w.Code, w.Body.String())
+				}
+				syncs.Add(1)
+				request("GET", "/status")
+				control.Health(ctx)
+				db.ReplicationPosition()
+			}
+		}()
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); syncs.Load() < 4 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	control.fence(errors.New("lease lost"))
+	fenced := syncs.Load()
+	for deadline := time.Now().Add(5 * time.Second); syncs.Load() < fenced+4 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if db.dbManager.Replicating() {
+		t.Error("Expected replication to be stopped once fenced")
+	}
+	if w := request("POST", "/stack/db/sync"); w.Code != http.StatusConflict {
+		t.Errorf("Expected a sync after fencing to report replication stopped, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDBManagerInitializeHonorsCancellation(t *testing.T) {
+	cfg := &ObjectStorageConfig{Bucket: "test-bucket", Endpoint: "http://localhost:1", Region: "auto", KeyPrefix: "/"}
+	dm := NewDBManager(cfg, t.TempDir())
+
+	// Simulate a disk that hangs creating the database directory
+	release := make(chan struct{})
+	defer close(release)
+	dm.mkdirAll = func(path string, perm os.FileMode) error {
+		<-release
+		return errors.New("disk unavailable")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := dm.InitializeContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected initialization to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected initialization to return promptly after cancellation, took %v", elapsed)
+	}
+	if _, err := os.Stat(dm.DBPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no database to be created, got %v", err)
+	}
+
+	// A context that is already done does not start any work
+	dm.mkdirAll = nil
+	if err := dm.InitializeContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a done context to be rejected, got %v", err)
+	}
+	if err := dm.InitializeContext(context.Background()); err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	if _, err := os.Stat(dm.DBPath); err != nil {
+		t.Errorf("Expected the database to be created, got %v", err)
+	}
+}
+
+func TestManualSyncMakesWritesRestorable(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+	}
+	ctx := context.Background()
+
+	// A long sync interval leaves the write to the manual sync
+	db := NewDBManagerComponent(t.TempDir())
+	db.Configure(DBConfig{ReplicationIntervals: ReplicationIntervals{SyncIntervalSeconds: 3600}})
+	if err := db.Setup(ctx, cfg, ""); err != nil {
+		t.Fatalf("Failed to set up db: %v", err)
+	}
+	defer db.Cleanup(ctx)
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, db)
+	control.config = &SystemConfig{Stacks: []string{"db"}}
+	control.setupRoutes()
+	syncDB := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/stack/db/sync", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	conn, err := sql.Open("sqlite3", db.dbManager.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(`CREATE TABLE t (name TEXT); INSERT INTO t VALUES ('durable')`); err != nil {
+		t.Fatalf("Failed to write row: %v", err)
+	}
+	conn.Close()
+
+	w := syncDB()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected sync to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Status   string              `json:"status"`
+		Position ReplicationPosition `json:"position"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Status != "synced" || resp.Position.Generation == "" {
+		t.Errorf("Expected the replicated position in the response, got %+v", resp)
+	}
+
+	// The row is restorable on a fresh machine right away
+	fresh := NewDBManager(cfg, t.TempDir())
+	if restored, err := fresh.RestoreFromReplica(ctx); err != nil || !restored {
+		t.Fatalf("Expected a restore from the replica, got %v (%v)", restored, err)
+	}
+	conn, err = sql.Open("sqlite3", fresh.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var got string
+	if err := conn.QueryRow(`SELECT name FROM t`).Scan(&got); err != nil || got != "durable" {
+		t.Errorf("Expected the synced row to be restored, got %q (%v)", got, err)
+	}
+
+	// A stopped replica is reported instead of claiming the writes are durable
+	if err := db.Fence(ctx); err != nil {
+		t.Fatalf("Failed to stop replication: %v", err)
+	}
+	if w := syncDB(); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while replication is stopped, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,25 @@
+package lib
+
+import (
+	"os"
+	"runtime"
+)
+
+// ResourceUsage reports process resource counts used to detect leaks across repeated operations
+type ResourceUsage struct {
+	Goroutines int `json:"goroutines"`
+	OpenFDs    int `json:"open_fds"`
+}
+
+// CurrentResourceUsage returns the current goroutine and open file descriptor counts.
+// OpenFDs is -1 when /proc/self/fd is unavailable.
+func CurrentResourceUsage() ResourceUsage {
+	usage := ResourceUsage{
+		Goroutines: runtime.NumGoroutine(),
+		OpenFDs:    -1,
+	}
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		usage.OpenFDs = len(entries)
+	}
+	return usage
+}
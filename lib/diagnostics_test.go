@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCheckpointCyclesResourceUsage(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("Skipping test: /proc/self/fd not available")
+	}
+
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(basePath, "juicefs", "checkpoints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+
+	post := func(path, id string) {
+		body, _ := json.Marshal(map[string]string{"checkpoint_id": id})
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected status 200, got %d: %s", path, id, w.Code, w.Body.String())
+		}
+	}
+
+	cycle := func(i int) {
+		if err := os.WriteFile(filepath.Join(activeDir, "data.txt"), []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("cp-%d", i)
+		post("/checkpoint", id)
+		post("/restore", id)
+	}
+
+	// Warm up so lazily created resources are already counted
+	for i := 0; i < 5; i++ {
+		cycle(i)
+	}
+	runtime.GC()
+	before := CurrentResourceUsage()
+
+	for i := 5; i < 105; i++ {
+		cycle(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	runtime.GC()
+	after := CurrentResourceUsage()
+
+	if after.OpenFDs > before.OpenFDs+2 {
+		t.Errorf("Open FDs grew from %d to %d over 100 checkpoint cycles", before.OpenFDs, after.OpenFDs)
+	}
+	if after.Goroutines > before.Goroutines+2 {
+		t.Errorf("Goroutines grew from %d to %d over 100 checkpoint cycles", before.Goroutines, after.Goroutines)
+	}
+}
+
+func TestSupervisorCyclesResourceUsage(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("Skipping test: /proc/self/fd not available")
+	}
+
+	s := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{
+		TimeoutStop:  5 * time.Second,
+		RestartDelay: 50 * time.Millisecond,
+	})
+	defer s.StopProcess()
+
+	before := CurrentResourceUsage()
+	for i := 0; i < 10; i++ {
+		if err := s.StartProcess(); err != nil {
+			t.Fatalf("Failed to start process: %v", err)
+		}
+		if err := s.StopProcess(); err != nil {
+			t.Fatalf("Failed to stop process: %v", err)
+		}
+	}
+
+	// A stopped process must not be restarted
+	time.Sleep(200 * time.Millisecond)
+	if s.IsRunning() {
+		t.Error("Process should not be restarted after an intentional stop")
+	}
+
+	after := CurrentResourceUsage()
+	if after.OpenFDs > before.OpenFDs+2 {
+		t.Errorf("Open FDs grew from %d to %d over 10 supervisor cycles", before.OpenFDs, after.OpenFDs)
+	}
+	if after.Goroutines > before.Goroutines+2 {
+		t.Errorf("Goroutines grew from %d to %d over 10 supervisor cycles", before.Goroutines, after.Goroutines)
+	}
+}
@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DefaultDialTimeout bounds connecting to the backend when no dial timeout is set
+const DefaultDialTimeout = 5 * time.Second
+
+// dialBackend opens a connection to the backend; replaceable in tests to simulate a wedged backend
+var dialBackend = (&net.Dialer{
+	KeepAlive: 0, // Let OS/user app manage keepalive
+}).DialContext
+
+// SetDialTimeout bounds connecting to the backend, so a request to a backend whose socket exists
+// but whose process is wedged fails with 502 instead of hanging. Zero uses DefaultDialTimeout and
+// a negative value waits indefinitely. Once connected, the request and response are not limited.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetDialTimeout(timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialTimeout = timeout
+	return p.setupProxy()
+}
+
+// dialer returns the function the backend transport connects with, reaching a unix socket at
+// socketPath instead of the requested address when set
+func (p *Proxy) dialer(socketPath string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := p.dialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socketPath != "" {
+			network, addr = "unix", socketPath
+		}
+		// rule: the deadline covers the connect only; the connection outlives it
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return dialBackend(ctx, network, addr)
+	}
+}
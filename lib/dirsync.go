@@ -0,0 +1,388 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultSyncInterval is how often the directory is mirrored when not configured
+const defaultSyncInterval = time.Minute
+
+// SyncConfig holds settings for the sync component
+type SyncConfig struct {
+	// Dir is the local directory mirrored to object storage. Required for the sync stack.
+	Dir string `json:"dir"`
+	// IntervalSeconds is how often changes are mirrored. Zero uses the default of 60 seconds.
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+	// Include lists the path.Match patterns, relative to Dir, of the files to mirror; a pattern
+	// matching a directory covers everything below it, and a pattern without a slash matches
+	// names at any depth. Empty includes every file.
+	Include []string `json:"include,omitempty"`
+	// Exclude lists the patterns of files left out even when included
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// interval returns the configured sync interval
+func (cfg SyncConfig) interval() time.Duration {
+	if cfg.IntervalSeconds <= 0 {
+		return defaultSyncInterval
+	}
+	return time.Duration(cfg.IntervalSeconds) * time.Second
+}
+
+// matchesAny reports whether rel, or one of its parent directories, matches any of the patterns.
+// A pattern without a slash matches a file or directory name at any depth.
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+			name := p
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(p)
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selected reports whether the file at rel (slash-separated, relative to Dir) is mirrored
+func (cfg SyncConfig) selected(rel string) bool {
+	if len(cfg.Include) > 0 && !matchesAny(cfg.Include, rel) {
+		return false
+	}
+	return !matchesAny(cfg.Exclude, rel)
+}
+
+// syncedFile is the state of a mirrored file at its last upload
+type syncedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// SyncComponent implements StackComponent by mirroring a local directory to object storage:
+// the directory is restored from storage on setup when it is empty, then changed files are
+// uploaded and removed files deleted periodically and on cleanup.
+type SyncComponent struct {
+	mu       sync.Mutex // protects all fields below
+	settings SyncConfig
+	config   *ObjectStorageConfig
+	client   *s3.S3
+	prefix   string                // object key prefix of the mirrored files, ending in /
+	synced   map[string]syncedFile // files as last uploaded, keyed by relative path
+	remote   map[string]bool       // keys known to exist in storage, relative to prefix
+	lastSync time.Time
+	lastErr  error
+	stop     chan struct{} // closed to stop the sync loop
+	done     chan struct{} // closed once the sync loop has stopped
+}
+
+// NewSyncComponent creates a new sync component
+func NewSyncComponent() *SyncComponent {
+	return &SyncComponent{}
+}
+
+// Configure applies the sync stack settings
+func (s *SyncComponent) Configure(settings SyncConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings = settings
+}
+
+// Name returns the stack name of the sync component
+func (s *SyncComponent) Name() string {
+	return "sync"
+}
+
+// syncPrefix returns the object key prefix holding the mirrored directory
+func syncPrefix(cfg *ObjectStorageConfig) string {
+	return cfg.layout().sync()
+}
+
+// Setup restores the directory from storage if it is empty, then starts mirroring it
+func (s *SyncComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.settings.Dir == "" {
+		return fmt.Errorf("sync.dir is required for the sync stack")
+	}
+	sess, err := cfg.newSession()
+	if err != nil {
+		return err
+	}
+	s.config = cfg
+	s.client = s3.New(sess)
+	s.prefix = syncPrefix(cfg)
+	s.synced = make(map[string]syncedFile)
+
+	if err := os.MkdirAll(s.settings.Dir, DirMode); err != nil {
+		return fmt.Errorf("failed to create sync directory: %w", err)
+	}
+	if s.remote, err = s.listRemote(ctx); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.settings.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read sync directory: %w", err)
+	}
+	// rule: only an empty directory is restored, so local changes made before setup are never overwritten
+	if len(entries) == 0 {
+		if err := s.restore(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.settings.interval(), s.stop, s.done)
+	return nil
+}
+
+// listRemote returns the keys, relative to the prefix, of the mirrored files in storage
+func (s *SyncComponent) listRemote(ctx context.Context) (map[string]bool, error) {
+	remote := make(map[string]bool)
+	err := s.client.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			remote[strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix)] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mirrored files: %w", err)
+	}
+	return remote, nil
+}
+
+// restore downloads every mirrored file into the directory; the caller must hold s.mu
+func (s *SyncComponent) restore(ctx context.Context) error {
+	for rel := range s.remote {
+		dst := filepath.Join(s.settings.Dir, filepath.FromSlash(rel))
+		// rule: keys escaping the directory are skipped so a tampered bucket cannot write elsewhere
+		if !strings.HasPrefix(dst, filepath.Clean(s.settings.Dir)+string(filepath.Separator)) {
+			logWarnf("Skipping mirrored file outside the sync directory: %s", rel)
+			continue
+		}
+		if err := s.download(ctx, rel, dst); err != nil {
+			return err
+		}
+		info, err := os.Stat(dst)
+		if err != nil {
+			return fmt.Errorf("failed to stat restored file: %w", err)
+		}
+		s.synced[rel] = syncedFile{size: info.Size(), modTime: info.ModTime()}
+	}
+	if len(s.remote) > 0 {
+		logInfof("Restored %d files into %s", len(s.remote), s.settings.Dir)
+	}
+	return nil
+}
+
+// download writes the mirrored file rel to dst
+func (s *SyncComponent) download(ctx context.Context, rel, dst string) error {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.prefix + rel),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", rel, err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", rel, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), DirMode); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", rel, err)
+	}
+	if err := writeFileAtomic(dst, data, FileMode); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", rel, err)
+	}
+	return nil
+}
+
+// run mirrors the directory every interval until stop is closed
+func (s *SyncComponent) run(interval time.Duration, stop, done chan struct{}) {
+	defer RecoverPanic("directory sync")
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.SyncReplication(context.Background()); err != nil {
+				logWarnf("Directory sync failed: %v", err)
+			}
+		}
+	}
+}
+
+// SyncReplication uploads the files changed since the last sync and deletes removed files from storage
+func (s *SyncComponent) SyncReplication(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.sync(ctx)
+	s.lastErr = err
+	if err == nil {
+		s.lastSync = time.Now()
+	}
+	return err
+}
+
+// sync implements SyncReplication; the caller must hold s.mu
+func (s *SyncComponent) sync(ctx context.Context) error {
+	local := make(map[string]bool)
+	err := filepath.WalkDir(s.settings.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.settings.Dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !s.settings.selected(rel) {
+			return nil
+		}
+		local[rel] = true
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if prev, ok := s.synced[rel]; ok && prev.size == info.Size() && prev.modTime.Equal(info.ModTime()) {
+			return nil
+		}
+		if err := s.upload(ctx, rel, p); err != nil {
+			return err
+		}
+		s.synced[rel] = syncedFile{size: info.Size(), modTime: info.ModTime()}
+		s.remote[rel] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mirror %s: %w", s.settings.Dir, err)
+	}
+
+	for rel := range s.remote {
+		if local[rel] {
+			continue
+		}
+		if _, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.config.Bucket),
+			Key:    aws.String(s.prefix + rel),
+		}); err != nil {
+			return fmt.Errorf("failed to delete mirrored file %s: %w", rel, err)
+		}
+		delete(s.remote, rel)
+		delete(s.synced, rel)
+	}
+	return nil
+}
+
+// upload writes the local file p to storage as rel
+func (s *SyncComponent) upload(ctx context.Context, rel, p string) error {
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed since the walk listed it; the next sync deletes it from storage
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open %s: %w", rel, err)
+	}
+	defer f.Close()
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.prefix + rel),
+		Body:   f,
+	}
+	if s.config.SSE != "" {
+		input.ServerSideEncryption = aws.String(s.config.SSE)
+		if s.config.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.config.SSEKMSKeyID)
+		}
+	}
+	if _, err := s.client.PutObjectWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", rel, err)
+	}
+	return nil
+}
+
+// Cleanup stops the sync loop and mirrors any remaining changes
+func (s *SyncComponent) Cleanup(ctx context.Context) error {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-done
+
+	// rule: changes made since the last tick are mirrored before shutdown
+	err := s.SyncReplication(ctx)
+	s.mu.Lock()
+	s.client = nil
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory on cleanup: %w", err)
+	}
+	return nil
+}
+
+// Fence stops the sync loop without mirroring pending changes
+func (s *SyncComponent) Fence(ctx context.Context) error {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.client = nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// Status returns the mirrored directory and the outcome of the last sync
+func (s *SyncComponent) Status(ctx context.Context) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := map[string]interface{}{
+		"dir":              s.settings.Dir,
+		"interval_seconds": int(s.settings.interval() / time.Second),
+		"running":          s.stop != nil,
+		"files":            len(s.synced),
+	}
+	if !s.lastSync.IsZero() {
+		status["last_sync_at"] = s.lastSync.UTC().Format(time.RFC3339)
+	}
+	if s.lastErr != nil {
+		status["last_error"] = s.lastErr.Error()
+	}
+	return status
+}
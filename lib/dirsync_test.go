@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncComponentRoundTrip(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/app/",
+	}
+	ctx := context.Background()
+
+	src := t.TempDir()
+	files := map[string]string{
+		"notes.txt":        "hello",
+		"data/records.csv": "a,b",
+		"cache/tmp.bin":    "scratch",
+		"data/skip.log":    "noise",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := SyncConfig{Dir: src, IntervalSeconds: 3600, Exclude: []string{"cache", "*.log"}}
+	source := NewSyncComponent()
+	source.Configure(settings)
+	if err := source.Setup(ctx, cfg, ""); err != nil {
+		t.Fatalf("Failed to set up sync: %v", err)
+	}
+	if err := source.SyncReplication(ctx); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	for key, want := range map[string]string{
+		"/test-bucket/app/sync/notes.txt":        "hello",
+		"/test-bucket/app/sync/data/records.csv": "a,b",
+	} {
+		if got, ok := s3.objects[key]; !ok || string(got) != want {
+			t.Errorf("Expected %s to hold %q, got %q", key, want, got)
+		}
+	}
+	if len(s3.objects) != 2 {
+		t.Errorf("Expected excluded files not to be mirrored, got %d objects", len(s3.objects))
+	}
+
+	// Removed files are deleted from storage, and cleanup mirrors the last changes
+	if err := os.Remove(filepath.Join(src, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "data", "records.csv"), []byte("a,b,c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Cleanup(ctx); err != nil {
+		t.Fatalf("Failed to clean up: %v", err)
+	}
+	if _, ok := s3.objects["/test-bucket/app/sync/notes.txt"]; ok {
+		t.Error("Expected the removed file to be deleted from storage")
+	}
+
+	// An empty directory is restored on setup
+	dst := t.TempDir()
+	restored := NewSyncComponent()
+	restored.Configure(SyncConfig{Dir: dst, IntervalSeconds: 3600})
+	if err := restored.Setup(ctx, cfg, ""); err != nil {
+		t.Fatalf("Failed to set up restoring sync: %v", err)
+	}
+	defer restored.Cleanup(ctx)
+	if data, err := os.ReadFile(filepath.Join(dst, "data", "records.csv")); err != nil || string(data) != "a,b,c" {
+		t.Errorf("Expected the directory to be restored, got %q (%v)", data, err)
+	}
+	if status := restored.Status(ctx); status["files"] != 1 {
+		t.Errorf("Expected one mirrored file, got %v", status)
+	}
+}
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// drainRetryAfter is the Retry-After value, in seconds, sent to requests shed while draining
+const drainRetryAfter = "10"
+
+// DrainProvider is an interface for checking if the proxy should shed new requests before shutdown
+type DrainProvider interface {
+	Draining() bool
+}
+
+// Drain stops the proxy from accepting new requests ahead of a shutdown. Requests already in
+// flight complete normally, and /healthz reports not-ready so the load balancer stops routing here.
+// Unlike maintenance, draining is not persisted and lasts until this process exits.
+func (c *Control) Drain() {
+	if c.draining.Swap(true) {
+		return
+	}
+	logInfof("Draining: new proxied requests will be rejected")
+	c.events.Record(EventDraining, "control", "", nil)
+	c.NotifyStatusChange()
+}
+
+// Draining reports whether the environment is draining
+func (c *Control) Draining() bool {
+	return c.draining.Load()
+}
+
+// handleDrain starts draining
+func (c *Control) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.Drain()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+}
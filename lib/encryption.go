@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// Server-side encryption algorithms accepted in ObjectStorageConfig.SSE
+const (
+	SSEAES256 = s3.ServerSideEncryptionAes256
+	SSEKMS    = s3.ServerSideEncryptionAwsKms
+)
+
+// validateEncryption checks that the server-side encryption settings are valid for the endpoint
+func (cfg *ObjectStorageConfig) validateEncryption() error {
+	switch cfg.SSE {
+	case "":
+		if cfg.SSEKMSKeyID != "" {
+			return fmt.Errorf("sse_kms_key_id requires sse to be %q", SSEKMS)
+		}
+	case SSEAES256:
+		if cfg.SSEKMSKeyID != "" {
+			return fmt.Errorf("sse_kms_key_id requires sse to be %q", SSEKMS)
+		}
+	case SSEKMS:
+		// KMS keys only exist on AWS; S3-compatible stores reject SSE-KMS requests
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+			return fmt.Errorf("sse %q is only supported by AWS S3 endpoints, not %s", SSEKMS, cfg.Endpoint)
+		}
+	default:
+		return fmt.Errorf("unsupported sse algorithm %q (expected %q or %q)", cfg.SSE, SSEAES256, SSEKMS)
+	}
+	return nil
+}
+
+// applySSE sets the configured server-side encryption on an upload
+func (cfg *ObjectStorageConfig) applySSE(input *s3manager.UploadInput) {
+	if cfg.SSE == "" {
+		return
+	}
+	input.ServerSideEncryption = aws.String(cfg.SSE)
+	if cfg.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(cfg.SSEKMSKeyID)
+	}
+}
+
+// newSession creates an AWS session for the storage endpoint using the configured credentials,
+// or the default credential chain when no keys are configured
+func (cfg *ObjectStorageConfig) newSession() (*session.Session, error) {
+	// Each session gets its own HTTP client; the SDK otherwise mutates the shared default client
+	awsCfg := aws.NewConfig().
+		WithEndpoint(cfg.Endpoint).
+		WithRegion(cfg.region()).
+		WithS3ForcePathStyle(cfg.pathStyle()).
+		WithHTTPClient(&http.Client{})
+	cfg.applyClientSettings(awsCfg)
+	if cfg.AccessKey != "" {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken))
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage session: %w", err)
+	}
+	return sess, nil
+}
+
+// uploadReplicaClient is a Litestream S3 replica client that writes snapshots and WAL segments
+// with server-side encryption and tuned multipart uploads. The upstream client has no options
+// for either, so uploads go through an uploader owned by this wrapper; every other operation is
+// left to the upstream client.
+type uploadReplicaClient struct {
+	*lss3.ReplicaClient
+	cfg      *ObjectStorageConfig
+	settings DBConfig
+
+	mu       sync.Mutex
+	uploader *s3manager.Uploader
+}
+
+// withUploader wraps client so its uploads use the configured server-side encryption, upload
+// settings and storage request settings. The client is returned unchanged if none is configured.
+func withUploader(cfg *ObjectStorageConfig, client *lss3.ReplicaClient, settings DBConfig) litestream.ReplicaClient {
+	if cfg.SSE == "" && !settings.tuned() && !cfg.clientTuned() {
+		return client
+	}
+	return &uploadReplicaClient{ReplicaClient: client, cfg: cfg, settings: settings}
+}
+
+// upload writes rd to key and returns the number of bytes written
+func (c *uploadReplicaClient) upload(ctx context.Context, key string, rd io.Reader) (int64, error) {
+	c.mu.Lock()
+	if c.uploader == nil {
+		sess, err := c.cfg.newSession()
+		if err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.uploader = s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+			u.Concurrency = c.settings.uploadConcurrency()
+			u.PartSize = c.settings.uploadPartSize()
+		})
+	}
+	uploader := c.uploader
+	c.mu.Unlock()
+
+	rc := &countingReader{r: rd}
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+		Body:   rc,
+	}
+	c.cfg.applySSE(input)
+	if _, err := uploader.UploadWithContext(ctx, input); err != nil {
+		return 0, err
+	}
+	return rc.n, nil
+}
+
+// WriteSnapshot writes a snapshot through the wrapper's uploader
+func (c *uploadReplicaClient) WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader) (info litestream.SnapshotInfo, err error) {
+	key, err := litestream.SnapshotPath(c.Path, generation, index)
+	if err != nil {
+		return info, fmt.Errorf("cannot determine snapshot path: %w", err)
+	}
+	startTime := time.Now()
+	n, err := c.upload(ctx, key, rd)
+	if err != nil {
+		return info, err
+	}
+	return litestream.SnapshotInfo{
+		Generation: generation,
+		Index:      index,
+		Size:       n,
+		CreatedAt:  startTime.UTC(),
+	}, nil
+}
+
+// WriteWALSegment writes a WAL segment through the wrapper's uploader
+func (c *uploadReplicaClient) WriteWALSegment(ctx context.Context, pos litestream.Pos, rd io.Reader) (info litestream.WALSegmentInfo, err error) {
+	key, err := litestream.WALSegmentPath(c.Path, pos.Generation, pos.Index, pos.Offset)
+	if err != nil {
+		return info, fmt.Errorf("cannot determine wal segment path: %w", err)
+	}
+	startTime := time.Now()
+	n, err := c.upload(ctx, key, rd)
+	if err != nil {
+		return info, err
+	}
+	return litestream.WALSegmentInfo{
+		Generation: pos.Generation,
+		Index:      pos.Index,
+		Offset:     pos.Offset,
+		Size:       n,
+		CreatedAt:  startTime.UTC(),
+	}, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
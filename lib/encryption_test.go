@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+func TestSSEAppliedToStorageWrites(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte), headers: make(map[string]http.Header)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+		SSE:       SSEAES256,
+	}
+	if err := cfg.validateEncryption(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	// Litestream replica uploads
+	client, err := newReplicaClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create replica client: %v", err)
+	}
+	client.Path = "db"
+	replica := withUploader(cfg, client, DBConfig{})
+	if _, ok := replica.(*uploadReplicaClient); !ok {
+		t.Fatalf("Expected replica client to be wrapped for SSE, got %T", replica)
+	}
+	info, err := replica.WriteSnapshot(context.Background(), "0123456789abcdef", 1, strings.NewReader("snapshot"))
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	if info.Size != int64(len("snapshot")) {
+		t.Errorf("Expected snapshot size %d, got %d", len("snapshot"), info.Size)
+	}
+	if _, err := replica.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0123456789abcdef", Index: 1}, strings.NewReader("wal")); err != nil {
+		t.Fatalf("Failed to write WAL segment: %v", err)
+	}
+
+	// Stored config
+	store, err := NewS3ConfigStore(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config store: %v", err)
+	}
+	if err := store.Save(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	if len(s3.headers) != 3 {
+		t.Fatalf("Expected 3 objects written, got %d", len(s3.headers))
+	}
+	for key, h := range s3.headers {
+		if got := h.Get("X-Amz-Server-Side-Encryption"); got != SSEAES256 {
+			t.Errorf("Expected %s to be written with SSE %q, got %q", key, SSEAES256, got)
+		}
+	}
+
+	// Without SSE the upstream client is used as-is
+	cfg.SSE = ""
+	if _, ok := withUploader(cfg, lss3.NewReplicaClient(), DBConfig{}).(*lss3.ReplicaClient); !ok {
+		t.Error("Expected unwrapped replica client without SSE")
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ObjectStorageConfig
+		wantErr bool
+	}{
+		{"none", ObjectStorageConfig{Endpoint: "https://fly.storage.tigris.dev"}, false},
+		{"aes256", ObjectStorageConfig{Endpoint: "https://fly.storage.tigris.dev", SSE: SSEAES256}, false},
+		{"kms on aws", ObjectStorageConfig{Endpoint: "https://s3.us-east-1.amazonaws.com", SSE: SSEKMS, SSEKMSKeyID: "key"}, false},
+		{"kms elsewhere", ObjectStorageConfig{Endpoint: "https://fly.storage.tigris.dev", SSE: SSEKMS}, true},
+		{"key without kms", ObjectStorageConfig{Endpoint: "https://s3.us-east-1.amazonaws.com", SSE: SSEAES256, SSEKMSKeyID: "key"}, true},
+		{"unknown", ObjectStorageConfig{Endpoint: "https://fly.storage.tigris.dev", SSE: "rot13"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validateEncryption(); (err != nil) != tt.wantErr {
+				t.Errorf("validateEncryption() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// envIDPrefix is the storage prefix under which an environment with an ID keeps its objects
+const envIDPrefix = "envs"
+
+// EnvIDFromEnv returns the environment ID: FLY_ENV_ID if set, otherwise the app and machine from
+// FLY_APP_NAME and FLY_MACHINE_ID, otherwise the hostname
+func EnvIDFromEnv() string {
+	if id := os.Getenv("FLY_ENV_ID"); id != "" {
+		return id
+	}
+	var parts []string
+	for _, name := range []string{"FLY_APP_NAME", "FLY_MACHINE_ID"} {
+		if v := os.Getenv(name); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) > 0 {
+		return strings.Join(parts, "/")
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// validateEnvID checks that a configured environment ID is usable as a single storage path segment
+func (cfg *ObjectStorageConfig) validateEnvID() error {
+	if cfg.EnvID == "" {
+		return nil
+	}
+	if strings.ContainsAny(cfg.EnvID, "/\\") || cfg.EnvID == "." || cfg.EnvID == ".." {
+		return fmt.Errorf("invalid env_id %q: must be a single path segment", cfg.EnvID)
+	}
+	return nil
+}
+
+// keyPrefix returns the object key prefix of the environment, without leading or trailing slashes.
+// rule: only a configured EnvID namespaces storage; an ID defaulted from the machine would strand
+// the environment's data when the machine is replaced
+func (cfg *ObjectStorageConfig) keyPrefix() string {
+	if prefix := strings.Trim(cfg.KeyPrefix, "/"); prefix != "" || cfg.EnvID == "" {
+		return prefix
+	}
+	return path.Join(envIDPrefix, cfg.EnvID)
+}
@@ -0,0 +1,294 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType identifies a kind of lifecycle event
+type EventType string
+
+const (
+	EventProcessStarted     EventType = "process_started"
+	EventProcessStopped     EventType = "process_stopped"
+	EventProcessExited      EventType = "process_exited"
+	EventProcessRestarted   EventType = "process_restarted"
+	EventCheckpointCreated  EventType = "checkpoint_created"
+	EventCheckpointRestored EventType = "checkpoint_restored"
+	EventConfigChanged      EventType = "config_changed"
+	EventLeaseAcquired      EventType = "lease_acquired"
+	EventLeaseReleased      EventType = "lease_released"
+	EventLeaseLost          EventType = "lease_lost"
+	EventFenced             EventType = "fenced"
+	EventMountRemounted     EventType = "mount_remounted"
+	EventMountCrashed       EventType = "mount_crashed"
+	EventMountStopped       EventType = "mount_stopped"
+	EventComponentRestarted EventType = "component_restarted"
+	EventSuspended          EventType = "suspended"
+	EventResumed            EventType = "resumed"
+	EventDraining           EventType = "draining"
+	EventPromoted           EventType = "promoted"
+	EventAutoRestartChanged EventType = "autorestart_changed"
+	// EventRestartPolicyChanged is recorded when the restart policy is changed at runtime
+	EventRestartPolicyChanged EventType = "restart_policy_changed"
+	// EventCommandChanged is recorded when the supervised command is replaced at runtime
+	EventCommandChanged EventType = "command_changed"
+	// EventTokenReloaded is recorded when a reload changed the controller token
+	EventTokenReloaded EventType = "token_reloaded"
+	// EventDataEvicted is recorded when an artifact was deleted to stay within the data quota
+	EventDataEvicted EventType = "data_evicted"
+	// EventOperationCancelled is recorded when an operator cancelled a long-running operation
+	EventOperationCancelled EventType = "operation_cancelled"
+	// EventClockJump is recorded when the wall clock was stepped while the lease was held
+	EventClockJump EventType = "clock_jump"
+	// EventReconcileRepaired is recorded when the reconciliation loop repaired a stack
+	EventReconcileRepaired EventType = "reconcile_repaired"
+	// EventReconcileFailed is recorded when a repair by the reconciliation loop failed
+	EventReconcileFailed EventType = "reconcile_failed"
+	// EventCheckpointInconsistent is recorded when a checkpoint restored under the "warn"
+	// checkpoint_consistency mode was not taken at one point across components
+	EventCheckpointInconsistent EventType = "checkpoint_inconsistent"
+	// EventMigrated is recorded when the environment moved to the storage of a new config
+	EventMigrated EventType = "migrated"
+	// EventMigrationFailed is recorded when a migration failed and the old config was set up again
+	EventMigrationFailed EventType = "migration_failed"
+	// EventReadyNotified is recorded when the readiness webhook was told the environment is ready
+	EventReadyNotified EventType = "ready_notified"
+	// EventReadyWebhookFailed is recorded when the readiness webhook failed on every attempt
+	EventReadyWebhookFailed EventType = "ready_webhook_failed"
+)
+
+// DefaultEventLogSize is the number of events retained when no size is given
+const DefaultEventLogSize = 1000
+
+// Event is a single entry in the event log
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Type    EventType         `json:"type"`
+	Source  string            `json:"source"`
+	Message string            `json:"message,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// EventLog is a bounded, in-memory, chronological log of lifecycle events.
+// A nil *EventLog discards all events.
+type EventLog struct {
+	mu          sync.Mutex
+	size        int
+	entries     []Event
+	subscribers map[chan Event]struct{}
+}
+
+// EventRecorder represents a component that records events to an event log
+type EventRecorder interface {
+	SetEventLog(events *EventLog)
+}
+
+// NewEventLog creates an event log retaining at most size entries
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = DefaultEventLogSize
+	}
+	return &EventLog{
+		size:        size,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Record appends an event and delivers it to live subscribers
+func (l *EventLog) Record(typ EventType, source, message string, fields map[string]string) {
+	if l == nil {
+		return
+	}
+	event := Event{
+		Time:    time.Now(),
+		Type:    typ,
+		Source:  source,
+		Message: message,
+		Fields:  fields,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, event)
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+	// rule: slow subscribers drop events rather than blocking the recorder
+	for ch := range l.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Recent returns up to n of the most recent events, oldest first. n <= 0 returns all retained events.
+func (l *EventLog) Recent(n int) []Event {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n <= 0 || n > len(l.entries) {
+		n = len(l.entries)
+	}
+	recent := make([]Event, n)
+	copy(recent, l.entries[len(l.entries)-n:])
+	return recent
+}
+
+// Subscribe returns a channel receiving new events and a function to cancel the subscription
+func (l *EventLog) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	if l == nil {
+		return ch, func() {}
+	}
+	l.mu.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.subscribers, ch)
+			l.mu.Unlock()
+		})
+	}
+}
+
+// ServeHTTP returns recent events as JSON, or streams live events as server-sent events
+// when the request accepts text/event-stream or sets follow=true
+func (l *EventLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+	if !follow && r.Header.Get("Accept") != "text/event-stream" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"events": l.Recent(limit)})
+		return
+	}
+
+	events, cancel := l.Subscribe()
+	defer cancel()
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	for _, event := range l.Recent(limit) {
+		sse.send(string(event.Type), event)
+	}
+	for {
+		select {
+		case event := <-events:
+			if err := sse.send(string(event.Type), event); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sseWriter writes server-sent events to a response
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newSSEWriter sets the event stream headers, returning false if the response cannot be flushed
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}, true
+}
+
+// comment writes an SSE comment line, used for keepalives
+func (s *sseWriter) comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// send writes a single named event with a JSON payload
+func (s *sseWriter) send(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// notifier broadcasts wake-ups to subscribers without blocking the notifying goroutine
+type notifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+// subscribe returns a channel signalled after each notify and a function to cancel the subscription
+func (n *notifier) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	if n.subs == nil {
+		n.subs = make(map[chan struct{}]struct{})
+	}
+	n.subs[ch] = struct{}{}
+	n.mu.Unlock()
+	return ch, func() {
+		n.mu.Lock()
+		delete(n.subs, ch)
+		n.mu.Unlock()
+	}
+}
+
+// notify signals all subscribers, coalescing with any pending signal
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// count returns the number of active subscribers
+func (n *notifier) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.subs)
+}
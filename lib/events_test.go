@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEventLogBounded(t *testing.T) {
+	events := NewEventLog(3)
+	for i := 0; i < 5; i++ {
+		events.Record(EventConfigChanged, "test", "", nil)
+	}
+	if got := len(events.Recent(0)); got != 3 {
+		t.Errorf("Expected 3 retained events, got %d", got)
+	}
+	if got := len(events.Recent(2)); got != 2 {
+		t.Errorf("Expected 2 recent events, got %d", got)
+	}
+}
+
+func TestCheckpointRecordsEvent(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(basePath, "juicefs", "checkpoints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+
+	body, _ := json.Marshal(map[string]string{"checkpoint_id": "cp-1"})
+	req := httptest.NewRequest("POST", "/checkpoint", bytes.NewReader(body))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/events", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w = httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var resp struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode events: %v", err)
+	}
+	found := false
+	for _, event := range resp.Events {
+		if event.Type == EventCheckpointCreated && event.Fields["checkpoint_id"] == "cp-1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a checkpoint_created event for cp-1, got %+v", resp.Events)
+	}
+}
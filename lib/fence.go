@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"context"
+	"time"
+)
+
+// fenceTimeout bounds stopping the write-capable components once the lease is lost
+const fenceTimeout = 30 * time.Second
+
+// Fenceable represents a component that writes to shared storage and must stop doing so
+// once this machine no longer holds the lease
+type Fenceable interface {
+	StackComponent
+	// Fence stops all writes to shared storage; the component stays stopped until it is set up again
+	Fence(ctx context.Context) error
+}
+
+// fence stops every enabled write-capable component after the lease was lost, so this machine
+// cannot keep writing alongside the new lease holder. Fencing lasts until the next setup.
+func (c *Control) fence(cause error) {
+	if c.fenced.Swap(true) {
+		return
+	}
+	logErrorf("Fencing write-capable components: %v", cause)
+
+	c.mu.RLock()
+	var stacks []string
+	if c.config != nil {
+		stacks = c.config.Stacks
+	}
+	c.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), fenceTimeout)
+	defer cancel()
+	available := c.getAvailableComponents()
+	for _, stack := range stacks {
+		f, ok := available[stack].(Fenceable)
+		if !ok {
+			continue
+		}
+		if err := f.Fence(ctx); err != nil {
+			logErrorf("Failed to fence %s: %v", stack, err)
+		}
+	}
+	c.events.Record(EventFenced, "control", cause.Error(), nil)
+	c.NotifyStatusChange()
+}
+
+// Fenced reports whether the write-capable components were stopped after the lease was lost
+func (c *Control) Fenced() bool {
+	return c.fenced.Load()
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// DirMode is the permission mode of the directories created for state, databases and mounts
+var DirMode os.FileMode = 0755
+
+// FileMode is the permission mode of state files that hold no secrets
+var FileMode os.FileMode = 0644
+
+// ConfigFileMode is the permission mode of the config file, which holds storage credentials
+var ConfigFileMode os.FileMode = 0600
+
+// parseFileMode parses an octal permission mode such as "0750"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid permission mode %q (want octal, e.g. 0750)", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// SetFileModesFromEnv overrides the permission modes from FLY_ENV_DIR_MODE, FLY_ENV_FILE_MODE
+// and FLY_ENV_CONFIG_FILE_MODE when set. It must be called before the control interface is created.
+func SetFileModesFromEnv() error {
+	for name, mode := range map[string]*os.FileMode{
+		"FLY_ENV_DIR_MODE":         &DirMode,
+		"FLY_ENV_FILE_MODE":        &FileMode,
+		"FLY_ENV_CONFIG_FILE_MODE": &ConfigFileMode,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseFileMode(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*mode = parsed
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// HealthChecker represents a component that can report whether it is still working at runtime
+type HealthChecker interface {
+	StackComponent
+	// Healthy returns an error describing why the component is not working, or nil
+	Healthy(ctx context.Context) error
+}
+
+// ComponentHealth describes the runtime health of one enabled stack component
+type ComponentHealth struct {
+	Healthy  bool   `json:"healthy"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// isCritical reports whether a failure of the named stack fails the whole environment.
+// Stacks are critical unless explicitly configured otherwise.
+func (cfg *SystemConfig) isCritical(stack string) bool {
+	critical, ok := cfg.Critical[stack]
+	return !ok || critical
+}
+
+// componentHealth returns the health of every enabled stack; the caller must hold c.mu
+func (c *Control) componentHealth(ctx context.Context) map[string]ComponentHealth {
+	if c.config == nil {
+		return nil
+	}
+
+	available := c.getAvailableComponents()
+	health := make(map[string]ComponentHealth, len(c.config.Stacks))
+	for _, stack := range c.config.Stacks {
+		h := ComponentHealth{Healthy: true, Critical: c.config.isCritical(stack)}
+		if err := c.setupErrors[stack]; err != nil {
+			h.Healthy = false
+			h.Error = err.Error()
+		} else if hc, ok := available[stack].(HealthChecker); ok {
+			if err := hc.Healthy(ctx); err != nil {
+				h.Healthy = false
+				h.Error = err.Error()
+			}
+		}
+		health[stack] = h
+	}
+	return health
+}
+
+// Health reports whether the environment is healthy, along with the health of each enabled stack.
+// The environment is unhealthy only if a critical stack is unhealthy.
+func (c *Control) Health(ctx context.Context) (bool, map[string]ComponentHealth) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	components := c.componentHealth(ctx)
+	// rule: a standby is never ready to serve; its stacks only follow the active machine
+	if c.Fenced() || c.Standby() {
+		return false, components
+	}
+	for _, h := range components {
+		if !h.Healthy && h.Critical {
+			return false, components
+		}
+	}
+	return true, components
+}
+
+// handleHealthz reports overall health, failing when a critical stack is unhealthy or while draining
+func (c *Control) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	healthy, components := c.Health(r.Context())
+	draining := c.Draining()
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy || draining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"healthy":    healthy,
+		"draining":   draining,
+		"standby":    c.Standby(),
+		"components": components,
+	})
+}
+
+// HealthProvider is an interface for checking whether the critical stacks are healthy
+type HealthProvider interface {
+	Health(ctx context.Context) (bool, map[string]ComponentHealth)
+}
+
+// ReadinessGate is a StatusProvider that reports the upstream as running only once the process
+// is running and every critical stack is healthy, so the proxy holds traffic with a 503 until
+// the whole environment is ready (e.g. the JuiceFS mount the app reads from is up).
+type ReadinessGate struct {
+	process StatusProvider
+	health  HealthProvider
+}
+
+// NewReadinessGate creates a readiness gate over the given process and stack health
+func NewReadinessGate(process StatusProvider, health HealthProvider) *ReadinessGate {
+	return &ReadinessGate{process: process, health: health}
+}
+
+// IsRunning reports whether the process is running and all critical stacks are healthy
+func (g *ReadinessGate) IsRunning() bool {
+	if !g.process.IsRunning() {
+		return false
+	}
+	healthy, _ := g.health.Health(context.Background())
+	return healthy
+}
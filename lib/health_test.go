@@ -0,0 +1,277 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNonCriticalComponentFailure(t *testing.T) {
+	// A JuiceFS component whose mount never started is unhealthy
+	juicefs := NewJuiceFSComponent()
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{
+		Stacks:   []string{"juicefs"},
+		Critical: map[string]bool{"juicefs": false},
+	}
+	control.setupRoutes()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/healthz")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected healthz to stay up with a non-critical failure, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var status SystemStatus
+	if err := json.NewDecoder(get("/status").Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	h, ok := status.Health["juicefs"]
+	if !ok || h.Healthy || h.Critical || h.Error == "" {
+		t.Errorf("Expected juicefs to be reported unhealthy and non-critical, got %+v", status.Health)
+	}
+
+	// The same failure in a critical component fails the environment
+	control.config.Critical = nil
+	if w := get("/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected healthz to fail with a critical failure, got %d", w.Code)
+	}
+}
+
+func TestReadinessGateHoldsTrafficUntilStacksReady(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// The process is up, but the JuiceFS mount never became ready
+	juicefs := NewJuiceFSComponent()
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+
+	proxy, err := New(backend.URL[7:], NewReadinessGate(&mockStatusProvider{running: true}, control))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	get := func() int {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while a critical stack is not ready, got %d", code)
+	}
+
+	// A non-critical stack does not hold traffic
+	control.config.Critical = map[string]bool{"juicefs": false}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("Expected traffic once only non-critical stacks are not ready, got %d", code)
+	}
+
+	// Nor does readiness of the stacks make up for a stopped process
+	proxy, _ = New(backend.URL[7:], NewReadinessGate(&mockStatusProvider{running: false}, control))
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the process is not running, got %d", code)
+	}
+}
+
+func TestHealthPathsOnAppHost(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	control.config = &SystemConfig{}
+	control.setupRoutes()
+	app := control.AppHostHealth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app " + r.URL.Path))
+	}))
+	get := func(h http.Handler, host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// By default the app's own /healthz and /metrics are proxied, not intercepted
+	for _, path := range []string{"/healthz", "/metrics"} {
+		if w := get(app, "myapp.fly.dev", path); w.Body.String() != "app "+path {
+			t.Errorf("Expected %s on the app host to be proxied, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	if w := get(control, "fly-app-controller", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected /healthz on the admin host, got %d", w.Code)
+	}
+
+	// Moved endpoints answer on their new paths only, and on the app host when asked to
+	if err := control.SetHealthEndpoints(HealthEndpoints{HealthPath: "/_fly/health", MetricsPath: "/_fly/metrics", OnAppHost: true}); err != nil {
+		t.Fatalf("SetHealthEndpoints failed: %v", err)
+	}
+	// The old path falls through to the status page
+	var old map[string]interface{}
+	json.Unmarshal(get(control, "fly-app-controller", "/healthz").Body.Bytes(), &old)
+	if _, ok := old["healthy"]; ok {
+		t.Error("Expected the old health path to stop answering on the admin host")
+	}
+	if w := get(control, "fly-app-controller", "/_fly/health"); w.Code != http.StatusOK {
+		t.Errorf("Expected the moved health endpoint on the admin host, got %d", w.Code)
+	}
+	if w := get(app, "myapp.fly.dev", "/healthz"); w.Body.String() != "app /healthz" {
+		t.Errorf("Expected the app's /healthz to be proxied, got %s", w.Body.String())
+	}
+	var health map[string]interface{}
+	w := get(app, "myapp.fly.dev", "/_fly/health")
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil || health["healthy"] != true {
+		t.Errorf("Expected the health endpoint on the app host, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := get(app, "myapp.fly.dev", "/_fly/metrics"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "fly_proxy_responses_total") {
+		t.Errorf("Expected the metrics endpoint on the app host, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Paths of other admin routes are rejected
+	if err := control.SetHealthEndpoints(HealthEndpoints{HealthPath: "/status"}); err == nil {
+		t.Error("Expected a health path colliding with /status to be rejected")
+	}
+	if w := get(control, "fly-app-controller", "/_fly/health"); w.Code != http.StatusOK {
+		t.Errorf("Expected a rejected change to keep the endpoints, got %d", w.Code)
+	}
+}
+
+func TestMetricsHandlerOnDedicatedListener(t *testing.T) {
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	control.config = &SystemConfig{}
+	control.setupRoutes()
+	server := httptest.NewServer(control.MetricsHandler())
+	defer server.Close()
+
+	// Metrics need no token on the dedicated listener
+	resp, err := http.Get(server.URL + DefaultMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "fly_proxy_responses_total") {
+		t.Fatalf("Expected metrics on the dedicated listener, got %d: %s", resp.StatusCode, body)
+	}
+
+	// The control API is not reachable there, even with the token and the admin host
+	for _, path := range []string{"/status", "/debug", "/checkpoint", DefaultHealthPath, "/"} {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404 on the metrics listener, got %d", path, resp.StatusCode)
+		}
+	}
+	resp, err = http.Post(server.URL+DefaultMetricsPath, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to the metrics endpoint to be refused, got %d", resp.StatusCode)
+	}
+}
+
+// startingComponent is a component that finishes starting once ready is set
+type startingComponent struct {
+	ready atomic.Bool
+}
+
+func (s *startingComponent) Name() string {
+	return "starting"
+}
+
+func (s *startingComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	return nil
+}
+
+func (s *startingComponent) Cleanup(ctx context.Context) error {
+	return nil
+}
+
+func (s *startingComponent) Status(ctx context.Context) map[string]interface{} {
+	return nil
+}
+
+func (s *startingComponent) Ready() bool {
+	return s.ready.Load()
+}
+
+func TestReadyWebhookCalledOnceReady(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	var received []ReadyNotification
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// The first call fails, so it is retried
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var n ReadyNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("Failed to decode webhook body: %v", err)
+		}
+		received = append(received, n)
+	}))
+	defer receiver.Close()
+	notified := func() []ReadyNotification {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]ReadyNotification(nil), received...)
+	}
+
+	comp := &startingComponent{}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, comp)
+	control.config = &SystemConfig{Stacks: []string{"starting"}, Storage: ObjectStorageConfig{EnvID: "env-1"}}
+	control.setupComplete.Store(true)
+	if err := control.SetReadyWebhook(ReadyWebhookConfig{URL: receiver.URL, Retries: 2, Backoff: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Failed to set the webhook: %v", err)
+	}
+	defer control.SetReadyWebhook(ReadyWebhookConfig{})
+
+	// Nothing is sent while a stack is still starting
+	time.Sleep(100 * time.Millisecond)
+	if got := notified(); len(got) != 0 {
+		t.Fatalf("Expected no webhook before the stack is ready, got %+v", got)
+	}
+
+	comp.ready.Store(true)
+	control.NotifyStatusChange()
+	var got []ReadyNotification
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(got) == 0; time.Sleep(10 * time.Millisecond) {
+		got = notified()
+	}
+	if len(got) != 1 || got[0].EnvID != "env-1" || !got[0].Status.Configured {
+		t.Fatalf("Expected one notification with the status and environment ID, got %+v", got)
+	}
+
+	// Staying ready does not call it again
+	control.NotifyStatusChange()
+	time.Sleep(100 * time.Millisecond)
+	if got := notified(); len(got) != 1 {
+		t.Errorf("Expected a single notification while ready, got %d", len(got))
+	}
+}
@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Default paths of the health and metrics endpoints
+const (
+	DefaultHealthPath  = "/healthz"
+	DefaultMetricsPath = "/metrics"
+)
+
+// HealthEndpoints configures where the health and metrics endpoints are served. By default they
+// are only served on the admin host, so the app's own routes with the same paths are never shadowed.
+type HealthEndpoints struct {
+	// HealthPath is the path of the health endpoint; empty uses DefaultHealthPath
+	HealthPath string
+	// MetricsPath is the path of the metrics endpoint; empty uses DefaultMetricsPath
+	MetricsPath string
+	// OnAppHost also answers both paths for requests to the app's hosts, without the controller
+	// token, for platforms that can only send health checks there. Requests for those paths then
+	// never reach the app.
+	OnAppHost bool
+}
+
+// paths returns the health and metrics paths with the defaults applied
+func (e HealthEndpoints) paths() (string, string) {
+	health, metrics := e.HealthPath, e.MetricsPath
+	if health == "" {
+		health = DefaultHealthPath
+	}
+	if metrics == "" {
+		metrics = DefaultMetricsPath
+	}
+	return health, metrics
+}
+
+// Validate checks the endpoint paths
+func (e HealthEndpoints) Validate() error {
+	health, metrics := e.paths()
+	for _, path := range []string{health, metrics} {
+		if !strings.HasPrefix(path, "/") || path == "/" || strings.ContainsAny(path, " {}") {
+			return fmt.Errorf("endpoint path %q must be an absolute path other than /", path)
+		}
+	}
+	if health == metrics {
+		return fmt.Errorf("health and metrics endpoints must have different paths, both are %q", health)
+	}
+	return nil
+}
+
+// SetHealthEndpoints moves the health and metrics endpoints and chooses whether the app's hosts
+// answer them too. It must be called before the control interface serves requests.
+func (c *Control) SetHealthEndpoints(e HealthEndpoints) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.healthEndpoints
+	c.healthEndpoints = e
+	// rule: a path another admin route already uses is rejected rather than panicking the mux
+	mux, err := c.tryRoutes()
+	if err != nil {
+		c.healthEndpoints = previous
+		return err
+	}
+	// The admin routes are registered again so the old paths stop answering
+	if c.config == nil {
+		mux = http.NewServeMux()
+		c.registerBaseRoutes(mux)
+	}
+	c.mux = mux
+	return nil
+}
+
+// tryRoutes builds the routes of a configured system, returning an error if two of them conflict;
+// the caller must hold c.mu
+func (c *Control) tryRoutes() (mux *http.ServeMux, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("endpoint path conflicts with the control API: %v", r)
+		}
+	}()
+	return c.routes(), nil
+}
+
+// AppHostHealth wraps the proxy handler so the health and metrics paths are answered by the
+// control interface when HealthEndpoints.OnAppHost is set; otherwise every request is proxied,
+// including ones for paths that match the admin endpoints.
+func (c *Control) AppHostHealth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		e := c.healthEndpoints
+		c.mu.RUnlock()
+		if e.OnAppHost {
+			health, metrics := e.paths()
+			switch r.URL.Path {
+			case health:
+				c.handleHealthz(w, r)
+				return
+			case metrics:
+				c.handleMetrics(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MetricsHandler serves only the metrics endpoint, without the controller token, for a dedicated
+// metrics listener that scrapers reach without access to the control API. Every other path is
+// answered with 404, so nothing but the metrics, which hold no secrets, is exposed.
+func (c *Control) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		_, metrics := c.healthEndpoints.paths()
+		c.mu.RUnlock()
+		if r.URL.Path != metrics {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.handleMetrics(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DefaultHistorySize is the number of lifecycle events a supervisor keeps when no size is given
+const DefaultHistorySize = 100
+
+// LifecycleTransition identifies a change of state of the supervised process
+type LifecycleTransition string
+
+const (
+	TransitionStarted   LifecycleTransition = "started"   // started by StartProcess
+	TransitionExited    LifecycleTransition = "exited"    // exited on its own
+	TransitionRestarted LifecycleTransition = "restarted" // started again after exiting on its own
+	TransitionStopped   LifecycleTransition = "stopped"   // exited after StopProcess
+)
+
+// LifecycleExit describes how the process exited, for exited and stopped transitions
+type LifecycleExit struct {
+	// ExitCode is the process exit code, or -1 if it was terminated by a signal
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LifecycleEvent is one state transition of the supervised process
+type LifecycleEvent struct {
+	Time       time.Time           `json:"time"`
+	Transition LifecycleTransition `json:"transition"`
+	PID        int                 `json:"pid"`
+	Exit       *LifecycleExit      `json:"exit,omitempty"`
+}
+
+// recordLifecycle appends a transition to the history, dropping the oldest beyond HistorySize
+func (s *Supervisor) recordLifecycle(transition LifecycleTransition, pid int, exit *ExitInfo) {
+	event := LifecycleEvent{Time: time.Now().UTC(), Transition: transition, PID: pid}
+	if exit != nil {
+		event.Exit = &LifecycleExit{ExitCode: exit.ExitCode}
+		if exit.Err != nil {
+			event.Exit.Error = exit.Err.Error()
+		}
+	}
+
+	s.history.Lock()
+	defer s.history.Unlock()
+	s.history.events = append(s.history.events, event)
+	if over := len(s.history.events) - s.config.HistorySize; over > 0 {
+		s.history.events = append(s.history.events[:0:0], s.history.events[over:]...)
+	}
+}
+
+// History returns the recent lifecycle transitions of the supervised process, oldest first
+func (s *Supervisor) History() []LifecycleEvent {
+	s.history.Lock()
+	defer s.history.Unlock()
+	history := make([]LifecycleEvent, len(s.history.events))
+	copy(history, s.history.events)
+	return history
+}
+
+// handleHistory reports the lifecycle history of the supervised process
+func (c *Control) handleHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if c.supervisor == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errNoSupervisor.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]LifecycleEvent{"events": c.supervisor.History()})
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// normalizeHost lowercases a Host value and strips its port and any trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// validateAllowedHosts checks the hosts the proxy accepts
+func (cfg *SystemConfig) validateAllowedHosts() error {
+	for _, host := range cfg.AllowedHosts {
+		if normalizeHost(host) == "" || strings.ContainsAny(host, "/ ") {
+			return fmt.Errorf("allowed_hosts entry %q must be a host name", host)
+		}
+	}
+	return nil
+}
+
+// HostAllowed reports whether the proxy serves requests for host. Every host is allowed unless the
+// config lists allowed_hosts.
+func (c *Control) HostAllowed(host string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.config == nil || len(c.config.AllowedHosts) == 0 {
+		return true
+	}
+	host = normalizeHost(host)
+	return slices.ContainsFunc(c.config.AllowedHosts, func(allowed string) bool {
+		return normalizeHost(allowed) == host
+	})
+}
+
+// HostFilter wraps the proxy handler so requests for a Host outside allowed_hosts are rejected
+// with 421 Misdirected Request instead of reaching the backend
+func (c *Control) HostFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.HostAllowed(r.Host) {
+			logDebugf("Rejecting request for host %q not in allowed_hosts", r.Host)
+			http.Error(w, "Misdirected request", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
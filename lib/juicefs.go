@@ -1,19 +1,249 @@
 package lib
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// juicefsQuotaCheckInterval is how often the active directory's usage is measured against its quota
+const juicefsQuotaCheckInterval = time.Minute
+
+// defaultMountProbeInterval is how often the mountpoint is checked for staleness when not configured
+const defaultMountProbeInterval = 10 * time.Second
+
+// defaultMinFreeSpaceMiB is the free space env_dir must have before setup when not configured
+const defaultMinFreeSpaceMiB = 1024
+
+// juicefsVersionTimeout bounds the `juicefs version` pre-flight check
+const juicefsVersionTimeout = 10 * time.Second
+
+// defaultFormatTimeout bounds juicefs format when not configured; format is normally fast,
+// so a hang usually means object storage is unreachable
+const defaultFormatTimeout = 30 * time.Second
+
+// defaultMountRetries is how many times a failed mount startup is retried when not configured
+const defaultMountRetries = 3
+
+// defaultMountRetryBackoff is the wait before the first mount startup retry when not configured
+const defaultMountRetryBackoff = time.Second
+
+// JuiceFSConfig holds settings for the JuiceFS component
+type JuiceFSConfig struct {
+	// ActiveQuotaGiB limits the size of the active directory in GiB. Zero disables the quota.
+	ActiveQuotaGiB int64 `json:"active_quota_gib,omitempty"`
+	// ProbeIntervalSeconds is how often the mountpoint is checked for staleness.
+	// Zero uses the default of 10 seconds; a negative value disables the probe.
+	ProbeIntervalSeconds int `json:"probe_interval_seconds,omitempty"`
+	// FormatTimeoutSeconds bounds the juicefs format step. Zero uses the default of 30 seconds.
+	FormatTimeoutSeconds int `json:"format_timeout_seconds,omitempty"`
+	// MinFreeSpaceMiB is the free space, in MiB, env_dir must have for the metadata database and
+	// cache before setup starts. Zero uses the default of 1024 MiB; a negative value disables the check.
+	MinFreeSpaceMiB int64 `json:"min_free_space_mib,omitempty"`
+	// Binary is the path or name of the juicefs binary, for pinning a version or running from
+	// outside PATH. Empty uses "juicefs" from PATH.
+	Binary string `json:"binary,omitempty"`
+	// CheckpointDir stores checkpoints outside the JuiceFS mount, e.g. on local disk for faster
+	// checkpoints. Empty keeps them in the mount, next to the active directory.
+	CheckpointDir string `json:"checkpoint_dir,omitempty"`
+	// Metadata sets how often the metadata database is replicated, apart from the db stack.
+	// Metadata changes on every file operation, so longer intervals can cut storage requests.
+	Metadata ReplicationIntervals `json:"metadata,omitempty"`
+	// DiscardOnRestore drops the active directory when a checkpoint is restored. By default it is
+	// kept as a pre-restore-<timestamp> checkpoint, so a mistaken restore can be undone.
+	DiscardOnRestore bool `json:"discard_on_restore,omitempty"`
+	// MountRetries is how many times a failed format and mount during setup is retried. Zero uses
+	// the default of 3; a negative value disables retries.
+	MountRetries int `json:"mount_retries,omitempty"`
+	// MountRetryBackoffMillis is the wait before the first mount retry, doubling after each
+	// attempt. Zero uses the default of 1000.
+	MountRetryBackoffMillis int `json:"mount_retry_backoff_ms,omitempty"`
+	// MountLogLines is how many recent lines of mount output are kept for the component status.
+	// Zero uses the default of 20; a negative value keeps none.
+	MountLogLines int `json:"mount_log_lines,omitempty"`
+	// FsyncCheckpoints syncs the directories a checkpoint or restore renamed entries in before it
+	// reports success, so a crash right afterwards cannot undo it. Off by default since each sync
+	// waits for the disk.
+	FsyncCheckpoints bool `json:"fsync_checkpoints,omitempty"`
+	// CacheSizeMiB is the size of the mount's local read cache in MiB. Zero keeps the JuiceFS default.
+	CacheSizeMiB int64 `json:"cache_size_mib,omitempty"`
+	// CacheDir is the absolute directory of the mount's local read cache. Empty keeps the JuiceFS default.
+	CacheDir string `json:"cache_dir,omitempty"`
+	// MountDir is where the filesystem is mounted, absolute or relative to env_dir, so the app can
+	// find its data where it expects. Empty uses <env_dir>/juicefs.
+	MountDir string `json:"mount_dir,omitempty"`
+	// DBDir is the directory of the metadata database, absolute or relative to env_dir. It must not
+	// overlap the mount point. Empty uses <env_dir>/db.
+	DBDir string `json:"db_dir,omitempty"`
+}
+
+// binary returns the configured juicefs binary
+func (cfg JuiceFSConfig) binary() string {
+	if cfg.Binary == "" {
+		return "juicefs"
+	}
+	return cfg.Binary
+}
+
+// minFreeSpace returns the required free space in bytes, or 0 if the check is disabled
+func (cfg JuiceFSConfig) minFreeSpace() uint64 {
+	switch {
+	case cfg.MinFreeSpaceMiB < 0:
+		return 0
+	case cfg.MinFreeSpaceMiB == 0:
+		return defaultMinFreeSpaceMiB << 20
+	default:
+		return uint64(cfg.MinFreeSpaceMiB) << 20
+	}
+}
+
+// formatTimeout returns the configured format timeout
+func (cfg JuiceFSConfig) formatTimeout() time.Duration {
+	if cfg.FormatTimeoutSeconds <= 0 {
+		return defaultFormatTimeout
+	}
+	return time.Duration(cfg.FormatTimeoutSeconds) * time.Second
+}
+
+// mountPath returns the mount point for the env_dir base
+func (cfg JuiceFSConfig) mountPath(base string) string {
+	return envPath(base, cfg.MountDir, "juicefs")
+}
+
+// dbDirPath returns the metadata database directory for the env_dir base
+func (cfg JuiceFSConfig) dbDirPath(base string) string {
+	return envPath(base, cfg.DBDir, "db")
+}
+
+// envPath resolves a directory setting, absolute or relative to the env_dir base, using def if it is empty
+func envPath(base, dir, def string) string {
+	if dir == "" {
+		dir = def
+	}
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(base, dir)
+}
+
+// pathsOverlap reports whether a and b are the same directory or one contains the other
+func pathsOverlap(a, b string) bool {
+	rel, err := filepath.Rel(a, b)
+	if err != nil {
+		return false
+	}
+	if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		return true
+	}
+	rel, err = filepath.Rel(b, a)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// validateLayout checks that the mount point, the metadata database directory and the checkpoint
+// directory, resolved against the env_dir base, don't overlap. Unless base is known, a relative
+// directory is only compared against other relative ones.
+func (cfg JuiceFSConfig) validateLayout(base string) error {
+	mount, db := cfg.mountPath(base), cfg.dbDirPath(base)
+	comparable := func(a, b string) bool { return filepath.IsAbs(a) == filepath.IsAbs(b) }
+	// rule: the database must stay off the mount, which needs it to start, and out of the checkpoints the mount holds
+	if comparable(mount, db) && pathsOverlap(mount, db) {
+		return fmt.Errorf("juicefs.mount_dir %s and juicefs.db_dir %s must not overlap", mount, db)
+	}
+	if cfg.CheckpointDir != "" && comparable(cfg.CheckpointDir, db) && pathsOverlap(cfg.CheckpointDir, db) {
+		return fmt.Errorf("juicefs.checkpoint_dir %s and juicefs.db_dir %s must not overlap", cfg.CheckpointDir, db)
+	}
+	return nil
+}
+
+// validate checks the JuiceFS settings
+func (cfg JuiceFSConfig) validate() error {
+	if cfg.MountRetryBackoffMillis < 0 {
+		return fmt.Errorf("juicefs.mount_retry_backoff_ms must not be negative")
+	}
+	if cfg.CacheSizeMiB < 0 {
+		return fmt.Errorf("juicefs.cache_size_mib must not be negative")
+	}
+	if cfg.CacheDir != "" && !filepath.IsAbs(cfg.CacheDir) {
+		return fmt.Errorf("juicefs.cache_dir must be an absolute path")
+	}
+	if err := cfg.validateLayout(""); err != nil {
+		return err
+	}
+	return cfg.Metadata.validate("juicefs.metadata")
+}
+
+// cacheFlags returns the juicefs mount flags for the configured cache settings
+func (cfg JuiceFSConfig) cacheFlags() []string {
+	var flags []string
+	if cfg.CacheSizeMiB > 0 {
+		flags = append(flags, "--cache-size", strconv.FormatInt(cfg.CacheSizeMiB, 10))
+	}
+	if cfg.CacheDir != "" {
+		flags = append(flags, "--cache-dir", cfg.CacheDir)
+	}
+	return flags
+}
+
+// mountLogLines returns how many recent lines of mount output are kept
+func (cfg JuiceFSConfig) mountLogLines() int {
+	switch {
+	case cfg.MountLogLines < 0:
+		return 0
+	case cfg.MountLogLines == 0:
+		return defaultMountLogLines
+	}
+	return cfg.MountLogLines
+}
+
+// mountRetries returns how many times a failed mount startup is retried
+func (cfg JuiceFSConfig) mountRetries() int {
+	switch {
+	case cfg.MountRetries < 0:
+		return 0
+	case cfg.MountRetries > 0:
+		return cfg.MountRetries
+	}
+	return defaultMountRetries
+}
+
+// mountRetryBackoff returns the wait before the first mount startup retry
+func (cfg JuiceFSConfig) mountRetryBackoff() time.Duration {
+	if cfg.MountRetryBackoffMillis > 0 {
+		return time.Duration(cfg.MountRetryBackoffMillis) * time.Millisecond
+	}
+	return defaultMountRetryBackoff
+}
+
+// probeInterval returns the configured mount probe interval, or 0 if probing is disabled
+func (cfg JuiceFSConfig) probeInterval() time.Duration {
+	switch {
+	case cfg.ProbeIntervalSeconds < 0:
+		return 0
+	case cfg.ProbeIntervalSeconds == 0:
+		return defaultMountProbeInterval
+	default:
+		return time.Duration(cfg.ProbeIntervalSeconds) * time.Second
+	}
+}
+
+// newMetadataDB returns the manager replicating the metadata database at dbPath
+func (j *JuiceFSComponent) newMetadataDB(cfg *ObjectStorageConfig, dbPath string) *DBManager {
+	dm := NewDBManager(cfg, filepath.Dir(dbPath))
+	dm.DBPath = dbPath
+	dm.Intervals = j.settings.Metadata
+	return dm
+}
+
 // JuiceFSComponent implements StackComponent and CheckpointableComponent for JuiceFS file system management
 type JuiceFSComponent struct {
 	config            *ObjectStorageConfig
@@ -24,7 +254,27 @@ type JuiceFSComponent struct {
 	isReady           bool
 	shutdownRequested bool
 	mu                sync.RWMutex // protect isReady, mountCmd, and shutdownRequested access
-	stderrReader      io.ReadCloser
+	mountLog          *mountLog    // output of the current mount process
+	lastExit          *mountExit   // how the mount process last exited, nil if it never has
+	crashes           int          // unexpected exits of the mount process since setup
+	juicefsPath       string
+	version           string // output of `juicefs version`, recorded by the pre-flight check
+	dbPath            string
+	mountDir          string
+	settings          JuiceFSConfig
+	quotaUsed         int64         // bytes used in the active directory at the last check
+	quotaStop         chan struct{} // closed to stop the quota monitor
+	probeStop         chan struct{} // closed to stop the mount prober
+	events            *EventLog
+	created           map[string]bool // IDs of the existing checkpoints this component created
+	// statMount and remount are replaceable in tests to simulate a stale mount
+	statMount func(name string) (os.FileInfo, error)
+	remount   func(ctx context.Context) error
+	// freeSpace is replaceable in tests to simulate a full disk
+	freeSpace func(dir string) (uint64, error)
+	// activeOnMount is replaceable in tests, which have no real mount to create the active directory on
+	activeOnMount func(activeDir, mountDir string) error
+	activeReady   bool // the active directory exists on the mount, so the app may start
 }
 
 // NewJuiceFSComponent creates a new JuiceFS component
@@ -32,100 +282,364 @@ func NewJuiceFSComponent() *JuiceFSComponent {
 	return &JuiceFSComponent{}
 }
 
+// createWriteProbe creates the file used to check env_dir is writable, replaceable in tests to
+// simulate a read-only filesystem (which root cannot emulate with permission bits)
+var createWriteProbe = os.CreateTemp
+
+// envDirNotWritable describes why env_dir cannot be written, naming read-only filesystems and
+// permission problems explicitly since the raw errno is easy to misread
+func envDirNotWritable(dir string, err error) error {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Errorf("environment directory %s is not writable: it is on a read-only filesystem; point env_dir at a writable volume: %w", dir, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("environment directory %s is not writable: permission denied: %w", dir, err)
+	}
+	return fmt.Errorf("environment directory %s is not writable: %w", dir, err)
+}
+
+// resolveEnvDir validates EnvDir and returns it as an absolute path to a writable directory,
+// creating the directory if needed
+func (cfg *ObjectStorageConfig) resolveEnvDir() (string, error) {
+	if strings.TrimSpace(cfg.EnvDir) == "" {
+		return "", fmt.Errorf("env_dir must be set to the directory holding the JuiceFS data")
+	}
+	dir, err := filepath.Abs(cfg.EnvDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve env_dir %q: %w", cfg.EnvDir, err)
+	}
+	if dir != filepath.Clean(cfg.EnvDir) {
+		logInfof("Resolved env_dir %q to %s", cfg.EnvDir, dir)
+	}
+
+	// rule: writability is probed before anything else touches env_dir, so a read-only volume
+	// fails setup with one clear error instead of an obscure failure inside juicefs format
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		if errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission) {
+			return "", envDirNotWritable(dir, err)
+		}
+		return "", fmt.Errorf("env_dir %s cannot be created: %w", dir, err)
+	}
+	probe, err := createWriteProbe(dir, ".write-check-*")
+	if err != nil {
+		return "", envDirNotWritable(dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return dir, nil
+}
+
+// diskFreeSpace returns the bytes available to unprivileged users on the filesystem holding dir
+func diskFreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// checkFreeSpace returns an error if dir has less free space than the configured minimum
+func (j *JuiceFSComponent) checkFreeSpace(dir string) error {
+	j.mu.RLock()
+	required := j.settings.minFreeSpace()
+	j.mu.RUnlock()
+	if required == 0 {
+		return nil
+	}
+
+	freeSpace := j.freeSpace
+	if freeSpace == nil {
+		freeSpace = diskFreeSpace
+	}
+	available, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free space in env_dir %s: %w", dir, err)
+	}
+	if available < required {
+		return fmt.Errorf("insufficient disk space in env_dir %s: %d MiB available, %d MiB required",
+			dir, available>>20, required>>20)
+	}
+	return nil
+}
+
+// checkJuiceFSBinary confirms the JuiceFS binary exists and runs, returning its resolved path and version
+func checkJuiceFSBinary(ctx context.Context, juicefsPath string) (string, string, error) {
+	resolved, err := exec.LookPath(juicefsPath)
+	if err != nil {
+		return "", "", fmt.Errorf("juicefs binary not found: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, juicefsVersionTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, resolved, "version").CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("juicefs binary %s is not runnable: %w\nOutput: %s", resolved, err, string(output))
+	}
+	return resolved, strings.TrimSpace(string(output)), nil
+}
+
+// Name returns the stack name of the JuiceFS component
+func (j *JuiceFSComponent) Name() string {
+	return "juicefs"
+}
+
+// Configure sets the JuiceFS settings. It must be called before Setup.
+func (j *JuiceFSComponent) Configure(settings JuiceFSConfig) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.settings = settings
+}
+
+// SetEventLog sets the event log that remount events are recorded to
+func (j *JuiceFSComponent) SetEventLog(events *EventLog) {
+	j.events = events
+}
+
 // SetMountContext sets the context to use for the mount process
 func (j *JuiceFSComponent) SetMountContext(ctx context.Context) {
 	// The supervisor handles the mount process, so no need to set mountCtx
 }
 
 // Setup initializes the JuiceFS component with the given config
-func (j *JuiceFSComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+func (j *JuiceFSComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) (err error) {
 	j.config = cfg
+	j.mu.Lock()
+	j.shutdownRequested = false
+	j.lastExit = nil
+	j.crashes = 0
+	j.mu.Unlock()
 
-	// Convert base path to absolute path
-	basePath, err := filepath.Abs(cfg.EnvDir)
+	// rule: an unset env_dir would otherwise resolve to the working directory and mount JuiceFS there
+	basePath, err := cfg.resolveEnvDir()
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for base directory: %w", err)
+		return err
 	}
 	j.basePath = basePath
+	j.mu.RLock()
+	settings := j.settings
+	j.mu.RUnlock()
+	if err := settings.validateLayout(basePath); err != nil {
+		return err
+	}
+
+	// rule: a setup failing part way stops the mount and replication it started, so none outlive it
+	defer func() {
+		if err != nil {
+			j.rollbackSetup(context.WithoutCancel(ctx))
+		}
+	}()
+
+	// rule: check disk space before formatting so a full disk fails early with a clear error
+	if err := j.checkFreeSpace(basePath); err != nil {
+		return err
+	}
+
+	juicefsPath, version, err := checkJuiceFSBinary(ctx, juicefsPath)
+	if err != nil {
+		return err
+	}
+	logInfof("Using %s (%s)", version, juicefsPath)
+	j.mu.Lock()
+	j.version = version
+	j.mu.Unlock()
 
 	// Create mount directory
 	mountDirStart := time.Now()
-	mountDir := filepath.Join(j.basePath, "juicefs")
-	if err := os.MkdirAll(mountDir, 0755); err != nil {
+	mountDir := settings.mountPath(basePath)
+	if err := os.MkdirAll(mountDir, DirMode); err != nil {
 		return fmt.Errorf("failed to create mount directory: %w", err)
 	}
-	log.Printf("Mount directory setup took %v", time.Since(mountDirStart))
+	logDebugf("Mount directory setup took %v", time.Since(mountDirStart))
 
 	// Create db directory - separate from mount
 	dbDirStart := time.Now()
-	dbDir := filepath.Join(j.basePath, "db")
-	if err := os.MkdirAll(dbDir, 0755); err != nil {
+	dbDir := settings.dbDirPath(basePath)
+	if err := os.MkdirAll(dbDir, DirMode); err != nil {
 		return fmt.Errorf("failed to create db directory: %w", err)
 	}
-	log.Printf("DB directory setup took %v", time.Since(dbDirStart))
+	logDebugf("DB directory setup took %v", time.Since(dbDirStart))
 
 	// Initialize SQLite database for metadata
 	dbInitStart := time.Now()
 	dbPath := filepath.Join(dbDir, "juicefs.sqlite")
-	j.dbManager = NewDBManager(cfg, dbDir)
-	j.dbManager.DBPath = dbPath
-	if err := j.dbManager.Initialize(); err != nil {
+	j.dbManager = j.newMetadataDB(cfg, dbPath)
+	if err := j.dbManager.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 	if err := j.dbManager.StartReplication(); err != nil {
 		return fmt.Errorf("failed to start replication: %w", err)
 	}
-	log.Printf("DB initialization and replication start took %v", time.Since(dbInitStart))
+	logDebugf("DB initialization and replication start took %v", time.Since(dbInitStart))
+
+	// Format the filesystem if it doesn't exist, then start the mount process
+	j.juicefsPath = juicefsPath
+	j.dbPath = dbPath
+	j.mountDir = mountDir
+	if err := j.startMount(ctx); err != nil {
+		return err
+	}
+
+	// Create active and checkpoints directories within the mount
+	dirsStart := time.Now()
+	checkpointsDir := j.checkpointsDir()
+	if err := os.MkdirAll(checkpointsDir, DirMode); err != nil {
+		return fmt.Errorf("failed to create checkpoints directory: %w", err)
+	}
+	if err := j.prepareActiveDir(mountDir); err != nil {
+		return err
+	}
+	logDebugf("Creating active and checkpoints directories took %v", time.Since(dirsStart))
+
+	if err := j.applyQuota(ctx); err != nil {
+		return err
+	}
+	j.startQuotaMonitor()
+	j.startMountProber()
+
+	// Log the state of the active directory and mount process before checkpointing
+	logDebugf("Checking active directory at %s", j.activeDir)
+	if _, err := os.Stat(j.activeDir); os.IsNotExist(err) {
+		logDebugf("Active directory does not exist at %s", j.activeDir)
+	} else {
+		logDebugf("Active directory exists at %s", j.activeDir)
+	}
+
+	return nil
+}
+
+// rollbackSetup stops everything a failed setup started: the monitors, the mount process, the
+// mount itself and the metadata replication
+func (j *JuiceFSComponent) rollbackSetup(ctx context.Context) {
+	logWarnf("JuiceFS setup failed, stopping the mount and replication it started")
+	if err := j.Fence(ctx); err != nil {
+		logWarnf("Failed to roll back JuiceFS setup: %v", err)
+	}
+}
+
+// RestoreState restores a missing metadata database from its replica and verifies it, so a
+// recreated machine mounts the existing volume instead of formatting a new one
+func (j *JuiceFSComponent) RestoreState(ctx context.Context, cfg *ObjectStorageConfig) error {
+	basePath, err := cfg.resolveEnvDir()
+	if err != nil {
+		return err
+	}
+	j.mu.RLock()
+	dbDir := j.settings.dbDirPath(basePath)
+	j.mu.RUnlock()
+	dm := j.newMetadataDB(cfg, filepath.Join(dbDir, "juicefs.sqlite"))
+	if _, err := dm.RestoreFromReplica(ctx); err != nil {
+		return fmt.Errorf("failed to restore metadata database: %w", err)
+	}
+	return dm.VerifyIntegrity(ctx)
+}
+
+// startMount formats the filesystem and mounts it, retrying transient failures with backoff
+func (j *JuiceFSComponent) startMount(ctx context.Context) error {
+	j.mu.RLock()
+	retries, backoff := j.settings.mountRetries(), j.settings.mountRetryBackoff()
+	j.mu.RUnlock()
+
+	for attempt := 1; ; attempt++ {
+		err := j.format(ctx, j.juicefsPath, j.dbPath)
+		if err == nil {
+			err = j.mount(ctx)
+		}
+		if err == nil {
+			if attempt > 1 {
+				logInfof("JuiceFS mount started on attempt %d", attempt)
+			}
+			return nil
+		}
+		// rule: bad credentials or a missing bucket fail the same way every time, so they fail setup at once
+		if attempt > retries || ctx.Err() != nil || isPermanentMountError(err) {
+			return classifyStorageFailure("juicefs format and mount", err)
+		}
+		logWarnf("JuiceFS mount startup failed (attempt %d of %d), retrying in %v: %v", attempt, retries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isPermanentMountError reports whether a format or mount failure is caused by object storage
+// rejecting the credentials or bucket, rather than a transient failure such as a timeout or 5xx
+func isPermanentMountError(err error) bool {
+	category := ClassifyStorageError(err)
+	return category == StorageAuthFailed || category == StorageNotFound
+}
+
+// format runs juicefs format against the metadata database, bounded by the configured timeout
+func (j *JuiceFSComponent) format(ctx context.Context, juicefsPath, dbPath string) error {
+	cfg := j.config
+	j.mu.RLock()
+	timeout := j.settings.formatTimeout()
+	j.mu.RUnlock()
 
-	// Format the filesystem if it doesn't exist
 	formatStart := time.Now()
-	formatCmd := exec.CommandContext(ctx, juicefsPath, "format",
+	formatCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	formatCmd := exec.CommandContext(formatCtx, juicefsPath, "format",
 		"--storage", "s3",
-		"--bucket", cfg.Endpoint+"/"+cfg.Bucket,
+		"--bucket", cfg.juicefsBucketURL(),
 		"--trash-days", "0",
 		fmt.Sprintf("sqlite3://%s", dbPath),
-		"juicefs")
+		cfg.layout().juicefsVolume())
 
 	// Set environment variables for authentication during format
-	formatCmd.Env = append(os.Environ(),
-		"AWS_ACCESS_KEY_ID="+cfg.AccessKey,
-		"AWS_SECRET_ACCESS_KEY="+cfg.SecretKey,
-		"AWS_ENDPOINT_URL="+cfg.Endpoint,
-		"AWS_REGION="+cfg.Region,
-	)
+	formatCmd.Env = append(os.Environ(), cfg.awsEnv()...)
+	// rule: don't wait on children of a killed format that still hold the output pipe
+	formatCmd.WaitDelay = 5 * time.Second
 
 	// Capture format command output
 	formatOutput, err := formatCmd.CombinedOutput()
 	if err != nil {
+		if errors.Is(formatCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return fmt.Errorf("JuiceFS format timed out after %v; check that object storage at %s is reachable\nOutput: %s",
+				timeout, cfg.Endpoint, string(formatOutput))
+		}
 		return fmt.Errorf("failed to format JuiceFS: %w\nOutput: %s", err, string(formatOutput))
 	}
-	fmt.Printf("JuiceFS format output: %s\n", string(formatOutput))
-	log.Printf("JuiceFS format took %v", time.Since(formatStart))
+	logDebugf("JuiceFS format output: %s", string(formatOutput))
+	logDebugf("JuiceFS format took %v", time.Since(formatStart))
+	return nil
+}
 
-	// Start the mount process
+// mount starts the supervised mount process and waits for it to become ready
+func (j *JuiceFSComponent) mount(ctx context.Context) error {
 	mountStart := time.Now()
+	cfg := j.config
+	mountDir := j.mountDir
 
 	// Create mount command
-	mountCmd := exec.Command(juicefsPath, "mount", "--no-syslog", "--no-color",
-		fmt.Sprintf("sqlite3://%s", dbPath), mountDir)
-	mountCmd.Env = append(os.Environ(),
-		"AWS_ACCESS_KEY_ID="+cfg.AccessKey,
-		"AWS_SECRET_ACCESS_KEY="+cfg.SecretKey,
-		"AWS_ENDPOINT_URL="+cfg.Endpoint,
-		"AWS_REGION="+cfg.Region,
-	)
-
-	// Set up stdout/stderr before creating supervisor
+	args := append([]string{"mount", "--no-syslog", "--no-color"}, cfg.juicefsMountFlags()...)
+	args = append(args, j.settings.cacheFlags()...)
+	mountCmd := exec.Command(j.juicefsPath, append(args, fmt.Sprintf("sqlite3://%s", j.dbPath), mountDir)...)
+	mountCmd.Env = append(os.Environ(), cfg.awsEnv()...)
+
+	// Stderr is scanned for the life of the mount, including after a restart by the supervisor
+	// rule: the log is drained continuously so the mount process never blocks on a full pipe
+	readyMsg := fmt.Sprintf("juicefs is ready at %s", mountDir)
+	logDebugf("Waiting for ready message: %q", readyMsg)
+	mountLog := newMountLog(j.settings.mountLogLines(), readyMsg)
 	mountCmd.Stdout = os.Stdout
-	stderr, err := mountCmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
-	}
-	j.stderrReader = stderr
+	mountCmd.Stderr = mountLog
+	j.mu.Lock()
+	j.mountLog = mountLog
+	j.mu.Unlock()
 
 	// Create supervisor for mount process
 	j.supervisor = NewSupervisorCmd(mountCmd, SupervisorConfig{
 		TimeoutStop: 90 * time.Second,
+		OnStop: func(info ExitInfo) {
+			mountLog.processExited()
+			j.mountExited(info, mountLog)
+		},
+		OnRestart: func(pid int) {
+			go j.mountRestarted(pid, mountLog)
+		},
 	})
 
 	// Start the supervisor
@@ -133,51 +647,23 @@ func (j *JuiceFSComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig,
 		return fmt.Errorf("failed to start juicefs mount: %v", err)
 	}
 
-	// Create a channel to signal when the mount is ready
-	mountReady := make(chan error, 1)
-
-	// Monitor stderr for the ready message
-	go func() {
-		defer close(mountReady)
-		scanner := bufio.NewScanner(j.stderrReader)
-		expectedPath := mountDir
-		readyMsg := fmt.Sprintf("juicefs is ready at %s", expectedPath)
-		log.Printf("Waiting for ready message: %q", readyMsg)
-		for scanner.Scan() {
-			line := scanner.Text()
-			log.Printf("juicefs mount stderr: %s", line)
-			if strings.Contains(line, readyMsg) {
-				log.Printf("juicefs mount ready message detected")
-				mountReady <- nil
-				return
-			} else {
-				// Print raw text when no match
-				log.Printf("juicefs mount stderr (raw): %q", line)
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			mountReady <- fmt.Errorf("error reading mount stderr: %v", err)
-		}
-	}()
-
 	// Wait for mount to be ready or timeout
 	select {
-	case err := <-mountReady:
-		if err != nil {
-			j.mu.Lock()
-			if j.supervisor != nil {
-				j.supervisor.StopProcess()
-			}
-			j.mu.Unlock()
-			return fmt.Errorf("mount failed: %v", err)
+	case <-mountLog.readyChan():
+	case <-mountLog.exited:
+		j.mu.Lock()
+		if j.supervisor != nil {
+			j.supervisor.StopProcess()
 		}
-	case <-time.After(60 * time.Second):
+		j.mu.Unlock()
+		return fmt.Errorf("mount failed: mount process exited before becoming ready: %s", mountLog.Last())
+	case <-time.After(mountReadyTimeout):
 		j.mu.Lock()
 		if j.supervisor != nil {
 			j.supervisor.StopProcess()
 		}
 		j.mu.Unlock()
-		return fmt.Errorf("mount timed out after 60 seconds")
+		return fmt.Errorf("mount timed out after %v", mountReadyTimeout)
 	case <-ctx.Done():
 		j.mu.Lock()
 		if j.supervisor != nil {
@@ -192,67 +678,185 @@ func (j *JuiceFSComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig,
 	j.isReady = true
 	j.mu.Unlock()
 
-	log.Printf("JuiceFS mount took %v", time.Since(mountStart))
+	logInfof("JuiceFS mount took %v", time.Since(mountStart))
 
-	// Create active and checkpoints directories within the mount
-	dirsStart := time.Now()
-	activeDir := filepath.Join(mountDir, "active")
-	checkpointsDir := filepath.Join(mountDir, "checkpoints")
-	if err := os.MkdirAll(activeDir, 0755); err != nil {
-		return fmt.Errorf("failed to create active directory: %w", err)
+	return nil
+}
+
+// RefreshCredentials remounts the filesystem so the mount process uses the rotated credentials
+func (j *JuiceFSComponent) RefreshCredentials(ctx context.Context, cfg *ObjectStorageConfig) error {
+	j.mu.Lock()
+	j.config = cfg
+	supervisor := j.supervisor
+	j.isReady = false
+	j.mu.Unlock()
+
+	if supervisor == nil {
+		return nil
 	}
-	if err := os.MkdirAll(checkpointsDir, 0755); err != nil {
-		return fmt.Errorf("failed to create checkpoints directory: %w", err)
+	if err := supervisor.StopProcess(); err != nil {
+		return fmt.Errorf("failed to stop mount process: %w", err)
+	}
+	if j.dbManager != nil {
+		if err := j.dbManager.RefreshCredentials(cfg); err != nil {
+			return err
+		}
 	}
-	log.Printf("Creating active and checkpoints directories took %v", time.Since(dirsStart))
+	if err := j.mount(ctx); err != nil {
+		return fmt.Errorf("failed to remount with refreshed credentials: %w", err)
+	}
+	return nil
+}
 
-	// Set active directory path within the mount
-	j.activeDir = activeDir
+// SyncReplication flushes the metadata database to object storage
+func (j *JuiceFSComponent) SyncReplication(ctx context.Context) error {
+	if j.dbManager != nil {
+		return j.dbManager.Sync(ctx)
+	}
+	return nil
+}
 
-	// Log the state of the active directory and mount process before checkpointing
-	log.Printf("Checking active directory at %s", j.activeDir)
-	if _, err := os.Stat(j.activeDir); os.IsNotExist(err) {
-		log.Printf("Active directory does not exist at %s", j.activeDir)
-	} else {
-		log.Printf("Active directory exists at %s", j.activeDir)
+// ReplicationPosition returns the position of the metadata database durable in its replica
+func (j *JuiceFSComponent) ReplicationPosition() (ReplicationPosition, error) {
+	if j.dbManager == nil {
+		return ReplicationPosition{}, errReplicationStopped
+	}
+	return j.dbManager.Position()
+}
+
+// ForwardSignal sends a signal to the mount process, if it is running
+func (j *JuiceFSComponent) ForwardSignal(sig os.Signal) error {
+	j.mu.RLock()
+	supervisor := j.supervisor
+	j.mu.RUnlock()
+	if supervisor == nil {
+		return nil
 	}
+	return supervisor.ForwardSignal(sig)
+}
 
-	return nil
+// RecentLogs returns the most recent output of the mount process, kept per mount_log_lines
+func (j *JuiceFSComponent) RecentLogs() ([]string, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.settings.mountLogLines() == 0 {
+		return nil, false
+	}
+	if j.mountLog == nil {
+		return []string{}, true
+	}
+	return j.mountLog.Lines(), true
 }
 
 // Status returns the current status of the component
 func (j *JuiceFSComponent) Status(ctx context.Context) map[string]interface{} {
+	// rule: the mount is read outside the lock so a hung mount cannot block status callers
+	j.mu.RLock()
+	ready, mountDir := j.isReady, j.mountDir
+	j.mu.RUnlock()
+	var stats *JuiceFSStats
+	if ready {
+		stats = mountStats(mountDir)
+	}
+
 	j.mu.RLock()
 	defer j.mu.RUnlock()
 
 	status := make(map[string]interface{})
 	status["ready"] = j.isReady
 	status["process_running"] = j.supervisor != nil
+	if j.version != "" {
+		status["version"] = j.version
+	}
+	if j.settings.ActiveQuotaGiB > 0 {
+		limit := j.settings.ActiveQuotaGiB << 30
+		status["quota"] = map[string]interface{}{
+			"limit_bytes": limit,
+			"used_bytes":  j.quotaUsed,
+			"exceeded":    j.quotaUsed >= limit,
+		}
+	}
+	if stats != nil {
+		status["stats"] = stats
+	}
+	if j.lastExit != nil {
+		status["last_exit"] = j.lastExit
+	}
+	if j.crashes > 0 {
+		status["crashes"] = j.crashes
+	}
+	if j.mountLog != nil {
+		if lines := j.mountLog.Lines(); len(lines) > 0 {
+			status["mount_output"] = lines
+		}
+	}
 	return status
 }
 
+// Ready reports whether the mount is ready, so checkpoints and restores operate on the mounted filesystem
+func (j *JuiceFSComponent) Ready() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.isReady
+}
+
+// Healthy reports an error if the mount is not ready or its process has died
+func (j *JuiceFSComponent) Healthy(ctx context.Context) error {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if j.supervisor == nil {
+		return fmt.Errorf("mount process not started")
+	}
+	if !j.isReady {
+		return fmt.Errorf("mount not ready")
+	}
+	if !j.supervisor.IsRunning() {
+		return fmt.Errorf("mount process not running")
+	}
+	return nil
+}
+
 // Cleanup performs cleanup when the component is no longer needed
 func (j *JuiceFSComponent) Cleanup(ctx context.Context) error {
 	j.mu.Lock()
 	j.shutdownRequested = true
+	j.activeReady = false
+	j.isReady = false
+	if j.quotaStop != nil {
+		close(j.quotaStop)
+		j.quotaStop = nil
+	}
+	if j.probeStop != nil {
+		close(j.probeStop)
+		j.probeStop = nil
+	}
 	j.mu.Unlock()
 
 	if j.supervisor != nil {
 		if err := j.supervisor.StopProcess(); err != nil {
-			log.Printf("Failed to stop mount process: %v", err)
+			logWarnf("Failed to stop mount process: %v", err)
 		}
 	}
 
 	// Clean up DB manager if it exists
 	if j.dbManager != nil {
 		if err := j.dbManager.StopReplication(); err != nil {
-			log.Printf("Failed to stop DB replication: %v", err)
+			logWarnf("Failed to stop DB replication: %v", err)
 		}
 	}
 
 	return nil
 }
 
+// Fence stops the mount process and unmounts the filesystem, without remounting it
+func (j *JuiceFSComponent) Fence(ctx context.Context) error {
+	if err := j.Cleanup(ctx); err != nil {
+		return err
+	}
+	return j.unmount(ctx)
+}
+
 // Shutdown performs a graceful shutdown of the component
 func (j *JuiceFSComponent) Shutdown(ctx context.Context) error {
 	return j.Cleanup(ctx)
@@ -268,36 +872,600 @@ func (j *JuiceFSComponent) CreateCheckpoint(ctx context.Context, id string) (str
 		return "", nil
 	}
 
-	// Use the base path for checkpoint directory
-	checkpointDir := filepath.Join(j.basePath, "juicefs", "checkpoints", id)
+	// rule: a retried checkpoint request is a no-op, but reusing the ID of another checkpoint is a conflict
+	exists, err := j.HasCheckpoint(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		if j.created[id] {
+			logInfof("Checkpoint %s already created, skipping", id)
+			return id, nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrCheckpointExists, id)
+	}
+
+	checkpointDir := filepath.Join(j.checkpointsDir(), id)
 
-	// Move active to checkpoint
-	if err := os.Rename(j.activeDir, checkpointDir); err != nil {
+	// rule: an incomplete checkpoint left by an interrupted create is never usable, so it is replaced
+	if err := os.RemoveAll(checkpointDir); err != nil {
+		return "", fmt.Errorf("failed to remove incomplete checkpoint: %w", err)
+	}
+
+	// Move active to checkpoint, then mark it complete
+	if err := moveDir(j.activeDir, checkpointDir); err != nil {
 		return "", fmt.Errorf("failed to move active to checkpoint: %w", err)
 	}
+	// rule: the consistency tag and parent go into the marker so a checkpoint is never complete without them
+	head := j.loadHead()
+	parent := head.CheckpointID
+	if parent == id {
+		// Recreating the checkpoint last restored, as the rollback of a failed restore does, keeps its parent
+		parent = head.Parent
+	}
+	marker, err := newCheckpointMarker(ctx, parent)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(checkpointDir+checkpointCompleteSuffix, marker, FileMode); err != nil {
+		return "", fmt.Errorf("failed to mark checkpoint complete: %w", err)
+	}
+	if j.created == nil {
+		j.created = make(map[string]bool)
+	}
+	j.created[id] = true
+	// Hidden checkpoints, such as a restore's rollback state, are not part of the lineage
+	if !strings.HasPrefix(id, ".") {
+		j.saveHead(checkpointHead{CheckpointID: id, Parent: parent})
+	}
 
 	// Create new active directory
-	if err := os.MkdirAll(j.activeDir, 0755); err != nil {
+	if err := os.MkdirAll(j.activeDir, DirMode); err != nil {
 		return "", fmt.Errorf("failed to create new active directory: %w", err)
 	}
+	if err := j.syncRenames(j.activeDir, checkpointDir); err != nil {
+		return "", err
+	}
+
+	// rule: the quota belongs to the directory, so the new active directory needs its own
+	if err := j.applyQuota(ctx); err != nil {
+		return "", err
+	}
 
 	return id, nil
 }
 
+// checkpointCompleteSuffix names the marker file written next to a checkpoint directory as the
+// final step of creating it; a checkpoint directory without one was interrupted and is not usable
+const checkpointCompleteSuffix = ".complete"
+
+// checkpointsDir returns the directory holding the checkpoints
+func (j *JuiceFSComponent) checkpointsDir() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.settings.CheckpointDir != "" {
+		return j.settings.CheckpointDir
+	}
+	return filepath.Join(j.settings.mountPath(j.basePath), "checkpoints")
+}
+
+// HasCheckpoint reports whether a complete checkpoint exists for the given ID
+func (j *JuiceFSComponent) HasCheckpoint(ctx context.Context, id string) (bool, error) {
+	if id == "" || filepath.Base(id) != id {
+		return false, nil
+	}
+	checkpointDir := filepath.Join(j.checkpointsDir(), id)
+	info, err := os.Stat(checkpointDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat checkpoint: %w", err)
+	}
+	if !info.IsDir() {
+		return false, nil
+	}
+	return checkpointComplete(checkpointDir)
+}
+
+// checkpointComplete reports whether the checkpoint directory has its completion marker
+func checkpointComplete(checkpointDir string) (bool, error) {
+	if _, err := os.Stat(checkpointDir + checkpointCompleteSuffix); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat checkpoint marker: %w", err)
+	}
+	return true, nil
+}
+
+// listCheckpoints returns the IDs of the checkpoint directories that are complete, or incomplete
+func (j *JuiceFSComponent) listCheckpoints(complete bool) ([]string, error) {
+	dir := j.checkpointsDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		// Hidden directories are partial copies still being moved into place
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		ok, err := checkpointComplete(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if ok == complete {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// ListCheckpoints returns the IDs of the complete checkpoints
+func (j *JuiceFSComponent) ListCheckpoints(ctx context.Context) ([]string, error) {
+	return j.listCheckpoints(true)
+}
+
+// ListIncompleteCheckpoints returns the IDs of checkpoints left incomplete by an interrupted create
+func (j *JuiceFSComponent) ListIncompleteCheckpoints(ctx context.Context) ([]string, error) {
+	return j.listCheckpoints(false)
+}
+
+// ReclaimableArtifacts lists the complete checkpoints kept in a local checkpoint_dir. Checkpoints
+// in the mount live in object storage, so deleting them frees no local disk.
+func (j *JuiceFSComponent) ReclaimableArtifacts(ctx context.Context) ([]ReclaimableArtifact, error) {
+	j.mu.RLock()
+	local := j.settings.CheckpointDir != ""
+	j.mu.RUnlock()
+	if !local {
+		return nil, nil
+	}
+	ids, err := j.ListCheckpoints(ctx)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dir := j.checkpointsDir()
+	var artifacts []ReclaimableArtifact
+	for _, id := range ids {
+		// The completion marker is written last, so its time is when the checkpoint was created
+		info, err := os.Stat(filepath.Join(dir, id) + checkpointCompleteSuffix)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to stat checkpoint marker: %w", err)
+		}
+		artifacts = append(artifacts, ReclaimableArtifact{
+			Name:         "juicefs checkpoint " + id,
+			CheckpointID: id,
+			Path:         filepath.Join(dir, id),
+			Created:      info.ModTime(),
+			Remove:       func(ctx context.Context) error { return j.DeleteCheckpoint(ctx, id) },
+		})
+	}
+	return artifacts, nil
+}
+
+// DeleteCheckpoint removes the checkpoint directory for the given ID
+func (j *JuiceFSComponent) DeleteCheckpoint(ctx context.Context, id string) error {
+	if id == "" || filepath.Base(id) != id {
+		return fmt.Errorf("invalid checkpoint ID: %q", id)
+	}
+	checkpointDir := filepath.Join(j.checkpointsDir(), id)
+	// The marker goes first so a partly removed checkpoint is never listed as complete
+	if err := os.Remove(checkpointDir + checkpointCompleteSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove checkpoint marker: %w", err)
+	}
+	if err := os.RemoveAll(checkpointDir); err != nil {
+		return fmt.Errorf("failed to remove checkpoint directory: %w", err)
+	}
+	delete(j.created, id)
+	// rule: once the checkpoint the environment was last at is gone, the next checkpoint descends from its parent
+	if head := j.loadHead(); head.CheckpointID == id {
+		j.saveHead(checkpointHead{CheckpointID: head.Parent})
+	}
+	return nil
+}
+
 // RestoreToCheckpoint restores the filesystem to a previous checkpoint
 func (j *JuiceFSComponent) RestoreToCheckpoint(ctx context.Context, id string) error {
-	// Use the base path for checkpoint directory
-	checkpointDir := filepath.Join(j.basePath, "juicefs", "checkpoints", id)
+	checkpointDir := filepath.Join(j.checkpointsDir(), id)
+
+	// rule: restoring an incomplete checkpoint would replace the active directory with partial data
+	complete, err := checkpointComplete(checkpointDir)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return fmt.Errorf("%w: %s", ErrCheckpointIncomplete, id)
+	}
+	marker, _, err := j.readCheckpointMarker(id)
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint marker: %w", err)
+	}
 
-	// Remove current active
-	if err := os.RemoveAll(j.activeDir); err != nil {
-		return fmt.Errorf("failed to remove active directory: %w", err)
+	// Keep or remove current active
+	if err := j.replaceActive(j.loadHead().CheckpointID); err != nil {
+		return err
 	}
 
 	// Move checkpoint to active
-	if err := os.Rename(checkpointDir, j.activeDir); err != nil {
+	if err := moveDir(checkpointDir, j.activeDir); err != nil {
 		return fmt.Errorf("failed to move checkpoint to active: %w", err)
 	}
+	delete(j.created, id)
+	if err := os.Remove(checkpointDir + checkpointCompleteSuffix); err != nil && !os.IsNotExist(err) {
+		logWarnf("Failed to remove marker of restored checkpoint %s: %v", id, err)
+	}
+	// rule: restoring a hidden checkpoint, i.e. rolling back, returns the lineage to where it was when that was saved
+	if strings.HasPrefix(id, ".") {
+		j.saveHead(checkpointHead{CheckpointID: marker.Parent})
+	} else {
+		j.saveHead(checkpointHead{CheckpointID: id, Parent: marker.Parent})
+	}
+	if err := j.syncRenames(j.activeDir, checkpointDir); err != nil {
+		return err
+	}
+
+	if err := j.applyQuota(ctx); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// syncRenames makes the renames of the given paths durable when FsyncCheckpoints is set, by
+// syncing the directories holding them, since a rename is only persisted once its directory is
+func (j *JuiceFSComponent) syncRenames(paths ...string) error {
+	j.mu.RLock()
+	enabled := j.settings.FsyncCheckpoints
+	j.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	synced := make(map[string]bool)
+	for _, p := range paths {
+		dir := filepath.Dir(p)
+		if synced[dir] {
+			continue
+		}
+		synced[dir] = true
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// preRestorePrefix names the checkpoints holding the active directory as it was before a restore
+const preRestorePrefix = "pre-restore-"
+
+// replaceActive clears the active directory before a restore, first saving a non-empty one as a
+// pre-restore checkpoint with the given parent unless DiscardOnRestore is set
+func (j *JuiceFSComponent) replaceActive(parent string) error {
+	j.mu.RLock()
+	discard := j.settings.DiscardOnRestore
+	j.mu.RUnlock()
+
+	entries, err := os.ReadDir(j.activeDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read active directory: %w", err)
+	}
+	if discard || len(entries) == 0 {
+		if err := os.RemoveAll(j.activeDir); err != nil {
+			return fmt.Errorf("failed to remove active directory: %w", err)
+		}
+		return nil
+	}
+	_, err = j.savePreRestore(j.activeDir, parent)
+	return err
+}
+
+// savePreRestore moves dir to a new complete pre-restore checkpoint with the given parent and returns its ID
+func (j *JuiceFSComponent) savePreRestore(dir, parent string) (string, error) {
+	id := fmt.Sprintf("%s%d", preRestorePrefix, time.Now().UnixNano())
+	checkpointDir := filepath.Join(j.checkpointsDir(), id)
+	if err := moveDir(dir, checkpointDir); err != nil {
+		return "", fmt.Errorf("failed to save pre-restore state: %w", err)
+	}
+	marker, err := json.Marshal(checkpointMarker{CompletedAt: time.Now().UTC(), Parent: parent})
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(checkpointDir+checkpointCompleteSuffix, marker, FileMode); err != nil {
+		return "", fmt.Errorf("failed to mark pre-restore checkpoint complete: %w", err)
+	}
+	logInfof("Saved the state before restore as checkpoint %s", id)
+	return id, nil
+}
+
+// keepRollback turns the rollback checkpoint saved by restoreAll into a pre-restore checkpoint,
+// or deletes it if DiscardOnRestore is set
+func (j *JuiceFSComponent) keepRollback(ctx context.Context, rollbackID string) error {
+	j.mu.RLock()
+	discard := j.settings.DiscardOnRestore
+	j.mu.RUnlock()
+	rollbackDir := filepath.Join(j.checkpointsDir(), rollbackID)
+	// rule: an empty active directory, e.g. on resume or auto-restore, has nothing worth undoing to
+	entries, err := os.ReadDir(rollbackDir)
+	if err != nil {
+		return fmt.Errorf("failed to read rollback checkpoint: %w", err)
+	}
+	if discard || len(entries) == 0 {
+		return j.DeleteCheckpoint(ctx, rollbackID)
+	}
+	// The rollback checkpoint recorded the checkpoint the replaced state came from
+	marker, _, err := j.readCheckpointMarker(rollbackID)
+	if err != nil {
+		return fmt.Errorf("failed to read rollback marker: %w", err)
+	}
+
+	// The marker goes first so a partly moved rollback is never listed as complete
+	if err := os.Remove(rollbackDir + checkpointCompleteSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove rollback marker: %w", err)
+	}
+	if _, err := j.savePreRestore(rollbackDir, marker.Parent); err != nil {
+		return err
+	}
+	delete(j.created, rollbackID)
+	return j.syncRenames(rollbackDir)
+}
+
+// applyQuota sets the configured quota on the active directory using `juicefs quota`
+func (j *JuiceFSComponent) applyQuota(ctx context.Context) error {
+	j.mu.RLock()
+	quota := j.settings.ActiveQuotaGiB
+	j.mu.RUnlock()
+	if quota <= 0 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, j.juicefsPath, "quota", "set",
+		fmt.Sprintf("sqlite3://%s", j.dbPath),
+		"--path", "/"+filepath.Base(j.activeDir),
+		"--capacity", strconv.FormatInt(quota, 10))
+	if j.config != nil {
+		cmd.Env = append(os.Environ(), j.config.awsEnv()...)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set quota on active directory: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// checkQuota measures the size of the active directory and records it for status reporting
+func (j *JuiceFSComponent) checkQuota() {
+	var used int64
+	err := filepath.WalkDir(j.activeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may disappear while walking; count what can be read
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				used += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logWarnf("Failed to measure active directory usage: %v", err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	limit := j.settings.ActiveQuotaGiB << 30
+	if used >= limit && j.quotaUsed < limit {
+		logWarnf("JuiceFS active directory is at or over its quota: %d of %d bytes used", used, limit)
+	}
+	j.quotaUsed = used
+}
+
+// startQuotaMonitor periodically measures the active directory's usage while a quota is configured
+func (j *JuiceFSComponent) startQuotaMonitor() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.settings.ActiveQuotaGiB <= 0 || j.quotaStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	j.quotaStop = stop
+
+	go func() {
+		defer RecoverPanic("juicefs quota monitor")
+		ticker := time.NewTicker(juicefsQuotaCheckInterval)
+		defer ticker.Stop()
+		j.checkQuota()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				j.checkQuota()
+			}
+		}
+	}()
+}
+
+// isStaleMount reports whether err from accessing the mountpoint means the FUSE mount is stale
+func isStaleMount(err error) bool {
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
+// probeMount checks the mountpoint and remounts it if it has gone stale.
+// It returns true if a remount was attempted.
+func (j *JuiceFSComponent) probeMount(ctx context.Context) bool {
+	stat, remount := j.statMount, j.remount
+	if stat == nil {
+		stat = os.Stat
+	}
+	if remount == nil {
+		remount = j.forceRemount
+	}
+
+	if _, err := stat(j.mountDir); !isStaleMount(err) {
+		return false
+	}
+
+	logWarnf("JuiceFS mount at %s is stale, remounting", j.mountDir)
+	if err := remount(ctx); err != nil {
+		logErrorf("Failed to remount stale JuiceFS mount: %v", err)
+		j.events.Record(EventMountRemounted, "juicefs", fmt.Sprintf("remount after stale mount failed: %v", err), map[string]string{"mount": j.mountDir})
+		return true
+	}
+	j.events.Record(EventMountRemounted, "juicefs", "remounted stale mount", map[string]string{"mount": j.mountDir})
+	return true
+}
+
+// forceRemount stops the mount process, lazily unmounts the mountpoint and mounts it again
+func (j *JuiceFSComponent) forceRemount(ctx context.Context) error {
+	j.mu.Lock()
+	supervisor := j.supervisor
+	j.isReady = false
+	j.mu.Unlock()
+
+	if supervisor != nil {
+		if err := supervisor.StopProcess(); err != nil {
+			logWarnf("Failed to stop mount process: %v", err)
+		}
+	}
+
+	if err := j.unmount(ctx); err != nil {
+		return err
+	}
+	return j.mount(ctx)
+}
+
+// prepareActiveDir creates the active directory on the mount and, once it is confirmed to be on
+// the mounted filesystem, lets the supervised process start
+func (j *JuiceFSComponent) prepareActiveDir(mountDir string) error {
+	activeDir := filepath.Join(mountDir, "active")
+	if err := os.MkdirAll(activeDir, DirMode); err != nil {
+		return fmt.Errorf("failed to create active directory: %w", err)
+	}
+	check := j.activeOnMount
+	if check == nil {
+		check = checkActiveOnMount
+	}
+	// rule: an active directory created before the mount would be shadowed by it, losing the app's writes
+	if err := check(activeDir, mountDir); err != nil {
+		return err
+	}
 
+	j.mu.Lock()
+	j.activeDir = activeDir
+	j.activeReady = true
+	j.mu.Unlock()
 	return nil
 }
+
+// checkActiveOnMount verifies that mountDir is mounted and activeDir is on that filesystem
+func checkActiveOnMount(activeDir, mountDir string) error {
+	if !isMountpoint(mountDir) {
+		return fmt.Errorf("active directory %s is not on a mounted filesystem: %s is not mounted", activeDir, mountDir)
+	}
+	active, err := os.Stat(activeDir)
+	if err != nil {
+		return fmt.Errorf("failed to check active directory: %w", err)
+	}
+	mount, err := os.Stat(mountDir)
+	if err != nil {
+		return fmt.Errorf("failed to check mount directory: %w", err)
+	}
+	if active.Sys().(*syscall.Stat_t).Dev != mount.Sys().(*syscall.Stat_t).Dev {
+		return fmt.Errorf("active directory %s is not on the filesystem mounted at %s", activeDir, mountDir)
+	}
+	return nil
+}
+
+// StartReady implements StartGate: the supervised process may start once the active directory is on the mount
+func (j *JuiceFSComponent) StartReady() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.activeReady
+}
+
+// isMountpoint reports whether dir is a mountpoint; a stale mount still counts as mounted
+func isMountpoint(dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return isStaleMount(err)
+	}
+	parent, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return false
+	}
+	return info.Sys().(*syscall.Stat_t).Dev != parent.Sys().(*syscall.Stat_t).Dev
+}
+
+// unmount lazily unmounts the mountpoint if the kernel still holds it after the mount process is gone
+func (j *JuiceFSComponent) unmount(ctx context.Context) error {
+	if !isMountpoint(j.mountDir) {
+		return nil
+	}
+	if output, err := exec.CommandContext(ctx, "fusermount", "-uz", j.mountDir).CombinedOutput(); err != nil {
+		logWarnf("fusermount failed, falling back to umount: %v: %s", err, strings.TrimSpace(string(output)))
+		if output, err := exec.CommandContext(ctx, "umount", "-l", j.mountDir).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w: %s", j.mountDir, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// Restart stops the mount process, unmounts the mountpoint and mounts it again
+func (j *JuiceFSComponent) Restart(ctx context.Context) error {
+	j.mu.Lock()
+	supervisor := j.supervisor
+	j.isReady = false
+	j.mu.Unlock()
+
+	if supervisor == nil {
+		return fmt.Errorf("mount process not started")
+	}
+	if err := supervisor.StopProcess(); err != nil {
+		return fmt.Errorf("failed to stop mount process: %w", err)
+	}
+	if err := j.unmount(ctx); err != nil {
+		return err
+	}
+	if err := j.mount(ctx); err != nil {
+		return fmt.Errorf("failed to remount: %w", err)
+	}
+	j.events.Record(EventMountRemounted, "juicefs", "restarted mount", map[string]string{"mount": j.mountDir})
+	return nil
+}
+
+// startMountProber periodically checks the mountpoint for staleness and remounts it
+func (j *JuiceFSComponent) startMountProber() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	interval := j.settings.probeInterval()
+	if interval <= 0 || j.probeStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	j.probeStop = stop
+
+	go func() {
+		defer RecoverPanic("juicefs mount probe")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				j.probeMount(ctx)
+			}
+		}
+	}()
+}
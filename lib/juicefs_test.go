@@ -0,0 +1,1490 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeStubJuiceFS writes a fake juicefs binary that records its arguments to argsFile
+func writeStubJuiceFS(t *testing.T, dir, argsFile string) string {
+	t.Helper()
+	path := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub juicefs: %v", err)
+	}
+	return path
+}
+
+func TestJuiceFSQuota(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	activeDir := filepath.Join(dir, "juicefs", "active")
+	if err := os.MkdirAll(activeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data.bin"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &JuiceFSComponent{
+		basePath:    dir,
+		activeDir:   activeDir,
+		juicefsPath: writeStubJuiceFS(t, t.TempDir(), argsFile),
+		dbPath:      filepath.Join(dir, "juicefs.sqlite"),
+		config:      &ObjectStorageConfig{},
+	}
+	j.Configure(JuiceFSConfig{ActiveQuotaGiB: 2})
+
+	if err := j.applyQuota(context.Background()); err != nil {
+		t.Fatalf("Failed to apply quota: %v", err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Stub juicefs was not run: %v", err)
+	}
+	want := "quota set sqlite3://" + j.dbPath + " --path /active --capacity 2"
+	if strings.TrimSpace(string(args)) != want {
+		t.Errorf("Expected juicefs %q, got %q", want, strings.TrimSpace(string(args)))
+	}
+
+	j.checkQuota()
+	quota, ok := j.Status(context.Background())["quota"].(map[string]interface{})
+	if !ok {
+		t.Fatal("Expected quota in status")
+	}
+	if quota["used_bytes"] != int64(4096) {
+		t.Errorf("Expected 4096 bytes used, got %v", quota["used_bytes"])
+	}
+	if quota["limit_bytes"] != int64(2<<30) {
+		t.Errorf("Expected limit of 2 GiB, got %v", quota["limit_bytes"])
+	}
+	if quota["exceeded"] != false {
+		t.Errorf("Expected quota not to be exceeded")
+	}
+
+	// A new active directory created by a checkpoint gets the quota too
+	if err := os.MkdirAll(filepath.Join(dir, "juicefs", "checkpoints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.CreateCheckpoint(context.Background(), "cp-1"); err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	args, _ = os.ReadFile(argsFile)
+	if n := strings.Count(string(args), "quota set"); n != 2 {
+		t.Errorf("Expected quota to be reapplied after checkpoint, applied %d times", n)
+	}
+}
+
+func TestJuiceFSRemountsStaleMount(t *testing.T) {
+	events := NewEventLog(10)
+	stale := true
+	remounts := 0
+	j := &JuiceFSComponent{
+		mountDir: t.TempDir(),
+		events:   events,
+		statMount: func(name string) (os.FileInfo, error) {
+			if stale {
+				return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ENOTCONN}
+			}
+			return os.Stat(name)
+		},
+		remount: func(ctx context.Context) error {
+			remounts++
+			stale = false
+			return nil
+		},
+	}
+
+	if !j.probeMount(context.Background()) {
+		t.Fatal("Expected a stale mount to trigger a remount")
+	}
+	if remounts != 1 {
+		t.Errorf("Expected 1 remount, got %d", remounts)
+	}
+	recent := events.Recent(0)
+	if len(recent) != 1 || recent[0].Type != EventMountRemounted {
+		t.Errorf("Expected a remount event, got %+v", recent)
+	}
+
+	// A healthy mount is left alone
+	if j.probeMount(context.Background()) {
+		t.Error("Expected a healthy mount not to be remounted")
+	}
+	if remounts != 1 {
+		t.Errorf("Expected no further remounts, got %d", remounts)
+	}
+}
+
+func TestJuiceFSRejectsInvalidEnvDir(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		envDir  string
+		wantErr string
+	}{
+		{"empty", "", "env_dir must be set"},
+		{"blank", "  ", "env_dir must be set"},
+		{"not a directory", filepath.Join(file, "env"), "cannot be created"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := NewJuiceFSComponent()
+			err := j.Setup(context.Background(), &ObjectStorageConfig{EnvDir: tt.envDir}, "juicefs")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if j.basePath != "" {
+				t.Errorf("Expected no base path after a failed setup, got %s", j.basePath)
+			}
+		})
+	}
+
+	// A missing env_dir is created and returned cleaned
+	base := t.TempDir()
+	cfg := &ObjectStorageConfig{EnvDir: filepath.Join(base, "nested", "..", "env") + "/"}
+	dir, err := cfg.resolveEnvDir()
+	if err != nil {
+		t.Fatalf("Failed to resolve env_dir: %v", err)
+	}
+	if want := filepath.Join(base, "env"); dir != want {
+		t.Errorf("Expected %s, got %s", want, dir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("Expected env_dir to be created, got %v", err)
+	}
+}
+
+func TestJuiceFSRejectsReadOnlyEnvDir(t *testing.T) {
+	dir := t.TempDir()
+	defer func(orig func(string, string) (*os.File, error)) { createWriteProbe = orig }(createWriteProbe)
+	createWriteProbe = func(dir, pattern string) (*os.File, error) {
+		return nil, &fs.PathError{Op: "open", Path: filepath.Join(dir, pattern), Err: syscall.EROFS}
+	}
+
+	j := NewJuiceFSComponent()
+	err := j.Setup(context.Background(), &ObjectStorageConfig{EnvDir: dir}, "juicefs")
+	if err == nil || !strings.Contains(err.Error(), "environment directory "+dir+" is not writable") ||
+		!strings.Contains(err.Error(), "read-only filesystem") {
+		t.Fatalf("Expected a read-only env_dir error, got %v", err)
+	}
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Expected the error to wrap EROFS, got %v", err)
+	}
+	if j.basePath != "" {
+		t.Errorf("Expected no base path after a failed setup, got %s", j.basePath)
+	}
+
+	// Permission bits are honoured for non-root users
+	createWriteProbe = os.CreateTemp
+	if os.Geteuid() == 0 {
+		return
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	cfg := &ObjectStorageConfig{EnvDir: dir}
+	if _, err := cfg.resolveEnvDir(); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected a permission error for a read-only env_dir, got %v", err)
+	}
+}
+
+func TestJuiceFSFormatTimeout(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\necho \"connecting to object storage\"\nexec sleep 60\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub juicefs: %v", err)
+	}
+
+	j := NewJuiceFSComponent()
+	j.config = &ObjectStorageConfig{Endpoint: "https://storage.invalid", Bucket: "test-bucket"}
+	j.Configure(JuiceFSConfig{FormatTimeoutSeconds: 1})
+
+	start := time.Now()
+	err := j.format(context.Background(), path, filepath.Join(dir, "juicefs.sqlite"))
+	if err == nil {
+		t.Fatal("Expected a hung format to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected format to stop after its timeout, took %v", elapsed)
+	}
+	for _, want := range []string{"timed out after 1s", "https://storage.invalid", "connecting to object storage"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %v", want, err)
+		}
+	}
+}
+
+func TestJuiceFSRejectsFullDisk(t *testing.T) {
+	envDir := t.TempDir()
+	j := NewJuiceFSComponent()
+	j.Configure(JuiceFSConfig{MinFreeSpaceMiB: 512})
+	j.freeSpace = func(dir string) (uint64, error) {
+		if dir != envDir {
+			t.Errorf("Expected free space of %s to be checked, got %s", envDir, dir)
+		}
+		return 100 << 20, nil
+	}
+
+	// The juicefs binary does not exist, so getting past the check would fail differently
+	err := j.Setup(context.Background(), &ObjectStorageConfig{EnvDir: envDir}, filepath.Join(envDir, "missing-juicefs"))
+	if err == nil || !strings.Contains(err.Error(), "insufficient disk space") || !strings.Contains(err.Error(), "100 MiB available, 512 MiB required") {
+		t.Fatalf("Expected an insufficient disk space error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(envDir, "juicefs")); !os.IsNotExist(err) {
+		t.Errorf("Expected setup to stop before creating the mount directory, got %v", err)
+	}
+
+	// A negative minimum disables the check
+	j.Configure(JuiceFSConfig{MinFreeSpaceMiB: -1})
+	if err := j.checkFreeSpace(envDir); err != nil {
+		t.Errorf("Expected no error with the check disabled, got %v", err)
+	}
+}
+
+func TestJuiceFSBinaryPreflight(t *testing.T) {
+	envDir := t.TempDir()
+	j := NewJuiceFSComponent()
+	j.Configure(JuiceFSConfig{MinFreeSpaceMiB: -1})
+	bogus := filepath.Join(envDir, "no-such-juicefs")
+	err := j.Setup(context.Background(), &ObjectStorageConfig{EnvDir: envDir}, bogus)
+	if err == nil || !strings.Contains(err.Error(), "juicefs binary not found") {
+		t.Fatalf("Expected a clear missing binary error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(envDir, "juicefs")); !os.IsNotExist(err) {
+		t.Errorf("Expected setup to stop before creating the mount directory, got %v", err)
+	}
+
+	// A binary that is present but fails to run is reported with its output
+	broken := filepath.Join(envDir, "broken-juicefs")
+	if err := os.WriteFile(broken, []byte("#!/bin/sh\necho 'error while loading shared libraries' >&2\nexit 127\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := checkJuiceFSBinary(context.Background(), broken); err == nil || !strings.Contains(err.Error(), "shared libraries") {
+		t.Errorf("Expected a not runnable error with output, got %v", err)
+	}
+
+	stub := filepath.Join(envDir, "juicefs-stub")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\necho 'juicefs version 1.2.0+2024-06-18.873c47b'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resolved, version, err := checkJuiceFSBinary(context.Background(), stub)
+	if err != nil {
+		t.Fatalf("Unexpected error for a runnable binary: %v", err)
+	}
+	if resolved != stub || version != "juicefs version 1.2.0+2024-06-18.873c47b" {
+		t.Errorf("Expected %s to report its version, got %s %q", stub, resolved, version)
+	}
+}
+
+func TestJuiceFSConfiguredBinary(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "bin", "juicefs-1.2")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\n" +
+		"if [ \"$1\" = mount ]; then for last; do :; done; echo \"juicefs is ready at $last\" >&2; exec sleep 60; fi\n"
+	if err := os.MkdirAll(filepath.Dir(binary), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	jfs := NewJuiceFSComponent()
+	// The stub reports ready without mounting anything
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	cfg := &SystemConfig{
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/",
+			EnvDir:    filepath.Join(dir, "env"),
+		},
+		Stacks:  []string{"juicefs"},
+		JuiceFS: JuiceFSConfig{Binary: binary, MinFreeSpaceMiB: -1},
+	}
+	if err := control.setupComponents(context.Background(), cfg); err != nil {
+		t.Fatalf("Failed to set up juicefs: %v", err)
+	}
+	defer jfs.Cleanup(context.Background())
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Expected the configured binary to be run: %v", err)
+	}
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		commands = append(commands, strings.Fields(line)[0])
+	}
+	if got := strings.Join(commands, ","); got != "version,format,mount" {
+		t.Errorf("Expected version, format and mount to use the configured binary, got %s", got)
+	}
+
+	// Unset, the binary is looked up on PATH
+	if got := (JuiceFSConfig{}).binary(); got != "juicefs" {
+		t.Errorf("Expected the default binary to be juicefs, got %s", got)
+	}
+}
+
+func TestMountOutputCapturedAfterReady(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	// The stub reports ready, fails during operation and is restarted by its supervisor
+	dir := t.TempDir()
+	restarted := filepath.Join(dir, "restarted")
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\nif [ \"$1\" = mount ]; then for last; do :; done; echo \"juicefs is ready at $last\" >&2\n" +
+		"  if [ -f " + restarted + " ]; then echo \"juicefs <WARNING>: mount restarted\" >&2; exec sleep 60; fi\n" +
+		"  touch " + restarted + "; sleep 0.1; echo \"juicefs <ERROR>: read timeout\" >&2; exit 1\nfi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	jfs := NewJuiceFSComponent()
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	cfg := &SystemConfig{
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/",
+			EnvDir:    filepath.Join(dir, "env"),
+		},
+		Stacks:  []string{"juicefs"},
+		JuiceFS: JuiceFSConfig{Binary: binary, MinFreeSpaceMiB: -1},
+	}
+	if err := control.setupComponents(context.Background(), cfg); err != nil {
+		t.Fatalf("Failed to set up juicefs: %v", err)
+	}
+	defer jfs.Cleanup(context.Background())
+
+	// Output after the ready message is still captured, as is the restarted mount's
+	ready := "juicefs is ready at " + jfs.mountDir
+	want := []string{ready, "juicefs <ERROR>: read timeout", ready, "juicefs <WARNING>: mount restarted"}
+	var output []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if output, _ = jfs.Status(context.Background())["mount_output"].([]string); slices.Equal(output, want) {
+			return
+		}
+	}
+	t.Errorf("Expected mount output %q, got %q", want, output)
+}
+
+func TestJuiceFSCustomMountDir(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	// The stub records where it was asked to mount
+	dir := t.TempDir()
+	mountedAt := filepath.Join(dir, "mounted-at")
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\nif [ \"$1\" = mount ]; then for last; do :; done; echo \"$last\" > " + mountedAt +
+		"; echo \"juicefs is ready at $last\" >&2; exec sleep 60; fi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	envDir := filepath.Join(dir, "env")
+	dbDir := filepath.Join(dir, "metadata")
+	jfs := NewJuiceFSComponent()
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	cfg := &SystemConfig{
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/",
+			EnvDir:    envDir,
+		},
+		Stacks:  []string{"juicefs"},
+		JuiceFS: JuiceFSConfig{Binary: binary, MinFreeSpaceMiB: -1, MountDir: "app/data", DBDir: dbDir},
+	}
+	if err := control.setupComponents(context.Background(), cfg); err != nil {
+		t.Fatalf("Failed to set up juicefs: %v", err)
+	}
+	defer jfs.Cleanup(context.Background())
+
+	want := filepath.Join(envDir, "app", "data")
+	if got, err := os.ReadFile(mountedAt); err != nil || strings.TrimSpace(string(got)) != want {
+		t.Errorf("Expected the mount at %s, got %q (%v)", want, got, err)
+	}
+	if jfs.activeDir != filepath.Join(want, "active") {
+		t.Errorf("Expected the active directory under %s, got %s", want, jfs.activeDir)
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, "juicefs.sqlite")); err != nil {
+		t.Errorf("Expected the metadata database in %s: %v", dbDir, err)
+	}
+	if _, err := os.Stat(filepath.Join(envDir, "juicefs")); !os.IsNotExist(err) {
+		t.Errorf("Expected no default mount directory, got %v", err)
+	}
+
+	// A database inside the mount point is rejected
+	overlapping := JuiceFSConfig{MountDir: "app/data", DBDir: "app/data/db"}
+	if err := overlapping.validate(); err == nil || !strings.Contains(err.Error(), "must not overlap") {
+		t.Errorf("Expected overlapping directories to be rejected, got %v", err)
+	}
+}
+
+func TestJuiceFSMountRetriesTransientFailures(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	failedFile := filepath.Join(dir, "failed")
+	writeStub := func(formatOutput string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "juicefs")
+		script := "#!/bin/sh\necho \"$1\" >> " + argsFile + "\n" +
+			"if [ \"$1\" = format ] && [ -n \"" + formatOutput + "\" ]; then echo \"" + formatOutput + "\" >&2; exit 1; fi\n" +
+			"if [ \"$1\" = mount ]; then\n" +
+			"  if [ ! -f " + failedFile + " ]; then touch " + failedFile + "; echo \"connection reset by peer\" >&2; exit 1; fi\n" +
+			"  for last; do :; done; echo \"juicefs is ready at $last\" >&2; exec sleep 60\n" +
+			"fi\n"
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	commands := func() []string {
+		t.Helper()
+		data, _ := os.ReadFile(argsFile)
+		os.Remove(argsFile)
+		return strings.Fields(string(data))
+	}
+	cfg := &ObjectStorageConfig{Bucket: "test-bucket", Endpoint: "http://localhost:1", Region: "auto"}
+	ctx := context.Background()
+
+	// The first mount fails transiently and the retry succeeds
+	juicefs := &JuiceFSComponent{
+		config:      cfg,
+		juicefsPath: writeStub(""),
+		mountDir:    t.TempDir(),
+		dbPath:      filepath.Join(t.TempDir(), "juicefs.sqlite"),
+	}
+	juicefs.Configure(JuiceFSConfig{MountRetryBackoffMillis: 1})
+	if err := juicefs.startMount(ctx); err != nil {
+		t.Fatalf("Expected the mount to succeed on retry: %v", err)
+	}
+	defer juicefs.Cleanup(ctx)
+	if !juicefs.Ready() {
+		t.Error("Expected the mount to be ready")
+	}
+	if got := strings.Join(commands(), ","); got != "format,mount,format,mount" {
+		t.Errorf("Expected format and mount to be retried once, got %s", got)
+	}
+
+	// Rejected credentials are not retried
+	rejected := &JuiceFSComponent{
+		config:      cfg,
+		juicefsPath: writeStub("AccessDenied: Access Denied"),
+		mountDir:    t.TempDir(),
+		dbPath:      filepath.Join(t.TempDir(), "juicefs.sqlite"),
+	}
+	rejected.Configure(JuiceFSConfig{MountRetryBackoffMillis: 1})
+	if err := rejected.startMount(ctx); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("Expected the access error, got %v", err)
+	}
+	if got := strings.Join(commands(), ","); got != "format" {
+		t.Errorf("Expected a permanent failure not to be retried, got %s", got)
+	}
+}
+
+func TestJuiceFSCheckpointDir(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointDir := filepath.Join(t.TempDir(), "checkpoints")
+	for _, dir := range []string{activeDir, checkpointDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data"), []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data", filepath.Join(activeDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir}
+	juicefs.Configure(JuiceFSConfig{CheckpointDir: checkpointDir, DiscardOnRestore: true})
+
+	// The checkpoint directory is on another filesystem, so directories are copied
+	defer func(rename func(string, string) error) { renameDir = rename }(renameDir)
+	renameDir = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	ctx := context.Background()
+	if _, err := juicefs.CreateCheckpoint(ctx, "cp-1"); err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(checkpointDir, "cp-1", "data")); err != nil || string(data) != "v1" {
+		t.Fatalf("Expected the checkpoint in the configured directory, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(basePath, "juicefs", "checkpoints", "cp-1")); !os.IsNotExist(err) {
+		t.Errorf("Expected no checkpoint inside the mount, got %v", err)
+	}
+	if ids, err := juicefs.ListCheckpoints(ctx); err != nil || !slices.Equal(ids, []string{"cp-1"}) {
+		t.Errorf("Expected to list cp-1, got %v (%v)", ids, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(activeDir, "data"), []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := juicefs.RestoreToCheckpoint(ctx, "cp-1"); err != nil {
+		t.Fatalf("Failed to restore checkpoint: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(activeDir, "link")); err != nil || string(data) != "v1" {
+		t.Errorf("Expected the checkpointed data to be restored, got %q (%v)", data, err)
+	}
+	if exists, _ := juicefs.HasCheckpoint(ctx, "cp-1"); exists {
+		t.Error("Expected the restored checkpoint to be consumed")
+	}
+	entries, _ := os.ReadDir(checkpointDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected no leftovers in the checkpoint directory, got %v", entries)
+	}
+}
+
+func TestJuiceFSRestoreKeepsPreRestoreState(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointsDir := filepath.Join(basePath, "juicefs", "checkpoints")
+	for _, dir := range []string{activeDir, checkpointsDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(activeDir, "data"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() string {
+		t.Helper()
+		data, _ := os.ReadFile(filepath.Join(activeDir, "data"))
+		return string(data)
+	}
+	// latestPreRestore returns the newest pre-restore checkpoint; undoing a restore is itself a
+	// restore, so it saves one too
+	latestPreRestore := func() string {
+		t.Helper()
+		ids, err := juicefsListPreRestore(checkpointsDir)
+		if err != nil || len(ids) == 0 {
+			t.Fatalf("Expected a pre-restore checkpoint, got %v (%v)", ids, err)
+		}
+		return slices.Max(ids)
+	}
+
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	ctx := context.Background()
+
+	write("checkpointed")
+	if _, err := juicefs.CreateCheckpoint(ctx, "cp-1"); err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	write("original")
+	if err := juicefs.RestoreToCheckpoint(ctx, "cp-1"); err != nil {
+		t.Fatalf("Failed to restore checkpoint: %v", err)
+	}
+	if got := read(); got != "checkpointed" {
+		t.Fatalf("Expected the checkpoint to be restored, got %q", got)
+	}
+
+	// Undo the restore with the saved pre-restore checkpoint
+	if err := juicefs.RestoreToCheckpoint(ctx, latestPreRestore()); err != nil {
+		t.Fatalf("Failed to restore the pre-restore checkpoint: %v", err)
+	}
+	if got := read(); got != "original" {
+		t.Errorf("Expected the original state to be recovered, got %q", got)
+	}
+
+	// A restore through the control API keeps the state it replaces too
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	if _, err := juicefs.CreateCheckpoint(ctx, "cp-2"); err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	write("newer")
+	req := httptest.NewRequest("POST", "/restore", strings.NewReader(`{"checkpoint_id": "cp-2"}`))
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected restore to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := read(); got != "original" {
+		t.Fatalf("Expected cp-2 to be restored, got %q", got)
+	}
+	if err := juicefs.RestoreToCheckpoint(ctx, latestPreRestore()); err != nil {
+		t.Fatalf("Failed to restore the pre-restore checkpoint: %v", err)
+	}
+	if got := read(); got != "newer" {
+		t.Errorf("Expected the state before the API restore to be recovered, got %q", got)
+	}
+
+	// With DiscardOnRestore the replaced state is dropped
+	juicefs.Configure(JuiceFSConfig{DiscardOnRestore: true})
+	before, _ := juicefsListPreRestore(checkpointsDir)
+	if _, err := juicefs.CreateCheckpoint(ctx, "cp-3"); err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	write("dropped")
+	if err := juicefs.RestoreToCheckpoint(ctx, "cp-3"); err != nil {
+		t.Fatalf("Failed to restore checkpoint: %v", err)
+	}
+	if after, _ := juicefsListPreRestore(checkpointsDir); len(after) != len(before) {
+		t.Errorf("Expected no new pre-restore checkpoint with DiscardOnRestore, got %v", after)
+	}
+}
+
+func TestCheckpointGraphLineage(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointsDir := filepath.Join(basePath, "juicefs", "checkpoints")
+	for _, dir := range []string{activeDir, checkpointsDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	post := func(path, id string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"checkpoint_id": "`+id+`"}`))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %s of %s to succeed, got %d: %s", path, id, w.Code, w.Body.String())
+		}
+	}
+	checkpoint := func(id, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(activeDir, "data"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		post("/checkpoint", id)
+	}
+
+	// cp-1 <- cp-2 <- cp-3, then restoring cp-1 keeps the replaced state as a child of cp-3 and
+	// consumes cp-1, which cp-2 and the next checkpoint still name as their parent
+	checkpoint("cp-1", "one")
+	checkpoint("cp-2", "two")
+	checkpoint("cp-3", "three")
+	if err := os.WriteFile(filepath.Join(activeDir, "data"), []byte("unsaved"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	post("/restore", "cp-1")
+	checkpoint("cp-4", "four")
+
+	req := httptest.NewRequest("GET", "/checkpoints/graph", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the graph, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Checkpoints map[string][]CheckpointInfo `json:"checkpoints"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode the graph: %v", err)
+	}
+	nodes := make(map[string]CheckpointInfo)
+	var order []string
+	for _, node := range resp.Checkpoints["juicefs"] {
+		nodes[node.ID] = node
+		order = append(order, node.ID)
+		if node.CreatedAt.IsZero() {
+			t.Errorf("Expected %s to have a creation time", node.ID)
+		}
+	}
+	preRestore, err := juicefsListPreRestore(checkpointsDir)
+	if err != nil || len(preRestore) != 1 {
+		t.Fatalf("Expected one pre-restore checkpoint, got %v (%v)", preRestore, err)
+	}
+	if want := []string{"cp-2", "cp-3", preRestore[0], "cp-4"}; !slices.Equal(order, want) {
+		t.Fatalf("Expected checkpoints %v oldest first, got %v", want, order)
+	}
+
+	want := map[string]struct {
+		parent   string
+		children []string
+		size     int64
+	}{
+		"cp-2":        {parent: "cp-1", children: []string{"cp-3"}, size: 3},
+		"cp-3":        {parent: "cp-2", children: []string{preRestore[0]}, size: 5},
+		preRestore[0]: {parent: "cp-3", children: []string{}, size: 7},
+		"cp-4":        {parent: "cp-1", children: []string{}, size: 4},
+	}
+	for id, exp := range want {
+		node := nodes[id]
+		if node.Parent != exp.parent || !slices.Equal(node.Children, exp.children) || node.SizeBytes != exp.size {
+			t.Errorf("Expected %s to have parent %q, children %v and size %d, got %q, %v and %d",
+				id, exp.parent, exp.children, exp.size, node.Parent, node.Children, node.SizeBytes)
+		}
+	}
+
+	// Deleting the checkpoint the environment was last at makes the next one descend from its parent
+	if err := juicefs.DeleteCheckpoint(context.Background(), "cp-4"); err != nil {
+		t.Fatalf("Failed to delete checkpoint: %v", err)
+	}
+	checkpoint("cp-5", "five")
+	if info, err := juicefs.DescribeCheckpoint(context.Background(), "cp-5"); err != nil || info.Parent != "cp-1" {
+		t.Errorf("Expected cp-5 to descend from cp-1, got %+v (%v)", info, err)
+	}
+}
+
+// juicefsListPreRestore returns the IDs of the pre-restore checkpoints in dir
+func juicefsListPreRestore(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), preRestorePrefix) {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+func TestJuiceFSRefusesIncompleteCheckpoint(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	checkpointsDir := filepath.Join(basePath, "juicefs", "checkpoints")
+	for _, dir := range []string{activeDir, filepath.Join(checkpointsDir, "partial")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(activeDir, "data"), []byte("current"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir}
+	ctx := context.Background()
+
+	// A checkpoint directory without its marker was interrupted while being created
+	if err := juicefs.RestoreToCheckpoint(ctx, "partial"); !errors.Is(err, ErrCheckpointIncomplete) {
+		t.Fatalf("Expected ErrCheckpointIncomplete, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(activeDir, "data")); err != nil || string(data) != "current" {
+		t.Errorf("Expected the active directory to be untouched, got %q (%v)", data, err)
+	}
+	if exists, _ := juicefs.HasCheckpoint(ctx, "partial"); exists {
+		t.Error("Expected an incomplete checkpoint not to exist")
+	}
+
+	if _, err := juicefs.CreateCheckpoint(ctx, "cp-1"); err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	list := func(query string) map[string]map[string][]string {
+		req := httptest.NewRequest("GET", "/checkpoints"+query, nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		var resp map[string]map[string][]string
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response %d: %v", w.Code, err)
+		}
+		return resp
+	}
+	resp := list("")
+	if !slices.Equal(resp["checkpoints"]["juicefs"], []string{"cp-1"}) || resp["incomplete"] != nil {
+		t.Errorf("Expected only the complete checkpoint, got %v", resp)
+	}
+	resp = list("?include_incomplete=true")
+	if !slices.Equal(resp["checkpoints"]["juicefs"], []string{"cp-1"}) || !slices.Equal(resp["incomplete"]["juicefs"], []string{"partial"}) {
+		t.Errorf("Expected the incomplete checkpoint to be reported, got %v", resp)
+	}
+
+	// The incomplete checkpoint can still be deleted
+	if err := juicefs.DeleteCheckpoint(ctx, "partial"); err != nil {
+		t.Fatalf("Failed to delete incomplete checkpoint: %v", err)
+	}
+	if ids, err := juicefs.ListIncompleteCheckpoints(ctx); err != nil || len(ids) != 0 {
+		t.Errorf("Expected no incomplete checkpoints left, got %v (%v)", ids, err)
+	}
+}
+
+func TestJuiceFSMetadataReplicationIntervals(t *testing.T) {
+	cfg := &ObjectStorageConfig{Bucket: "test-bucket", Endpoint: "http://localhost:1", Region: "auto", KeyPrefix: "/"}
+
+	db := NewDBManagerComponent(t.TempDir())
+	db.Configure(DBConfig{ReplicationIntervals: ReplicationIntervals{SyncIntervalSeconds: 1}})
+	j := NewJuiceFSComponent()
+	j.Configure(JuiceFSConfig{Metadata: ReplicationIntervals{SyncIntervalSeconds: 30, SnapshotIntervalSeconds: 3600}})
+
+	meta := j.newMetadataDB(cfg, filepath.Join(t.TempDir(), "juicefs.sqlite"))
+	replica := meta.litestreamDB().Replicas[0]
+	if replica.SyncInterval != 30*time.Second || replica.SnapshotInterval != time.Hour {
+		t.Errorf("Expected the metadata db to sync every 30s and snapshot hourly, got %v and %v",
+			replica.SyncInterval, replica.SnapshotInterval)
+	}
+
+	// The app database keeps its own intervals
+	app := NewDBManager(cfg, t.TempDir())
+	app.Intervals = db.settings.ReplicationIntervals
+	replica = app.litestreamDB().Replicas[0]
+	if replica.SyncInterval != time.Second || replica.SnapshotInterval != 0 {
+		t.Errorf("Expected the app db to sync every second without periodic snapshots, got %v and %v",
+			replica.SyncInterval, replica.SnapshotInterval)
+	}
+	if status := meta.Status(context.Background()); status["sync_interval_seconds"] != 30 {
+		t.Errorf("Expected the metadata sync interval in status, got %v", status["sync_interval_seconds"])
+	}
+
+	if err := (JuiceFSConfig{Metadata: ReplicationIntervals{SyncIntervalSeconds: -1}}).Metadata.validate("juicefs.metadata"); err == nil {
+		t.Error("Expected an error for a negative sync interval")
+	}
+}
+
+func TestJuiceFSStats(t *testing.T) {
+	dir := t.TempDir()
+	mountDir := filepath.Join(dir, "mount")
+	if err := os.MkdirAll(mountDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metrics := "# HELP juicefs_used_space Total used space in bytes.\n" +
+		"juicefs_used_space{mp=\"/mnt\",vol_name=\"fly\"} 1.048576e+06\n" +
+		"juicefs_used_inodes{vol_name=\"fly\"} 42\n" +
+		"juicefs_blockcache_hits_total 30\n" +
+		"juicefs_blockcache_miss 10\n" +
+		"garbage line\n"
+	if err := os.WriteFile(filepath.Join(mountDir, ".stats"), []byte(metrics), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An older JuiceFS without the Statistic section, logging before its JSON
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\necho '2024/01/01 juicefs[1] <INFO>: Meta address: sqlite3://x'\n" +
+		"echo '{\"Setting\": {\"Name\": \"fly\", \"Capacity\": 4194304, \"Inodes\": 0}, \"Sessions\": []}'\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &JuiceFSComponent{juicefsPath: binary, mountDir: mountDir, dbPath: filepath.Join(dir, "meta.db")}
+	if _, err := j.VolumeStats(context.Background()); !errors.Is(err, errComponentNotReady) {
+		t.Errorf("Expected stats to wait for the mount, got %v", err)
+	}
+	j.isReady = true
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, j)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	req := httptest.NewRequest("GET", "/stack/juicefs/stats", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var stats map[string]float64
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	want := map[string]float64{
+		"used_bytes":      1 << 20,
+		"available_bytes": 3 << 20,
+		"used_inodes":     42,
+		"cache_hits":      30,
+		"cache_misses":    10,
+		"cache_hit_rate":  0.75,
+	}
+	for name, v := range want {
+		if stats[name] != v {
+			t.Errorf("Expected %s = %v, got %v", name, v, stats[name])
+		}
+	}
+	if _, ok := stats["available_inodes"]; ok {
+		t.Error("Expected available_inodes to be omitted without an inode limit")
+	}
+
+	// A newer JuiceFS reports the volume totals itself
+	script = "#!/bin/sh\necho '{\"Setting\": {}, \"Statistic\": {\"UsedSpace\": 100, \"AvailableSpace\": 900, \"UsedInodes\": 7, \"AvailableInodes\": 93}}'\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	volume, err := j.VolumeStats(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if *volume.UsedBytes != 100 || *volume.AvailableBytes != 900 || *volume.AvailableInodes != 93 || *volume.CacheHitRate != 0.75 {
+		t.Errorf("Unexpected stats %+v", volume)
+	}
+
+	// The mount metrics are part of the component status
+	if s, ok := j.Status(context.Background())["stats"].(*JuiceFSStats); !ok || *s.UsedInodes != 42 {
+		t.Errorf("Expected mount stats in the status, got %v", j.Status(context.Background())["stats"])
+	}
+}
+
+func TestMoveDirCrossDeviceFailureKeepsSource(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "active")
+	dst := filepath.Join(base, "checkpoints", "cp-1")
+	for _, dir := range []string{src, filepath.Dir(dst)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "data"), []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A named pipe cannot be copied, so the fallback fails partway through
+	if err := syscall.Mkfifo(filepath.Join(src, "pipe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(rename func(string, string) error) { renameDir = rename }(renameDir)
+	renameDir = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	err := moveDir(src, dst)
+	if err == nil || !strings.Contains(err.Error(), "across filesystems") {
+		t.Fatalf("Expected a cross-filesystem copy error, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(src, "data")); err != nil || string(data) != "v1" {
+		t.Errorf("Expected the source to be left intact, got %q (%v)", data, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(dst)); len(entries) != 0 {
+		t.Errorf("Expected no partial copy to be left behind, got %v", entries)
+	}
+}
+
+func TestProcessWaitsForActiveDirOnMount(t *testing.T) {
+	mountDir := filepath.Join(t.TempDir(), "juicefs")
+	if err := os.MkdirAll(mountDir, 0755); err != nil {
+		t.Fatalf("Failed to create mount directory: %v", err)
+	}
+
+	// A plain directory is not a mount, so the active directory must not be accepted on it
+	juicefs := NewJuiceFSComponent()
+	if err := juicefs.prepareActiveDir(mountDir); err == nil || !strings.Contains(err.Error(), "not mounted") {
+		t.Fatalf("Expected an active directory off the mount to be rejected, got %v", err)
+	}
+	if juicefs.StartReady() {
+		t.Fatal("Expected the process to be held while the active directory is not on the mount")
+	}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	s := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{
+		TimeoutStop: 5 * time.Second,
+		PreStart:    control.WaitForStart,
+	})
+	defer s.StopProcess()
+
+	started := make(chan error, 1)
+	go func() { started <- s.StartProcess() }()
+	time.Sleep(300 * time.Millisecond)
+	if s.IsRunning() {
+		t.Fatal("Expected the process not to start before the active directory is ready")
+	}
+
+	juicefs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	if err := juicefs.prepareActiveDir(mountDir); err != nil {
+		t.Fatalf("Failed to prepare active directory: %v", err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Failed to start process: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the process to start once the active directory is ready")
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "active")); err != nil {
+		t.Errorf("Expected the active directory to exist before the process started: %v", err)
+	}
+}
+
+func TestCompactMetadataDB(t *testing.T) {
+	dir := t.TempDir()
+	dm := NewDBManager(&ObjectStorageConfig{}, dir)
+	dm.DBPath = filepath.Join(dir, "juicefs.db")
+
+	// Inflate the database, then delete most of it, leaving free pages behind
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"PRAGMA journal_mode = WAL",
+		"CREATE TABLE jfs_edge (id INTEGER PRIMARY KEY, name BLOB)",
+		"WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 5000) INSERT INTO jfs_edge (name) SELECT randomblob(512) FROM n",
+		"DELETE FROM jfs_edge WHERE id > 10",
+		"PRAGMA wal_checkpoint(TRUNCATE)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Failed to run %q: %v", stmt, err)
+		}
+	}
+
+	jfs := NewJuiceFSComponent()
+	jfs.dbManager = dm
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	compact := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/stack/juicefs/compact", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// The mount must be up, since the database is only created alongside it
+	if w := compact(); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 before the mount is ready, got %d: %s", w.Code, w.Body.String())
+	}
+
+	jfs.isReady = true
+	w := compact()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected compaction to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		BeforeBytes int64 `json:"before_bytes"`
+		AfterBytes  int64 `json:"after_bytes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.BeforeBytes < 1<<20 || resp.AfterBytes > resp.BeforeBytes/10 {
+		t.Errorf("Expected the database to shrink, got %d to %d bytes", resp.BeforeBytes, resp.AfterBytes)
+	}
+	if size, err := dm.dbSize(); err != nil || size != resp.AfterBytes {
+		t.Errorf("Expected the reported size %d on disk, got %d (%v)", resp.AfterBytes, size, err)
+	}
+
+	// The remaining rows survive
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM jfs_edge").Scan(&count); err != nil || count != 10 {
+		t.Errorf("Expected 10 rows after compaction, got %d (%v)", count, err)
+	}
+}
+
+func TestMountCrashVersusIntentionalStop(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\nif [ \"$1\" = mount ]; then for last; do :; done; echo \"juicefs is ready at $last\" >&2; exec sleep 60; fi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	jfs := NewJuiceFSComponent()
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	cfg := &SystemConfig{
+		Storage: ObjectStorageConfig{
+			Bucket:    "test-bucket",
+			Endpoint:  server.URL,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Region:    "auto",
+			KeyPrefix: "/",
+			EnvDir:    filepath.Join(dir, "env"),
+		},
+		Stacks:  []string{"juicefs"},
+		JuiceFS: JuiceFSConfig{Binary: binary, MinFreeSpaceMiB: -1},
+	}
+	ctx := context.Background()
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Failed to set up juicefs: %v", err)
+	}
+	defer jfs.Cleanup(ctx)
+
+	events := func(typ EventType) int {
+		return len(slices.DeleteFunc(control.events.Recent(0), func(e Event) bool { return e.Type != typ }))
+	}
+	lastExit := func() *mountExit {
+		exit, _ := jfs.Status(ctx)["last_exit"].(*mountExit)
+		return exit
+	}
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+		}
+	}
+
+	// Killing the mount externally is a crash: the mount is unhealthy until it is restarted
+	jfs.supervisor.process.RLock()
+	pid := jfs.supervisor.process.pid
+	jfs.supervisor.process.RUnlock()
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the crash to be recorded", func() bool { return events(EventMountCrashed) == 1 })
+	if exit := lastExit(); exit == nil || exit.Intentional || exit.PID != pid {
+		t.Errorf("Expected an unexpected exit of %d, got %+v", pid, exit)
+	}
+	if crashes := jfs.Status(ctx)["crashes"]; crashes != 1 {
+		t.Errorf("Expected 1 crash in status, got %v", crashes)
+	}
+	waitFor("the mount to be remounted", func() bool { return events(EventMountRemounted) == 1 })
+	if err := jfs.Healthy(ctx); err != nil {
+		t.Errorf("Expected the remounted mount to be healthy, got %v", err)
+	}
+
+	// Cleanup stops the mount on purpose: no crash, no remount
+	if err := jfs.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the stop to be recorded", func() bool { return events(EventMountStopped) == 1 })
+	if exit := lastExit(); exit == nil || !exit.Intentional {
+		t.Errorf("Expected an intentional exit, got %+v", exit)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if events(EventMountCrashed) != 1 || events(EventMountRemounted) != 1 || jfs.supervisor.IsRunning() {
+		t.Error("Expected an intentional stop not to be handled as a crash")
+	}
+}
+
+func TestDataQuotaEvictsOldCheckpoints(t *testing.T) {
+	envDir := t.TempDir()
+	checkpointDir := filepath.Join(envDir, "checkpoints")
+	jfs := NewJuiceFSComponent()
+	jfs.Configure(JuiceFSConfig{CheckpointDir: checkpointDir})
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+	cfg := &SystemConfig{
+		Storage:   ObjectStorageConfig{EnvDir: envDir},
+		Stacks:    []string{"juicefs"},
+		DataQuota: DataQuotaConfig{MaxSizeMiB: 4},
+	}
+
+	writeMiB := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, 1<<20), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Live data and four checkpoints of 1 MiB each fill the directory past its 4 MiB quota
+	writeMiB(filepath.Join(envDir, "db", "juicefs.sqlite"))
+	created := time.Now().Add(-time.Hour)
+	for i := 1; i <= 4; i++ {
+		id := fmt.Sprintf("cp-%d", i)
+		writeMiB(filepath.Join(checkpointDir, id, "data"))
+		marker := filepath.Join(checkpointDir, id) + checkpointCompleteSuffix
+		if err := os.WriteFile(marker, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(marker, created, created); err != nil {
+			t.Fatal(err)
+		}
+		created = created.Add(time.Minute)
+	}
+	// The oldest checkpoint is the current one and must survive
+	if err := control.saveCurrentCheckpoint("cp-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := control.enforceDataQuota(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("enforceDataQuota failed: %v", err)
+	}
+	if usage >= cfg.DataQuota.threshold() {
+		t.Errorf("Expected usage below %d bytes after eviction, got %d", cfg.DataQuota.threshold(), usage)
+	}
+	if measured, _ := diskUsage(envDir); measured != usage {
+		t.Errorf("Expected reported usage %d to match the directory size %d", usage, measured)
+	}
+	ids, err := jfs.ListCheckpoints(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{"cp-1", "cp-4"}) {
+		t.Errorf("Expected the two oldest evictable checkpoints to be evicted, keeping cp-1 and cp-4, got %v", ids)
+	}
+	if _, err := os.Stat(filepath.Join(envDir, "db", "juicefs.sqlite")); err != nil {
+		t.Errorf("Expected live data to be kept: %v", err)
+	}
+	evicted := slices.DeleteFunc(control.events.Recent(0), func(e Event) bool { return e.Type != EventDataEvicted })
+	if len(evicted) != 2 {
+		t.Errorf("Expected 2 data_evicted events, got %d", len(evicted))
+	}
+}
+
+func TestFailedSetupStopsMountAndReplication(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\nif [ \"$1\" = mount ]; then for last; do :; done; echo \"juicefs is ready at $last\" >&2; exec sleep 60; fi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A checkpoint directory below a regular file cannot be created, failing setup after the mount is ready
+	blocker := filepath.Join(dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jfs := NewJuiceFSComponent()
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	jfs.Configure(JuiceFSConfig{Binary: binary, MinFreeSpaceMiB: -1, CheckpointDir: filepath.Join(blocker, "checkpoints")})
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+		EnvDir:    filepath.Join(dir, "env"),
+	}
+	err := jfs.Setup(context.Background(), cfg, binary)
+	if err == nil || !strings.Contains(err.Error(), "checkpoints directory") {
+		t.Fatalf("Expected setup to fail creating the checkpoints directory, got %v", err)
+	}
+
+	if jfs.supervisor == nil {
+		t.Fatal("Expected the mount process to have been started before the failure")
+	}
+	if jfs.supervisor.IsRunning() {
+		t.Error("Expected the mount process to be stopped after the failed setup")
+	}
+	if jfs.dbManager.replicating {
+		t.Error("Expected metadata replication to be stopped after the failed setup")
+	}
+	if jfs.Ready() {
+		t.Error("Expected the failed mount not to be ready")
+	}
+}
+
+func TestJuiceFSFsyncCheckpoints(t *testing.T) {
+	var ops []string
+	defer func(rename func(string, string) error) { renameDir = rename }(renameDir)
+	renameDir = func(oldpath, newpath string) error {
+		ops = append(ops, "rename "+filepath.Base(oldpath)+" "+filepath.Base(newpath))
+		return os.Rename(oldpath, newpath)
+	}
+	defer func(sync func(string) error) { syncDir = sync }(syncDir)
+	syncDir = func(dir string) error {
+		ops = append(ops, "sync "+filepath.Base(dir))
+		return nil
+	}
+
+	for _, enabled := range []bool{false, true} {
+		ops = nil
+		basePath := t.TempDir()
+		activeDir := filepath.Join(basePath, "juicefs", "active")
+		for _, dir := range []string{activeDir, filepath.Join(basePath, "juicefs", "checkpoints")} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir}
+		juicefs.Configure(JuiceFSConfig{FsyncCheckpoints: enabled, DiscardOnRestore: true})
+
+		ctx := context.Background()
+		if _, err := juicefs.CreateCheckpoint(ctx, "cp-1"); err != nil {
+			t.Fatalf("Failed to create checkpoint: %v", err)
+		}
+		if err := juicefs.RestoreToCheckpoint(ctx, "cp-1"); err != nil {
+			t.Fatalf("Failed to restore checkpoint: %v", err)
+		}
+
+		// Each rename is followed by syncing the directories it changed before the operation returns
+		want := []string{"rename active cp-1", "rename cp-1 active"}
+		if enabled {
+			want = []string{"rename active cp-1", "sync juicefs", "sync checkpoints", "rename cp-1 active", "sync juicefs", "sync checkpoints"}
+		}
+		if !slices.Equal(ops, want) {
+			t.Errorf("fsync %v: expected %v, got %v", enabled, want, ops)
+		}
+	}
+}
+
+func TestJuiceFSCacheSettings(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\n" +
+		"if [ \"$1\" = mount ]; then for last; do :; done; echo \"juicefs is ready at $last\" >&2; exec sleep 60; fi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	jfs := NewJuiceFSComponent()
+	jfs.activeOnMount = func(activeDir, mountDir string) error { return nil }
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, jfs)
+
+	// The cache is tuned in the juicefs block of the config
+	cacheDir := filepath.Join(dir, "cache")
+	body := fmt.Sprintf(`{"stacks": ["juicefs"],
+		"storage": {"bucket": "test-bucket", "endpoint": %q, "access_key": "key", "secret_key": "secret", "region": "auto", "env_dir": %q},
+		"juicefs": {"binary": %q, "min_free_space_mib": -1, "cache_size_mib": 2048, "cache_dir": %q}}`,
+		server.URL, filepath.Join(dir, "env"), binary, cacheDir)
+	cfg := DefaultSystemConfig()
+	if err := decodeConfig(strings.NewReader(body), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.setupComponents(context.Background(), &cfg); err != nil {
+		t.Fatalf("Failed to set up juicefs: %v", err)
+	}
+	defer jfs.Cleanup(context.Background())
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mountArgs string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "mount ") {
+			mountArgs = line
+		}
+	}
+	if !strings.Contains(mountArgs, "--cache-size 2048") || !strings.Contains(mountArgs, "--cache-dir "+cacheDir) {
+		t.Errorf("Expected the cache settings to reach the mount, got %q", mountArgs)
+	}
+
+	cfg.JuiceFS.CacheDir = "relative/cache"
+	if err := cfg.validate(); err == nil {
+		t.Error("Expected a relative cache directory to be rejected")
+	}
+}
+
+func TestActiveTarStreamsActiveDirectory(t *testing.T) {
+	basePath := t.TempDir()
+	activeDir := filepath.Join(basePath, "juicefs", "active")
+	if err := os.MkdirAll(filepath.Join(activeDir, "uploads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"app.db": "tables", "uploads/photo.jpg": "pixels"}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(activeDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("app.db", filepath.Join(activeDir, "current.db")); err != nil {
+		t.Fatal(err)
+	}
+	juicefs := &JuiceFSComponent{basePath: basePath, activeDir: activeDir, isReady: true}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"juicefs"}}
+	control.setupRoutes()
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/stack/juicefs/active.tar", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// It exposes user data, so it is off until enabled
+	if w := get(); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 while disabled, got %d: %s", w.Code, w.Body.String())
+	}
+
+	control.SetActiveTar(ActiveTarConfig{Enabled: true})
+	w := get()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("Expected a tar, got %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	got := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(w.Body.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Invalid tar: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, _ := io.ReadAll(tr)
+			got[hdr.Name] = string(data)
+		case tar.TypeSymlink:
+			got[hdr.Name] = "-> " + hdr.Linkname
+		case tar.TypeDir:
+			got[hdr.Name] = "dir"
+		}
+	}
+	want := map[string]string{"app.db": "tables", "uploads/": "dir", "uploads/photo.jpg": "pixels", "current.db": "-> app.db"}
+	if !maps.Equal(got, want) {
+		t.Errorf("Expected the tar to hold %v, got %v", want, got)
+	}
+
+	// A directory over the limit is refused before anything is streamed
+	if err := os.WriteFile(filepath.Join(activeDir, "big.bin"), make([]byte, 2<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	control.SetActiveTar(ActiveTarConfig{Enabled: true, MaxMiB: 1})
+	if w := get(); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 over the size limit, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// juicefsStatsTimeout bounds the `juicefs status` run behind a stats request
+const juicefsStatsTimeout = 30 * time.Second
+
+// JuiceFSStats are usage and cache statistics of the JuiceFS volume. Figures the running JuiceFS
+// version does not report are omitted rather than reported as zero.
+type JuiceFSStats struct {
+	UsedBytes       *int64   `json:"used_bytes,omitempty"`
+	AvailableBytes  *int64   `json:"available_bytes,omitempty"`
+	UsedInodes      *int64   `json:"used_inodes,omitempty"`
+	AvailableInodes *int64   `json:"available_inodes,omitempty"`
+	CacheHits       *int64   `json:"cache_hits,omitempty"`
+	CacheMisses     *int64   `json:"cache_misses,omitempty"`
+	CacheHitRate    *float64 `json:"cache_hit_rate,omitempty"`
+}
+
+// parseMountMetrics parses the Prometheus-style `.stats` file at the root of a mount into metric
+// totals. Labels are ignored, series of the same metric are summed and a _total suffix is dropped,
+// so names match across JuiceFS versions.
+func parseMountMetrics(data []byte) map[string]float64 {
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], "{")
+		metrics[strings.TrimSuffix(name, "_total")] += value
+	}
+	return metrics
+}
+
+// applyMountMetrics fills the usage and cache figures found in the mount's metrics
+func (s *JuiceFSStats) applyMountMetrics(metrics map[string]float64) {
+	counter := func(names ...string) *int64 {
+		for _, name := range names {
+			if v, ok := metrics[name]; ok {
+				n := int64(v)
+				return &n
+			}
+		}
+		return nil
+	}
+	s.UsedBytes = counter("juicefs_used_space")
+	s.UsedInodes = counter("juicefs_used_inodes")
+	s.CacheHits = counter("juicefs_blockcache_hits")
+	s.CacheMisses = counter("juicefs_blockcache_miss", "juicefs_blockcache_misses")
+	if s.CacheHits != nil && s.CacheMisses != nil && *s.CacheHits+*s.CacheMisses > 0 {
+		rate := float64(*s.CacheHits) / float64(*s.CacheHits+*s.CacheMisses)
+		s.CacheHitRate = &rate
+	}
+}
+
+// applyVolumeStatus fills the usage figures from `juicefs status` output. Only versions 1.1 and
+// later report a Statistic section; for older ones the configured capacity bounds the free space.
+func (s *JuiceFSStats) applyVolumeStatus(output []byte) error {
+	// Log lines may precede the JSON document
+	if i := bytes.IndexByte(output, '{'); i > 0 {
+		output = output[i:]
+	}
+	var status struct {
+		Setting struct {
+			Capacity int64
+			Inodes   int64
+		}
+		Statistic *struct {
+			UsedSpace       int64
+			AvailableSpace  int64
+			UsedInodes      int64
+			AvailableInodes int64
+		}
+	}
+	if err := json.NewDecoder(bytes.NewReader(output)).Decode(&status); err != nil {
+		return fmt.Errorf("failed to parse juicefs status output: %w", err)
+	}
+	if st := status.Statistic; st != nil {
+		s.UsedBytes, s.AvailableBytes = &st.UsedSpace, &st.AvailableSpace
+		s.UsedInodes, s.AvailableInodes = &st.UsedInodes, &st.AvailableInodes
+		return nil
+	}
+	if s.UsedBytes != nil && status.Setting.Capacity > 0 {
+		available := max(status.Setting.Capacity-*s.UsedBytes, 0)
+		s.AvailableBytes = &available
+	}
+	if s.UsedInodes != nil && status.Setting.Inodes > 0 {
+		available := max(status.Setting.Inodes-*s.UsedInodes, 0)
+		s.AvailableInodes = &available
+	}
+	return nil
+}
+
+// mountStats reads the usage and cache figures from the mount's `.stats` file, which is cheap
+// enough for every status request; nil is returned when the file cannot be read
+func mountStats(mountDir string) *JuiceFSStats {
+	data, err := os.ReadFile(filepath.Join(mountDir, ".stats"))
+	if err != nil {
+		logDebugf("Failed to read JuiceFS mount statistics: %v", err)
+		return nil
+	}
+	stats := &JuiceFSStats{}
+	stats.applyMountMetrics(parseMountMetrics(data))
+	return stats
+}
+
+// Stats implements StatsProvider
+func (j *JuiceFSComponent) Stats(ctx context.Context) (interface{}, error) {
+	return j.VolumeStats(ctx)
+}
+
+// VolumeStats returns the volume's usage and cache statistics, combining the mount's metrics with
+// the volume totals reported by `juicefs status`
+func (j *JuiceFSComponent) VolumeStats(ctx context.Context) (*JuiceFSStats, error) {
+	j.mu.RLock()
+	ready, mountDir, juicefsPath, dbPath, cfg := j.isReady, j.mountDir, j.juicefsPath, j.dbPath, j.config
+	j.mu.RUnlock()
+	if !ready {
+		return nil, errComponentNotReady
+	}
+
+	stats := mountStats(mountDir)
+	if stats == nil {
+		stats = &JuiceFSStats{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, juicefsStatsTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, juicefsPath, "status", fmt.Sprintf("sqlite3://%s", dbPath))
+	if cfg != nil {
+		cmd.Env = append(os.Environ(), cfg.awsEnv()...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("juicefs status failed: %w\nOutput: %s", err, stderr.String())
+	}
+	if err := stats.applyVolumeStatus(output); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+)
+
+// Key layout versions. The layout decides where each component keeps its objects under the key
+// prefix; a new version places them under a namespace no earlier version uses, so environments
+// can move to it without their objects colliding with the old ones.
+const (
+	// KeyLayoutV1 is the original layout with each component at the top of the key prefix
+	KeyLayoutV1 = 1
+	// KeyLayoutV2 groups every object of the environment under <key_prefix>/v2/
+	KeyLayoutV2 = 2
+	// DefaultKeyLayout is used when no layout is configured, so existing data stays where it is
+	DefaultKeyLayout = KeyLayoutV1
+	// latestKeyLayout is the newest layout version
+	latestKeyLayout = KeyLayoutV2
+)
+
+// keyLayout derives the object keys of every component from the key prefix and environment ID
+type keyLayout struct {
+	version int
+	prefix  string // the environment's key prefix, see ObjectStorageConfig.keyPrefix
+}
+
+// layout returns the key layout of the environment
+func (cfg *ObjectStorageConfig) layout() keyLayout {
+	version := cfg.KeyLayout
+	if version == 0 {
+		version = DefaultKeyLayout
+	}
+	return keyLayout{version: version, prefix: cfg.keyPrefix()}
+}
+
+// validateKeyLayout checks that the configured key layout is a known version
+func (cfg *ObjectStorageConfig) validateKeyLayout() error {
+	if cfg.KeyLayout < 0 || cfg.KeyLayout > latestKeyLayout {
+		return fmt.Errorf("unknown key_layout %d: use 1 to %d", cfg.KeyLayout, latestKeyLayout)
+	}
+	return nil
+}
+
+// key joins a key relative to the layout's root
+func (l keyLayout) key(v1, v2 string) string {
+	if l.version == KeyLayoutV1 {
+		return path.Join(l.prefix, v1)
+	}
+	return path.Join(l.prefix, "v2", v2)
+}
+
+// lease returns the key of the environment's lock object
+func (l keyLayout) lease() string {
+	return l.key("leases/fly.lock", "lease/fly.lock")
+}
+
+// replica returns the key prefix holding the snapshots and WAL of the named database
+func (l keyLayout) replica(name string) string {
+	return path.Join(l.key("litestream", "db"), name)
+}
+
+// sync returns the key prefix holding the mirrored directory, with a trailing slash
+func (l keyLayout) sync() string {
+	return l.key("sync", "sync") + "/"
+}
+
+// config returns the key of the stored config
+func (l keyLayout) config() string {
+	return l.key("fly-user-env/config.json", "config/current.json")
+}
+
+// configHistory returns the key prefix holding the config history, with a trailing slash
+func (l keyLayout) configHistory() string {
+	return l.key("fly-user-env/config-history", "config/history") + "/"
+}
+
+// scratch returns the key prefix of short-lived objects, such as write tests and self tests
+func (l keyLayout) scratch() string {
+	return l.key("fly-user-env", "tmp")
+}
+
+// juicefsVolume returns the JuiceFS volume name. JuiceFS keeps its objects under the volume name
+// at the top of the bucket, not under the key prefix, so the name is what separates the versions.
+func (l keyLayout) juicefsVolume() string {
+	if l.version == KeyLayoutV1 {
+		return "juicefs"
+	}
+	return "juicefs-v2"
+}
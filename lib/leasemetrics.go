@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsExporter is implemented by components that expose their own metrics on the metrics
+// endpoint, after the proxy counters
+type MetricsExporter interface {
+	// WriteMetrics writes the component's metrics in the Prometheus text format
+	WriteMetrics(w io.Writer)
+}
+
+// LeaseMetrics counts the leadership lifecycle of the leaser, so flapping leadership or failing
+// renewals can be alerted on before the lease is lost and the environment fenced
+type LeaseMetrics struct {
+	acquisitions    atomic.Uint64
+	renewals        atomic.Uint64
+	renewalFailures atomic.Uint64
+	losses          atomic.Uint64
+	lastRenewal     atomic.Int64 // unix nanoseconds of the last acquisition or renewal, zero if none
+}
+
+// Acquisitions returns how many times the lease was acquired
+func (m *LeaseMetrics) Acquisitions() uint64 { return m.acquisitions.Load() }
+
+// Renewals returns how many times the held lease was renewed
+func (m *LeaseMetrics) Renewals() uint64 { return m.renewals.Load() }
+
+// RenewalFailures returns how many renewals failed, whether or not the lease was lost
+func (m *LeaseMetrics) RenewalFailures() uint64 { return m.renewalFailures.Load() }
+
+// Losses returns how many times the held lease was lost
+func (m *LeaseMetrics) Losses() uint64 { return m.losses.Load() }
+
+// renewed records an acquisition or renewal at now
+func (m *LeaseMetrics) renewed(now time.Time) {
+	m.lastRenewal.Store(now.UnixNano())
+}
+
+// sinceRenewal returns the time since the lease was last acquired or renewed, and false if it never was
+func (m *LeaseMetrics) sinceRenewal(now time.Time) (time.Duration, bool) {
+	last := m.lastRenewal.Load()
+	if last == 0 {
+		return 0, false
+	}
+	return now.Sub(time.Unix(0, last)), true
+}
+
+// Metrics returns the leadership lifecycle counters of the leaser
+func (l *LeaserComponent) Metrics() *LeaseMetrics {
+	return &l.metrics
+}
+
+// WriteMetrics writes the leadership lifecycle metrics in the Prometheus text format
+func (l *LeaserComponent) WriteMetrics(w io.Writer) {
+	m := &l.metrics
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"fly_lease_acquisitions_total", "Times the lease was acquired.", m.Acquisitions()},
+		{"fly_lease_renewals_total", "Times the held lease was renewed.", m.Renewals()},
+		{"fly_lease_renewal_failures_total", "Lease renewals that failed, whether or not the lease was lost.", m.RenewalFailures()},
+		{"fly_lease_losses_total", "Times the held lease was lost to another machine or expired.", m.Losses()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	held := 0
+	if l.HeldLease() != nil {
+		held = 1
+	}
+	fmt.Fprintln(w, "# HELP fly_lease_held Whether this machine holds the lease.")
+	fmt.Fprintln(w, "# TYPE fly_lease_held gauge")
+	fmt.Fprintf(w, "fly_lease_held %d\n", held)
+	// rule: the age is only exposed once the lease was held, so a standby does not look like a stalled holder
+	if since, ok := m.sinceRenewal(time.Now()); ok {
+		fmt.Fprintln(w, "# HELP fly_lease_seconds_since_renewal Seconds since the lease was last acquired or renewed.")
+		fmt.Fprintln(w, "# TYPE fly_lease_seconds_since_renewal gauge")
+		fmt.Fprintf(w, "fly_lease_seconds_since_renewal %.3f\n", since.Seconds())
+	}
+}
+
+// handleMetrics serves the proxy counters followed by the metrics of every component that exports any
+func (c *Control) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	c.metrics.ServeHTTP(w, r)
+	for _, component := range c.components {
+		if exporter, ok := component.(MetricsExporter); ok {
+			exporter.WriteMetrics(w)
+		}
+	}
+}
@@ -2,79 +2,695 @@ package lib
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"os"
+	"slices"
+	"sync"
 	"time"
 
-	lss3 "github.com/benbjohnson/litestream/s3"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/benbjohnson/litestream"
 )
 
 // LeaserComponent implements StackComponent for S3 lease management
 type LeaserComponent struct {
-	Leaser *lss3.Leaser
+	// Leaser writes the lock objects; once set up it is replaced only under mu, e.g. when
+	// credentials are refreshed while renewal runs, so it is read through leaser()
+	Leaser litestream.Leaser
 	owner  string
+
+	// RetryBase is the initial wait between attempts to acquire a contended lease.
+	RetryBase time.Duration
+	// RetryCap is the maximum wait between attempts to acquire a contended lease.
+	RetryCap time.Duration
+	// RetryJitter is the fraction of each wait that is randomized, between 0 and 1.
+	RetryJitter float64
+	// CorruptLeaseGrace opts in to breaking a lease whose lock object cannot be parsed: once it has
+	// stayed unreadable for this long, it is deleted and acquisition proceeds. Zero disables it.
+	CorruptLeaseGrace time.Duration
+	// ReleaseTimeout bounds releasing every lease so a hung object store cannot stall shutdown.
+	// Zero leaves it to the caller's context.
+	ReleaseTimeout time.Duration
+	// ReleaseConcurrency caps how many epochs are released at once.
+	ReleaseConcurrency int
+	// AcquireTimeout bounds waiting for leadership during environment setup. The default outlasts
+	// the lease timeout, so a lease abandoned by a crashed machine expires before setup gives up.
+	AcquireTimeout time.Duration
+	// RenewInterval is how often the held lease is renewed. It must be well under the lease
+	// timeout so a few failed renewals in a row do not let the lease expire.
+	RenewInterval time.Duration
+	// ExpiryGrace is the margin past the lease timeout before other machines treat the lease as
+	// expired, absorbing clock skew between machines. The holder still treats its lease as valid
+	// for the lease timeout only, so failover after a crash takes this much longer.
+	ExpiryGrace time.Duration
+
+	mu        sync.Mutex        // protects the fields below
+	lease     *litestream.Lease // lease held since setup, nil if none
+	leaseTill time.Time         // when the holder stops trusting lease, on the monotonic clock
+	renewedAt time.Time         // when the request that acquired or last renewed lease was sent
+	lost      error             // why the lease was lost, nil while held or never acquired
+	onLost    func(error)       // called once when the held lease is lost
+	renewStop chan struct{}     // closed to stop the renewal loop
+	renewDone chan struct{}     // closed once the renewal loop has stopped
+	observing bool              // on a standby: the lease is observed, never acquired or released
+	metrics   LeaseMetrics      // leadership lifecycle counters, exposed on the metrics endpoint
+
+	// open creates the leaser on setup, writing leases with the given timeout; replaceable in tests
+	open   func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error)
+	wait   func(ctx context.Context, d time.Duration) error
+	events *EventLog
 }
 
 func NewLeaserComponent() *LeaserComponent {
 	return &LeaserComponent{
-		owner: fmt.Sprintf("%s-%d", os.Getenv("HOSTNAME"), os.Getpid()),
+		owner:              fmt.Sprintf("%s-%d", os.Getenv("HOSTNAME"), os.Getpid()),
+		RetryBase:          litestream.LeaseRetryInterval,
+		RetryCap:           30 * time.Second,
+		RetryJitter:        0.2,
+		ReleaseTimeout:     30 * time.Second,
+		ReleaseConcurrency: 8,
+		AcquireTimeout:     6 * time.Minute,
+		RenewInterval:      leaseTimeout / 5,
+		ExpiryGrace:        defaultLeaseExpiryGrace,
+		open:               openS3Leaser,
+		wait:               sleepContext,
+	}
+}
+
+// leaseTimeout is how long an acquired lease is held before it expires unless renewed
+const leaseTimeout = 5 * time.Minute
+
+// defaultLeaseExpiryGrace is the margin past the lease timeout before a lease is taken over when not configured
+const defaultLeaseExpiryGrace = 30 * time.Second
+
+// maxLeaseExpiryGrace bounds the grace period so a lease abandoned by a crashed machine still
+// expires within the default acquire timeout
+const maxLeaseExpiryGrace = 60 * time.Second
+
+// LeaserConfig holds settings for the leaser component
+type LeaserConfig struct {
+	// ExpiryGraceSeconds is how long past its timeout a lease held by another machine is still
+	// honored, to absorb clock skew. Zero uses the default of 30 seconds; a negative value disables it.
+	ExpiryGraceSeconds int `json:"expiry_grace_seconds,omitempty"`
+}
+
+// expiryGrace returns the configured grace period
+func (cfg LeaserConfig) expiryGrace() time.Duration {
+	switch {
+	case cfg.ExpiryGraceSeconds < 0:
+		return 0
+	case cfg.ExpiryGraceSeconds == 0:
+		return defaultLeaseExpiryGrace
+	default:
+		return time.Duration(cfg.ExpiryGraceSeconds) * time.Second
+	}
+}
+
+// validate checks the leaser settings
+func (cfg LeaserConfig) validate() error {
+	if cfg.expiryGrace() > maxLeaseExpiryGrace {
+		return fmt.Errorf("leaser.expiry_grace_seconds must be at most %d", int(maxLeaseExpiryGrace.Seconds()))
+	}
+	return nil
+}
+
+// Configure sets the leaser settings. It must be called before Setup.
+func (l *LeaserComponent) Configure(settings LeaserConfig) {
+	l.ExpiryGrace = settings.expiryGrace()
+}
+
+// validUntil returns when the holder stops trusting the lease.
+// rule: leases are written with the grace period added to their timeout, so other machines wait
+// it out while the holder gives up at the plain timeout; clock skew up to the grace cannot
+// make both believe they hold it
+func (l *LeaserComponent) validUntil(lease *litestream.Lease) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lease != nil && lease == l.lease && !l.leaseTill.IsZero() {
+		return l.leaseTill
+	}
+	return lease.Deadline().Add(-l.ExpiryGrace)
+}
+
+// holdLease records lease as held. l.mu must be held.
+// rule: the held lease is trusted for its timeout counted on the monotonic clock from when the
+// request writing it was sent, never from its ModTime: that is a wall-clock time, possibly from
+// object storage's clock, so an NTP step could otherwise expire the lease early or keep it late.
+// Counting from the request keeps the holder's deadline at or before the one other machines see.
+func (l *LeaserComponent) holdLease(lease *litestream.Lease, sent time.Time) {
+	l.lease = lease
+	l.leaseTill = sent.Add(lease.Timeout - l.ExpiryGrace)
+	l.renewedAt = sent
+}
+
+// clockJumpThreshold is how far the wall clock may drift from the monotonic clock between
+// renewals before the jump is reported
+const clockJumpThreshold = 5 * time.Second
+
+// checkClockJump warns when the wall clock was stepped since the held lease was last renewed.
+// The lease deadline does not depend on the wall clock, but other machines judge its expiry by
+// theirs, so a jump is worth knowing about.
+func (l *LeaserComponent) checkClockJump(now time.Time) {
+	l.mu.Lock()
+	renewedAt := l.renewedAt
+	l.mu.Unlock()
+	if renewedAt.IsZero() {
+		return
+	}
+	// rule: Round(0) strips the monotonic reading, so the first difference is wall-clock time
+	jump := now.Round(0).Sub(renewedAt.Round(0)) - now.Sub(renewedAt)
+	if jump.Abs() >= clockJumpThreshold {
+		logWarnf("Wall clock jumped by %v since the lease was last renewed; its expiry follows the monotonic clock", jump)
+		l.events.Record(EventClockJump, "leaser", fmt.Sprintf("wall clock jumped by %v", jump), nil)
+	}
+}
+
+// SetLeaseLostHandler sets the function called when the held lease is lost to another machine
+// or expires before it could be renewed. It runs on the renewal goroutine.
+func (l *LeaserComponent) SetLeaseLostHandler(fn func(error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onLost = fn
+}
+
+// SetEventLog sets the event log that lease events are recorded to
+func (l *LeaserComponent) SetEventLog(events *EventLog) {
+	l.events = events
+}
+
+// sleepContext waits for the given duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AcquireLease blocks until the lease is acquired or the context is done.
+// Attempts against a contended lease are spaced with jittered, capped exponential backoff.
+func (l *LeaserComponent) AcquireLease(ctx context.Context) (*litestream.Lease, error) {
+	lease, _, err := l.acquireLease(ctx)
+	return lease, err
+}
+
+// acquireLease acquires the lease like AcquireLease, also returning when the successful attempt was sent
+func (l *LeaserComponent) acquireLease(ctx context.Context) (*litestream.Lease, time.Time, error) {
+	if l.leaser() == nil {
+		return nil, time.Time{}, fmt.Errorf("leaser not initialized")
+	}
+
+	var corruptSince time.Time
+	for attempt := 0; ; attempt++ {
+		sent := time.Now()
+		lease, err := l.leaser().AcquireLease(ctx)
+
+		// rule: an unreadable lock object would otherwise wedge acquisition forever
+		if l.CorruptLeaseGrace > 0 && isCorruptLease(err) {
+			if corruptSince.IsZero() {
+				corruptSince = time.Now()
+			}
+			if time.Since(corruptSince) >= l.CorruptLeaseGrace {
+				if err := l.breakCorruptLease(ctx, err); err != nil {
+					return nil, time.Time{}, err
+				}
+				corruptSince = time.Time{}
+				continue
+			}
+			interval := l.retryInterval(attempt)
+			logWarnf("Lease lock object is unreadable (%v), retrying in %v", err, interval)
+			if err := l.wait(ctx, interval); err != nil {
+				return nil, time.Time{}, err
+			}
+			continue
+		}
+
+		var existsErr *litestream.LeaseExistsError
+		if !errors.As(err, &existsErr) {
+			if err == nil {
+				l.events.Record(EventLeaseAcquired, "leaser", "", map[string]string{"epoch": fmt.Sprint(lease.Epoch)})
+			}
+			return lease, sent, err
+		}
+
+		interval := l.retryInterval(attempt)
+		logInfof("Lease held by %q (epoch %d), retrying in %v", existsErr.Lease.Owner, existsErr.Lease.Epoch, interval)
+		if err := l.wait(ctx, interval); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+}
+
+// isCorruptLease reports whether err is a failure to parse a lease lock object
+func isCorruptLease(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// breakCorruptLease deletes the latest lock object, which has been unreadable for the grace period
+func (l *LeaserComponent) breakCorruptLease(ctx context.Context, cause error) error {
+	leaser := l.leaser()
+	epochs, err := leaser.Epochs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list epochs: %w", err)
+	}
+	if len(epochs) == 0 {
+		return fmt.Errorf("lease lock object is unreadable: %w", cause)
+	}
+	epoch := epochs[len(epochs)-1]
+	logWarnf("Lease lock object for epoch %d has been unreadable for over %v (%v); deleting it to allow acquisition",
+		epoch, l.CorruptLeaseGrace, cause)
+	if err := leaser.DeleteLease(ctx, epoch); err != nil {
+		return fmt.Errorf("failed to delete corrupt lease %d: %w", epoch, err)
+	}
+	l.events.Record(EventLeaseReleased, "leaser", "corrupt lease deleted", map[string]string{"epoch": fmt.Sprint(epoch)})
+	return nil
+}
+
+// retryInterval returns the wait before the given retry attempt.
+// The jitter only shortens the interval so successive intervals still grow until the cap.
+func (l *LeaserComponent) retryInterval(attempt int) time.Duration {
+	interval := l.RetryBase
+	for i := 0; i < attempt && interval < l.RetryCap; i++ {
+		interval *= 2
+	}
+	if interval > l.RetryCap {
+		interval = l.RetryCap
 	}
+	return interval - time.Duration(float64(interval)*l.RetryJitter*rand.Float64())
+}
+
+// Name returns the stack name of the leaser component
+func (l *LeaserComponent) Name() string {
+	return "leaser"
 }
 
 func (l *LeaserComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
-	leaser := lss3.NewLeaser()
-	leaser.Bucket = cfg.Bucket
-	leaser.Endpoint = cfg.Endpoint
-	leaser.AccessKeyID = cfg.AccessKey
-	leaser.SecretAccessKey = cfg.SecretKey
-	leaser.Region = cfg.Region
-	leaser.ForcePathStyle = true
-	leaser.Path = "leases/fly.lock"
-	leaser.Owner = l.owner
-	leaser.LeaseTimeout = 5 * time.Minute
+	leaser, err := l.open(cfg, l.owner, leaseTimeout+l.ExpiryGrace)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.Leaser = leaser
+	l.mu.Unlock()
+	return nil
+}
+
+// leaser returns the current leaser, or nil before setup
+func (l *LeaserComponent) leaser() litestream.Leaser {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Leaser
+}
+
+// leasePath returns the object key prefix of the environment's lease.
+// rule: the lease lives under the key prefix so environments sharing a bucket do not contend for one lease
+func leasePath(cfg *ObjectStorageConfig) string {
+	return cfg.layout().lease()
+}
+
+// openS3Leaser opens the S3 leaser of the environment's lock object
+func openS3Leaser(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+	leaser, err := newS3Leaser(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure leaser: %w", err)
+	}
+	leaser.Path = leasePath(cfg)
+	leaser.Owner = owner
+	leaser.LeaseTimeout = timeout
 
 	if err := leaser.Open(); err != nil {
-		return fmt.Errorf("failed to open leaser: %w", err)
+		return nil, fmt.Errorf("failed to open leaser: %w", err)
 	}
+	sess, err := cfg.newSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open leaser: %w", err)
+	}
+	return &timeoutLeaser{Leaser: leaser, timeout: cfg.requestTimeout(), s3: s3.New(sess), bucket: cfg.Bucket, path: leaser.Path}, nil
+}
 
-	l.Leaser = leaser
+// AcquireLeadership blocks until the lease is held, giving up after AcquireTimeout.
+// The environment calls it before setting up any component that writes to shared storage.
+func (l *LeaserComponent) AcquireLeadership(ctx context.Context) error {
+	if l.AcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.AcquireTimeout)
+		defer cancel()
+	}
+	lease, sent, err := l.acquireLease(ctx)
+	if err != nil {
+		return classifyStorageFailure(fmt.Sprintf("failed to acquire lease within %v", l.AcquireTimeout), err)
+	}
+	l.mu.Lock()
+	l.holdLease(lease, sent)
+	l.lost = nil
+	l.mu.Unlock()
+	l.metrics.acquisitions.Add(1)
+	l.metrics.renewed(time.Now())
+	logInfof("Acquired lease (epoch %d)", lease.Epoch)
+	l.startRenewal()
 	return nil
 }
 
-func (l *LeaserComponent) Cleanup(ctx context.Context) error {
-	if l.Leaser != nil {
-		// Get all epochs to find active leases
-		epochs, err := l.Leaser.Epochs(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to list epochs: %w", err)
+// startRenewal starts renewing the held lease every RenewInterval
+func (l *LeaserComponent) startRenewal() {
+	l.stopRenewal()
+	if l.RenewInterval <= 0 {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	l.mu.Lock()
+	l.renewStop, l.renewDone = stop, done
+	l.mu.Unlock()
+	go l.renewLoop(l.RenewInterval, stop, done)
+}
+
+// stopRenewal stops the renewal loop, if running, and waits for it to exit
+func (l *LeaserComponent) stopRenewal() {
+	l.mu.Lock()
+	stop, done := l.renewStop, l.renewDone
+	l.renewStop, l.renewDone = nil, nil
+	l.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// renewLoop renews the held lease every interval until stop is closed or the lease is lost
+func (l *LeaserComponent) renewLoop(interval time.Duration, stop, done chan struct{}) {
+	defer RecoverPanic("lease renewal")
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := l.renew(); err != nil {
+			l.leaseLost(stop, err)
+			return
 		}
+	}
+}
 
-		// Release each lease
-		for _, epoch := range epochs {
-			if err := l.Leaser.ReleaseLease(ctx, epoch); err != nil {
-				return fmt.Errorf("failed to release lease %d: %w", epoch, err)
-			}
+// renew renews the held lease, returning an error only once the lease is lost.
+// A failed renewal is retried on the next tick until the lease deadline passes.
+func (l *LeaserComponent) renew() error {
+	lease, leaser := l.HeldLease(), l.leaser()
+	if lease == nil || leaser == nil {
+		return nil
+	}
+	sent := time.Now()
+	l.checkClockJump(sent)
+	until := l.validUntil(lease)
+	ctx, cancel := context.WithDeadline(context.Background(), until)
+	defer cancel()
+	renewed, err := leaser.RenewLease(ctx, lease)
+	if err == nil {
+		l.mu.Lock()
+		l.holdLease(renewed, sent)
+		l.mu.Unlock()
+		l.metrics.renewals.Add(1)
+		l.metrics.renewed(time.Now())
+		logDebugf("Renewed lease (epoch %d)", renewed.Epoch)
+		return nil
+	}
+	l.metrics.renewalFailures.Add(1)
+
+	var existsErr *litestream.LeaseExistsError
+	if errors.As(err, &existsErr) {
+		return fmt.Errorf("lease taken by %q (epoch %d)", existsErr.Lease.Owner, existsErr.Lease.Epoch)
+	}
+	if !time.Now().Before(until) {
+		return fmt.Errorf("lease (epoch %d) expired before it could be renewed: %w", lease.Epoch, err)
+	}
+	logWarnf("Failed to renew lease (epoch %d), retrying: %v", lease.Epoch, err)
+	return nil
+}
+
+// errNoLease is returned when renewing while no lease is held
+var errNoLease = errors.New("no lease held")
+
+// RenewLease renews the held lease now rather than on the next tick, pushing out its expiry,
+// e.g. ahead of a long operation. It returns the renewed lease; losing it to another machine is
+// left to the renewal loop to act on.
+func (l *LeaserComponent) RenewLease(ctx context.Context) (*litestream.Lease, error) {
+	lease, leaser := l.HeldLease(), l.leaser()
+	if lease == nil || leaser == nil {
+		return nil, errNoLease
+	}
+	sent := time.Now()
+	ctx, cancel := context.WithDeadline(ctx, l.validUntil(lease))
+	defer cancel()
+	renewed, err := leaser.RenewLease(ctx, lease)
+	if err != nil {
+		var existsErr *litestream.LeaseExistsError
+		if errors.As(err, &existsErr) {
+			return nil, fmt.Errorf("%w: taken by %q (epoch %d)", errNoLease, existsErr.Lease.Owner, existsErr.Lease.Epoch)
 		}
+		return nil, fmt.Errorf("failed to renew lease (epoch %d): %w", lease.Epoch, err)
+	}
+
+	l.mu.Lock()
+	// rule: a lease released or lost meanwhile stays released rather than being revived
+	if l.lease == nil || l.lease.Epoch != renewed.Epoch {
+		l.mu.Unlock()
+		return nil, errNoLease
+	}
+	l.holdLease(renewed, sent)
+	l.mu.Unlock()
+	l.metrics.renewals.Add(1)
+	l.metrics.renewed(time.Now())
+	logInfof("Renewed lease (epoch %d) on request", renewed.Epoch)
+	return renewed, nil
+}
+
+// leaseLost clears the held lease and notifies the lease-lost handler, unless the renewal
+// loop was stopped meanwhile by a deliberate release
+func (l *LeaserComponent) leaseLost(stop chan struct{}, cause error) {
+	l.mu.Lock()
+	if l.renewStop != stop {
+		l.mu.Unlock()
+		return
+	}
+	l.lease = nil
+	l.lost = cause
+	handler := l.onLost
+	l.mu.Unlock()
+	l.metrics.losses.Add(1)
+
+	logErrorf("Lost lease: %v", cause)
+	l.events.Record(EventLeaseLost, "leaser", cause.Error(), nil)
+	if handler != nil {
+		handler(cause)
+	}
+}
 
-		l.Leaser = nil
+// Healthy reports an error once the held lease has been lost
+func (l *LeaserComponent) Healthy(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost != nil {
+		return fmt.Errorf("lease lost: %w", l.lost)
+	}
+	return nil
+}
+
+// HeldLease returns the lease acquired during setup, or nil if none is held
+func (l *LeaserComponent) HeldLease() *litestream.Lease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lease
+}
+
+// RefreshCredentials reopens the leaser with rotated credentials. The new leaser is opened
+// before it replaces the old one, so renewal carries on with one or the other.
+func (l *LeaserComponent) RefreshCredentials(ctx context.Context, cfg *ObjectStorageConfig) error {
+	if l.leaser() == nil {
+		return nil
+	}
+	return l.Setup(ctx, cfg, "")
+}
+
+func (l *LeaserComponent) Cleanup(ctx context.Context) error {
+	l.stopRenewal()
+	if l.leaser() != nil {
+		if err := l.ReleaseAllLeases(ctx); err != nil {
+			return err
+		}
 	}
+	l.mu.Lock()
+	l.Leaser = nil
+	l.lease = nil
+	l.lost = nil
+	l.observing = false
+	l.mu.Unlock()
 	return nil
 }
 
+// leaseReader represents a leaser that can read the lock object of an epoch, which tells whose it is
+type leaseReader interface {
+	// ReadLease returns the lease recorded for the epoch, or os.ErrNotExist if it has none
+	ReadLease(ctx context.Context, epoch int64) (*litestream.Lease, error)
+}
+
+// releasable returns the lease this machine holds, or nil if it holds none it may release.
+// rule: a fenced machine releases nothing, since the latest epoch may be the new holder's
+func (l *LeaserComponent) releasable() *litestream.Lease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost != nil {
+		logInfof("Not releasing the lease: it was lost: %v", l.lost)
+		return nil
+	}
+	return l.lease
+}
+
+// ownedEpochs lists the epochs whose lock objects this machine owns, oldest first. The held
+// epoch is always ours; any other counts only if the leaser can read it and it names this owner.
+func (l *LeaserComponent) ownedEpochs(ctx context.Context, leaser litestream.Leaser, held *litestream.Lease) ([]int64, error) {
+	epochs, err := leaser.Epochs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list epochs: %w", err)
+	}
+	reader, _ := leaser.(leaseReader)
+	var owned []int64
+	for _, epoch := range epochs {
+		if epoch == held.Epoch {
+			owned = append(owned, epoch)
+			continue
+		}
+		if reader == nil {
+			continue
+		}
+		lease, err := reader.ReadLease(ctx, epoch)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read lease %d: %w", epoch, err)
+		}
+		if lease.Owner == l.owner {
+			owned = append(owned, epoch)
+		}
+	}
+	return owned, nil
+}
+
+// ReleaseAllLeases releases the lease for every epoch this machine owns, up to ReleaseConcurrency
+// at a time. It releases nothing unless the lease is held and was not lost. It gives up once
+// ReleaseTimeout elapses or ctx is done; every failure is reported together with how many epochs
+// were released.
 func (l *LeaserComponent) ReleaseAllLeases(ctx context.Context) error {
-	if l.Leaser != nil {
-		// Get all epochs to find active leases
-		epochs, err := l.Leaser.Epochs(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to list epochs: %w", err)
-		}
-		// Release each lease
-		for _, epoch := range epochs {
-			if err := l.Leaser.ReleaseLease(ctx, epoch); err != nil {
-				return fmt.Errorf("failed to release lease %d: %w", epoch, err)
+	// rule: a standby never holds the lease, so it must not release the active machine's
+	leaser := l.leaser()
+	if leaser == nil || l.Observing() {
+		return nil
+	}
+	// rule: renewal stops before release, so a released lease is never renewed into a new epoch
+	l.stopRenewal()
+	held := l.releasable()
+	if held == nil {
+		return nil
+	}
+	if l.ReleaseTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.ReleaseTimeout)
+		defer cancel()
+	}
+
+	epochs, err := l.ownedEpochs(ctx, leaser, held)
+	if err != nil {
+		return err
+	}
+
+	// Release each lease with a bounded number of requests in flight
+	workers := max(1, l.ReleaseConcurrency)
+	sem := make(chan struct{}, workers)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, epoch := range epochs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(epoch int64) {
+			defer func() { <-sem; wg.Done() }()
+			if err := leaser.ReleaseLease(ctx, epoch); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("failed to release lease %d: %w", epoch, err))
+				mu.Unlock()
 			}
+		}(epoch)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("released %d of %d epochs: %w", len(epochs)-len(errs), len(epochs), errors.Join(errs...))
+	}
+	l.mu.Lock()
+	l.lease = nil
+	l.mu.Unlock()
+	return nil
+}
+
+// Handoff releases the epochs this machine owns and confirms the lock objects are no longer held
+// so a replacement machine can acquire the lease without waiting for it to time out. A machine
+// that does not hold the lease, or was fenced, leaves every lock object alone.
+func (l *LeaserComponent) Handoff(ctx context.Context) error {
+	leaser := l.leaser()
+	if leaser == nil || l.Observing() {
+		return nil
+	}
+	l.stopRenewal()
+	held := l.releasable()
+	if held == nil {
+		return nil
+	}
+
+	epochs, err := l.ownedEpochs(ctx, leaser, held)
+	if err != nil {
+		return err
+	}
+	if err := l.ReleaseAllLeases(ctx); err != nil {
+		return err
+	}
+
+	// Reap our superseded lock objects so only the expired held epoch remains
+	for _, epoch := range epochs {
+		if epoch >= held.Epoch {
+			continue
+		}
+		if err := leaser.DeleteLease(ctx, epoch); err != nil {
+			return fmt.Errorf("failed to delete lease %d: %w", epoch, err)
+		}
+	}
+
+	// Confirm none of the lock objects we reaped is still listed
+	remaining, err := leaser.Epochs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to confirm lease release: %w", err)
+	}
+	for _, epoch := range remaining {
+		if epoch < held.Epoch && slices.Contains(epochs, epoch) {
+			return fmt.Errorf("lease %d still present after handoff", epoch)
 		}
 	}
+	logInfof("Lease handoff complete: released epochs %v", epochs)
+	l.events.Record(EventLeaseReleased, "leaser", "lease handed off", map[string]string{"epochs": fmt.Sprint(epochs)})
 	return nil
 }
 
@@ -82,10 +698,24 @@ func (l *LeaserComponent) ReleaseAllLeases(ctx context.Context) error {
 func (l *LeaserComponent) Status(ctx context.Context) map[string]interface{} {
 	status := make(map[string]interface{})
 
-	if l.Leaser != nil {
-		status["leaser"] = map[string]interface{}{
+	if l.leaser() != nil {
+		leaser := map[string]interface{}{
 			"initialized": true,
+			"held":        false,
+		}
+		if lease := l.HeldLease(); lease != nil {
+			leaser["held"] = true
+			leaser["epoch"] = lease.Epoch
+			leaser["valid_until"] = l.validUntil(lease)
+		}
+		if l.Observing() {
+			leaser["observing"] = true
+		}
+		leaser["expiry_grace"] = l.ExpiryGrace.String()
+		if err := l.Healthy(ctx); err != nil {
+			leaser["lost"] = err.Error()
 		}
+		status["leaser"] = leaser
 	} else {
 		status["leaser"] = nil
 	}
@@ -0,0 +1,1037 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// memLeaseStore holds lease objects shared between stub leasers
+type memLeaseStore struct {
+	mu     sync.Mutex
+	leases map[int64]*litestream.Lease
+}
+
+func newMemLeaseStore() *memLeaseStore {
+	return &memLeaseStore{leases: make(map[int64]*litestream.Lease)}
+}
+
+// memLeaser implements litestream.Leaser against an in-memory store
+type memLeaser struct {
+	store   *memLeaseStore
+	owner   string
+	timeout time.Duration // timeout of acquired leases; zero uses a minute
+}
+
+func (m *memLeaser) Type() string { return "mem" }
+
+func (m *memLeaser) Epochs(ctx context.Context) ([]int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var epochs []int64
+	for epoch := range m.store.leases {
+		epochs = append(epochs, epoch)
+	}
+	slices.Sort(epochs)
+	return epochs, nil
+}
+
+func (m *memLeaser) AcquireLease(ctx context.Context) (*litestream.Lease, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var latest int64
+	for epoch := range m.store.leases {
+		latest = max(latest, epoch)
+	}
+	if lease, ok := m.store.leases[latest]; ok && !lease.Expired() {
+		return nil, litestream.NewLeaseExistsError(lease)
+	}
+	timeout := m.timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	lease := &litestream.Lease{Epoch: latest + 1, ModTime: time.Now(), Timeout: timeout, Owner: m.owner}
+	m.store.leases[lease.Epoch] = lease
+	return lease, nil
+}
+
+func (m *memLeaser) RenewLease(ctx context.Context, lease *litestream.Lease) (*litestream.Lease, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for epoch, other := range m.store.leases {
+		if epoch > lease.Epoch {
+			return nil, litestream.NewLeaseExistsError(other)
+		}
+	}
+	renewed := *lease
+	renewed.ModTime = time.Now()
+	m.store.leases[lease.Epoch] = &renewed
+	return &renewed, nil
+}
+
+func (m *memLeaser) ReleaseLease(ctx context.Context, epoch int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if lease, ok := m.store.leases[epoch]; ok {
+		lease.Timeout = 0
+	}
+	return nil
+}
+
+func (m *memLeaser) DeleteLease(ctx context.Context, epoch int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	delete(m.store.leases, epoch)
+	return nil
+}
+
+func (m *memLeaser) ReadLease(ctx context.Context, epoch int64) (*litestream.Lease, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	lease, ok := m.store.leases[epoch]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	read := *lease
+	return &read, nil
+}
+
+func TestLeaseHandoffOnShutdown(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	leaser.Leaser = &memLeaser{store: store, owner: leaser.owner}
+
+	if err := leaser.AcquireLeadership(context.Background()); err != nil {
+		t.Fatalf("Failed to acquire initial lease: %v", err)
+	}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser)
+	if err := control.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	successor := &memLeaser{store: store, owner: "new"}
+	lease, err := successor.AcquireLease(context.Background())
+	if err != nil {
+		t.Fatalf("Expected successor to acquire lease immediately, got: %v", err)
+	}
+	if lease.Epoch != 2 {
+		t.Errorf("Expected successor epoch 2, got %d", lease.Epoch)
+	}
+}
+
+func TestLeaserHandoffReapsOldEpochs(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	store.leases[1] = &litestream.Lease{Epoch: 1, ModTime: time.Now(), Timeout: 0, Owner: "other"}
+	store.leases[2] = &litestream.Lease{Epoch: 2, ModTime: time.Now(), Timeout: 0, Owner: leaser.owner}
+
+	leaser.Leaser = &memLeaser{store: store, owner: leaser.owner}
+	if err := leaser.AcquireLeadership(context.Background()); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	if err := leaser.Handoff(context.Background()); err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+
+	// Only our own superseded epoch is reaped; another machine's lock object is left alone
+	epochs, _ := leaser.Leaser.Epochs(context.Background())
+	if !slices.Equal(epochs, []int64{1, 3}) {
+		t.Errorf("Expected epochs 1 and 3 to remain, got %v", epochs)
+	}
+	if !store.leases[3].Expired() {
+		t.Error("Expected latest lease to be expired after handoff")
+	}
+}
+
+func TestShutdownAfterFenceKeepsNewLease(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	leaser.open = func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+		return &memLeaser{store: store, owner: owner, timeout: timeout}, nil
+	}
+	leaser.RenewInterval = 5 * time.Millisecond
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser)
+
+	ctx := context.Background()
+	cfg := &SystemConfig{Stacks: []string{"leaser"}}
+	control.config = cfg
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Another machine takes the lease after ours lapsed
+	store.mu.Lock()
+	expired := *store.leases[1]
+	expired.Timeout = 0
+	store.leases[1] = &expired
+	store.mu.Unlock()
+	if _, err := (&memLeaser{store: store, owner: "new"}).AcquireLease(ctx); err != nil {
+		t.Fatalf("Failed to take over the lease: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !control.Fenced() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !control.Fenced() {
+		t.Fatal("Expected the environment to be fenced after the lease was lost")
+	}
+
+	// Shutting down must neither release nor reap the new holder's lease
+	if err := control.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := leaser.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	lease, ok := store.leases[2]
+	if !ok || lease.Expired() || lease.Owner != "new" {
+		t.Errorf("Expected the new holder's lease to survive shutdown, got %+v", lease)
+	}
+}
+
+// contendedLeaser fails with a lease exists error a fixed number of times before succeeding
+type contendedLeaser struct {
+	memLeaser
+	failures int
+}
+
+func (c *contendedLeaser) AcquireLease(ctx context.Context) (*litestream.Lease, error) {
+	if c.failures > 0 {
+		c.failures--
+		return nil, litestream.NewLeaseExistsError(&litestream.Lease{Epoch: 1, Owner: "other"})
+	}
+	return c.memLeaser.AcquireLease(ctx)
+}
+
+func TestLeaserAcquireBackoff(t *testing.T) {
+	leaser := NewLeaserComponent()
+	leaser.Leaser = &contendedLeaser{memLeaser: memLeaser{store: newMemLeaseStore()}, failures: 6}
+	leaser.RetryBase = 100 * time.Millisecond
+	leaser.RetryCap = 2 * time.Second
+	leaser.RetryJitter = 0.25
+
+	var intervals []time.Duration
+	leaser.wait = func(ctx context.Context, d time.Duration) error {
+		intervals = append(intervals, d)
+		return nil
+	}
+
+	if _, err := leaser.AcquireLease(context.Background()); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if len(intervals) != 6 {
+		t.Fatalf("Expected 6 retries, got %d", len(intervals))
+	}
+
+	expected := leaser.RetryBase
+	for i, d := range intervals {
+		lower := time.Duration(float64(expected) * (1 - leaser.RetryJitter))
+		if d < lower || d > expected {
+			t.Errorf("Interval %d: expected between %v and %v, got %v", i, lower, expected, d)
+		}
+		if i > 0 && expected < leaser.RetryCap && d <= intervals[i-1] {
+			t.Errorf("Interval %d: expected growth over %v, got %v", i, intervals[i-1], d)
+		}
+		expected = min(expected*2, leaser.RetryCap)
+	}
+}
+
+func TestLeaserAcquireCanceled(t *testing.T) {
+	leaser := NewLeaserComponent()
+	leaser.Leaser = &contendedLeaser{memLeaser: memLeaser{store: newMemLeaseStore()}, failures: 100}
+	leaser.RetryBase = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := leaser.AcquireLease(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+// corruptLeaser fails to parse its latest lock object until that object is deleted
+type corruptLeaser struct {
+	memLeaser
+	corrupt bool
+}
+
+func (c *corruptLeaser) AcquireLease(ctx context.Context) (*litestream.Lease, error) {
+	if c.corrupt {
+		var lease litestream.Lease
+		err := json.Unmarshal([]byte(`{"epoch": 1, "own`), &lease)
+		return nil, fmt.Errorf("fetch lease (1): %w", err)
+	}
+	return c.memLeaser.AcquireLease(ctx)
+}
+
+func (c *corruptLeaser) DeleteLease(ctx context.Context, epoch int64) error {
+	c.corrupt = false
+	return c.memLeaser.DeleteLease(ctx, epoch)
+}
+
+func TestLeaserCorruptLease(t *testing.T) {
+	newCorrupt := func() *corruptLeaser {
+		store := newMemLeaseStore()
+		store.leases[1] = &litestream.Lease{Epoch: 1, ModTime: time.Now(), Timeout: time.Hour, Owner: "other"}
+		return &corruptLeaser{memLeaser: memLeaser{store: store, owner: "self"}, corrupt: true}
+	}
+
+	// Without the policy a corrupt lock object fails acquisition
+	leaser := NewLeaserComponent()
+	leaser.Leaser = newCorrupt()
+	if _, err := leaser.AcquireLease(context.Background()); err == nil {
+		t.Fatal("Expected acquisition to fail on a corrupt lease")
+	}
+
+	// With the policy it is retried for the grace period, then broken
+	corrupt := newCorrupt()
+	leaser = NewLeaserComponent()
+	leaser.Leaser = corrupt
+	leaser.RetryBase = 5 * time.Millisecond
+	leaser.CorruptLeaseGrace = 30 * time.Millisecond
+	retries := 0
+	leaser.wait = func(ctx context.Context, d time.Duration) error {
+		retries++
+		return sleepContext(ctx, d)
+	}
+
+	start := time.Now()
+	lease, err := leaser.AcquireLease(context.Background())
+	if err != nil {
+		t.Fatalf("Expected acquisition to succeed after the grace period, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < leaser.CorruptLeaseGrace {
+		t.Errorf("Expected corrupt lease to be kept for the grace period, broken after %v", elapsed)
+	}
+	if retries == 0 {
+		t.Error("Expected acquisition to be retried during the grace period")
+	}
+	if lease.Owner != "self" || corrupt.corrupt {
+		t.Errorf("Expected corrupt lease to be replaced, got %+v", lease)
+	}
+}
+
+// blockingLeaser hangs releasing a given epoch until the context is done
+type blockingLeaser struct {
+	*memLeaser
+	block int64
+}
+
+func (b *blockingLeaser) ReleaseLease(ctx context.Context, epoch int64) error {
+	if epoch == b.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.memLeaser.ReleaseLease(ctx, epoch)
+}
+
+func TestReleaseAllLeasesTimeout(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	for epoch := int64(1); epoch <= 3; epoch++ {
+		store.leases[epoch] = &litestream.Lease{Epoch: epoch, ModTime: time.Now(), Timeout: time.Minute, Owner: leaser.owner}
+	}
+
+	leaser.Leaser = &blockingLeaser{memLeaser: &memLeaser{store: store}, block: 2}
+	leaser.lease = store.leases[3]
+	leaser.ReleaseTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := leaser.ReleaseAllLeases(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected release to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected release to give up after the timeout, took %v", elapsed)
+	}
+	if !strings.Contains(err.Error(), "released 2 of 3 epochs") {
+		t.Errorf("Expected error to report partial progress, got %v", err)
+	}
+	if !store.leases[1].Expired() || !store.leases[3].Expired() || store.leases[2].Expired() {
+		t.Error("Expected every epoch but the hung one to be released")
+	}
+
+	// A cancelled caller context stops the release even without a timeout
+	leaser.ReleaseTimeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := leaser.ReleaseAllLeases(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected release to stop on cancellation, got %v", err)
+	}
+}
+
+// slowLeaser tracks how many releases are in flight and fails selected epochs
+type slowLeaser struct {
+	*memLeaser
+	fail map[int64]bool
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *slowLeaser) ReleaseLease(ctx context.Context, epoch int64) error {
+	s.mu.Lock()
+	s.inFlight++
+	s.maxInFlight = max(s.maxInFlight, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if s.fail[epoch] {
+		return fmt.Errorf("epoch %d unavailable", epoch)
+	}
+	return s.memLeaser.ReleaseLease(ctx, epoch)
+}
+
+func TestReleaseAllLeasesConcurrently(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	for epoch := int64(1); epoch <= 10; epoch++ {
+		store.leases[epoch] = &litestream.Lease{Epoch: epoch, ModTime: time.Now(), Timeout: time.Minute, Owner: leaser.owner}
+	}
+
+	slow := &slowLeaser{memLeaser: &memLeaser{store: store}, fail: map[int64]bool{4: true, 7: true}}
+	leaser.Leaser = slow
+	leaser.lease = store.leases[10]
+	leaser.ReleaseConcurrency = 3
+
+	err := leaser.ReleaseAllLeases(context.Background())
+	if err == nil {
+		t.Fatal("Expected failed releases to be reported")
+	}
+	for _, want := range []string{"released 8 of 10 epochs", "failed to release lease 4", "failed to release lease 7"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %v", want, err)
+		}
+	}
+	if slow.maxInFlight < 2 || slow.maxInFlight > 3 {
+		t.Errorf("Expected between 2 and 3 concurrent releases, got %d", slow.maxInFlight)
+	}
+	for epoch, lease := range store.leases {
+		if lease.Expired() == slow.fail[epoch] {
+			t.Errorf("Unexpected release state for epoch %d: expired=%v", epoch, lease.Expired())
+		}
+	}
+}
+
+func TestSetupWaitsForLeadership(t *testing.T) {
+	store := newMemLeaseStore()
+	held := &litestream.Lease{Epoch: 1, ModTime: time.Now(), Timeout: time.Minute, Owner: "other"}
+	store.leases[1] = held
+
+	leaser := NewLeaserComponent()
+	leaser.open = func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+		return &memLeaser{store: store, owner: owner, timeout: timeout}, nil
+	}
+	leaser.RetryBase = time.Millisecond
+	leaser.RetryCap = 5 * time.Millisecond
+	leaser.AcquireTimeout = 50 * time.Millisecond
+	writer := &namedHTTPComponent{name: "db"}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, writer, leaser)
+
+	// The writer is listed first but is never set up while another machine holds the lease
+	cfg := &SystemConfig{Stacks: []string{"db", "leaser"}, Critical: map[string]bool{"leaser": false}}
+	if err := control.setupComponents(context.Background(), cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected setup to fail once the acquire timeout passed, got %v", err)
+	}
+	if writer.setup {
+		t.Error("Expected the writer not to be set up without leadership")
+	}
+
+	// Setup waits for the lease to be released, then proceeds
+	leaser.AcquireTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.mu.Lock()
+		held.Timeout = 0
+		store.mu.Unlock()
+	}()
+	if err := control.setupComponents(context.Background(), cfg); err != nil {
+		t.Fatalf("Expected setup to succeed once the lease was released, got %v", err)
+	}
+	defer leaser.Cleanup(context.Background())
+	if !writer.setup {
+		t.Error("Expected the writer to be set up after leadership was acquired")
+	}
+	if lease := leaser.HeldLease(); lease == nil || lease.Epoch != 2 {
+		t.Errorf("Expected the new lease to be held, got %+v", lease)
+	}
+}
+
+func TestRenewLeaseOverHTTP(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	leaser.Leaser = &memLeaser{store: store, owner: "me"}
+	leaser.RenewInterval = 0
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser)
+	control.config = &SystemConfig{Stacks: []string{"leaser"}}
+	control.setupRoutes()
+
+	renew := func() (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/stack/leaser/renew", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	// Nothing to renew before a lease is acquired
+	if w, _ := renew(); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 without a lease, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := leaser.AcquireLeadership(context.Background()); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	before := leaser.validUntil(leaser.HeldLease())
+	time.Sleep(10 * time.Millisecond)
+
+	w, body := renew()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected renewal to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	expiresAt, err := time.Parse(time.RFC3339Nano, fmt.Sprint(body["expires_at"]))
+	if err != nil {
+		t.Fatalf("Expected an expiry in the response, got %v", body)
+	}
+	if !expiresAt.After(before) {
+		t.Errorf("Expected the expiry to move past %v, got %v", before, expiresAt)
+	}
+	if held := leaser.validUntil(leaser.HeldLease()); !held.Equal(expiresAt) {
+		t.Errorf("Expected the held lease to expire at %v, got %v", expiresAt, held)
+	}
+
+	// A lease taken over by another machine is no longer ours to renew
+	store.mu.Lock()
+	store.leases[2] = &litestream.Lease{Epoch: 2, ModTime: time.Now(), Timeout: time.Minute, Owner: "other"}
+	store.mu.Unlock()
+	if w, _ := renew(); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 once the lease was taken, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLeaseExpiryGraceAbsorbsClockSkew(t *testing.T) {
+	const skew = 10 * time.Second
+	ctx := context.Background()
+
+	// holdSkewed acquires the lease with the given grace, then ages it as seen by a contender
+	// whose clock runs skew ahead, just past the lease timeout
+	holdSkewed := func(grace time.Duration) (*LeaserComponent, *memLeaseStore) {
+		t.Helper()
+		store := newMemLeaseStore()
+		holder := NewLeaserComponent()
+		holder.Configure(LeaserConfig{ExpiryGraceSeconds: int(grace / time.Second)})
+		holder.open = func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+			return &memLeaser{store: store, owner: "holder", timeout: timeout}, nil
+		}
+		holder.RenewInterval = 0
+		if err := holder.Setup(ctx, &ObjectStorageConfig{}, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := holder.AcquireLeadership(ctx); err != nil {
+			t.Fatalf("Failed to acquire lease: %v", err)
+		}
+		store.mu.Lock()
+		aged := *store.leases[1]
+		aged.ModTime = aged.ModTime.Add(-leaseTimeout - skew + time.Second)
+		store.leases[1] = &aged
+		store.mu.Unlock()
+
+		// The holder still trusts its lease, by its own clock, for the lease timeout from when it was requested
+		if trusted := holder.validUntil(holder.HeldLease()).Sub(holder.HeldLease().ModTime); trusted > leaseTimeout || trusted < leaseTimeout-time.Second {
+			t.Errorf("Expected the holder to trust its lease for %v, got %v", leaseTimeout, trusted)
+		}
+		return holder, store
+	}
+
+	// Within the grace period the skewed contender does not steal the lease
+	_, store := holdSkewed(30 * time.Second)
+	contender := &memLeaser{store: store, owner: "contender"}
+	if _, err := contender.AcquireLease(ctx); !errors.As(err, new(*litestream.LeaseExistsError)) {
+		t.Errorf("Expected the lease not to be stolen within the grace period, got %v", err)
+	}
+
+	// Without a grace period the same skew lets it be stolen while the holder still trusts it
+	_, store = holdSkewed(-time.Second)
+	contender = &memLeaser{store: store, owner: "contender"}
+	if _, err := contender.AcquireLease(ctx); err != nil {
+		t.Errorf("Expected the lease to be taken without a grace period, got %v", err)
+	}
+
+	if err := (LeaserConfig{ExpiryGraceSeconds: 120}).validate(); err == nil {
+		t.Error("Expected a grace period beyond the acquire timeout margin to be rejected")
+	}
+
+	// A config file with such a grace period is rejected naming the file
+	dir := t.TempDir()
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", dir, nil)
+	if err := os.WriteFile(control.configPath, []byte(`{"leaser":{"expiry_grace_seconds":120}}`), FileMode); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := control.loadConfig(); err == nil || !strings.Contains(err.Error(), "invalid config file "+control.configPath) {
+		t.Errorf("Expected the invalid config file to be named, got %v", err)
+	}
+}
+
+// fenceableComponent records whether it was fenced
+type fenceableComponent struct {
+	namedHTTPComponent
+	fenced atomic.Bool
+}
+
+func (f *fenceableComponent) Fence(ctx context.Context) error {
+	f.fenced.Store(true)
+	return nil
+}
+
+func TestLeaseLossFencesComponents(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	leaser.open = func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+		return &memLeaser{store: store, owner: owner, timeout: timeout}, nil
+	}
+	leaser.RenewInterval = 5 * time.Millisecond
+	writer := &fenceableComponent{namedHTTPComponent: namedHTTPComponent{name: "db"}}
+	disabled := &fenceableComponent{namedHTTPComponent: namedHTTPComponent{name: "juicefs"}}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser, writer, disabled)
+
+	ctx := context.Background()
+	cfg := &SystemConfig{Stacks: []string{"leaser", "db"}}
+	control.config = cfg
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer leaser.Cleanup(ctx)
+
+	// expire lets the lease of the given epoch lapse, replacing the object the holder may still read
+	expire := func(epoch int64) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		expired := *store.leases[epoch]
+		expired.Timeout = 0
+		store.leases[epoch] = &expired
+	}
+
+	// Renewals keep the lease while nobody else takes it
+	time.Sleep(20 * time.Millisecond)
+	if control.Fenced() || writer.fenced.Load() {
+		t.Fatal("Expected no fencing while the lease is renewed")
+	}
+
+	// Another machine takes the lease, e.g. after this one stalled past the lease timeout
+	expire(1)
+	if _, err := (&memLeaser{store: store, owner: "other"}).AcquireLease(ctx); err != nil {
+		t.Fatalf("Failed to take over the lease: %v", err)
+	}
+
+	// The fenced event is recorded once every component has been fenced
+	fencedEvent := func() bool {
+		return slices.ContainsFunc(control.events.Recent(0), func(e Event) bool { return e.Type == EventFenced })
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !fencedEvent() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !fencedEvent() || !control.Fenced() {
+		t.Fatal("Expected the environment to be fenced after the lease was lost")
+	}
+	if !writer.fenced.Load() {
+		t.Error("Expected the enabled writer to be fenced")
+	}
+	if disabled.fenced.Load() {
+		t.Error("Expected a disabled stack not to be fenced")
+	}
+	if lease := leaser.HeldLease(); lease != nil {
+		t.Errorf("Expected no lease to be held, got %+v", lease)
+	}
+
+	status := control.Status()
+	if !status.Fenced {
+		t.Error("Expected status to report fenced")
+	}
+	if h := status.Health["leaser"]; h.Healthy || !strings.Contains(h.Error, `"other"`) {
+		t.Errorf("Expected the leaser to report the lost lease, got %+v", h)
+	}
+	if healthy, _ := control.Health(ctx); healthy {
+		t.Error("Expected the environment to be unhealthy while fenced")
+	}
+
+	// A fresh setup clears the fenced state
+	expire(2)
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if control.Fenced() {
+		t.Error("Expected setup to clear the fenced state")
+	}
+}
+
+// flakyRenewLeaser fails renewals while failing is set
+type flakyRenewLeaser struct {
+	*memLeaser
+	failing atomic.Bool
+}
+
+func (f *flakyRenewLeaser) RenewLease(ctx context.Context, lease *litestream.Lease) (*litestream.Lease, error) {
+	if f.failing.Load() {
+		return nil, errors.New("connection reset")
+	}
+	return f.memLeaser.RenewLease(ctx, lease)
+}
+
+func TestLeaseLifecycleMetrics(t *testing.T) {
+	store := newMemLeaseStore()
+	stub := &flakyRenewLeaser{memLeaser: &memLeaser{store: store, owner: "self"}}
+	leaser := NewLeaserComponent()
+	leaser.Leaser = stub
+	leaser.RenewInterval = 5 * time.Millisecond
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser)
+	control.config = &SystemConfig{}
+	control.setupRoutes()
+	defer leaser.stopRenewal()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		control.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", DefaultMetricsPath, nil))
+		return rec.Body.String()
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !cond() {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+
+	if body := scrape(); !strings.Contains(body, "fly_lease_held 0") || strings.Contains(body, "fly_lease_seconds_since_renewal") {
+		t.Fatalf("Expected no lease and no renewal age before acquiring, got:\n%s", body)
+	}
+
+	if err := leaser.AcquireLeadership(context.Background()); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	m := leaser.Metrics()
+	if m.Acquisitions() != 1 {
+		t.Errorf("Expected 1 acquisition, got %d", m.Acquisitions())
+	}
+	waitFor("renewals", func() bool { return m.Renewals() >= 2 })
+	body := scrape()
+	for _, want := range []string{"fly_lease_acquisitions_total 1", "fly_lease_held 1", "fly_lease_seconds_since_renewal ", "fly_proxy_responses_total"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+
+	// A failed renewal is counted while the lease is still held
+	stub.failing.Store(true)
+	waitFor("a renewal failure", func() bool { return m.RenewalFailures() >= 1 })
+	if leaser.HeldLease() == nil || m.Losses() != 0 {
+		t.Fatal("Expected a transient renewal failure to keep the lease")
+	}
+	stub.failing.Store(false)
+
+	// Another machine takes the lease
+	store.mu.Lock()
+	expired := *store.leases[1]
+	expired.Timeout = 0
+	store.leases[1] = &expired
+	store.mu.Unlock()
+	if _, err := (&memLeaser{store: store, owner: "other"}).AcquireLease(context.Background()); err != nil {
+		t.Fatalf("Failed to take over the lease: %v", err)
+	}
+	waitFor("the lease loss", func() bool { return m.Losses() == 1 })
+	failures := m.RenewalFailures()
+	if body := scrape(); !strings.Contains(body, "fly_lease_held 0") || !strings.Contains(body, "fly_lease_losses_total 1") ||
+		!strings.Contains(body, fmt.Sprintf("fly_lease_renewal_failures_total %d", failures)) {
+		t.Errorf("Expected the loss in metrics, got:\n%s", body)
+	}
+}
+
+// skewedLeaser returns leases whose ModTime is off by skew and carries no monotonic reading, as
+// if read back from object storage after the wall clock was stepped
+type skewedLeaser struct {
+	litestream.Leaser
+	skew time.Duration
+}
+
+func (s *skewedLeaser) skewed(lease *litestream.Lease, err error) (*litestream.Lease, error) {
+	if err != nil {
+		return nil, err
+	}
+	skewed := *lease
+	skewed.ModTime = lease.ModTime.Add(s.skew).Round(0)
+	return &skewed, nil
+}
+
+func (s *skewedLeaser) AcquireLease(ctx context.Context) (*litestream.Lease, error) {
+	return s.skewed(s.Leaser.AcquireLease(ctx))
+}
+
+func (s *skewedLeaser) RenewLease(ctx context.Context, lease *litestream.Lease) (*litestream.Lease, error) {
+	return s.skewed(s.Leaser.RenewLease(ctx, lease))
+}
+
+func TestLeaseExpiryIgnoresClockJumps(t *testing.T) {
+	ctx := context.Background()
+
+	// A clock stepped forward makes the lease look long expired by its ModTime
+	leaser := NewLeaserComponent()
+	leaser.RenewInterval = 0
+	leaser.Leaser = &skewedLeaser{Leaser: &memLeaser{store: newMemLeaseStore(), owner: "me"}, skew: -time.Hour}
+	if err := leaser.AcquireLeadership(ctx); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	lease := leaser.HeldLease()
+	if until := leaser.validUntil(lease); until.Before(time.Now()) || until.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the lease to be trusted for its timeout, got until %v", until)
+	}
+	if err := leaser.renew(); err != nil {
+		t.Fatalf("Expected the renewal to succeed despite the clock jump, got %v", err)
+	}
+	if leaser.HeldLease() == nil || leaser.Metrics().Renewals() != 1 {
+		t.Fatal("Expected the lease to be renewed and still held")
+	}
+
+	// A clock stepped back makes the lease look valid for another hour, yet failed renewals
+	// still lose it once its timeout has passed
+	flaky := &flakyRenewLeaser{memLeaser: &memLeaser{store: newMemLeaseStore(), owner: "me", timeout: 100 * time.Millisecond}}
+	leaser = NewLeaserComponent()
+	leaser.RenewInterval = 0
+	leaser.ExpiryGrace = 0
+	leaser.Leaser = &skewedLeaser{Leaser: flaky, skew: time.Hour}
+	if err := leaser.AcquireLeadership(ctx); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	flaky.failing.Store(true)
+	if err := leaser.renew(); err != nil {
+		t.Fatalf("Expected a failed renewal within the timeout to be retried, got %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := leaser.renew(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the lease to expire after its timeout despite the clock jump, got %v", err)
+	}
+}
+
+func TestKeyLayoutVersions(t *testing.T) {
+	base := ObjectStorageConfig{Bucket: "test-bucket", Endpoint: "http://localhost:1", Region: "auto", KeyPrefix: "/tenant/"}
+	keys := func(version int) []string {
+		cfg := base
+		cfg.KeyLayout = version
+		store, err := NewS3ConfigStore(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{
+			leasePath(&cfg),
+			replicaPath(&cfg, "app"),
+			syncPrefix(&cfg),
+			store.key,
+			configHistoryKey(&cfg, time.Unix(0, 0)),
+			cfg.layout().scratch(),
+			cfg.layout().juicefsVolume() + "/",
+		}
+	}
+
+	// Unconfigured, the original keys are kept so existing data stays readable
+	v1 := keys(0)
+	want := []string{"tenant/leases/fly.lock", "tenant/litestream/app", "tenant/sync/", "tenant/fly-user-env/config.json",
+		"tenant/fly-user-env/config-history/19700101T000000.000000000Z.json", "tenant/fly-user-env", "juicefs/"}
+	if !slices.Equal(v1, want) || !slices.Equal(keys(KeyLayoutV1), want) {
+		t.Errorf("Expected the version 1 keys %v, got %v", want, v1)
+	}
+	v2 := keys(KeyLayoutV2)
+	want = []string{"tenant/v2/lease/fly.lock", "tenant/v2/db/app", "tenant/v2/sync/", "tenant/v2/config/current.json",
+		"tenant/v2/config/history/19700101T000000.000000000Z.json", "tenant/v2/tmp", "juicefs-v2/"}
+	if !slices.Equal(v2, want) {
+		t.Errorf("Expected the version 2 keys %v, got %v", want, v2)
+	}
+
+	// No object of one version lies under a key or prefix of the other
+	for _, a := range v1 {
+		for _, b := range v2 {
+			if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+				t.Errorf("Expected the layouts not to overlap, got %s and %s", a, b)
+			}
+		}
+	}
+
+	cfg := base
+	cfg.KeyLayout = latestKeyLayout + 1
+	if err := cfg.validateKeyLayout(); err == nil {
+		t.Error("Expected an unknown key layout to be rejected")
+	}
+}
+
+func TestEnvIDDerivesStoragePaths(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         ObjectStorageConfig
+		wantLease   string
+		wantReplica string
+	}{
+		{"no id", ObjectStorageConfig{KeyPrefix: "/"}, "leases/fly.lock", "litestream/app"},
+		{"id", ObjectStorageConfig{KeyPrefix: "/", EnvID: "env-a"}, "envs/env-a/leases/fly.lock", "envs/env-a/litestream/app"},
+		{"id without prefix", ObjectStorageConfig{EnvID: "env-a"}, "envs/env-a/leases/fly.lock", "envs/env-a/litestream/app"},
+		{"prefix wins", ObjectStorageConfig{KeyPrefix: "/tenant/", EnvID: "env-a"}, "tenant/leases/fly.lock", "tenant/litestream/app"},
+	}
+	for _, tt := range tests {
+		if got := leasePath(&tt.cfg); got != tt.wantLease {
+			t.Errorf("%s: expected lease path %s, got %s", tt.name, tt.wantLease, got)
+		}
+		if got := replicaPath(&tt.cfg, "app"); got != tt.wantReplica {
+			t.Errorf("%s: expected replica path %s, got %s", tt.name, tt.wantReplica, got)
+		}
+	}
+
+	// The ID is a single path segment
+	for _, id := range []string{"a/b", "..", `a\b`} {
+		cfg := ObjectStorageConfig{EnvID: id}
+		if err := cfg.validateEnvID(); err == nil {
+			t.Errorf("Expected env_id %q to be rejected", id)
+		}
+	}
+
+	// Unconfigured, the ID defaults to the app and machine
+	t.Setenv("FLY_ENV_ID", "")
+	t.Setenv("FLY_APP_NAME", "app")
+	t.Setenv("FLY_MACHINE_ID", "m1")
+	if got := EnvIDFromEnv(); got != "app/m1" {
+		t.Errorf("Expected the default env ID app/m1, got %s", got)
+	}
+	t.Setenv("FLY_ENV_ID", "env-a")
+	if got := EnvIDFromEnv(); got != "env-a" {
+		t.Errorf("Expected FLY_ENV_ID to win, got %s", got)
+	}
+	t.Setenv("FLY_STORAGE_BUCKET", "test-bucket")
+	t.Setenv("FLY_STORAGE_ENDPOINT", "http://localhost:1")
+	t.Setenv("FLY_STORAGE_ACCESS_KEY", "key")
+	t.Setenv("FLY_STORAGE_SECRET_KEY", "secret")
+	t.Setenv("FLY_STORAGE_KEY_PREFIX", "")
+	cfg, err := NewSystemConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if got := leasePath(&cfg.Storage); got != "envs/env-a/leases/fly.lock" {
+		t.Errorf("Expected FLY_ENV_ID to namespace the lease, got %s", got)
+	}
+}
+
+// standbyComponent records the standby lifecycle of a stack
+type standbyComponent struct {
+	namedHTTPComponent
+	following, ended bool
+}
+
+func (s *standbyComponent) SetupStandby(ctx context.Context, cfg *ObjectStorageConfig) error {
+	s.following = true
+	return nil
+}
+
+func (s *standbyComponent) EndStandby(ctx context.Context) error {
+	s.following = false
+	s.ended = true
+	return nil
+}
+
+func TestStandbyPromotion(t *testing.T) {
+	store := newMemLeaseStore()
+	leaser := NewLeaserComponent()
+	leaser.open = func(cfg *ObjectStorageConfig, owner string, timeout time.Duration) (litestream.Leaser, error) {
+		return &memLeaser{store: store, owner: owner, timeout: timeout}, nil
+	}
+	db := &standbyComponent{namedHTTPComponent: namedHTTPComponent{name: "db"}}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, leaser, db)
+
+	// The active machine holds the lease
+	ctx := context.Background()
+	active := &memLeaser{store: store, owner: "active"}
+	lease, err := active.AcquireLease(ctx)
+	if err != nil {
+		t.Fatalf("Failed to acquire the active lease: %v", err)
+	}
+
+	cfg := &SystemConfig{Stacks: []string{"leaser", "db"}, Standby: true}
+	control.config = cfg
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Standby setup failed: %v", err)
+	}
+	defer leaser.Cleanup(ctx)
+	control.setupRoutes()
+
+	if !control.Standby() || !leaser.Observing() {
+		t.Fatal("Expected the machine to run as a standby observing the lease")
+	}
+	if leaser.HeldLease() != nil {
+		t.Error("Expected a standby not to acquire the lease")
+	}
+	if !db.following || db.setup {
+		t.Errorf("Expected the db to follow without being set up, got following=%v setup=%v", db.following, db.setup)
+	}
+	if healthy, _ := control.Health(ctx); healthy {
+		t.Error("Expected a standby not to be ready")
+	}
+	if err := leaser.ReleaseAllLeases(ctx); err != nil {
+		t.Fatalf("ReleaseAllLeases failed: %v", err)
+	}
+	if _, ok := store.leases[lease.Epoch]; !ok {
+		t.Fatal("Expected a standby to leave the active machine's lease alone")
+	}
+
+	promote := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/promote", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// The active machine steps down and the standby is promoted
+	if err := active.ReleaseLease(ctx, lease.Epoch); err != nil {
+		t.Fatalf("Failed to release the active lease: %v", err)
+	}
+	if w := promote(); w.Code != http.StatusOK {
+		t.Fatalf("Expected promotion to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if control.Standby() || leaser.Observing() {
+		t.Error("Expected standby mode to end on promotion")
+	}
+	if held := leaser.HeldLease(); held == nil || held.Owner == "active" {
+		t.Errorf("Expected the promoted machine to hold the lease, got %+v", held)
+	}
+	if !db.ended || db.following || !db.setup {
+		t.Errorf("Expected the db to end standby and be set up, got ended=%v following=%v setup=%v", db.ended, db.following, db.setup)
+	}
+	if control.config.Standby {
+		t.Error("Expected the promoted config not to be a standby")
+	}
+
+	if w := promote(); w.Code != http.StatusConflict {
+		t.Errorf("Expected promoting an active machine to conflict, got %d", w.Code)
+	}
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Load shedding defaults
+const (
+	DefaultShedFraction = 0.5
+	DefaultShedWindow   = 200
+	// shedMinSamples is how many latencies must be recorded before shedding can engage
+	shedMinSamples = 20
+	// shedRetryAfter is the Retry-After value, in seconds, sent to shed requests
+	shedRetryAfter = "1"
+)
+
+// shedRand decides which requests are shed, replaceable in tests for deterministic shedding
+var shedRand = rand.Float64
+
+// LoadShedConfig configures latency-based load shedding in the proxy. Shedding is opt-in: it is
+// disabled while Threshold is zero.
+type LoadShedConfig struct {
+	// Threshold is the backend p99 latency, measured to the response headers, above which
+	// requests are shed
+	Threshold time.Duration
+	// Fraction of requests shed while over the threshold, above 0 and below 1; zero uses DefaultShedFraction
+	Fraction float64
+	// Window is how many recent latencies the p99 is computed over; zero uses DefaultShedWindow
+	Window int
+}
+
+// Validate checks the load shedding settings
+func (cfg LoadShedConfig) Validate() error {
+	if cfg.Threshold < 0 {
+		return fmt.Errorf("load shedding threshold must not be negative")
+	}
+	// rule: shedding every request would stop latency samples, so shedding could never disengage
+	if cfg.Fraction < 0 || cfg.Fraction >= 1 {
+		return fmt.Errorf("load shedding fraction must be at least 0 and below 1")
+	}
+	if cfg.Window < 0 {
+		return fmt.Errorf("load shedding window must not be negative")
+	}
+	return nil
+}
+
+// latencyTracker keeps a rolling window of backend latencies and decides when to shed load
+type latencyTracker struct {
+	mu       sync.Mutex // protects all fields below
+	cfg      LoadShedConfig
+	samples  []time.Duration // ring buffer of the most recent latencies
+	next     int             // index of the next sample to overwrite once the window is full
+	shedding bool            // whether the p99 was over the threshold at the last check
+}
+
+// newLatencyTracker creates a tracker for the given settings, filling in defaults
+func newLatencyTracker(cfg LoadShedConfig) *latencyTracker {
+	if cfg.Fraction == 0 {
+		cfg.Fraction = DefaultShedFraction
+	}
+	if cfg.Window == 0 {
+		cfg.Window = DefaultShedWindow
+	}
+	return &latencyTracker{cfg: cfg}
+}
+
+// record adds a backend latency to the window
+func (t *latencyTracker) record(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < t.cfg.Window {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % t.cfg.Window
+}
+
+// p99 returns the 99th percentile of the recorded latencies; the caller must hold t.mu
+func (t *latencyTracker) p99() time.Duration {
+	sorted := slices.Clone(t.samples)
+	slices.Sort(sorted)
+	return sorted[(len(sorted)*99)/100]
+}
+
+// shed reports whether this request should be rejected to relieve an overloaded backend
+func (t *latencyTracker) shed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	overloaded := len(t.samples) >= min(shedMinSamples, t.cfg.Window) && t.p99() > t.cfg.Threshold
+	if overloaded != t.shedding {
+		t.shedding = overloaded
+		if overloaded {
+			logWarnf("Backend p99 latency %s exceeds %s: shedding %.0f%% of requests", t.p99(), t.cfg.Threshold, t.cfg.Fraction*100)
+		} else {
+			logInfof("Backend latency recovered: load shedding stopped")
+		}
+	}
+	return overloaded && shedRand() < t.cfg.Fraction
+}
+
+// SetLoadShedding enables latency-based load shedding, or disables it when cfg.Threshold is zero.
+// The latency window starts empty.
+func (p *Proxy) SetLoadShedding(cfg LoadShedConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cfg.Threshold <= 0 {
+		p.latency = nil
+		return
+	}
+	p.latency = newLatencyTracker(cfg)
+}
+
+// serveShed rejects the request with 503 and Retry-After
+func serveShed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", shedRetryAfter)
+	http.Error(w, "Backend overloaded", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// ParseLogLevel parses a log level name (error, warn, info or debug); empty means info
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "error":
+		return slog.LevelError, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q (want error, warn, info or debug)", name)
+	}
+}
+
+// logPrefixKey is the attribute identifying the environment on every log record
+const logPrefixKey = "env"
+
+// NewLogger creates a logger writing records at or above level to w.
+// A non-empty prefix is attached to every record so aggregated logs can be filtered by environment.
+func NewLogger(w io.Writer, level slog.Level, prefix string) *slog.Logger {
+	logger := slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+	if prefix != "" {
+		logger = logger.With(logPrefixKey, prefix)
+	}
+	return logger
+}
+
+// LogPrefixFromEnv returns the log prefix: FLY_LOG_PREFIX if set, otherwise the environment ID
+func LogPrefixFromEnv() string {
+	if prefix := os.Getenv("FLY_LOG_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return EnvIDFromEnv()
+}
+
+// SetupLoggingFromEnv installs the default logger at the level named by FLY_LOG_LEVEL,
+// tagging records with LogPrefixFromEnv. Output of the standard log package is routed
+// through it at info level.
+func SetupLoggingFromEnv() error {
+	level, err := ParseLogLevel(os.Getenv("FLY_LOG_LEVEL"))
+	if err != nil {
+		return fmt.Errorf("invalid FLY_LOG_LEVEL: %w", err)
+	}
+	slog.SetDefault(NewLogger(os.Stderr, level, LogPrefixFromEnv()))
+	return nil
+}
+
+// logf formats and logs a message at level, skipping the formatting when the level is disabled
+func logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+// logDebugf logs noisy detail such as routing decisions and raw subprocess output
+func logDebugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+
+// logInfof logs lifecycle events
+func logInfof(format string, args ...any) { logf(slog.LevelInfo, format, args...) }
+
+// logWarnf logs failures that are tolerated or retried
+func logWarnf(format string, args ...any) { logf(slog.LevelWarn, format, args...) }
+
+// logErrorf logs failures that leave the environment degraded
+func logErrorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevelFiltering(t *testing.T) {
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+	level, err := ParseLogLevel("")
+	if err != nil || level != slog.LevelInfo {
+		t.Fatalf("Expected the default level to be info, got %v (%v)", level, err)
+	}
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(NewLogger(&buf, level, ""))
+	defer slog.SetDefault(previous)
+
+	logDebugf("routing %s", "request")
+	logInfof("started %s", "process")
+	logWarnf("retrying %s", "lease")
+
+	out := buf.String()
+	if strings.Contains(out, "routing request") {
+		t.Errorf("Expected debug lines to be suppressed at info level, got %q", out)
+	}
+	if !strings.Contains(out, "level=INFO") || !strings.Contains(out, "started process") {
+		t.Errorf("Expected info line, got %q", out)
+	}
+	if !strings.Contains(out, "level=WARN") || !strings.Contains(out, "retrying lease") {
+		t.Errorf("Expected warn line, got %q", out)
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	t.Setenv("FLY_LOG_PREFIX", "")
+	t.Setenv("FLY_APP_NAME", "my-app")
+	t.Setenv("FLY_MACHINE_ID", "148e")
+	prefix := LogPrefixFromEnv()
+	if prefix != "my-app/148e" {
+		t.Errorf("Expected prefix from app and machine, got %q", prefix)
+	}
+	t.Setenv("FLY_LOG_PREFIX", "tenant-a")
+	if got := LogPrefixFromEnv(); got != "tenant-a" {
+		t.Errorf("Expected explicit prefix, got %q", got)
+	}
+	t.Setenv("FLY_LOG_PREFIX", "")
+	t.Setenv("FLY_APP_NAME", "")
+	t.Setenv("FLY_MACHINE_ID", "")
+	if hostname, _ := os.Hostname(); LogPrefixFromEnv() != hostname {
+		t.Errorf("Expected prefix to default to the hostname %q, got %q", hostname, LogPrefixFromEnv())
+	}
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(NewLogger(&buf, slog.LevelInfo, prefix))
+	defer slog.SetDefault(previous)
+
+	logInfof("started")
+	log.Printf("from the standard logger")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "env=my-app/148e") {
+			t.Errorf("Expected prefix on record, got %q", line)
+		}
+	}
+}
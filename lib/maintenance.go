@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// DefaultMaintenanceMessage is shown when maintenance is enabled without a message
+const DefaultMaintenanceMessage = "This service is undergoing maintenance. Please try again shortly."
+
+// MaintenanceState describes whether proxied traffic is intercepted for maintenance
+type MaintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
+}
+
+// MaintenanceProvider is an interface for checking if the proxy should serve a maintenance response
+type MaintenanceProvider interface {
+	Maintenance() MaintenanceState
+}
+
+// ServeHTTP writes the maintenance page
+func (m MaintenanceState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	message := m.Message
+	if message == "" {
+		message = DefaultMaintenanceMessage
+	}
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>Maintenance</title></head><body><h1>Maintenance</h1><p>%s</p></body></html>\n", html.EscapeString(message))
+}
+
+// maintenancePath returns the path of the persisted maintenance flag
+func (c *Control) maintenancePath() string {
+	return filepath.Join(c.dataDir, "maintenance.json")
+}
+
+// Maintenance returns the current maintenance state
+func (c *Control) Maintenance() MaintenanceState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maintenance
+}
+
+// SetMaintenance updates and persists the maintenance state
+func (c *Control) SetMaintenance(state MaintenanceState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !state.Enabled {
+		if err := os.Remove(c.maintenancePath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove maintenance file: %w", err)
+		}
+		c.maintenance = MaintenanceState{}
+		return nil
+	}
+
+	if err := os.MkdirAll(c.dataDir, DirMode); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance state: %w", err)
+	}
+	if err := writeFileAtomic(c.maintenancePath(), data, FileMode); err != nil {
+		return fmt.Errorf("failed to write maintenance file: %w", err)
+	}
+	c.maintenance = state
+	return nil
+}
+
+// loadMaintenance restores a persisted maintenance state
+func (c *Control) loadMaintenance() error {
+	data, err := os.ReadFile(c.maintenancePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read maintenance file: %w", err)
+	}
+	var state MaintenanceState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse maintenance file: %w", err)
+	}
+	c.mu.Lock()
+	c.maintenance = state
+	c.mu.Unlock()
+	return nil
+}
+
+// handleMaintenance reports or updates the maintenance state
+func (c *Control) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var state MaintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		if state.RetryAfter < 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "retry_after must not be negative"})
+			return
+		}
+		if err := c.SetMaintenance(state); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		c.NotifyStatusChange()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Maintenance())
+}
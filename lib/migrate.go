@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// errInvalidMigration is returned when the config to migrate to is rejected before anything is touched
+var errInvalidMigration = errors.New("invalid migration")
+
+// errNotConfigured is returned when migrating an environment that has no config to migrate from
+var errNotConfigured = errors.New("not configured")
+
+// MigrationResult reports a completed storage migration
+type MigrationResult struct {
+	// Seeded is how many objects were copied from the old storage to the new
+	Seeded int `json:"seeded_objects"`
+}
+
+// Migrate moves the environment to the storage of next as one operation. The new config is
+// validated and its storage checked, the proxy is drained and the app stopped, replication to
+// the old storage is flushed, the new storage is seeded with the environment's objects unless
+// seed is false, and every stack is set up again against the new storage and flushed there before
+// the app starts again. If the switch fails the old config is set up again, so the environment
+// never runs on a mix of both.
+func (c *Control) Migrate(ctx context.Context, next *SystemConfig, seed bool) (*MigrationResult, error) {
+	if err := next.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidMigration, err)
+	}
+	c.mu.RLock()
+	current := c.config
+	suspended := c.suspension != nil
+	c.mu.RUnlock()
+	if current == nil {
+		return nil, errNotConfigured
+	}
+	if suspended || c.Standby() || next.Standby {
+		return nil, fmt.Errorf("%w: a suspended or standby environment cannot be migrated", errInvalidMigration)
+	}
+	// rule: the JuiceFS volume name follows the key layout, so moving to another layout is not a migration of the same data
+	if next.Storage.layout().version != current.Storage.layout().version {
+		return nil, fmt.Errorf("%w: key_layout must stay %d", errInvalidMigration, current.Storage.layout().version)
+	}
+	if validation := c.ValidateConfig(ctx, next); !validation.Valid {
+		return nil, fmt.Errorf("%w: %s", errInvalidMigration, validation.Error)
+	}
+
+	if !c.beginReconfigure() {
+		return nil, errReconfiguring
+	}
+	defer c.endReconfigure()
+	ctx, op := c.operations.Start(ctx, "migrate", "migration to "+next.Storage.Bucket+" at "+next.Storage.Endpoint)
+	defer op.End()
+	logInfof("Migrating from %s at %s to %s at %s", current.Storage.Bucket, current.Storage.Endpoint, next.Storage.Bucket, next.Storage.Endpoint)
+
+	// Deferred calls run last to first: the app starts again before the proxy stops draining
+	if !c.draining.Swap(true) {
+		defer func() {
+			c.draining.Store(false)
+			c.NotifyStatusChange()
+		}()
+	}
+	if c.supervisor != nil && c.supervisor.IsRunning() {
+		if err := c.supervisor.StopProcess(); err != nil {
+			return nil, fmt.Errorf("failed to stop the app: %w", err)
+		}
+		defer func() {
+			if err := c.supervisor.StartProcess(); err != nil {
+				logErrorf("Failed to start the app after migrating: %v", err)
+			}
+		}()
+	}
+
+	if err := c.flushStacks(ctx, current); err != nil {
+		return nil, fmt.Errorf("failed to flush the old storage: %w", err)
+	}
+	result := &MigrationResult{}
+	if seed {
+		seeded, err := seedStorage(ctx, &current.Storage, &next.Storage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seed the new storage: %w", err)
+		}
+		result.Seeded = seeded
+		logInfof("Seeded %d objects into the new storage", seeded)
+	}
+
+	// rule: from here on a failure sets the old config up again, so nothing keeps running against the new storage
+	if err := c.Cleanup(ctx); err != nil {
+		logWarnf("Failed to clean up the stacks before migrating: %v", err)
+	}
+	setupCtx, cancel, _ := c.configContext(ctx)
+	defer cancel()
+	err := c.setupComponents(setupCtx, next)
+	if err == nil {
+		err = c.flushStacks(setupCtx, next)
+	}
+	if err != nil {
+		logErrorf("Migration failed, returning to the old storage: %v", err)
+		if cleanupErr := c.rollbackSetup(); cleanupErr != nil {
+			logErrorf("Failed to clean up after the failed migration: %v", cleanupErr)
+		}
+		restoreCtx, cancel, _ := c.configContext(context.WithoutCancel(ctx))
+		defer cancel()
+		if restoreErr := c.setupComponents(restoreCtx, current); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to set the old config up again: %w", restoreErr))
+		}
+		c.setupRoutes()
+		c.events.Record(EventMigrationFailed, "control", err.Error(), map[string]string{"bucket": next.Storage.Bucket})
+		return nil, fmt.Errorf("failed to migrate: %w", err)
+	}
+
+	c.mu.Lock()
+	c.config = next
+	c.configSource = ConfigSourceAPI
+	envConfigured := c.envConfigured
+	c.mu.Unlock()
+	if !envConfigured {
+		if err := c.saveConfig(); err != nil {
+			logWarnf("Failed to save migrated config: %v", err)
+		}
+	}
+	c.setupRoutes()
+	c.startStorageMonitor(&next.Storage)
+	if err := c.applyTarget(); err != nil {
+		return nil, fmt.Errorf("failed to update proxy target: %w", err)
+	}
+	c.NotifyStatusChange()
+	c.events.Record(EventMigrated, "control", "", map[string]string{"bucket": next.Storage.Bucket, "endpoint": next.Storage.Endpoint})
+	logInfof("Migrated to %s at %s", next.Storage.Bucket, next.Storage.Endpoint)
+	return result, nil
+}
+
+// flushStacks blocks until the replicated stacks of cfg have made their pending changes durable,
+// flushing every stack even if one fails
+func (c *Control) flushStacks(ctx context.Context, cfg *SystemConfig) error {
+	available := c.getAvailableComponents()
+	var errs []error
+	for _, stack := range cfg.Stacks {
+		if rs, ok := available[stack].(ReplicationSyncer); ok {
+			if err := rs.SyncReplication(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("failed to flush replication of %s: %w", stack, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// seedStorage copies the environment's objects from one storage to another: everything under
+// its key prefix, moved under the new prefix, and the JuiceFS volume, which is kept at the top
+// of the bucket. It returns how many objects were copied.
+func seedStorage(ctx context.Context, from, to *ObjectStorageConfig) (int, error) {
+	fromSess, err := from.newSession()
+	if err != nil {
+		return 0, err
+	}
+	toSess, err := to.newSession()
+	if err != nil {
+		return 0, err
+	}
+	src := s3.New(fromSess)
+	uploader := s3manager.NewUploaderWithClient(s3.New(toSess))
+
+	root := func(cfg *ObjectStorageConfig) string {
+		if r := cfg.layout().key("", ""); r != "" {
+			return r + "/"
+		}
+		return ""
+	}
+	volume := from.layout().juicefsVolume() + "/"
+	seeded := 0
+	copyPrefix := func(prefix, dest string, skip func(key string) bool) error {
+		var keys []string
+		err := src.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+			Bucket: aws.String(from.Bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if key := aws.StringValue(obj.Key); !skip(key) {
+					keys = append(keys, key)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, key := range keys {
+			out, err := src.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(from.Bucket), Key: aws.String(key)})
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", key, err)
+			}
+			input := &s3manager.UploadInput{
+				Bucket: aws.String(to.Bucket),
+				Key:    aws.String(dest + strings.TrimPrefix(key, prefix)),
+				Body:   out.Body,
+			}
+			to.applySSE(input)
+			_, err = uploader.UploadWithContext(ctx, input)
+			out.Body.Close()
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %w", key, err)
+			}
+			seeded++
+		}
+		return nil
+	}
+
+	// rule: scratch objects such as write tests are not the environment's data and are not copied
+	scratch := from.layout().scratch() + "/"
+	fromRoot := root(from)
+	if err := copyPrefix(fromRoot, root(to), func(key string) bool {
+		return strings.HasPrefix(key, scratch) || (fromRoot == "" && strings.HasPrefix(key, volume))
+	}); err != nil {
+		return seeded, err
+	}
+	if err := copyPrefix(volume, volume, func(string) bool { return false }); err != nil {
+		return seeded, err
+	}
+	return seeded, nil
+}
+
+// handleMigrate moves the environment to the storage of the config in the request body. Seeding
+// the new storage from the old is skipped with ?seed=false, e.g. when it was copied beforehand.
+func (c *Control) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	cfg := DefaultSystemConfig()
+	if err := decodeConfig(r.Body, &cfg); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.Migrate(r.Context(), &cfg, r.URL.Query().Get("seed") != "false")
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errInvalidMigration):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, errNotConfigured), errors.Is(err, errReconfiguring):
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "migrated",
+		"seeded_objects": result.Seeded,
+	})
+}
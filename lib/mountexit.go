@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// mountReadyTimeout bounds the wait for a mount process to report ready, after a start or a restart
+const mountReadyTimeout = 60 * time.Second
+
+// mountExit describes how the mount process last exited
+type mountExit struct {
+	Time time.Time `json:"time"`
+	PID  int       `json:"pid"`
+	// Intentional is set when the process was stopped on purpose, e.g. by cleanup or a remount,
+	// rather than exiting on its own
+	Intentional bool   `json:"intentional"`
+	ExitCode    int    `json:"exit_code"`
+	Error       string `json:"error,omitempty"`
+}
+
+// mountExited handles an exit of the mount process writing to mountLog. An intentional stop is
+// only recorded. A crash marks the mount unhealthy until its supervisor has restarted the process
+// and it reports ready again.
+func (j *JuiceFSComponent) mountExited(info ExitInfo, mountLog *mountLog) {
+	exit := &mountExit{Time: time.Now(), PID: info.PID, Intentional: info.Stopped, ExitCode: info.ExitCode}
+	if info.Err != nil {
+		exit.Error = info.Err.Error()
+	}
+	data := map[string]string{"mount": j.mountDir, "pid": strconv.Itoa(info.PID), "exit_code": strconv.Itoa(info.ExitCode)}
+
+	j.mu.Lock()
+	j.lastExit = exit
+	// rule: a stop during cleanup or a remount is expected, so it is neither logged as an error nor remounted
+	if info.Stopped || j.shutdownRequested {
+		j.mu.Unlock()
+		logDebugf("JuiceFS mount process %d stopped", info.PID)
+		j.events.Record(EventMountStopped, "juicefs", "mount process stopped", data)
+		return
+	}
+	j.crashes++
+	j.isReady = false
+	j.mu.Unlock()
+
+	mountLog.rearm()
+	logErrorf("JuiceFS mount process %d exited unexpectedly with code %d, remounting: %s", info.PID, info.ExitCode, mountLog.Last())
+	j.events.Record(EventMountCrashed, "juicefs", fmt.Sprintf("mount process exited unexpectedly: %s", mountLog.Last()), data)
+}
+
+// mountRestarted waits for a mount process restarted after a crash to report ready, then marks the
+// mount ready again
+func (j *JuiceFSComponent) mountRestarted(pid int, mountLog *mountLog) {
+	defer RecoverPanic("juicefs remount")
+	select {
+	case <-mountLog.readyChan():
+	case <-time.After(mountReadyTimeout):
+		logErrorf("Restarted JuiceFS mount process %d did not become ready within %v", pid, mountReadyTimeout)
+		return
+	}
+
+	j.mu.Lock()
+	current := j.mountLog == mountLog && !j.shutdownRequested
+	if current {
+		j.isReady = true
+	}
+	j.mu.Unlock()
+	if !current {
+		return
+	}
+	logInfof("JuiceFS mount process %d remounted after a crash", pid)
+	j.events.Record(EventMountRemounted, "juicefs", "remounted after the mount process crashed", map[string]string{"mount": j.mountDir})
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultMountLogLines is how many recent lines of mount output are kept when not configured
+	defaultMountLogLines = 20
+	// maxMountLogLine bounds a line of mount output held while waiting for its newline
+	maxMountLogLine = 64 << 10
+)
+
+// mountLog receives the stderr of the JuiceFS mount process for the life of the mount, not just
+// until it reports ready: it logs every line, keeps the most recent ones for the component status
+// and signals when the ready message appears. It is wired up as an io.Writer rather than a pipe,
+// so exec gives every start its own pipe and a mount restarted by its supervisor keeps writing here.
+type mountLog struct {
+	mu       sync.Mutex
+	partial  []byte   // output after the last newline
+	lines    []string // ring buffer of the most recent lines, nil when disabled
+	next     int      // index in lines the next line is stored at
+	count    int      // lines stored, up to len(lines)
+	last     string   // the most recent line, kept even when the ring buffer is disabled
+	readyMsg string
+	ready    chan struct{} // closed once readyMsg has been seen
+	isReady  bool
+	exited   chan struct{} // closed once the mount process has exited
+	isExited bool
+}
+
+// newMountLog creates a log keeping the given number of recent lines that waits for readyMsg
+func newMountLog(size int, readyMsg string) *mountLog {
+	m := &mountLog{readyMsg: readyMsg, ready: make(chan struct{}), exited: make(chan struct{})}
+	if size > 0 {
+		m.lines = make([]string, size)
+	}
+	return m
+}
+
+// Write splits mount output into lines
+func (m *mountLog) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := append(m.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		m.line(string(bytes.TrimRight(data[:i], "\r")))
+		data = data[i+1:]
+	}
+	// rule: output without newlines is cut into lines rather than buffered without bound
+	for len(data) >= maxMountLogLine {
+		m.line(string(data[:maxMountLogLine]))
+		data = data[maxMountLogLine:]
+	}
+	m.partial = append(m.partial[:0], data...)
+	return len(p), nil
+}
+
+// line records a line of output; the caller must hold m.mu
+func (m *mountLog) line(line string) {
+	m.last = line
+	if len(m.lines) > 0 {
+		m.lines[m.next] = line
+		m.next = (m.next + 1) % len(m.lines)
+		m.count = min(m.count+1, len(m.lines))
+	}
+	if !m.isReady {
+		logDebugf("juicefs mount stderr: %s", line)
+		if strings.Contains(line, m.readyMsg) {
+			logDebugf("juicefs mount ready message detected")
+			m.isReady = true
+			close(m.ready)
+		}
+		return
+	}
+	// rule: once the mount is up, its warnings and errors are logged at their own level so
+	// problems during operation are not hidden behind debug logging
+	switch {
+	case strings.Contains(line, "<ERROR>"), strings.Contains(line, "<FATAL>"), strings.Contains(line, "<PANIC>"):
+		logErrorf("juicefs mount: %s", line)
+	case strings.Contains(line, "<WARNING>"):
+		logWarnf("juicefs mount: %s", line)
+	default:
+		logDebugf("juicefs mount stderr: %s", line)
+	}
+}
+
+// readyChan returns the channel closed once the current mount process reports ready
+func (m *mountLog) readyChan() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ready
+}
+
+// rearm waits for the ready message again, for a mount process restarted after a crash
+func (m *mountLog) rearm() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isReady {
+		m.isReady = false
+		m.ready = make(chan struct{})
+	}
+}
+
+// processExited records that the mount process exited. Its output has been fully written by then.
+func (m *mountLog) processExited() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isExited {
+		m.isExited = true
+		close(m.exited)
+	}
+}
+
+// Lines returns the most recent lines of output, oldest first
+func (m *mountLog) Lines() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := make([]string, 0, m.count)
+	for i := range m.count {
+		lines = append(lines, m.lines[(m.next-m.count+i+len(m.lines))%len(m.lines)])
+	}
+	return lines
+}
+
+// Last returns the most recent line of output
+func (m *mountLog) Last() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// renameDir moves a directory within a filesystem, replaceable in tests to simulate crossing devices
+var renameDir = os.Rename
+
+// syncDir flushes a directory's entries to disk, replaceable in tests to observe the sync order
+var syncDir = func(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// moveDir moves the directory src to dst, which must not exist. Within a filesystem this is a
+// rename; across filesystems (e.g. between the JuiceFS mount and local disk) src is copied next to
+// dst, renamed into place so dst never holds a partial copy, and then removed.
+func moveDir(src, dst string) error {
+	err := renameDir(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	logInfof("%s and %s are on different filesystems; copying instead of renaming", src, dst)
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("failed to remove stale partial copy: %w", err)
+	}
+	if err := copyDir(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to copy %s to %s across filesystems: %w", src, dst, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return fmt.Errorf("failed to remove %s after copying it: %w", src, err)
+	}
+	return nil
+}
+
+// copyDir recursively copies the directory src to dst, preserving modes and symlinks
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			return fmt.Errorf("cannot copy %s: unsupported file type %v", path, d.Type())
+		}
+	})
+}
+
+// copyFile copies the regular file src to dst with the given mode
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrOperationCancelled is the cause of an operation cancelled through POST /operations/{id}/cancel
+var ErrOperationCancelled = errors.New("cancelled by operator")
+
+// errOperationNotFound is returned when cancelling an operation that is not in progress
+var errOperationNotFound = errors.New("operation not found")
+
+// Operation describes a long-running operation in progress
+type Operation struct {
+	ID string `json:"id"`
+	// Kind is what the operation does: setup, checkpoint, restore or warmup
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	StartedAt   time.Time `json:"started_at"`
+	// Progress is the latest step the operation reported, if any
+	Progress string `json:"progress,omitempty"`
+	// Cancelling is set once a cancel was requested, until the operation has wound down
+	Cancelling bool `json:"cancelling"`
+}
+
+// TrackedOperation is an operation registered in an OperationRegistry
+type TrackedOperation struct {
+	registry *OperationRegistry
+	info     Operation // protected by registry.mu
+	cancel   context.CancelCauseFunc
+	endOnce  sync.Once
+}
+
+// SetProgress records the step the operation is at, reported by GET /operations
+func (op *TrackedOperation) SetProgress(format string, args ...interface{}) {
+	if op == nil {
+		return
+	}
+	op.registry.mu.Lock()
+	defer op.registry.mu.Unlock()
+	op.info.Progress = fmt.Sprintf(format, args...)
+}
+
+// End removes the operation from the registry and releases its context. It is safe to call more than once.
+func (op *TrackedOperation) End() {
+	if op == nil {
+		return
+	}
+	op.endOnce.Do(func() {
+		op.registry.mu.Lock()
+		delete(op.registry.ops, op.info.ID)
+		op.registry.mu.Unlock()
+		op.cancel(nil)
+	})
+}
+
+// OperationRegistry tracks the long-running operations in progress, such as setup, checkpoints,
+// restores and cache warming, so operators can see them and cancel one that is stuck
+type OperationRegistry struct {
+	mu     sync.Mutex
+	nextID int
+	ops    map[string]*TrackedOperation
+}
+
+// OperationRecorder represents a component that registers its own long-running operations
+type OperationRecorder interface {
+	SetOperationRegistry(ops *OperationRegistry)
+}
+
+// NewOperationRegistry creates an empty operation registry
+func NewOperationRegistry() *OperationRegistry {
+	return &OperationRegistry{ops: make(map[string]*TrackedOperation)}
+}
+
+// operationKey is the context key of the operation a context belongs to
+type operationKey struct{}
+
+// Start registers an operation and returns the context it must run under, cancelled when the
+// operation is cancelled. The operation must be ended with End.
+func (r *OperationRegistry) Start(ctx context.Context, kind, description string) (context.Context, *TrackedOperation) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	op := &TrackedOperation{
+		registry: r,
+		info:     Operation{ID: kind + "-" + strconv.Itoa(r.nextID), Kind: kind, Description: description, StartedAt: time.Now()},
+		cancel:   cancel,
+	}
+	r.ops[op.info.ID] = op
+	return context.WithValue(ctx, operationKey{}, op), op
+}
+
+// List returns the operations in progress, oldest first
+func (r *OperationRegistry) List() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := make([]Operation, 0, len(r.ops))
+	for _, op := range r.ops {
+		ops = append(ops, op.info)
+	}
+	slices.SortFunc(ops, func(a, b Operation) int { return a.StartedAt.Compare(b.StartedAt) })
+	return ops
+}
+
+// Cancel cancels the operation with the given ID. The operation winds down, rolling back what it
+// already changed where it can, and leaves the registry once it has ended.
+func (r *OperationRegistry) Cancel(id string) (Operation, error) {
+	r.mu.Lock()
+	op, ok := r.ops[id]
+	if ok {
+		op.info.Cancelling = true
+	}
+	r.mu.Unlock()
+	if !ok {
+		return Operation{}, fmt.Errorf("%w: %s", errOperationNotFound, id)
+	}
+	op.cancel(ErrOperationCancelled)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return op.info, nil
+}
+
+// setOperationProgress records progress on the operation ctx belongs to, if any
+func setOperationProgress(ctx context.Context, format string, args ...interface{}) {
+	if op, ok := ctx.Value(operationKey{}).(*TrackedOperation); ok {
+		op.SetProgress(format, args...)
+	}
+}
+
+// operationCancelled reports whether ctx was cancelled through the operations endpoint
+func operationCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrOperationCancelled)
+}
+
+// handleOperations lists the long-running operations in progress
+func (c *Control) handleOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"operations": c.operations.List()})
+}
+
+// handleCancelOperation cancels a long-running operation in progress
+func (c *Control) handleCancelOperation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	op, err := c.operations.Cancel(r.PathValue("id"))
+	if errors.Is(err, errOperationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	logWarnf("Cancelling %s on request", op.Description)
+	c.events.Record(EventOperationCancelled, "control", op.Description, map[string]string{"id": op.ID, "kind": op.Kind})
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
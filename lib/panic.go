@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	panicMu      sync.Mutex
+	panicHandler func(v any)
+)
+
+// SetPanicHandler installs a function called with the value of a panic caught by RecoverPanic,
+// before the panic is re-raised. It lets the process release mounts, leases and replication
+// on an unexpected failure instead of leaking them.
+func SetPanicHandler(handler func(v any)) {
+	panicMu.Lock()
+	defer panicMu.Unlock()
+	panicHandler = handler
+}
+
+// RecoverPanic must be deferred directly at the top of long-lived goroutines. On a panic it logs
+// the stack, runs the panic handler and re-raises the panic, so the process still crashes.
+func RecoverPanic(name string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	logErrorf("Panic in %s: %v\n%s", name, v, debug.Stack())
+	panicMu.Lock()
+	handler := panicHandler
+	panicMu.Unlock()
+	if handler != nil {
+		handler(v)
+	}
+	panic(v)
+}
@@ -2,13 +2,16 @@ package lib
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 // StatusProvider is an interface for checking if the upstream service is available
@@ -16,11 +19,63 @@ type StatusProvider interface {
 	IsRunning() bool
 }
 
+// ReconfigureProvider is an interface for checking if the system is being reconfigured
+type ReconfigureProvider interface {
+	Reconfiguring() bool
+}
+
+// reconfigureRetryAfter is the Retry-After value, in seconds, sent while reconfiguring
+const reconfigureRetryAfter = "5"
+
+// DefaultRequestIDHeader is the header carrying the correlation ID of proxied requests
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// HeaderRewrite configures how upstream response headers are rewritten before reaching the client,
+// for backends that are unaware they are behind a proxy
+type HeaderRewrite struct {
+	// Remove lists response headers that are stripped, e.g. Server
+	Remove []string
+	// Strip lists hop-by-hop headers removed from both the proxied request and the upstream
+	// response, e.g. internal auth tokens injected in front of the proxy
+	Strip []string
+	// Replace maps a response header to substring replacements applied to its values,
+	// e.g. {"Set-Cookie": {"Domain=internal": "Domain=example.com"}}
+	Replace map[string]map[string]string
+	// RewriteLocation rewrites redirects to the upstream's own address (the proxy target or a
+	// loopback host) so they point at the host the client requested
+	RewriteLocation bool
+}
+
+// inboundHostKey is the context key holding the Host of the client request
+type inboundHostKey struct{}
+
+// latencyKey is the context key carrying the latency sample of a proxied request
+type latencyKey struct{}
+
+// latencySample is a proxied request whose backend latency is being measured
+type latencySample struct {
+	tracker *latencyTracker
+	start   time.Time
+}
+
 // Proxy represents an HTTP proxy with configurable upstream
 type Proxy struct {
-	targetAddr string
-	status     StatusProvider
-	proxy      *httputil.ReverseProxy
+	mu          sync.RWMutex // protects targetAddr, proxy and latency
+	targetAddr  string
+	status      StatusProvider
+	reconfigure ReconfigureProvider
+	maintenance MaintenanceProvider
+	drain       DrainProvider
+	proxy       *httputil.ReverseProxy
+	requestID   string // name of the correlation ID header
+	rewrite     HeaderRewrite
+	flush       time.Duration       // flush interval for response bodies
+	latency     *latencyTracker     // backend latencies for load shedding; nil when disabled
+	h2c         bool                // speak HTTP/2 without TLS (h2c) to the backend
+	pool        ConnPoolConfig      // idle connection limits of the backend transport
+	metrics     *ProxyMetrics       // response counters; nil when not collected
+	unavailable UnavailableResponse // served while the upstream process is not running
+	dialTimeout time.Duration       // bounds connecting to the backend; zero uses the default
 }
 
 // New creates a new proxy instance
@@ -28,6 +83,7 @@ func New(targetAddr string, status StatusProvider) (*Proxy, error) {
 	p := &Proxy{
 		targetAddr: targetAddr,
 		status:     status,
+		requestID:  DefaultRequestIDHeader,
 	}
 
 	if err := p.setupProxy(); err != nil {
@@ -37,6 +93,28 @@ func New(targetAddr string, status StatusProvider) (*Proxy, error) {
 	return p, nil
 }
 
+// SetTarget swaps the upstream target. In-flight requests complete against the previous target.
+func (p *Proxy) SetTarget(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := p.targetAddr
+	p.targetAddr = addr
+	if err := p.setupProxy(); err != nil {
+		p.targetAddr = previous
+		return err
+	}
+	logInfof("Proxy target changed from %s to %s", previous, addr)
+	return nil
+}
+
+// Target returns the current upstream target address
+func (p *Proxy) Target() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.targetAddr
+}
+
 // setupProxy configures the reverse proxy based on the target address
 func (p *Proxy) setupProxy() error {
 	var targetURL string
@@ -52,23 +130,28 @@ func (p *Proxy) setupProxy() error {
 		return fmt.Errorf("invalid target address: %v", err)
 	}
 
+	// Configure transport for Unix domain sockets
+	var socketPath string
+	if strings.HasPrefix(p.targetAddr, "unix:") {
+		socketPath = strings.TrimPrefix(p.targetAddr, "unix:")
+	}
 	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   0, // No dial timeout
-			KeepAlive: 0, // Let OS/user app manage keepalive
-		}).DialContext,
-		MaxIdleConns:        0, // Unlimited
-		MaxIdleConnsPerHost: 0, // Unlimited
-		IdleConnTimeout:     0, // No idle timeout
-		DisableKeepAlives:   false,
+		DialContext:       p.dialer(socketPath),
+		DisableKeepAlives: false,
 		// Do not set ResponseHeaderTimeout, TLSHandshakeTimeout, etc.
 	}
+	p.pool.apply(transport)
+	if p.h2c {
+		// rule: h2c backends get prior-knowledge HTTP/2 only; there is no upgrade from HTTP/1.1
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
 
-	// Configure transport for Unix domain sockets
-	if strings.HasPrefix(p.targetAddr, "unix:") {
-		socketPath := strings.TrimPrefix(p.targetAddr, "unix:")
-		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return net.Dial("unix", socketPath)
+	// rule: the replaced transport's idle connections are closed so a flapping target cannot
+	// accumulate descriptors; requests in flight on it are unaffected
+	if p.proxy != nil {
+		if previous, ok := p.proxy.Transport.(*http.Transport); ok {
+			defer previous.CloseIdleConnections()
 		}
 	}
 
@@ -77,10 +160,23 @@ func (p *Proxy) setupProxy() error {
 			req.URL.Scheme = target.Scheme
 			req.URL.Host = target.Host
 			req.Host = target.Host
+			for _, name := range p.rewrite.Strip {
+				req.Header.Del(name)
+			}
+		},
+		Transport:     transport,
+		FlushInterval: p.flush,
+		ModifyResponse: func(resp *http.Response) error {
+			// The correlation ID was already set on the response; don't duplicate an upstream echo
+			resp.Header.Del(p.requestID)
+			if sample, ok := resp.Request.Context().Value(latencyKey{}).(latencySample); ok {
+				sample.tracker.record(time.Since(sample.start))
+			}
+			p.rewriteHeaders(resp, target.Host)
+			return nil
 		},
-		Transport: transport,
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("Proxy error: %v", err)
+			logWarnf("Proxy error: %v", err)
 			http.Error(w, "Proxy error", http.StatusBadGateway)
 		},
 	}
@@ -88,12 +184,202 @@ func (p *Proxy) setupProxy() error {
 	return nil
 }
 
-// ServeHTTP handles HTTP requests, proxying them to the target if available
+// SetReconfigureProvider sets the provider consulted to hold requests during reconfiguration
+func (p *Proxy) SetReconfigureProvider(reconfigure ReconfigureProvider) {
+	p.reconfigure = reconfigure
+}
+
+// SetMaintenanceProvider sets the provider consulted to serve a maintenance response instead of proxying
+func (p *Proxy) SetMaintenanceProvider(maintenance MaintenanceProvider) {
+	p.maintenance = maintenance
+}
+
+// SetDrainProvider sets the provider consulted to shed new requests before shutdown
+func (p *Proxy) SetDrainProvider(drain DrainProvider) {
+	p.drain = drain
+}
+
+// SetFlushInterval sets how often buffered response data is flushed to the client while copying
+// the response body: negative flushes after every write, zero disables periodic flushing.
+// Responses of unknown length and text/event-stream responses are always flushed immediately.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetFlushInterval(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flush = interval
+	p.proxy.FlushInterval = interval
+}
+
+// SetBackendH2C switches the connection to the backend between HTTP/1.1 (the default) and
+// HTTP/2 without TLS, for backends such as gRPC services that only speak h2c.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetBackendH2C(enabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.h2c = enabled
+	return p.setupProxy()
+}
+
+// SetRequestIDHeader sets the name of the header carrying the correlation ID.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetRequestIDHeader(name string) {
+	p.requestID = http.CanonicalHeaderKey(name)
+}
+
+// SetHeaderRewrite sets the rules applied to upstream response headers.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetHeaderRewrite(rewrite HeaderRewrite) {
+	p.rewrite = rewrite
+}
+
+// rewriteHeaders applies the header rewrite rules to an upstream response from targetHost
+func (p *Proxy) rewriteHeaders(resp *http.Response, targetHost string) {
+	for _, name := range p.rewrite.Remove {
+		resp.Header.Del(name)
+	}
+	for _, name := range p.rewrite.Strip {
+		resp.Header.Del(name)
+	}
+	for name, replacements := range p.rewrite.Replace {
+		values := resp.Header.Values(name)
+		resp.Header.Del(name)
+		for _, value := range values {
+			for old, replacement := range replacements {
+				value = strings.ReplaceAll(value, old, replacement)
+			}
+			resp.Header.Add(name, value)
+		}
+	}
+
+	location := resp.Header.Get("Location")
+	inbound, _ := resp.Request.Context().Value(inboundHostKey{}).(string)
+	if !p.rewrite.RewriteLocation || location == "" || inbound == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() || !isUpstreamHost(u.Host, targetHost) {
+		return
+	}
+	u.Host = inbound
+	resp.Header.Set("Location", u.String())
+}
+
+// isUpstreamHost reports whether host addresses the upstream itself rather than an external site
+func isUpstreamHost(host, targetHost string) bool {
+	if strings.EqualFold(host, targetHost) {
+		return true
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if strings.EqualFold(hostname, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(hostname, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// newRequestID generates a random correlation ID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", b)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder captures the response status for the access log and metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	// rule: informational responses such as 103 Early Hints precede the final status; 101 is final
+	if s.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streamed responses
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// ServeHTTP handles HTTP requests, proxying them to the target if available.
+// Every request carries a correlation ID: an inbound one is forwarded, otherwise one is generated.
+// The ID is echoed on the response and included in the access log.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(p.requestID)
+	if id == "" {
+		id = newRequestID()
+		r.Header.Set(p.requestID, id)
+	}
+	w.Header().Set(p.requestID, id)
+
+	rec := &statusRecorder{ResponseWriter: w}
+	var reason string
+	defer func() {
+		logInfof("[proxy] %s %s %d request_id=%s", r.Method, r.URL.RequestURI(), rec.status, id)
+		if p.metrics != nil {
+			p.metrics.record(rec.status, reason)
+		}
+	}()
+	reason = p.serve(rec, r)
+}
+
+// serve proxies the request to the target, or responds directly if it is unavailable. It returns
+// why the proxy answered the request itself, one of the Unavailable* reasons, or "" if proxied.
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) string {
+	if p.maintenance != nil {
+		if state := p.maintenance.Maintenance(); state.Enabled {
+			state.ServeHTTP(w, r)
+			return UnavailableMaintenance
+		}
+	}
+
+	// rule: draining only sheds requests arriving after it starts; in-flight requests run to completion
+	if p.drain != nil && p.drain.Draining() {
+		w.Header().Set("Retry-After", drainRetryAfter)
+		http.Error(w, "Draining", http.StatusServiceUnavailable)
+		return UnavailableDraining
+	}
+
+	if p.reconfigure != nil && p.reconfigure.Reconfiguring() {
+		w.Header().Set("Retry-After", reconfigureRetryAfter)
+		http.Error(w, "Reconfiguring", http.StatusServiceUnavailable)
+		return UnavailableReconfiguring
+	}
+
 	if !p.status.IsRunning() {
-		http.Error(w, "Upstream service is not running", http.StatusServiceUnavailable)
-		return
+		p.unavailable.ServeHTTP(w, r)
+		return UnavailableNotRunning
 	}
 
-	p.proxy.ServeHTTP(w, r)
+	p.mu.RLock()
+	proxy, latency := p.proxy, p.latency
+	p.mu.RUnlock()
+
+	// The director replaces the Host, so keep the client's for rewriting redirects
+	ctx := context.WithValue(r.Context(), inboundHostKey{}, r.Host)
+	if latency != nil {
+		// rule: only a healthy backend that is slow is shed; a down backend is reported above instead
+		if latency.shed() {
+			serveShed(w)
+			return UnavailableShed
+		}
+		ctx = context.WithValue(ctx, latencyKey{}, latencySample{tracker: latency, start: time.Now()})
+	}
+	r = r.WithContext(ctx)
+	proxy.ServeHTTP(w, r)
+	return ""
 }
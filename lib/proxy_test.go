@@ -1,12 +1,20 @@
 package lib
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // mockStatusProvider implements StatusProvider for testing
@@ -110,3 +118,753 @@ func TestUnixSocketProxy(t *testing.T) {
 		}
 	})
 }
+
+func TestProxyDuringReconfiguration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	control := NewControl(server.URL[7:], "fly-app-controller", "test-token", t.TempDir(), nil)
+	proxy, err := New(server.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetReconfigureProvider(control)
+
+	if !control.beginReconfigure() {
+		t.Fatal("Expected to begin reconfiguration")
+	}
+	if control.beginReconfigure() {
+		t.Error("Expected concurrent reconfiguration to be rejected")
+	}
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status code %d during reconfiguration, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After header during reconfiguration")
+		}
+	}
+
+	control.endReconfigure()
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d after reconfiguration, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestProxySetTarget(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("second"))
+	}))
+	defer second.Close()
+
+	proxy, err := New(first.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if body := get(); body != "first" {
+		t.Errorf("Expected body 'first', got '%s'", body)
+	}
+
+	if err := proxy.SetTarget(second.URL[7:]); err != nil {
+		t.Fatalf("Failed to set target: %v", err)
+	}
+	if proxy.Target() != second.URL[7:] {
+		t.Errorf("Expected target %s, got %s", second.URL[7:], proxy.Target())
+	}
+
+	if body := get(); body != "second" {
+		t.Errorf("Expected body 'second', got '%s'", body)
+	}
+}
+
+func TestProxyMaintenanceMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	control := NewControl(server.URL[7:], "fly-app-controller", "test-token", dir, nil)
+	proxy, err := New(server.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetMaintenanceProvider(control)
+
+	setMaintenance := func(body string) {
+		req := httptest.NewRequest("POST", "/maintenance", bytes.NewBufferString(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 from /maintenance, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	setMaintenance(`{"enabled": true, "message": "Back soon", "retry_after": 30}`)
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d in maintenance, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After 30, got %q", w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "Back soon") {
+		t.Errorf("Expected maintenance message in body, got %q", w.Body.String())
+	}
+
+	// Maintenance survives a restart of the control interface
+	restarted := NewControl(server.URL[7:], "fly-app-controller", "test-token", dir, nil)
+	if !restarted.Maintenance().Enabled {
+		t.Error("Expected maintenance mode to persist across restart")
+	}
+
+	setMaintenance(`{"enabled": false}`)
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d after maintenance, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestProxyDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	control := NewControl(server.URL[7:], "fly-app-controller", "test-token", t.TempDir(), nil)
+	proxy, err := New(server.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetDrainProvider(control)
+
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// Start a request that is in flight when draining begins
+	inflight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		inflight <- w
+	}()
+	<-started
+
+	if w := admin("POST", "/drain"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 from /drain, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// New requests are shed
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d while draining, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After while draining")
+	}
+	if w := admin("GET", "/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /healthz to report not-ready while draining, got %d", w.Code)
+	}
+
+	// The in-flight request completes
+	close(release)
+	if w := <-inflight; w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("Expected in-flight request to complete, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyRequestID(t *testing.T) {
+	var seen string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Trace-Id")
+		w.Header().Set("X-Trace-Id", seen)
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	proxy, err := New(server.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetRequestIDHeader("x-trace-id")
+
+	// Generated when absent
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if seen == "" {
+		t.Fatal("Expected a generated request ID to be forwarded upstream")
+	}
+	if got := w.Result().Header.Values("X-Trace-Id"); len(got) != 1 || got[0] != seen {
+		t.Errorf("Expected response to echo request ID %q once, got %v", seen, got)
+	}
+
+	// Passed through when present
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Trace-Id", "abc123")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if seen != "abc123" {
+		t.Errorf("Expected inbound request ID to be forwarded, got %q", seen)
+	}
+	if got := w.Header().Get("X-Trace-Id"); got != "abc123" {
+		t.Errorf("Expected response to echo inbound request ID, got %q", got)
+	}
+
+	// Echoed on responses the proxy serves itself
+	down, err := New(server.URL[7:], &mockStatusProvider{running: false})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	w = httptest.NewRecorder()
+	down.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get(DefaultRequestIDHeader) == "" {
+		t.Error("Expected request ID on a response served by the proxy")
+	}
+}
+
+func TestProxyHeaderRewrite(t *testing.T) {
+	var upstream string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal/1.0")
+		w.Header().Add("Set-Cookie", "a=1; Domain=app.internal")
+		w.Header().Add("Set-Cookie", "b=2; Domain=app.internal")
+		switch r.URL.Path {
+		case "/self":
+			http.Redirect(w, r, "http://"+upstream+"/next?x=1", http.StatusFound)
+		case "/loopback":
+			http.Redirect(w, r, "http://localhost:3000/next", http.StatusFound)
+		default:
+			http.Redirect(w, r, "https://other.example.com/next", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	upstream = server.URL[7:]
+
+	proxy, err := New(upstream, &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetHeaderRewrite(HeaderRewrite{
+		Remove:          []string{"Server"},
+		Replace:         map[string]map[string]string{"Set-Cookie": {"Domain=app.internal": "Domain=app.example.com"}},
+		RewriteLocation: true,
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://app.example.com"+path, nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/self")
+	if got := w.Header().Get("Server"); got != "" {
+		t.Errorf("Expected Server header to be stripped, got %q", got)
+	}
+	if got := w.Header().Values("Set-Cookie"); len(got) != 2 || !strings.HasSuffix(got[0], "Domain=app.example.com") || !strings.HasSuffix(got[1], "Domain=app.example.com") {
+		t.Errorf("Expected cookie domains to be rewritten, got %q", got)
+	}
+	if got := w.Header().Get("Location"); got != "http://app.example.com/next?x=1" {
+		t.Errorf("Expected redirect to the requested host, got %q", got)
+	}
+	if got := get("/loopback").Header().Get("Location"); got != "http://app.example.com/next" {
+		t.Errorf("Expected loopback redirect to the requested host, got %q", got)
+	}
+	if got := get("/external").Header().Get("Location"); got != "https://other.example.com/next" {
+		t.Errorf("Expected external redirect to be left alone, got %q", got)
+	}
+}
+
+func TestProxyFlushesStreamedChunks(t *testing.T) {
+	// The backend writes one chunk, then waits for the client to have received it
+	var received chan struct{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			// A known length would otherwise leave the proxy buffering the body
+			w.Header().Set("Content-Length", "12")
+		}
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("last!\n"))
+	}))
+	defer backend.Close()
+
+	p, err := New(backend.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	p.SetFlushInterval(-1)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	for _, path := range []string{"/events", "/download"} {
+		received = make(chan struct{})
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", path, err)
+		}
+
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+		select {
+		case line := <-lines:
+			if line != "first" {
+				t.Errorf("%s: expected the first chunk, got %q", path, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: first chunk was buffered by the proxy", path)
+		}
+		close(received)
+		if line := <-lines; line != "last!" {
+			t.Errorf("%s: expected the last chunk, got %q", path, line)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestProxyStripsHeadersBothWays(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.Header().Set("X-Internal-Token", "leaked")
+		w.Header().Set("X-App", "kept")
+	}))
+	defer server.Close()
+
+	proxy, err := New(server.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetHeaderRewrite(HeaderRewrite{Strip: []string{"x-internal-token"}})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Internal-Token", "secret")
+	req.Header.Set("X-Client", "kept")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if got := forwarded.Get("X-Internal-Token"); got != "" {
+		t.Errorf("Expected the header to be stripped from the request, got %q", got)
+	}
+	if got := forwarded.Get("X-Client"); got != "kept" {
+		t.Errorf("Expected other request headers to be forwarded, got %q", got)
+	}
+	if got := w.Header().Get("X-Internal-Token"); got != "" {
+		t.Errorf("Expected the header to be stripped from the response, got %q", got)
+	}
+	if got := w.Header().Get("X-App"); got != "kept" {
+		t.Errorf("Expected other response headers to be returned, got %q", got)
+	}
+}
+
+func TestProxyShedsLoadWhenBackendSlow(t *testing.T) {
+	var delay atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	proxy, err := New(server.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetLoadShedding(LoadShedConfig{Threshold: 20 * time.Millisecond, Window: 20})
+
+	defer func(orig func() float64) { shedRand = orig }(shedRand)
+	shedRand = func() float64 { return 0.25 }
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	// Fast responses stay under the threshold
+	for i := 0; i < 20; i++ {
+		if w := get(); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 below the threshold, got %d", w.Code)
+		}
+	}
+
+	// Slow responses push the p99 over the threshold and shedding engages
+	delay.Store(int64(40 * time.Millisecond))
+	shed := 0
+	for i := 0; i < 5 && shed == 0; i++ {
+		if w := get(); w.Code == http.StatusServiceUnavailable {
+			shed++
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("Expected Retry-After on a shed request")
+			}
+		}
+	}
+	if shed == 0 {
+		t.Fatal("Expected shedding to engage once the p99 exceeded the threshold")
+	}
+
+	// Only the configured fraction is shed
+	shedRand = func() float64 { return 0.75 }
+	if w := get(); w.Code != http.StatusOK {
+		t.Errorf("Expected requests outside the shed fraction to be proxied, got %d", w.Code)
+	}
+
+	// Once latency recovers the window refills with fast samples and shedding stops
+	delay.Store(0)
+	for i := 0; i < 20; i++ {
+		get()
+	}
+	shedRand = func() float64 { return 0.25 }
+	if w := get(); w.Code != http.StatusOK {
+		t.Errorf("Expected shedding to stop after latency recovered, got %d", w.Code)
+	}
+
+	// Disabled shedding never rejects
+	proxy.SetLoadShedding(LoadShedConfig{})
+	delay.Store(int64(40 * time.Millisecond))
+	for i := 0; i < 3; i++ {
+		if w := get(); w.Code != http.StatusOK {
+			t.Errorf("Expected no shedding when disabled, got %d", w.Code)
+		}
+	}
+}
+
+func TestLoadShedConfigValidate(t *testing.T) {
+	for _, cfg := range []LoadShedConfig{
+		{Threshold: -time.Second},
+		{Threshold: time.Second, Fraction: 1},
+		{Threshold: time.Second, Fraction: -0.1},
+		{Threshold: time.Second, Window: -1},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+	if err := (LoadShedConfig{Threshold: time.Second, Fraction: 0.3, Window: 50}).Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+}
+
+func TestProxyBackendH2C(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	proxy, err := New(backend.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	get := func() string {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if proto := get(); proto != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 to the backend by default, got %s", proto)
+	}
+	if err := proxy.SetBackendH2C(true); err != nil {
+		t.Fatalf("Failed to enable h2c: %v", err)
+	}
+	// Concurrent requests are multiplexed over the HTTP/2 connection
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if proto := get(); proto != "HTTP/2.0" {
+				t.Errorf("Expected HTTP/2.0 to an h2c backend, got %s", proto)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProxyConnPoolLimits(t *testing.T) {
+	proxy, err := New("localhost:1", &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	transport := func() *http.Transport {
+		return proxy.proxy.Transport.(*http.Transport)
+	}
+
+	if tr := transport(); tr.MaxIdleConns != DefaultMaxIdleConns || tr.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost ||
+		tr.IdleConnTimeout != DefaultIdleConnTimeout {
+		t.Errorf("Expected bounded defaults, got %d/%d/%s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	if err := proxy.SetConnPool(ConnPoolConfig{MaxIdleConns: 10, MaxIdleConnsPerHost: 4, IdleConnTimeout: 5 * time.Second}); err != nil {
+		t.Fatalf("Failed to set pool: %v", err)
+	}
+	if tr := transport(); tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 4 || tr.IdleConnTimeout != 5*time.Second {
+		t.Errorf("Expected configured limits, got %d/%d/%s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	// The limits survive a target change
+	if err := proxy.SetTarget("localhost:2"); err != nil {
+		t.Fatalf("Failed to set target: %v", err)
+	}
+	if tr := transport(); tr.MaxIdleConnsPerHost != 4 {
+		t.Errorf("Expected limits to survive a target change, got %d", tr.MaxIdleConnsPerHost)
+	}
+
+	// Negative values opt into unlimited pooling
+	if err := proxy.SetConnPool(ConnPoolConfig{MaxIdleConns: -1, MaxIdleConnsPerHost: -1, IdleConnTimeout: -1}); err != nil {
+		t.Fatalf("Failed to set pool: %v", err)
+	}
+	if tr := transport(); tr.MaxIdleConns != 0 || tr.MaxIdleConnsPerHost != math.MaxInt || tr.IdleConnTimeout != 0 {
+		t.Errorf("Expected unlimited pooling, got %d/%d/%s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	if err := (ConnPoolConfig{IdleConnTimeout: time.Millisecond}).Validate(); err == nil {
+		t.Error("Expected a sub-second idle timeout to be rejected")
+	}
+}
+
+func TestProxyMetricsCountResponsesByClass(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stream":
+			// Early hints precede the final status of a streamed response
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("chunk\n"))
+		case "/redirect":
+			http.Redirect(w, r, "/", http.StatusFound)
+		case "/missing":
+			http.NotFound(w, r)
+		case "/fail":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer backend.Close()
+
+	status := &mockStatusProvider{running: true}
+	p, err := New(backend.URL[7:], status)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	metrics := NewProxyMetrics()
+	p.SetMetrics(metrics)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	for _, path := range []string{"/", "/stream", "/redirect", "/missing", "/missing", "/fail"} {
+		get(path)
+	}
+	status.running = false
+	if code := get("/"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while the backend is down, got %d", code)
+	}
+
+	for class, want := range map[int]uint64{1: 0, 2: 2, 3: 1, 4: 2, 5: 1} {
+		if got := metrics.Responses(class); got != want {
+			t.Errorf("Expected %d %dxx responses, got %d", want, class, got)
+		}
+	}
+	if got := metrics.Unavailable(UnavailableNotRunning); got != 1 {
+		t.Errorf("Expected 1 proxy-generated 503, got %d", got)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`fly_proxy_responses_total{class="5xx"} 1`, `fly_proxy_unavailable_total{reason="not_running"} 1`} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestProxyCustomUnavailableResponse(t *testing.T) {
+	p, err := New("127.0.0.1:1", &mockStatusProvider{running: false})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != DefaultUnavailableBody || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected the default 503 with Retry-After, got %d %q (Retry-After %q)", w.Code, w.Body.String(), w.Header().Get("Retry-After"))
+	}
+
+	if err := p.SetUnavailableResponse(UnavailableResponse{
+		StatusCode:  http.StatusTooManyRequests,
+		ContentType: "application/json",
+		Body:        `{"error": "starting"}`,
+		RetryAfter:  2,
+	}); err != nil {
+		t.Fatalf("Failed to set unavailable response: %v", err)
+	}
+	w = get()
+	if w.Code != http.StatusTooManyRequests || w.Body.String() != `{"error": "starting"}` {
+		t.Errorf("Expected the configured response, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected the configured content type, got %q", got)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", got)
+	}
+
+	p.SetUnavailableResponse(UnavailableResponse{RetryAfter: -1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+	})})
+	if w = get(); w.Body.String() != "starting up\n" || w.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected the handler's response without Retry-After, got %q (Retry-After %q)", w.Body.String(), w.Header().Get("Retry-After"))
+	}
+
+	if err := p.SetUnavailableResponse(UnavailableResponse{StatusCode: 99}); err == nil {
+		t.Error("Expected an invalid status code to be rejected")
+	}
+}
+
+func TestProxyDialTimeout(t *testing.T) {
+	// A backend that answers slowly once connected is not cut off by the dial timeout
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("slow but fine"))
+	}))
+	defer backend.Close()
+
+	proxy, err := New(strings.TrimPrefix(backend.URL, "http://"), &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	if err := proxy.SetDialTimeout(100 * time.Millisecond); err != nil {
+		t.Fatalf("Failed to set dial timeout: %v", err)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "slow but fine" {
+		t.Errorf("Expected the slow response to be proxied, got %d %q", w.Code, w.Body.String())
+	}
+
+	// A wedged backend whose connect never completes fails once the dial timeout passes
+	defer func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) { dialBackend = dial }(dialBackend)
+	dialBackend = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	proxy.proxy.Transport.(*http.Transport).CloseIdleConnections()
+	start := time.Now()
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a backend that never accepts, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the connect to give up after the dial timeout, took %v", elapsed)
+	}
+}
+
+func TestProxyHostAllowlist(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	proxy, err := New(strings.TrimPrefix(backend.URL, "http://"), &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	handler := control.HostFilter(proxy)
+	serve := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Every host is served by default
+	if w := serve("anything.example"); w.Code != http.StatusOK {
+		t.Errorf("Expected every host to be served without an allowlist, got %d", w.Code)
+	}
+
+	control.config = &SystemConfig{AllowedHosts: []string{"app.example.com", "WWW.example.com"}}
+	for _, host := range []string{"app.example.com", "App.Example.com:443", "www.example.com"} {
+		if w := serve(host); w.Code != http.StatusOK || w.Body.String() != "backend" {
+			t.Errorf("Expected %s to be proxied, got %d %q", host, w.Code, w.Body.String())
+		}
+	}
+	for _, host := range []string{"evil.example", "example.com", ""} {
+		if w := serve(host); w.Code != http.StatusMisdirectedRequest {
+			t.Errorf("Expected %q to be rejected with 421, got %d", host, w.Code)
+		}
+	}
+
+	if err := (&SystemConfig{AllowedHosts: []string{"http://app.example.com"}}).validateAllowedHosts(); err == nil {
+		t.Error("Expected a URL in allowed_hosts to be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Reasons the proxy answers a request itself with 503 instead of proxying it
+const (
+	UnavailableNotRunning    = "not_running"
+	UnavailableReconfiguring = "reconfiguring"
+	UnavailableDraining      = "draining"
+	UnavailableShed          = "shed"
+	UnavailableMaintenance   = "maintenance"
+)
+
+// unavailableReasons lists the reasons in the order they are exposed
+var unavailableReasons = []string{UnavailableNotRunning, UnavailableReconfiguring, UnavailableDraining, UnavailableShed, UnavailableMaintenance}
+
+// ProxyMetrics counts proxy responses for SLO monitoring. Responses to proxied requests are
+// counted by status class, separately from the responses the proxy generates itself while the
+// backend is unavailable, so backend errors can be told apart from proxy-level unavailability.
+// It is safe for concurrent use and can be shared by several proxies.
+type ProxyMetrics struct {
+	classes     [6]atomic.Uint64 // proxied responses indexed by status/100; index 0 is unused
+	unavailable map[string]*atomic.Uint64
+}
+
+// NewProxyMetrics creates zeroed proxy counters
+func NewProxyMetrics() *ProxyMetrics {
+	m := &ProxyMetrics{unavailable: make(map[string]*atomic.Uint64, len(unavailableReasons))}
+	for _, reason := range unavailableReasons {
+		m.unavailable[reason] = new(atomic.Uint64)
+	}
+	return m
+}
+
+// record counts a response: proxy-generated when reason is set, otherwise by its status class
+func (m *ProxyMetrics) record(status int, reason string) {
+	if reason != "" {
+		if counter, ok := m.unavailable[reason]; ok {
+			counter.Add(1)
+		}
+		return
+	}
+	// rule: a handler that never writes a status answers 200
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if class := status / 100; class >= 1 && class <= 5 {
+		m.classes[class].Add(1)
+	}
+}
+
+// Responses returns the number of proxied responses in a status class, 2 for 2xx and so on
+func (m *ProxyMetrics) Responses(class int) uint64 {
+	if class < 1 || class > 5 {
+		return 0
+	}
+	return m.classes[class].Load()
+}
+
+// Unavailable returns the number of requests the proxy answered itself for one of the
+// Unavailable* reasons
+func (m *ProxyMetrics) Unavailable(reason string) uint64 {
+	if counter, ok := m.unavailable[reason]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+// ServeHTTP exposes the counters in the Prometheus text format
+func (m *ProxyMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP fly_proxy_responses_total Responses to proxied requests by status class.")
+	fmt.Fprintln(w, "# TYPE fly_proxy_responses_total counter")
+	for class := 1; class <= 5; class++ {
+		fmt.Fprintf(w, "fly_proxy_responses_total{class=\"%dxx\"} %d\n", class, m.classes[class].Load())
+	}
+	fmt.Fprintln(w, "# HELP fly_proxy_unavailable_total Requests answered by the proxy itself because the backend was unavailable.")
+	fmt.Fprintln(w, "# TYPE fly_proxy_unavailable_total counter")
+	for _, reason := range unavailableReasons {
+		fmt.Fprintf(w, "fly_proxy_unavailable_total{reason=%q} %d\n", reason, m.unavailable[reason].Load())
+	}
+}
+
+// SetMetrics sets the counters the proxy's responses are recorded in.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetMetrics(metrics *ProxyMetrics) {
+	p.metrics = metrics
+}
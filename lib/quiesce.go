@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalNames maps the signals an app can be quiesced with to their names
+var signalNames = map[string]syscall.Signal{
+	"STOP":  syscall.SIGSTOP,
+	"CONT":  syscall.SIGCONT,
+	"TSTP":  syscall.SIGTSTP,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"HUP":   syscall.SIGHUP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// ParseSignal parses a signal given by name, with or without the SIG prefix, or by number
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
+// CheckpointQuiesce configures pausing the supervised app around every checkpoint, so the app
+// does not write to the active directory while it is renamed and the checkpoint captures a
+// consistent state. Quiescing is opt-in: it is disabled while PauseSignal is zero.
+type CheckpointQuiesce struct {
+	// PauseSignal is sent to the app before the checkpoint, e.g. SIGSTOP or a signal the app
+	// handles by finishing its writes
+	PauseSignal syscall.Signal
+	// ResumeSignal is sent once the checkpoint is done, whether it succeeded or not; zero uses SIGCONT
+	ResumeSignal syscall.Signal
+}
+
+// SetCheckpointQuiesce sets how the supervised app is paused around checkpoints
+func (c *Control) SetCheckpointQuiesce(q CheckpointQuiesce) error {
+	if q.PauseSignal != 0 && c.supervisor == nil {
+		return fmt.Errorf("cannot quiesce checkpoints: %w", errNoSupervisor)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkpointQuiesce = q
+	return nil
+}
+
+// quiesceForCheckpoint pauses the app for a checkpoint when configured, returning the function
+// that resumes it; the caller must hold c.mu
+func (c *Control) quiesceForCheckpoint() (func(), error) {
+	q := c.checkpointQuiesce
+	if q.PauseSignal == 0 || c.supervisor == nil {
+		return func() {}, nil
+	}
+	resume := q.ResumeSignal
+	if resume == 0 {
+		resume = syscall.SIGCONT
+	}
+	if err := c.supervisor.ForwardSignal(q.PauseSignal); err != nil {
+		return nil, fmt.Errorf("failed to quiesce process: %w", err)
+	}
+	logDebugf("Quiesced process with %v for checkpoint", q.PauseSignal)
+	return func() {
+		// rule: the app is resumed even when the checkpoint failed, so a failure never leaves it paused
+		if err := c.supervisor.ForwardSignal(resume); err != nil {
+			logErrorf("Failed to resume process after checkpoint: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultControlBurst is how many requests an idle control endpoint accepts at once
+const DefaultControlBurst = 5
+
+// rateLimitNow is the clock the rate limiter refills by, replaceable in tests
+var rateLimitNow = time.Now
+
+// ControlRateLimit configures the per-endpoint rate limits of the control API. Every endpoint has
+// its own token bucket, so a storm of one request cannot starve the others. Rate limiting is
+// opt-in: it is disabled while both rates are zero.
+type ControlRateLimit struct {
+	// Rate is how many requests per second each mutating endpoint (any method but GET, HEAD and
+	// OPTIONS) accepts; zero leaves mutating endpoints unlimited
+	Rate float64
+	// Burst is how many requests an idle endpoint accepts at once; zero uses DefaultControlBurst
+	Burst int
+	// ReadRate is how many requests per second each read-only endpoint accepts; zero leaves
+	// read-only endpoints unlimited
+	ReadRate float64
+}
+
+// Validate checks the rate limit settings
+func (cfg ControlRateLimit) Validate() error {
+	if cfg.Rate < 0 {
+		return fmt.Errorf("control rate limit must not be negative")
+	}
+	if cfg.Burst < 0 {
+		return fmt.Errorf("control rate limit burst must not be negative")
+	}
+	if cfg.ReadRate < 0 {
+		return fmt.Errorf("control read rate limit must not be negative")
+	}
+	return nil
+}
+
+// tokenBucket holds the tokens left for one endpoint
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per control endpoint
+type rateLimiter struct {
+	mu      sync.Mutex // protects all fields below
+	cfg     ControlRateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(cfg ControlRateLimit) *rateLimiter {
+	return &rateLimiter{cfg: cfg, buckets: make(map[string]*tokenBucket)}
+}
+
+// readOnly reports whether requests with the given method only read state
+func readOnly(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// limits returns the rate and burst of read-only or mutating requests; a zero rate is unlimited
+func (l *rateLimiter) limits(read bool) (float64, float64) {
+	burst := l.cfg.Burst
+	if burst == 0 {
+		burst = DefaultControlBurst
+	}
+	if read {
+		return l.cfg.ReadRate, float64(burst)
+	}
+	return l.cfg.Rate, float64(burst)
+}
+
+// allow takes a token for a request to the endpoint, returning how long to wait when none is left
+func (l *rateLimiter) allow(method, endpoint string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	read := readOnly(method)
+	rate, burst := l.limits(read)
+	if rate <= 0 {
+		return true, 0
+	}
+
+	// rule: reads and writes of one endpoint, e.g. GET and POST /checkpoint, have separate buckets
+	// so polling an endpoint never uses up the tokens of its mutating requests
+	key := endpoint
+	if read {
+		key = "read " + endpoint
+	}
+	now := rateLimitNow()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// SetRateLimit replaces the per-endpoint rate limits of the control API, resetting every bucket
+func (c *Control) SetRateLimit(cfg ControlRateLimit) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limiter = newRateLimiter(cfg)
+	return nil
+}
+
+// rateLimited rejects a request over its endpoint's rate limit with 429 and Retry-After,
+// reporting whether it did
+func (c *Control) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	_, pattern := c.mux.Handler(r)
+	if pattern == "" {
+		// Unknown routes are answered by the mux without doing any work
+		return false
+	}
+	c.mu.RLock()
+	limiter := c.limiter
+	c.mu.RUnlock()
+	ok, wait := limiter.allow(r.Method, pattern)
+	if ok {
+		return false
+	}
+	logDebugf("Rate limited %s %s", r.Method, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{"error": "rate limit exceeded for " + pattern})
+	return true
+}
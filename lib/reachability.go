@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// storageProbeInterval is how often object storage reachability is checked
+	storageProbeInterval = 30 * time.Second
+	// storageProbeTimeout bounds a single reachability check
+	storageProbeTimeout = 10 * time.Second
+)
+
+// StorageReachability is the cached result of probing the object storage bucket
+type StorageReachability struct {
+	Reachable   bool       `json:"reachable"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// storageMonitor periodically probes object storage in the background and caches the result
+type storageMonitor struct {
+	probe    func(ctx context.Context) error
+	interval time.Duration
+
+	mu       sync.RWMutex
+	state    StorageReachability
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newStorageMonitor creates a monitor that runs probe every interval once started
+func newStorageMonitor(probe func(ctx context.Context) error, interval time.Duration) *storageMonitor {
+	return &storageMonitor{probe: probe, interval: interval}
+}
+
+// headBucketProbe returns a probe that issues a HEAD request against the configured bucket
+func headBucketProbe(cfg *ObjectStorageConfig) (func(ctx context.Context) error, error) {
+	sess, err := cfg.newSession()
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+	bucket := cfg.Bucket
+	return func(ctx context.Context) error {
+		if _, err := client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			return fmt.Errorf("head bucket %s: %w", bucket, err)
+		}
+		return nil
+	}, nil
+}
+
+// check runs the probe once and records the result
+func (m *storageMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), storageProbeTimeout)
+	defer cancel()
+	err := m.probe(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		if m.state.Reachable || m.state.LastError == "" {
+			logWarnf("Object storage unreachable: %v", err)
+		}
+		m.state.Reachable = false
+		m.state.LastError = err.Error()
+		return
+	}
+	now := time.Now().UTC()
+	m.state.Reachable = true
+	m.state.LastSuccess = &now
+	m.state.LastError = ""
+}
+
+// start begins probing in the background
+func (m *storageMonitor) start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func() {
+		defer RecoverPanic("storage monitor")
+		defer close(m.done)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		m.check()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.check()
+			}
+		}
+	}()
+}
+
+// close stops probing and waits for an in-flight probe to finish
+func (m *storageMonitor) close() {
+	if m == nil || m.stop == nil {
+		return
+	}
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+// Reachability returns the most recent probe result
+func (m *storageMonitor) Reachability() StorageReachability {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// startStorageMonitor replaces the storage monitor with one probing the bucket in cfg
+func (c *Control) startStorageMonitor(cfg *ObjectStorageConfig) {
+	probe, err := headBucketProbe(cfg)
+	if err != nil {
+		logWarnf("Failed to set up storage reachability probe: %v", err)
+		return
+	}
+	monitor := newStorageMonitor(probe, storageProbeInterval)
+	monitor.start()
+
+	c.mu.Lock()
+	previous := c.storage
+	c.storage = monitor
+	c.mu.Unlock()
+	previous.close()
+}
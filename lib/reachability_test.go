@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStorageReachabilityStatus(t *testing.T) {
+	var reachable atomic.Bool
+	var probes atomic.Int32
+	probe := func(ctx context.Context) error {
+		probes.Add(1)
+		if reachable.Load() {
+			return nil
+		}
+		return errors.New("connection refused")
+	}
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	control.config = &SystemConfig{}
+	control.storage = newStorageMonitor(probe, 10*time.Millisecond)
+	control.storage.start()
+	defer control.storage.close()
+
+	waitFor := func(want bool) SystemStatus {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			status := control.currentStatus()
+			if status.Storage != nil && status.Storage.Reachable == want && probes.Load() > 0 {
+				return status
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for reachable=%v, got %+v", want, status.Storage)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	status := waitFor(false)
+	if status.Storage.LastError != "connection refused" || status.Storage.LastSuccess != nil {
+		t.Errorf("Unexpected unreachable status: %+v", status.Storage)
+	}
+
+	reachable.Store(true)
+	status = waitFor(true)
+	if status.Storage.LastSuccess == nil || status.Storage.LastError != "" {
+		t.Errorf("Unexpected reachable status: %+v", status.Storage)
+	}
+	lastSuccess := *status.Storage.LastSuccess
+
+	reachable.Store(false)
+	status = waitFor(false)
+	if status.Storage.LastSuccess == nil || status.Storage.LastSuccess.Before(lastSuccess) {
+		t.Errorf("Expected last success time to be kept while unreachable, got %+v", status.Storage)
+	}
+
+	// Status reads the cached result rather than probing
+	before := probes.Load()
+	control.storage.close()
+	for i := 0; i < 10; i++ {
+		control.currentStatus()
+	}
+	if probes.Load() != before {
+		t.Error("Expected status calls not to probe storage")
+	}
+}
+
+func TestValidateConfigChecksWriteAccess(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	validate := func(body string) (int, ConfigValidation) {
+		req := httptest.NewRequest("POST", "/config/validate", strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		var result ConfigValidation
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return w.Code, result
+	}
+	cfg := `{"stacks": [], "storage": {"bucket": "test-bucket", "endpoint": "` + server.URL +
+		`", "access_key": "key", "secret_key": "secret", "region": "auto", "key_prefix": "/app/"}}`
+
+	code, result := validate(cfg)
+	if code != http.StatusOK || !result.Valid || result.Storage == nil || !result.Storage.Writable {
+		t.Fatalf("Expected writable storage to validate, got %d %+v", code, result)
+	}
+	s3.mu.Lock()
+	leftover := len(s3.objects)
+	s3.mu.Unlock()
+	if leftover != 0 {
+		t.Errorf("Expected the test object to be cleaned up, got %d objects", leftover)
+	}
+
+	// Read-only credentials reach the bucket but cannot replicate
+	s3.mu.Lock()
+	s3.readOnly = true
+	s3.mu.Unlock()
+	code, result = validate(cfg)
+	if code != http.StatusUnprocessableEntity || result.Valid {
+		t.Fatalf("Expected read-only storage to fail validation, got %d %+v", code, result)
+	}
+	if !result.Storage.Reachable || result.Storage.Writable || !strings.Contains(result.Error, "AccessDenied") {
+		t.Errorf("Expected missing write permission to be flagged, got %+v", result.Storage)
+	}
+	if result.Storage.Category != StorageAuthFailed {
+		t.Errorf("Expected missing write permission to be categorized as %s, got %q", StorageAuthFailed, result.Storage.Category)
+	}
+
+	// Invalid configs are rejected before storage is contacted
+	if code, result := validate(`{"storage": {"bucket": "test-bucket"}}`); code != http.StatusUnprocessableEntity || result.Storage != nil {
+		t.Errorf("Expected an invalid config to fail without a storage check, got %d %+v", code, result)
+	}
+	if control.config != nil {
+		t.Error("Expected validation not to apply the config")
+	}
+}
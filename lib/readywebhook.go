@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults of the readiness webhook when not configured
+const (
+	// DefaultReadyWebhookRetries is how many times a failed webhook call is retried
+	DefaultReadyWebhookRetries = 5
+	// DefaultReadyWebhookBackoff is the wait before the first retry, doubling after each
+	DefaultReadyWebhookBackoff = time.Second
+)
+
+// readyWebhookTimeout bounds each webhook call
+const readyWebhookTimeout = 10 * time.Second
+
+// readyWebhookPollInterval is how often readiness is rechecked when no status change signals it,
+// e.g. when a mount finishes starting
+const readyWebhookPollInterval = time.Second
+
+// ReadyWebhookConfig configures the callback POSTed once the environment becomes ready, so a
+// provisioning system learns of it without polling /healthz
+type ReadyWebhookConfig struct {
+	// URL receives the callback; empty disables it
+	URL string
+	// Retries is how many times a failed call is retried. Zero uses DefaultReadyWebhookRetries
+	// and a negative value disables retries.
+	Retries int
+	// Backoff is the wait before the first retry, doubling after each. Zero uses DefaultReadyWebhookBackoff.
+	Backoff time.Duration
+}
+
+// ReadyNotification is the body of the readiness webhook
+type ReadyNotification struct {
+	EnvID  string       `json:"env_id"`
+	Status SystemStatus `json:"status"`
+}
+
+// readyWebhook watches for the environment to become ready in the background
+type readyWebhook struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	ctx      context.Context // calls run under it, cancelled when the watcher stops
+	cancel   context.CancelFunc
+}
+
+// close stops the watcher, cancelling a call in progress, and waits for it to return
+func (w *readyWebhook) close() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		w.cancel()
+	})
+	<-w.done
+}
+
+// SetReadyWebhook starts, replaces or, with an empty URL, stops the readiness webhook. The URL is
+// called each time the environment becomes ready: once setup completes, and again after a
+// reconfiguration or a failure it recovered from.
+func (c *Control) SetReadyWebhook(cfg ReadyWebhookConfig) error {
+	if cfg.URL != "" {
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("ready webhook %q must be an http or https URL", cfg.URL)
+		}
+	}
+	if cfg.Backoff < 0 {
+		return fmt.Errorf("ready webhook backoff must not be negative")
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultReadyWebhookRetries
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = DefaultReadyWebhookBackoff
+	}
+
+	var w *readyWebhook
+	if cfg.URL != "" {
+		w = &readyWebhook{stop: make(chan struct{}), done: make(chan struct{})}
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+		go func() {
+			defer RecoverPanic("ready webhook")
+			defer close(w.done)
+			changes, unsubscribe := c.statusChanges.subscribe()
+			defer unsubscribe()
+			ticker := time.NewTicker(readyWebhookPollInterval)
+			defer ticker.Stop()
+
+			notified := false
+			for {
+				// rule: the webhook fires on each transition to ready, not on every check while ready
+				ready := c.environmentReady(w.ctx)
+				if ready && !notified {
+					c.notifyReady(w.ctx, cfg)
+				}
+				notified = ready
+				select {
+				case <-w.stop:
+					return
+				case <-changes:
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	c.readyWebhook.Swap(w).close()
+	return nil
+}
+
+// environmentReady reports whether the environment is ready to serve: setup has completed, every
+// critical stack is healthy and has finished starting, nothing is draining or being reconfigured,
+// and the supervised app, if any, has passed its readiness probe
+func (c *Control) environmentReady(ctx context.Context) bool {
+	if !c.setupComplete.Load() || c.Draining() || c.Reconfiguring() {
+		return false
+	}
+	if healthy, _ := c.Health(ctx); !healthy {
+		return false
+	}
+	c.mu.RLock()
+	cfg := c.config
+	c.mu.RUnlock()
+	if cfg == nil {
+		return false
+	}
+	available := c.getAvailableComponents()
+	for _, stack := range cfg.Stacks {
+		if rc, ok := available[stack].(ReadinessChecker); ok && cfg.isCritical(stack) && !rc.Ready() {
+			return false
+		}
+	}
+	return c.supervisor == nil || c.supervisor.IsReady()
+}
+
+// notifyReady POSTs the status to the webhook, retrying failed calls with backoff
+func (c *Control) notifyReady(ctx context.Context, cfg ReadyWebhookConfig) {
+	status := c.Status()
+	body, err := json.Marshal(ReadyNotification{EnvID: status.EnvID, Status: status})
+	if err != nil {
+		logErrorf("Failed to encode the ready webhook: %v", err)
+		return
+	}
+
+	backoff := cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		err := postReady(ctx, cfg.URL, body)
+		if err == nil {
+			logInfof("Notified %s that the environment is ready", cfg.URL)
+			c.events.Record(EventReadyNotified, "control", "", map[string]string{"url": cfg.URL})
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if attempt > cfg.Retries {
+			logErrorf("Ready webhook %s failed after %d attempts: %v", cfg.URL, attempt, err)
+			c.events.Record(EventReadyWebhookFailed, "control", err.Error(), map[string]string{"url": cfg.URL})
+			return
+		}
+		logWarnf("Ready webhook %s failed (attempt %d of %d), retrying in %v: %v", cfg.URL, attempt, cfg.Retries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// postReady makes one webhook call, failing unless the receiver answers with a 2xx status
+func postReady(ctx context.Context, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, readyWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
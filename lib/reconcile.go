@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultReconcileInterval is how often the reconciliation loop checks the stacks when not configured
+const DefaultReconcileInterval = 30 * time.Second
+
+// What the reconciliation loop does once the lease was lost and the environment fenced
+const (
+	// ReconcileLeaseNever leaves the environment fenced until it is configured again
+	ReconcileLeaseNever = "never"
+	// ReconcileLeaseReacquire sets every stack up again, acquiring the lease first, once it is free
+	ReconcileLeaseReacquire = "reacquire"
+)
+
+// maxReconcileBackoff caps how many checks a repair that keeps failing is skipped for
+const maxReconcileBackoff = 32
+
+// ReconcileConfig configures the reconciliation loop, which repairs stacks that stopped working
+// after setup instead of leaving them broken until the environment is configured again
+type ReconcileConfig struct {
+	// Interval is how often the stacks are checked. Zero uses DefaultReconcileInterval and a
+	// negative value disables the loop.
+	Interval time.Duration
+	// Lease is what is done once the lease was lost: ReconcileLeaseNever (the default) or
+	// ReconcileLeaseReacquire
+	Lease string
+}
+
+// reconciler runs the reconciliation loop in the background
+type reconciler struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	ctx      context.Context // repairs run under it, cancelled when the loop stops
+	cancel   context.CancelFunc
+
+	// failures counts the consecutive failed repairs of each target, which back off the next attempt
+	failures map[string]int
+	// skip is how many more checks each target's repair is skipped for
+	skip map[string]int
+}
+
+// close stops the loop, cancelling a repair in progress, and waits for it to return
+func (r *reconciler) close() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.cancel()
+	})
+	<-r.done
+}
+
+// due reports whether the repair of target is attempted on this check
+func (r *reconciler) due(target string) bool {
+	if r.skip[target] > 0 {
+		r.skip[target]--
+		return false
+	}
+	return true
+}
+
+// result records the outcome of a repair. rule: each failure doubles the checks skipped before the next attempt
+func (r *reconciler) result(target string, err error) {
+	if err == nil {
+		delete(r.failures, target)
+		delete(r.skip, target)
+		return
+	}
+	r.failures[target]++
+	r.skip[target] = min(1<<(r.failures[target]-1), maxReconcileBackoff) - 1
+}
+
+// SetReconcile starts, replaces or, with a negative interval, stops the reconciliation loop
+func (c *Control) SetReconcile(cfg ReconcileConfig) error {
+	switch cfg.Lease {
+	case "":
+		cfg.Lease = ReconcileLeaseNever
+	case ReconcileLeaseNever, ReconcileLeaseReacquire:
+	default:
+		return fmt.Errorf("unknown reconcile lease policy %q: use %s or %s", cfg.Lease, ReconcileLeaseNever, ReconcileLeaseReacquire)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultReconcileInterval
+	}
+
+	var r *reconciler
+	if cfg.Interval > 0 {
+		r = &reconciler{stop: make(chan struct{}), done: make(chan struct{}), failures: make(map[string]int), skip: make(map[string]int)}
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+		go func() {
+			defer RecoverPanic("reconciliation loop")
+			defer close(r.done)
+			ticker := time.NewTicker(cfg.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-r.stop:
+					return
+				case <-ticker.C:
+					c.reconcile(r, cfg)
+				}
+			}
+		}()
+	}
+
+	c.reconciler.Swap(r).close()
+	return nil
+}
+
+// reconcile compares the stacks against the applied config once, repairing the ones that stopped
+// working: a stack reporting itself unhealthy is restarted if it can be, and a lost lease is
+// acquired again if the policy allows. Every repair attempted is recorded as an event.
+func (c *Control) reconcile(r *reconciler, cfg ReconcileConfig) {
+	// rule: nothing is repaired while an operator or another transition owns the environment's state
+	if c.Reconfiguring() || c.Standby() || c.Draining() || c.Maintenance().Enabled {
+		return
+	}
+	c.mu.RLock()
+	var stacks []string
+	if c.config != nil && c.suspension == nil {
+		stacks = c.config.Stacks
+	}
+	c.mu.RUnlock()
+	// rule: a setup that failed outright is left to the operator, but a fenced one can still reacquire the lease
+	if stacks == nil || (!c.setupComplete.Load() && !c.Fenced()) {
+		return
+	}
+
+	// Repairs get as long as setting a stack up for a config POST
+	ctx, cancel, _ := c.configContext(r.ctx)
+	defer cancel()
+	if c.Fenced() {
+		if cfg.Lease == ReconcileLeaseReacquire && r.due("lease") {
+			err := c.reacquire(ctx)
+			r.result("lease", err)
+			c.recordRepair("leaser", "reacquire_lease", err)
+		}
+		return
+	}
+
+	_, health := c.Health(ctx)
+	available := c.getAvailableComponents()
+	for _, stack := range stacks {
+		if health[stack].Healthy {
+			continue
+		}
+		rc, ok := available[stack].(Restartable)
+		if !ok || !r.due(stack) {
+			continue
+		}
+		logWarnf("Reconciling %s, which is unhealthy: %s", stack, health[stack].Error)
+		err := c.RestartComponent(ctx, rc)
+		r.result(stack, err)
+		c.recordRepair(stack, "restart", err)
+	}
+}
+
+// reacquire sets every stack up again after the lease was lost, acquiring the lease first. If that
+// fails the environment is cleaned up and stays fenced.
+func (c *Control) reacquire(ctx context.Context) error {
+	if !c.beginReconfigure() {
+		return errReconfiguring
+	}
+	defer c.endReconfigure()
+
+	c.mu.RLock()
+	cfg := c.config
+	c.mu.RUnlock()
+	if err := c.Cleanup(ctx); err != nil {
+		logWarnf("Failed to clean up fenced components before reacquiring the lease: %v", err)
+	}
+	if err := c.setupComponents(ctx, cfg); err != nil {
+		if cleanupErr := c.rollbackSetup(); cleanupErr != nil {
+			logErrorf("Failed to clean up after reacquiring the lease failed: %v", cleanupErr)
+		}
+		c.fenced.Store(true)
+		c.NotifyStatusChange()
+		return err
+	}
+	c.setupRoutes()
+	return nil
+}
+
+// recordRepair logs and records a repair attempted by the reconciliation loop
+func (c *Control) recordRepair(stack, action string, err error) {
+	fields := map[string]string{"stack": stack, "action": action}
+	if err != nil {
+		logErrorf("Reconciliation could not %s %s: %v", action, stack, err)
+		fields["error"] = err.Error()
+		c.events.Record(EventReconcileFailed, "control", err.Error(), fields)
+		return
+	}
+	logInfof("Reconciliation repaired %s (%s)", stack, action)
+	c.events.Record(EventReconcileRepaired, "control", "", fields)
+}
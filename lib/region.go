@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultRegion is the region used when none is configured. Tigris and Cloudflare R2 resolve it
+// themselves; AWS S3 rejects it, so AWS endpoints use the region named by their hostname instead.
+const DefaultRegion = "auto"
+
+// endpointKind classifies a storage endpoint by how it treats the region
+type endpointKind int
+
+const (
+	endpointOther      endpointKind = iota // S3-compatible store whose region handling is unknown
+	endpointAutoRegion                     // resolves the "auto" region itself (Tigris, R2)
+	endpointAWS                            // AWS S3, which signs requests for one named region
+)
+
+// awsRegionPattern matches AWS region names such as us-east-1 or ap-southeast-2
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// classifyEndpoint returns the kind of the storage endpoint and, for AWS, the region its hostname names
+func classifyEndpoint(endpoint string) (endpointKind, string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpointOther, ""
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.HasSuffix(host, ".tigris.dev"), strings.HasSuffix(host, ".storage.dev"),
+		strings.HasSuffix(host, ".r2.cloudflarestorage.com"):
+		return endpointAutoRegion, ""
+	case strings.HasSuffix(host, ".amazonaws.com"), strings.HasSuffix(host, ".amazonaws.com.cn"):
+		return endpointAWS, awsEndpointRegion(host)
+	}
+	return endpointOther, ""
+}
+
+// awsEndpointRegion returns the region named by an AWS S3 hostname such as s3.eu-west-1.amazonaws.com,
+// bucket.s3.eu-west-1.amazonaws.com or s3-eu-west-1.amazonaws.com. The global s3.amazonaws.com
+// endpoint is us-east-1; an unrecognised hostname returns "".
+func awsEndpointRegion(host string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.TrimSuffix(host, ".cn"), ".amazonaws.com"), ".")
+	last := labels[len(labels)-1]
+	switch {
+	case awsRegionPattern.MatchString(last):
+		return last
+	case last == "s3", last == "s3-external-1":
+		return "us-east-1"
+	case strings.HasPrefix(last, "s3-") && awsRegionPattern.MatchString(last[len("s3-"):]):
+		return last[len("s3-"):]
+	}
+	return ""
+}
+
+// region returns the region requests are signed for. Unless SkipRegionCheck is set, an empty
+// region becomes DefaultRegion and "auto" against an AWS endpoint becomes the hostname's region.
+func (cfg *ObjectStorageConfig) region() string {
+	if cfg.SkipRegionCheck {
+		return cfg.Region
+	}
+	region := strings.ToLower(strings.TrimSpace(cfg.Region))
+	if region == "" {
+		region = DefaultRegion
+	}
+	if kind, endpointRegion := classifyEndpoint(cfg.Endpoint); kind == endpointAWS && region == DefaultRegion && endpointRegion != "" {
+		return endpointRegion
+	}
+	return region
+}
+
+// validateRegion rejects regions the endpoint is known to refuse, which otherwise surface as
+// obscure signature errors, and warns when "auto" is used with an endpoint that may not accept it
+func (cfg *ObjectStorageConfig) validateRegion() error {
+	if cfg.SkipRegionCheck {
+		return nil
+	}
+	kind, endpointRegion := classifyEndpoint(cfg.Endpoint)
+	region := cfg.region()
+	switch kind {
+	case endpointAWS:
+		if region == DefaultRegion {
+			return fmt.Errorf("region %q is not valid for the AWS S3 endpoint %s: set region to the bucket's region", DefaultRegion, cfg.Endpoint)
+		}
+		// rule: a region contradicting the endpoint hostname fails every request with SignatureDoesNotMatch
+		if endpointRegion != "" && region != endpointRegion {
+			return fmt.Errorf("region %q does not match the AWS S3 endpoint %s (region %s); set skip_region_check to override", region, cfg.Endpoint, endpointRegion)
+		}
+	case endpointOther:
+		if region == DefaultRegion {
+			logWarnf("Region %q may not be accepted by %s; set region if requests fail with signature errors", DefaultRegion, cfg.Endpoint)
+		}
+	}
+	return nil
+}
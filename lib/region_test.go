@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegionNormalizedForEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ObjectStorageConfig
+		want    string
+		wantErr string
+	}{
+		{"tigris auto", ObjectStorageConfig{Endpoint: "https://fly.storage.tigris.dev", Region: "auto"}, "auto", ""},
+		{"r2 auto", ObjectStorageConfig{Endpoint: "https://acct.r2.cloudflarestorage.com", Region: "auto"}, "auto", ""},
+		{"empty region", ObjectStorageConfig{Endpoint: "https://t3.storage.dev"}, "auto", ""},
+		{"aws regional", ObjectStorageConfig{Endpoint: "https://s3.eu-west-1.amazonaws.com", Region: "auto"}, "eu-west-1", ""},
+		{"aws virtual host", ObjectStorageConfig{Endpoint: "https://bucket.s3.ap-southeast-2.amazonaws.com", Region: "auto"}, "ap-southeast-2", ""},
+		{"aws dash style", ObjectStorageConfig{Endpoint: "https://s3-us-west-2.amazonaws.com", Region: "auto"}, "us-west-2", ""},
+		{"aws global", ObjectStorageConfig{Endpoint: "https://s3.amazonaws.com", Region: "AUTO"}, "us-east-1", ""},
+		{"aws matching region", ObjectStorageConfig{Endpoint: "https://s3.eu-west-1.amazonaws.com", Region: "eu-west-1"}, "eu-west-1", ""},
+		{"aws mismatched region", ObjectStorageConfig{Endpoint: "https://s3.eu-west-1.amazonaws.com", Region: "us-east-1"}, "us-east-1", "does not match"},
+		{"aws unknown hostname", ObjectStorageConfig{Endpoint: "https://vpce-123.s3.vpce.amazonaws.com", Region: "auto"}, "auto", "not valid for the AWS S3 endpoint"},
+		{"aws override", ObjectStorageConfig{Endpoint: "https://s3.eu-west-1.amazonaws.com", Region: "us-east-1", SkipRegionCheck: true}, "us-east-1", ""},
+		{"minio auto", ObjectStorageConfig{Endpoint: "http://localhost:9000", Region: "auto"}, "auto", ""},
+		{"minio region", ObjectStorageConfig{Endpoint: "http://localhost:9000", Region: "us-east-1"}, "us-east-1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.region(); got != tt.want {
+				t.Errorf("Expected region %q, got %q", tt.want, got)
+			}
+			err := tt.cfg.validateRegion()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// errStackNotEnabled is returned when restarting a component whose stack is not configured
+var errStackNotEnabled = errors.New("stack not enabled")
+
+// RestartComponent restarts a single component without reconfiguring the rest of the environment
+func (c *Control) RestartComponent(ctx context.Context, rc Restartable) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := rc.Name()
+	if c.config == nil || !slices.Contains(c.config.Stacks, name) {
+		return fmt.Errorf("%w: %s", errStackNotEnabled, name)
+	}
+	if err := rc.Restart(ctx); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", name, err)
+	}
+	// rule: a stack that failed to set up is healthy again once it restarts cleanly
+	delete(c.setupErrors, name)
+	c.events.Record(EventComponentRestarted, "control", "", map[string]string{"stack": name})
+	return nil
+}
+
+// handleRestart returns a handler restarting the given component
+func (c *Control) handleRestart(rc Restartable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := c.RestartComponent(r.Context(), rc); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errStackNotEnabled) {
+				status = http.StatusNotFound
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "restarted",
+			"stack":  rc.Name(),
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeStubJuiceFSMount writes a fake juicefs binary whose mount reports ready and keeps running
+func writeStubJuiceFSMount(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "juicefs")
+	script := "#!/bin/sh\nfor last; do :; done\necho \"juicefs is ready at $last\" >&2\nexec sleep 60\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub juicefs: %v", err)
+	}
+	return path
+}
+
+func TestRestartComponents(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	cfg := &ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/",
+	}
+	ctx := context.Background()
+
+	db := NewDBManagerComponent(t.TempDir())
+	if err := db.Setup(ctx, cfg, ""); err != nil {
+		t.Fatalf("Failed to set up db: %v", err)
+	}
+	defer db.Cleanup(ctx)
+
+	juicefs := &JuiceFSComponent{
+		config:      cfg,
+		juicefsPath: writeStubJuiceFSMount(t, t.TempDir()),
+		mountDir:    t.TempDir(),
+		dbPath:      filepath.Join(t.TempDir(), "juicefs.sqlite"),
+	}
+	if err := juicefs.mount(ctx); err != nil {
+		t.Fatalf("Failed to mount: %v", err)
+	}
+	defer juicefs.Cleanup(ctx)
+	first := juicefs.supervisor
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, db, juicefs)
+	control.config = &SystemConfig{Stacks: []string{"db", "juicefs"}}
+	control.setupRoutes()
+
+	restart := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/stack/"+name+"/restart", nil)
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, name := range []string{"db", "juicefs"} {
+		if w := restart(name); w.Code != http.StatusOK {
+			t.Fatalf("Expected %s restart to succeed, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	healthy, components := control.Health(ctx)
+	if !healthy {
+		t.Errorf("Expected components to be healthy after restart, got %+v", components)
+	}
+	if juicefs.supervisor == first || first.IsRunning() {
+		t.Error("Expected the mount process to be replaced on restart")
+	}
+	if !db.dbManager.replicating {
+		t.Error("Expected replication to be running after restart")
+	}
+
+	// Only enabled stacks can be restarted
+	control.config.Stacks = []string{"db"}
+	if w := restart("juicefs"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected restart of a disabled stack to return 404, got %d", w.Code)
+	}
+}
+
+// brokenComponent is a restartable component whose health is set by the test
+type brokenComponent struct {
+	missingCheckpointComponent
+	mu       sync.Mutex
+	broken   bool
+	restarts int
+}
+
+func (b *brokenComponent) Name() string {
+	return "broken"
+}
+
+func (b *brokenComponent) Healthy(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.broken {
+		return fmt.Errorf("process died")
+	}
+	return nil
+}
+
+func (b *brokenComponent) Restart(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.broken = false
+	b.restarts++
+	return nil
+}
+
+func TestReconcileRestartsUnhealthyComponents(t *testing.T) {
+	broken := &brokenComponent{}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, broken)
+	control.config = &SystemConfig{Stacks: []string{"broken"}}
+	control.setupComplete.Store(true)
+	if err := control.SetReconcile(ReconcileConfig{Interval: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer control.SetReconcile(ReconcileConfig{Interval: -1})
+
+	// A healthy stack is left alone
+	time.Sleep(50 * time.Millisecond)
+	broken.mu.Lock()
+	restarts := broken.restarts
+	broken.broken = true
+	broken.mu.Unlock()
+	if restarts != 0 {
+		t.Fatalf("Expected a healthy component not to be restarted, got %d restarts", restarts)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	repaired := func() bool {
+		for _, e := range control.Events().Recent(0) {
+			if e.Type == EventReconcileRepaired && e.Fields["stack"] == "broken" {
+				return true
+			}
+		}
+		return false
+	}
+	for !repaired() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the reconciliation loop to repair the component")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if healthy, components := control.Health(context.Background()); !healthy {
+		t.Errorf("Expected the component to be healthy after the repair, got %+v", components)
+	}
+	broken.mu.Lock()
+	defer broken.mu.Unlock()
+	if broken.restarts != 1 {
+		t.Errorf("Expected one restart, got %d", broken.restarts)
+	}
+
+	if err := control.SetReconcile(ReconcileConfig{Lease: "sometimes"}); err == nil {
+		t.Error("Expected an unknown lease policy to be rejected")
+	}
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RestartMode selects whether the supervised process is restarted when it exits on its own
+type RestartMode string
+
+const (
+	// RestartAlways restarts the process whenever it exits on its own
+	RestartAlways RestartMode = "always"
+	// RestartNever leaves the process stopped when it exits, for inspecting a crashing process
+	RestartNever RestartMode = "never"
+)
+
+// restartStreakReset is how long a process must run for its exit not to count towards MaxRestarts
+const restartStreakReset = time.Minute
+
+// RestartPolicy is how the supervisor restarts the process, adjustable at runtime
+type RestartPolicy struct {
+	Mode RestartMode `json:"mode"`
+	// DelayMillis is the wait before each automatic restart
+	DelayMillis int64 `json:"delay_ms"`
+	// Jitter is the fraction of the delay by which each restart is randomized, between 0 and 1
+	Jitter float64 `json:"jitter"`
+	// MaxRestarts caps consecutive restarts of a process that keeps exiting within a minute of
+	// starting; zero is unlimited
+	MaxRestarts int `json:"max_restarts"`
+}
+
+// validate checks the policy values
+func (p RestartPolicy) validate() error {
+	if p.Mode != RestartAlways && p.Mode != RestartNever {
+		return fmt.Errorf("mode must be %q or %q", RestartAlways, RestartNever)
+	}
+	if p.DelayMillis <= 0 {
+		return fmt.Errorf("delay_ms must be positive")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	if p.MaxRestarts < 0 {
+		return fmt.Errorf("max_restarts must not be negative")
+	}
+	return nil
+}
+
+// RestartPolicy returns the current restart policy
+func (s *Supervisor) RestartPolicy() RestartPolicy {
+	s.policy.Lock()
+	defer s.policy.Unlock()
+	mode := RestartAlways
+	if !s.AutoRestart() {
+		mode = RestartNever
+	}
+	return RestartPolicy{
+		Mode:        mode,
+		DelayMillis: s.config.RestartDelay.Milliseconds(),
+		Jitter:      s.config.RestartJitter,
+		MaxRestarts: s.config.MaxRestarts,
+	}
+}
+
+// SetRestartPolicy replaces the restart policy for every later exit of the process.
+// It also clears the count of consecutive restarts, so a process that hit MaxRestarts can be
+// restarted again once the cause is fixed.
+func (s *Supervisor) SetRestartPolicy(p RestartPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	s.policy.Lock()
+	defer s.policy.Unlock()
+	s.config.RestartDelay = time.Duration(p.DelayMillis) * time.Millisecond
+	s.config.RestartJitter = p.Jitter
+	s.config.MaxRestarts = p.MaxRestarts
+	s.policy.streak = 0
+	s.SetAutoRestart(p.Mode == RestartAlways)
+	return nil
+}
+
+// SetRestartPolicy changes the supervisor's restart policy at runtime. Nothing is persisted:
+// a restarted server goes back to its configured policy.
+func (c *Control) SetRestartPolicy(p RestartPolicy) error {
+	if c.supervisor == nil {
+		return errNoSupervisor
+	}
+	if err := c.supervisor.SetRestartPolicy(p); err != nil {
+		return err
+	}
+	logInfof("Restart policy changed: mode %s, delay %dms, jitter %v, max restarts %d", p.Mode, p.DelayMillis, p.Jitter, p.MaxRestarts)
+	c.events.Record(EventRestartPolicyChanged, "control", "", map[string]string{"mode": string(p.Mode)})
+	c.NotifyStatusChange()
+	return nil
+}
+
+// handleRestartPolicy reports or changes the restart policy of the supervised process.
+// A PUT body only needs the fields being changed.
+func (c *Control) handleRestartPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if c.supervisor == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errNoSupervisor.Error()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		policy := c.supervisor.RestartPolicy()
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&policy); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		if err := c.SetRestartPolicy(policy); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	default:
+		w.Header().Del("Content-Type")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(c.supervisor.RestartPolicy())
+}
@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// route sends requests under a path prefix to a handler
+type route struct {
+	prefix  string
+	handler http.Handler
+}
+
+// Router dispatches proxied requests by path prefix, so one environment can front several
+// upstreams (e.g. an API under /api and a static file server for everything else).
+// The longest matching prefix wins; unmatched requests go to the fallback.
+type Router struct {
+	mu       sync.RWMutex // protects routes
+	routes   []route      // sorted by descending prefix length
+	fallback http.Handler
+}
+
+// NewRouter creates a router sending unmatched requests to fallback
+func NewRouter(fallback http.Handler) *Router {
+	return &Router{fallback: fallback}
+}
+
+// Handle routes requests whose path is prefix, or is under prefix, to handler.
+// Each routed upstream is typically its own Proxy with its own StatusProvider.
+func (rt *Router) Handle(prefix string, handler http.Handler) error {
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("route prefix %q must start with /", prefix)
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, r := range rt.routes {
+		if r.prefix == prefix {
+			return fmt.Errorf("duplicate route prefix %q", prefix)
+		}
+	}
+	rt.routes = append(rt.routes, route{prefix: prefix, handler: handler})
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].prefix) > len(rt.routes[j].prefix)
+	})
+	return nil
+}
+
+// match returns the handler for the given request path
+func (rt *Router) match(path string) http.Handler {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, r := range rt.routes {
+		// rule: a prefix matches whole path segments only, so /api does not match /apix
+		if path == r.prefix || strings.HasPrefix(path, r.prefix+"/") {
+			return r.handler
+		}
+	}
+	return rt.fallback
+}
+
+// ServeHTTP forwards the request, path unchanged, to the handler of the longest matching prefix
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.match(r.URL.Path).ServeHTTP(w, r)
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterRoutesByPathPrefix(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	api := backend("api")
+	defer api.Close()
+	static := backend("static")
+	defer static.Close()
+
+	apiStatus := &mockStatusProvider{running: true}
+	apiProxy, err := New(api.URL[7:], apiStatus)
+	if err != nil {
+		t.Fatalf("Failed to create api proxy: %v", err)
+	}
+	staticProxy, err := New(static.URL[7:], &mockStatusProvider{running: true})
+	if err != nil {
+		t.Fatalf("Failed to create static proxy: %v", err)
+	}
+
+	router := NewRouter(staticProxy)
+	if err := router.Handle("/api/", apiProxy); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.Handle("/api", apiProxy); err == nil {
+		t.Error("Expected an error for a duplicate prefix")
+	}
+	if err := router.Handle("api", apiProxy); err == nil {
+		t.Error("Expected an error for a relative prefix")
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api", "api /api"},
+		{"/api/users", "api /api/users"},
+		{"/apix", "static /apix"},
+		{"/", "static /"},
+		{"/assets/app.js", "static /assets/app.js"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s: expected %q, got %d %q", tt.path, tt.want, w.Code, w.Body.String())
+		}
+	}
+
+	// Each route reports the availability of its own upstream
+	apiStatus.running = false
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/users", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a stopped api upstream, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the default upstream to stay available, got %d", w.Code)
+	}
+}
@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretFileSuffix marks an environment variable naming a file that holds the value of the variable
+// without the suffix, as platforms delivering secrets as mounted files (e.g. /run/secrets) expect
+const secretFileSuffix = "_FILE"
+
+// SecretEnv returns the value of a sensitive environment variable. If name+"_FILE" is set, the
+// named file is read instead, with trailing newlines trimmed, so the secret never has to be in the
+// process environment; the file takes precedence when both are set.
+func SecretEnv(name string) (string, error) {
+	path := os.Getenv(name + secretFileSuffix)
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		logWarnf("Both %s and %s%s are set; using the file", name, name, secretFileSuffix)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s%s: %w", name, secretFileSuffix, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// selfTestCheckTimeout bounds each self-test check
+const selfTestCheckTimeout = 2 * time.Minute
+
+// Self-test check outcomes
+const (
+	SelfTestPass = "pass"
+	SelfTestFail = "fail"
+	SelfTestSkip = "skip"
+)
+
+// SelfTestCheck is one check of the self-test
+type SelfTestCheck struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Unsupported explains why the check cannot run on this machine; such a check is skipped
+	Unsupported string
+}
+
+// SelfTestResult is the outcome of one self-test check
+type SelfTestResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`           // SelfTestPass, SelfTestFail or SelfTestSkip
+	Detail   string        `json:"detail,omitempty"` // the failure, or why the check was skipped
+	Duration time.Duration `json:"duration"`
+}
+
+// RunSelfTest runs the checks in order, skipping those named in skip, and reports whether none
+// failed. Every check runs even after a failure, so one run lists every problem.
+func RunSelfTest(ctx context.Context, checks []SelfTestCheck, skip []string) ([]SelfTestResult, bool, error) {
+	for _, name := range skip {
+		if !slices.ContainsFunc(checks, func(c SelfTestCheck) bool { return c.Name == name }) {
+			return nil, false, fmt.Errorf("unknown self-test check %q", name)
+		}
+	}
+
+	ok := true
+	results := make([]SelfTestResult, 0, len(checks))
+	for _, check := range checks {
+		result := SelfTestResult{Name: check.Name}
+		switch {
+		case slices.Contains(skip, check.Name):
+			result.Status, result.Detail = SelfTestSkip, "skipped on request"
+		case check.Unsupported != "":
+			result.Status, result.Detail = SelfTestSkip, check.Unsupported
+		default:
+			start := time.Now()
+			err := runSelfTestCheck(ctx, check)
+			result.Duration = time.Since(start)
+			result.Status = SelfTestPass
+			if err != nil {
+				result.Status, result.Detail = SelfTestFail, err.Error()
+				ok = false
+			}
+		}
+		results = append(results, result)
+	}
+	return results, ok, nil
+}
+
+// runSelfTestCheck runs a check under its timeout, reporting a panic as a failure
+func runSelfTestCheck(ctx context.Context, check SelfTestCheck) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, selfTestCheckTimeout)
+	defer cancel()
+	return check.Run(ctx)
+}
+
+// SelfTestChecks returns the checks of a machine's storage configuration: object read/write/delete,
+// lease acquire/release, a SQLite replicate-and-restore and, on Linux, a JuiceFS mount/unmount.
+// The checks work in a scratch namespace under the key prefix, removed afterwards by the
+// "cleanup" check, and local files go under workDir.
+func SelfTestChecks(cfg *SystemConfig, workDir string) []SelfTestCheck {
+	scratch := cfg.Storage
+	id := fmt.Sprintf("selftest-%d", time.Now().UnixNano())
+	// rule: checks never touch the environment's own lease, replicas or volume
+	scratch.KeyPrefix = path.Join(cfg.Storage.layout().scratch(), id)
+
+	juicefs := SelfTestCheck{Name: "juicefs", Run: func(ctx context.Context) error {
+		return selfTestJuiceFS(ctx, &scratch, cfg.JuiceFS.binary(), id, filepath.Join(workDir, "juicefs"))
+	}}
+	if runtime.GOOS != "linux" {
+		juicefs.Unsupported = "JuiceFS mounts need Linux"
+	}
+	return []SelfTestCheck{
+		{Name: "storage", Run: func(ctx context.Context) error { return selfTestStorage(ctx, &scratch) }},
+		{Name: "lease", Run: func(ctx context.Context) error { return selfTestLease(ctx, &scratch) }},
+		{Name: "db", Run: func(ctx context.Context) error { return selfTestDB(ctx, &scratch, filepath.Join(workDir, "db")) }},
+		juicefs,
+		{Name: "cleanup", Run: func(ctx context.Context) error {
+			if err := deletePrefix(ctx, &scratch, scratch.keyPrefix()+"/"); err != nil {
+				return err
+			}
+			return deletePrefix(ctx, &scratch, id+"/")
+		}},
+	}
+}
+
+// selfTestStorage writes an object, reads it back and deletes it
+func selfTestStorage(ctx context.Context, cfg *ObjectStorageConfig) error {
+	sess, err := cfg.newSession()
+	if err != nil {
+		return err
+	}
+	client := s3.New(sess)
+	key := path.Join(cfg.keyPrefix(), "object")
+	payload := []byte(fmt.Sprintf("fly-user-env self-test %d", time.Now().UnixNano()))
+
+	input := &s3.PutObjectInput{Bucket: aws.String(cfg.Bucket), Key: aws.String(key), Body: bytes.NewReader(payload)}
+	if cfg.SSE != "" {
+		input.ServerSideEncryption = aws.String(cfg.SSE)
+		if cfg.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(cfg.SSEKMSKeyID)
+		}
+	}
+	if _, err := client.PutObjectWithContext(ctx, input); err != nil {
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(cfg.Bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("read %s: %w", key, err)
+	}
+	data, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		return fmt.Errorf("read %s: %w", key, err)
+	}
+	if !bytes.Equal(data, payload) {
+		return fmt.Errorf("read %s: got %d bytes that differ from those written", key, len(data))
+	}
+	if _, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(cfg.Bucket), Key: aws.String(key)}); err != nil {
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// selfTestLease acquires and releases a lease on a scratch lock object
+func selfTestLease(ctx context.Context, cfg *ObjectStorageConfig) error {
+	leaser, err := openS3Leaser(cfg, "selftest", leaseTimeout)
+	if err != nil {
+		return err
+	}
+	lease, err := leaser.AcquireLease(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire lease: %w", err)
+	}
+	if err := leaser.ReleaseLease(ctx, lease.Epoch); err != nil {
+		return fmt.Errorf("release lease: %w", err)
+	}
+	return nil
+}
+
+// selfTestDB replicates a throwaway SQLite database and restores it
+func selfTestDB(ctx context.Context, cfg *ObjectStorageConfig, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", dir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	dm := NewDBManager(cfg, dir)
+	if err := dm.InitializeContext(ctx); err != nil {
+		return err
+	}
+	if err := dm.StartReplication(); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", dm.DBPath)
+	if err != nil {
+		dm.StopReplication()
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `CREATE TABLE selftest (value TEXT); INSERT INTO selftest VALUES ('ok')`)
+	db.Close()
+	if err != nil {
+		dm.StopReplication()
+		return fmt.Errorf("failed to write database: %w", err)
+	}
+	err = dm.Sync(ctx)
+	if stopErr := dm.StopReplication(); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		return err
+	}
+
+	restored := filepath.Join(dir, "restored.sqlite")
+	if err := dm.Restore(ctx, restored); err != nil {
+		return err
+	}
+	db, err = sql.Open("sqlite3", restored)
+	if err != nil {
+		return fmt.Errorf("failed to open restored database: %w", err)
+	}
+	defer db.Close()
+	var value string
+	if err := db.QueryRowContext(ctx, `SELECT value FROM selftest`).Scan(&value); err != nil {
+		return fmt.Errorf("failed to read restored database: %w", err)
+	}
+	if value != "ok" {
+		return fmt.Errorf("restored database holds %q, expected %q", value, "ok")
+	}
+	return nil
+}
+
+// selfTestJuiceFS formats a scratch volume named name, mounts it, writes and reads a file and unmounts it
+func selfTestJuiceFS(ctx context.Context, cfg *ObjectStorageConfig, binary, name, dir string) error {
+	resolved, err := exec.LookPath(binary)
+	if err != nil {
+		return fmt.Errorf("juicefs binary %q not found: %w", binary, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", dir, err)
+	}
+	mountDir := filepath.Join(dir, "mount")
+	if err := os.MkdirAll(mountDir, DirMode); err != nil {
+		return fmt.Errorf("failed to create %s: %w", mountDir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := fmt.Sprintf("sqlite3://%s", filepath.Join(dir, "meta.db"))
+	run := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, resolved, args...)
+		cmd.Env = append(os.Environ(), cfg.awsEnv()...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("juicefs %s: %w\nOutput: %s", args[0], err, output)
+		}
+		return nil
+	}
+	if err := run("format", "--storage", "s3", "--bucket", cfg.juicefsBucketURL(), "--trash-days", "0", meta, name); err != nil {
+		return err
+	}
+	if err := run(append(append([]string{"mount", "--background"}, cfg.juicefsMountFlags()...), meta, mountDir)...); err != nil {
+		return err
+	}
+	probe := filepath.Join(mountDir, "probe")
+	err = os.WriteFile(probe, []byte("ok"), FileMode)
+	if err == nil {
+		var data []byte
+		if data, err = os.ReadFile(probe); err == nil && string(data) != "ok" {
+			err = fmt.Errorf("read back %q from the mount, expected %q", data, "ok")
+		}
+	}
+	if umountErr := run("umount", mountDir); err == nil {
+		err = umountErr
+	}
+	return err
+}
+
+// deletePrefix deletes every object under prefix
+func deletePrefix(ctx context.Context, cfg *ObjectStorageConfig, prefix string) error {
+	sess, err := cfg.newSession()
+	if err != nil {
+		return err
+	}
+	client := s3.New(sess)
+	var keys []string
+	err = client.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket: aws.String(cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("list %s: %w", prefix, err)
+	}
+	for _, key := range keys {
+		if _, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(cfg.Bucket), Key: aws.String(key)}); err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestOrchestration(t *testing.T) {
+	var ran []string
+	check := func(name string, err error) SelfTestCheck {
+		return SelfTestCheck{Name: name, Run: func(ctx context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	checks := []SelfTestCheck{
+		check("storage", nil),
+		check("lease", errors.New("lease held")),
+		check("db", nil),
+		{Name: "juicefs", Unsupported: "needs Linux", Run: func(ctx context.Context) error {
+			t.Error("Expected an unsupported check not to run")
+			return nil
+		}},
+		{Name: "broken", Run: func(ctx context.Context) error { panic("check bug") }},
+	}
+
+	results, ok, err := RunSelfTest(context.Background(), checks, []string{"db"})
+	if err != nil {
+		t.Fatalf("Failed to run self-test: %v", err)
+	}
+	if ok {
+		t.Error("Expected the self-test to fail")
+	}
+	// Checks after a failure still run
+	if strings.Join(ran, ",") != "storage,lease" {
+		t.Errorf("Expected storage and lease to run, got %v", ran)
+	}
+	want := []struct{ status, detail string }{
+		{SelfTestPass, ""},
+		{SelfTestFail, "lease held"},
+		{SelfTestSkip, "skipped on request"},
+		{SelfTestSkip, "needs Linux"},
+		{SelfTestFail, "panic: check bug"},
+	}
+	for i, w := range want {
+		if results[i].Status != w.status || results[i].Detail != w.detail {
+			t.Errorf("%s: expected %s %q, got %s %q", results[i].Name, w.status, w.detail, results[i].Status, results[i].Detail)
+		}
+	}
+
+	if _, _, err := RunSelfTest(context.Background(), checks, []string{"nope"}); err == nil {
+		t.Error("Expected an unknown check name to be rejected")
+	}
+}
+
+func TestSelfTestChecksAgainstStorage(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	cfg := &SystemConfig{Storage: ObjectStorageConfig{
+		Bucket:    "test-bucket",
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "auto",
+		KeyPrefix: "/env/",
+	}}
+	s3.objects["/test-bucket/env/leases/fly.lock/0000000000000001"] = []byte("the environment's own lease")
+
+	results, ok, err := RunSelfTest(context.Background(), SelfTestChecks(cfg, t.TempDir()), []string{"juicefs"})
+	if err != nil {
+		t.Fatalf("Failed to run self-test: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Expected every check to pass, got %+v", results)
+	}
+
+	// The scratch objects are removed and the environment's own objects are untouched
+	s3.mu.Lock()
+	remaining := len(s3.objects)
+	s3.readOnly = true
+	s3.mu.Unlock()
+	if remaining != 1 {
+		t.Errorf("Expected only the environment's lease to remain, got %d objects", remaining)
+	}
+
+	// Read-only credentials fail the write checks
+	results, ok, _ = RunSelfTest(context.Background(), SelfTestChecks(cfg, t.TempDir()), []string{"juicefs", "db"})
+	if ok || results[0].Status != SelfTestFail || !strings.Contains(results[0].Detail, "AccessDenied") {
+		t.Errorf("Expected the storage check to fail on read-only storage, got %+v", results[0])
+	}
+}
@@ -0,0 +1,38 @@
+package lib
+
+// SetupGuidance tells a caller of an unconfigured server how to configure it, reported as
+// setup in the status until a config is applied
+type SetupGuidance struct {
+	Message string `json:"message"`
+	// Configure is the request applying a config
+	Configure string `json:"configure"`
+	// Validate is the request checking a config without applying it
+	Validate string `json:"validate"`
+	// Stacks is the request listing the stacks a config can enable
+	Stacks string `json:"stacks"`
+	// Available names the stacks this build supports
+	Available []string `json:"available"`
+}
+
+// SetSetupGuidance chooses whether the status of an unconfigured server includes SetupGuidance.
+// It is included unless disabled.
+func (c *Control) SetSetupGuidance(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.noSetupGuidance = !enabled
+}
+
+// setupGuidance returns the guidance reported while unconfigured; the caller must hold c.mu
+func (c *Control) setupGuidance() *SetupGuidance {
+	available := make([]string, 0, len(c.components))
+	for _, comp := range c.components {
+		available = append(available, comp.Name())
+	}
+	return &SetupGuidance{
+		Message:   "not configured: POST a config to / to set up the environment",
+		Configure: "POST /",
+		Validate:  "POST /config/validate",
+		Stacks:    "GET /stacks",
+		Available: available,
+	}
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// How shutdown treats a checkpoint or restore that is in progress when it begins
+const (
+	// ShutdownWaitForOperation lets the operation finish, up to the shutdown deadline
+	ShutdownWaitForOperation = "wait"
+	// ShutdownAbortOperation cancels the operation, which rolls back what it already changed
+	ShutdownAbortOperation = "abort"
+)
+
+// errAbortedForShutdown is returned by a checkpoint or restore cancelled by shutdown
+var errAbortedForShutdown = errors.New("aborted for shutdown")
+
+// operationTracker records the checkpoint or restore in progress. Those operations hold c.mu
+// throughout, so at most one runs at a time.
+type operationTracker struct {
+	mu     sync.Mutex
+	policy string
+	name   string        // the operation in progress, or "" when idle
+	done   chan struct{} // closed when the operation in progress ends
+	cancel context.CancelCauseFunc
+}
+
+// SetShutdownOperationPolicy sets how shutdown treats a checkpoint or restore in progress:
+// ShutdownWaitForOperation (the default) or ShutdownAbortOperation
+func (c *Control) SetShutdownOperationPolicy(policy string) error {
+	switch policy {
+	case "":
+		policy = ShutdownWaitForOperation
+	case ShutdownWaitForOperation, ShutdownAbortOperation:
+	default:
+		return fmt.Errorf("unknown shutdown operation policy %q: use %s or %s", policy, ShutdownWaitForOperation, ShutdownAbortOperation)
+	}
+	c.operation.mu.Lock()
+	defer c.operation.mu.Unlock()
+	c.operation.policy = policy
+	return nil
+}
+
+// beginOperation records a checkpoint or restore as in progress, also in the operations registry,
+// and returns the context it runs under, cancelled if shutdown aborts it or an operator cancels it,
+// and the function ending it
+func (c *Control) beginOperation(ctx context.Context, kind, name string) (context.Context, func()) {
+	ctx, op := c.operations.Start(ctx, kind, name)
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	c.operation.mu.Lock()
+	c.operation.name, c.operation.done, c.operation.cancel = name, done, cancel
+	c.operation.mu.Unlock()
+	return ctx, func() {
+		c.operation.mu.Lock()
+		c.operation.name, c.operation.done, c.operation.cancel = "", nil, nil
+		c.operation.mu.Unlock()
+		cancel(nil)
+		op.End()
+		close(done)
+	}
+}
+
+// settleOperation waits, up to ctx's deadline, for a checkpoint or restore in progress to end
+// before shutdown tears down the components it works on, first cancelling it under the abort policy
+func (c *Control) settleOperation(ctx context.Context) {
+	c.operation.mu.Lock()
+	name, done, cancel, policy := c.operation.name, c.operation.done, c.operation.cancel, c.operation.policy
+	c.operation.mu.Unlock()
+	if done == nil {
+		return
+	}
+
+	if policy == ShutdownAbortOperation {
+		logWarnf("Shutdown: aborting %s in progress", name)
+		cancel(errAbortedForShutdown)
+	} else {
+		logInfof("Shutdown: waiting for %s in progress to finish", name)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logErrorf("Shutdown deadline reached with %s still in progress", name)
+	}
+}
+
+// operationErr returns the error of an operation cut short, naming a shutdown abort or an operator's cancel
+func operationErr(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errAbortedForShutdown) {
+		return fmt.Errorf("%w: %w", errAbortedForShutdown, err)
+	} else if errors.Is(cause, ErrOperationCancelled) {
+		return fmt.Errorf("%w: %w", ErrOperationCancelled, err)
+	}
+	return err
+}
+
+// deleteCheckpoints removes the checkpoint with the given ID from the components it was created in
+func deleteCheckpoints(ctx context.Context, created []CheckpointableComponent, id string) {
+	for _, cc := range created {
+		if cd, ok := cc.(CheckpointDeleter); ok {
+			if err := cd.DeleteCheckpoint(ctx, id); err != nil {
+				logWarnf("Failed to delete partial checkpoint %s of %s: %v", id, cc.Name(), err)
+			}
+		}
+	}
+}
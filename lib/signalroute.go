@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// SignalTargetApp names the supervised process in signal routes
+const SignalTargetApp = "app"
+
+// SignalReceiver represents a component running a process of its own, such as the JuiceFS mount,
+// that signals received by the server can be forwarded to
+type SignalReceiver interface {
+	ForwardSignal(sig os.Signal) error
+}
+
+// SignalRoutes maps signals received by the server to the processes they are forwarded to, each
+// named SignalTargetApp or after a stack implementing SignalReceiver. A signal without a route
+// is forwarded to the supervised process only.
+type SignalRoutes map[syscall.Signal][]string
+
+// ParseSignalRoute parses a route given as SIGNAL=TARGET[,TARGET...], e.g. USR1=app
+func ParseSignalRoute(route string) (syscall.Signal, []string, error) {
+	name, list, ok := strings.Cut(route, "=")
+	if !ok {
+		return 0, nil, fmt.Errorf("signal route %q must be SIGNAL=TARGET[,TARGET...]", route)
+	}
+	sig, err := ParseSignal(name)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid signal route %q: %w", route, err)
+	}
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			return 0, nil, fmt.Errorf("invalid signal route %q: empty target", route)
+		}
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return sig, targets, nil
+}
+
+// SetSignalRoutes sets which processes each signal received by the server is forwarded to.
+// Every target must be the supervised process or a stack that runs a process of its own.
+func (c *Control) SetSignalRoutes(routes SignalRoutes) error {
+	components := c.getAvailableComponents()
+	for sig, targets := range routes {
+		for _, target := range targets {
+			if target == SignalTargetApp {
+				if c.supervisor == nil {
+					return fmt.Errorf("cannot route %v to %s: %w", sig, target, errNoSupervisor)
+				}
+				continue
+			}
+			if _, ok := components[target].(SignalReceiver); !ok {
+				return fmt.Errorf("cannot route %v to %q: not %s or a stack running its own process", sig, target, SignalTargetApp)
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.signalRoutes = routes
+	return nil
+}
+
+// RoutedSignals returns the signals with a route, which the server listens for to forward them
+func (c *Control) RoutedSignals() []os.Signal {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	signals := make([]os.Signal, 0, len(c.signalRoutes))
+	for sig := range c.signalRoutes {
+		signals = append(signals, sig)
+	}
+	return signals
+}
+
+// ForwardSignal forwards a signal received by the server to the processes routed for it, or to
+// the supervised process when it has no route. A target whose process is not running is skipped.
+func (c *Control) ForwardSignal(sig os.Signal) error {
+	targets := []string{SignalTargetApp}
+	c.mu.RLock()
+	if s, ok := sig.(syscall.Signal); ok {
+		if routed, ok := c.signalRoutes[s]; ok {
+			targets = routed
+		}
+	}
+	c.mu.RUnlock()
+
+	var errs []error
+	for _, target := range targets {
+		var receiver SignalReceiver
+		if target == SignalTargetApp {
+			if c.supervisor == nil {
+				continue
+			}
+			receiver = c.supervisor
+		} else if receiver, _ = c.getAvailableComponents()[target].(SignalReceiver); receiver == nil {
+			continue
+		}
+		if err := receiver.ForwardSignal(sig); err != nil {
+			errs = append(errs, fmt.Errorf("failed to forward %v to %s: %w", sig, target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// errComponentNotReady is returned when checkpointing a component that has not finished starting
+var errComponentNotReady = errors.New("component not ready")
+
+// CheckpointStack creates a checkpoint of a single component, leaving the other components untouched
+func (c *Control) CheckpointStack(ctx context.Context, cc CheckpointableComponent, id string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := cc.Name()
+	if c.config == nil || !slices.Contains(c.config.Stacks, name) {
+		return "", fmt.Errorf("%w: %s", errStackNotEnabled, name)
+	}
+	if len(unready([]CheckpointableComponent{cc})) > 0 {
+		return "", fmt.Errorf("%w: %s", errComponentNotReady, name)
+	}
+	resume, err := c.quiesceForCheckpoint()
+	if err != nil {
+		return "", err
+	}
+	defer resume()
+	ctx, end := c.beginOperation(ctx, "checkpoint", fmt.Sprintf("checkpoint %s of %s", id, name))
+	defer end()
+	ctx = withCheckpointTag(ctx)
+	err = ctx.Err()
+	var result string
+	if err == nil {
+		result, err = cc.CreateCheckpoint(ctx, id)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to checkpoint %s: %w", name, operationErr(ctx, err))
+	}
+	c.events.Record(EventCheckpointCreated, "control", "", map[string]string{"checkpoint_id": id, "stack": name})
+	return result, nil
+}
+
+// handleStackCheckpoint returns a handler checkpointing the given component
+func (c *Control) handleStackCheckpoint(cc CheckpointableComponent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CheckpointID string `json:"checkpoint_id"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		if req.CheckpointID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Checkpoint ID is required"})
+			return
+		}
+
+		result, err := c.CheckpointStack(r.Context(), cc, req.CheckpointID)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errStackNotEnabled):
+				status = http.StatusNotFound
+			case errors.Is(err, errComponentNotReady), errors.Is(err, ErrCheckpointExists):
+				status = http.StatusConflict
+			case errors.Is(err, errAbortedForShutdown):
+				status = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":        "success",
+			"stack":         cc.Name(),
+			"checkpoint_id": req.CheckpointID,
+			"result":        result,
+		})
+	}
+}
+
+// handleNotCheckpointable rejects a checkpoint of a component that has no checkpoints
+func handleNotCheckpointable(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%s is not checkpointable", name)})
+	}
+}
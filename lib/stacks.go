@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// StackInfo describes a stack this build supports and what it can do
+type StackInfo struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Checkpointable is set for stacks included in checkpoints and restores
+	Checkpointable bool `json:"checkpointable"`
+	// HTTP is set for stacks serving their own endpoints under /stack/{name}/
+	HTTP        bool `json:"http"`
+	Restartable bool `json:"restartable"`
+	HealthCheck bool `json:"health_check"`
+}
+
+// validateStacks rejects a stack listed more than once.
+// rule: setting up a component twice would re-initialize it and leak what the first setup started,
+// and silently dropping the duplicate could hide a typo meant to name another stack
+func (cfg *SystemConfig) validateStacks() error {
+	seen := make(map[string]bool, len(cfg.Stacks))
+	for _, name := range cfg.Stacks {
+		if seen[name] {
+			return fmt.Errorf("stack %q is listed more than once in stacks", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// ComponentConfigurer is implemented by components that read their settings from the
+// components.<name> block of the config, for stacks without a section of their own
+type ComponentConfigurer interface {
+	StackComponent
+	// ConfigureComponent applies the raw settings before the component is set up. Settings are
+	// nil when the config has none for the component.
+	ConfigureComponent(settings json.RawMessage) error
+}
+
+// typedStackSections names the stacks configured by their own section of SystemConfig
+var typedStackSections = []string{"juicefs", "db", "sync", "leaser", "warmer"}
+
+// validateComponents rejects a components block for a stack that has its own config section,
+// so each setting has exactly one place
+func (cfg *SystemConfig) validateComponents() error {
+	for name := range cfg.Components {
+		if slices.Contains(typedStackSections, name) {
+			return fmt.Errorf("components.%s is not supported: use the %s section of the config", name, name)
+		}
+	}
+	return nil
+}
+
+// Stacks lists every available stack, in registration order, with whether it is enabled
+func (c *Control) Stacks() []StackInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stacks := make([]StackInfo, 0, len(c.components))
+	for _, comp := range c.components {
+		info := StackInfo{Name: comp.Name()}
+		info.Enabled = c.config != nil && slices.Contains(c.config.Stacks, info.Name)
+		_, info.Checkpointable = comp.(CheckpointableComponent)
+		_, info.HTTP = comp.(ControlHTTP)
+		_, info.Restartable = comp.(Restartable)
+		_, info.HealthCheck = comp.(HealthChecker)
+		stacks = append(stacks, info)
+	}
+	return stacks
+}
+
+// handleStacks lists the available stacks so provisioning tooling can build valid configs
+func (c *Control) handleStacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"stacks": c.Stacks()})
+}
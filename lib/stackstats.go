@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+)
+
+// handleStats returns a handler reporting the statistics of the given component
+func (c *Control) handleStats(sp StatsProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		enabled := c.config != nil && slices.Contains(c.config.Stacks, sp.Name())
+		c.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !enabled {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": errStackNotEnabled.Error() + ": " + sp.Name()})
+			return
+		}
+		stats, err := sp.Stats(r.Context())
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errComponentNotReady) {
+				status = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	}
+}
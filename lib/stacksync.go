@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// errReplicationStopped is returned when a database's replication is not running
+var errReplicationStopped = errors.New("replication not running")
+
+// ReplicationPosition is the point of a replicated database that is durable in object storage
+type ReplicationPosition struct {
+	Generation string `json:"generation"`
+	Index      int    `json:"index"`  // WAL index
+	Offset     int64  `json:"offset"` // offset within the WAL index
+}
+
+// ReplicationPositioner represents a replicating component that can report how far its replica has got
+type ReplicationPositioner interface {
+	ReplicationSyncer
+	// ReplicationPosition returns the replicated position, or errReplicationStopped if replication is not running
+	ReplicationPosition() (ReplicationPosition, error)
+}
+
+// SyncStack forces a synchronous replication sync of a single component, returning its replicated
+// position afterwards when the component reports one
+func (c *Control) SyncStack(ctx context.Context, rs ReplicationSyncer) (*ReplicationPosition, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := rs.Name()
+	if c.config == nil || !slices.Contains(c.config.Stacks, name) {
+		return nil, fmt.Errorf("%w: %s", errStackNotEnabled, name)
+	}
+	if err := rs.SyncReplication(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sync %s: %w", name, err)
+	}
+	rp, ok := rs.(ReplicationPositioner)
+	if !ok {
+		return nil, nil
+	}
+	// rule: a stopped replica would make the sync a silent no-op, so it is reported rather than claimed durable
+	pos, err := rp.ReplicationPosition()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync %s: %w", name, err)
+	}
+	return &pos, nil
+}
+
+// handleSync returns a handler forcing a replication sync of the given component
+func (c *Control) handleSync(rs ReplicationSyncer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pos, err := c.SyncStack(r.Context(), rs)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errStackNotEnabled):
+				status = http.StatusNotFound
+			case errors.Is(err, errReplicationStopped):
+				status = http.StatusConflict
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		resp := map[string]interface{}{
+			"status": "synced",
+			"stack":  rs.Name(),
+		}
+		if pos != nil {
+			resp["position"] = pos
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// errNotStandby is returned when promoting a machine that is not a standby
+var errNotStandby = errors.New("not a standby")
+
+// errReconfiguring is returned when a reconfiguration is already in progress
+var errReconfiguring = errors.New("reconfiguration already in progress")
+
+// defaultStandbyRestoreInterval is how often a standby restores the latest database replica
+const defaultStandbyRestoreInterval = 30 * time.Second
+
+// StandbyComponent represents a component kept warm on a standby machine without writing to
+// shared storage or holding the lease. Stacks that are not StandbyComponents are only set up
+// once the machine is promoted.
+type StandbyComponent interface {
+	StackComponent
+	// SetupStandby starts the component's standby mode
+	SetupStandby(ctx context.Context, cfg *ObjectStorageConfig) error
+	// EndStandby stops standby mode on promotion, before the component's normal Setup
+	EndStandby(ctx context.Context) error
+}
+
+// Standby reports whether the machine is a warm standby: it follows the active machine's state
+// but holds no lease and is not ready to serve traffic
+func (c *Control) Standby() bool {
+	return c.standby.Load()
+}
+
+// setupStandby starts standby mode of the configured stacks, leaving the others for promotion
+func (c *Control) setupStandby(ctx context.Context, cfg *SystemConfig) error {
+	for _, stackName := range leaserFirst(cfg.Stacks) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("standby setup cancelled before component %s: %w", stackName, err)
+		}
+		component, ok := c.getAvailableComponents()[stackName]
+		if !ok {
+			return fmt.Errorf("unknown stack component: %s", stackName)
+		}
+		sc, ok := component.(StandbyComponent)
+		if !ok {
+			logInfof("Component %s starts on promotion", stackName)
+			continue
+		}
+		if err := configureComponent(component, cfg); err != nil {
+			return err
+		}
+		if err := sc.SetupStandby(ctx, &cfg.Storage); err != nil {
+			return fmt.Errorf("failed to set up standby component %s: %w", stackName, err)
+		}
+	}
+	c.standby.Store(true)
+	logInfof("Running as a warm standby")
+	return nil
+}
+
+// Promote turns a standby into the active machine: standby mode ends, the lease is acquired,
+// waiting for the active machine to release it or for it to expire, and the stacks are set up
+// as usual. If setup fails the machine returns to standby.
+func (c *Control) Promote(ctx context.Context) error {
+	if !c.Standby() {
+		return errNotStandby
+	}
+	if !c.beginReconfigure() {
+		return errReconfiguring
+	}
+	defer c.endReconfigure()
+
+	c.mu.Lock()
+	standbyCfg := c.config
+	cfg := *standbyCfg
+	cfg.Standby = false
+	c.mu.Unlock()
+
+	for _, stackName := range cfg.Stacks {
+		if sc, ok := c.getAvailableComponents()[stackName].(StandbyComponent); ok {
+			if err := sc.EndStandby(ctx); err != nil {
+				return fmt.Errorf("failed to end standby of %s: %w", stackName, err)
+			}
+		}
+	}
+	c.standby.Store(false)
+
+	setupCtx, cancel, _ := c.configContext(ctx)
+	defer cancel()
+	if err := c.setupComponents(setupCtx, &cfg); err != nil {
+		logErrorf("Promotion failed, returning to standby: %v", err)
+		if cleanupErr := c.rollbackSetup(); cleanupErr != nil {
+			logErrorf("Failed to clean up after failed promotion: %v", cleanupErr)
+		}
+		if standbyErr := c.setupStandby(context.WithoutCancel(ctx), standbyCfg); standbyErr != nil {
+			logErrorf("Failed to return to standby: %v", standbyErr)
+		}
+		return fmt.Errorf("failed to promote: %w", err)
+	}
+
+	// rule: the promoted config is saved so a restart comes back active rather than as a standby
+	c.mu.Lock()
+	c.config = &cfg
+	envConfigured := c.envConfigured
+	c.mu.Unlock()
+	if !envConfigured {
+		if err := c.saveConfig(); err != nil {
+			logWarnf("Failed to save promoted config: %v", err)
+		}
+	}
+	c.setupRoutes()
+	if err := c.applyTarget(); err != nil {
+		return fmt.Errorf("failed to update proxy target: %w", err)
+	}
+	c.NotifyStatusChange()
+	c.events.Record(EventPromoted, "control", "standby promoted to active", nil)
+	logInfof("Promoted from standby to active")
+	return nil
+}
+
+// handlePromote promotes a standby to the active machine
+func (c *Control) handlePromote(w http.ResponseWriter, r *http.Request) {
+	err := c.Promote(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotStandby) || errors.Is(err, errReconfiguring) {
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "active"})
+}
+
+// SetupStandby opens the lease client without acquiring the lease, so the standby only observes it
+func (l *LeaserComponent) SetupStandby(ctx context.Context, cfg *ObjectStorageConfig) error {
+	if err := l.Setup(ctx, cfg, ""); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.observing = true
+	l.mu.Unlock()
+	return nil
+}
+
+// EndStandby ends observe-only mode, so the lease can be acquired and released again
+func (l *LeaserComponent) EndStandby(ctx context.Context) error {
+	l.mu.Lock()
+	l.observing = false
+	l.mu.Unlock()
+	return nil
+}
+
+// Observing reports whether the leaser only observes the lease, on a standby machine
+func (l *LeaserComponent) Observing() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.observing
+}
+
+// SetupStandby keeps restoring the latest replica of the database, so a promoted standby has
+// a recent local copy and the replica is known to be restorable
+func (d *DBManagerComponent) SetupStandby(ctx context.Context, cfg *ObjectStorageConfig) error {
+	d.dbManager = NewDBManager(cfg, d.dataDir)
+	d.dbManager.Upload = d.settings
+	interval := d.standbyInterval
+	if interval <= 0 {
+		interval = defaultStandbyRestoreInterval
+	}
+	d.following = newFollower(d.dbManager, interval)
+	return nil
+}
+
+// EndStandby stops following the replica and removes the followed copy.
+// rule: the active machine may have written right up to losing the lease, so the promoted machine
+// restores the latest replica in Setup rather than starting replication from an older copy
+func (d *DBManagerComponent) EndStandby(ctx context.Context) error {
+	if d.following != nil {
+		d.following.stop()
+		d.following = nil
+	}
+	if d.dbManager == nil {
+		return nil
+	}
+	for _, path := range append([]string{d.dbManager.DBPath}, d.dbManager.staleFiles()...) {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove followed copy %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// follower restores the latest replica of a database every interval until stopped
+type follower struct {
+	stopOnce sync.Once
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// newFollower starts restoring dm's replica over its local copy every interval
+func newFollower(dm *DBManager, interval time.Duration) *follower {
+	f := &follower{done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer RecoverPanic("standby restore")
+		defer close(f.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := followReplica(dm); err != nil {
+				logWarnf("Standby restore of %s failed: %v", dm.name(), err)
+			}
+			select {
+			case <-f.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return f
+}
+
+// stop stops following and waits for a restore in progress to finish
+func (f *follower) stop() {
+	f.stopOnce.Do(func() { close(f.done) })
+	<-f.stopped
+}
+
+// followReplica replaces the local copy of the database with the latest replica
+func followReplica(dm *DBManager) error {
+	if err := os.MkdirAll(filepath.Dir(dm.DBPath), DirMode); err != nil {
+		return fmt.Errorf("failed to create database directory: %w", err)
+	}
+	tmp := dm.DBPath + ".standby"
+	os.Remove(tmp)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStandbyRestoreInterval)
+	defer cancel()
+	if err := dm.Restore(ctx, tmp); errors.Is(err, errNoReplica) {
+		return nil
+	} else if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dm.DBPath); err != nil {
+		return fmt.Errorf("failed to replace followed copy: %w", err)
+	}
+	return nil
+}
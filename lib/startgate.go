@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// startGatePollInterval is how often WaitForStart rechecks stacks not signalled by a status change
+const startGatePollInterval = 100 * time.Millisecond
+
+// WaitForStart blocks until the supervised process may start: every critical stack that is a
+// StartGate reports ready. It is meant as the supervisor's PreStart hook. Without a config there
+// is nothing to wait for, unless the config is expected to arrive after startup or
+// SetStartAfterSetup is enabled.
+func (c *Control) WaitForStart(ctx context.Context) error {
+	changes, unsubscribe := c.statusChanges.subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(startGatePollInterval)
+	defer ticker.Stop()
+
+	logged := false
+	for {
+		waiting, ok := c.pendingStartGates()
+		if ok {
+			return nil
+		}
+		if !logged {
+			logInfof("Waiting for stacks %v before starting the process", waiting)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+// pendingStartGates returns the stacks the process is still waiting for, and whether it may start
+func (c *Control) pendingStartGates() ([]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.config == nil {
+		if c.waitForConfig || c.startAfterSetup {
+			return []string{"config"}, false
+		}
+		return nil, true
+	}
+	// rule: a config being applied is not enough, every stack must have finished setting up
+	if c.startAfterSetup && !c.setupComplete.Load() {
+		return []string{"setup"}, false
+	}
+	var waiting []string
+	for _, comp := range c.components {
+		gate, ok := comp.(StartGate)
+		if !ok || !slices.Contains(c.config.Stacks, comp.Name()) {
+			continue
+		}
+		// rule: a non-critical stack may fail setup without failing the environment, so the process never waits on it
+		if !c.config.isCritical(comp.Name()) || gate.StartReady() {
+			continue
+		}
+		waiting = append(waiting, comp.Name())
+	}
+	return waiting, len(waiting) == 0
+}
+
+// SetStartAfterSetup holds the supervised process until a config has been applied and the setup
+// of its stacks has completed, so the app never runs against storage that is not ready yet, e.g.
+// an unmounted data directory. A failed or in-progress setup keeps holding it, and so does a
+// warm standby until it is promoted.
+func (c *Control) SetStartAfterSetup(enabled bool) {
+	c.mu.Lock()
+	c.startAfterSetup = enabled
+	c.mu.Unlock()
+	c.NotifyStatusChange()
+}
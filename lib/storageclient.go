@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// Defaults of the storage request settings in ObjectStorageConfig
+const (
+	DefaultStorageRequestTimeout = 60 * time.Second
+	DefaultStorageMaxRetries     = 3
+	DefaultStorageRetryBackoff   = 100 * time.Millisecond
+)
+
+// clientTuned reports whether any storage request setting is configured explicitly
+func (cfg *ObjectStorageConfig) clientTuned() bool {
+	return cfg.RequestTimeoutSeconds != 0 || cfg.MaxRetries != 0 || cfg.RetryBackoffMillis != 0
+}
+
+// requestTimeout returns the bound on a single storage request
+func (cfg *ObjectStorageConfig) requestTimeout() time.Duration {
+	if cfg.RequestTimeoutSeconds > 0 {
+		return time.Duration(cfg.RequestTimeoutSeconds) * time.Second
+	}
+	return DefaultStorageRequestTimeout
+}
+
+// maxRetries returns how many times a failed storage request is retried
+func (cfg *ObjectStorageConfig) maxRetries() int {
+	switch {
+	case cfg.MaxRetries < 0:
+		return 0
+	case cfg.MaxRetries > 0:
+		return cfg.MaxRetries
+	}
+	return DefaultStorageMaxRetries
+}
+
+// retryBackoff returns the wait before the first retry of a failed storage request
+func (cfg *ObjectStorageConfig) retryBackoff() time.Duration {
+	if cfg.RetryBackoffMillis > 0 {
+		return time.Duration(cfg.RetryBackoffMillis) * time.Millisecond
+	}
+	return DefaultStorageRetryBackoff
+}
+
+// validateClient checks the storage request settings
+func (cfg *ObjectStorageConfig) validateClient() error {
+	if cfg.RequestTimeoutSeconds < 0 {
+		return fmt.Errorf("request_timeout_seconds must not be negative")
+	}
+	if cfg.RetryBackoffMillis < 0 {
+		return fmt.Errorf("retry_backoff_ms must not be negative")
+	}
+	return nil
+}
+
+// applyClientSettings sets the request timeout and retry policy on an AWS SDK config.
+// The SDK's retryer doubles the backoff after each attempt, with jitter.
+func (cfg *ObjectStorageConfig) applyClientSettings(awsCfg *aws.Config) {
+	awsCfg.HTTPClient.Timeout = cfg.requestTimeout()
+	awsCfg.MaxRetries = aws.Int(cfg.maxRetries())
+	awsCfg.Retryer = client.DefaultRetryer{
+		NumMaxRetries:    cfg.maxRetries(),
+		MinRetryDelay:    cfg.retryBackoff(),
+		MinThrottleDelay: cfg.retryBackoff(),
+	}
+}
+
+// juicefsMountFlags returns the JuiceFS mount flags for the storage request settings. Only
+// explicitly configured settings are passed, so JuiceFS otherwise keeps its own defaults.
+func (cfg *ObjectStorageConfig) juicefsMountFlags() []string {
+	var flags []string
+	if cfg.RequestTimeoutSeconds > 0 {
+		timeout := fmt.Sprint(cfg.RequestTimeoutSeconds)
+		flags = append(flags, "--get-timeout", timeout, "--put-timeout", timeout)
+	}
+	if cfg.MaxRetries != 0 {
+		flags = append(flags, "--io-retries", fmt.Sprint(cfg.maxRetries()))
+	}
+	return flags
+}
+
+// timeoutLeaser bounds every request of a Litestream leaser with the storage request timeout.
+// The upstream leaser builds its own AWS session without options, so the timeout is applied
+// through the request context; its retries stay at the SDK default.
+type timeoutLeaser struct {
+	litestream.Leaser
+	timeout time.Duration
+
+	// s3, bucket and path locate the lock objects, which the upstream leaser only reads internally
+	s3     *s3.S3
+	bucket string
+	path   string
+}
+
+func (l *timeoutLeaser) Epochs(ctx context.Context) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.Leaser.Epochs(ctx)
+}
+
+func (l *timeoutLeaser) AcquireLease(ctx context.Context) (*litestream.Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.Leaser.AcquireLease(ctx)
+}
+
+func (l *timeoutLeaser) RenewLease(ctx context.Context, lease *litestream.Lease) (*litestream.Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.Leaser.RenewLease(ctx, lease)
+}
+
+func (l *timeoutLeaser) ReleaseLease(ctx context.Context, epoch int64) error {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.Leaser.ReleaseLease(ctx, epoch)
+}
+
+func (l *timeoutLeaser) DeleteLease(ctx context.Context, epoch int64) error {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.Leaser.DeleteLease(ctx, epoch)
+}
+
+// ReadLease reads the lock object of the given epoch, keyed and encoded as the upstream leaser
+// writes it. It returns os.ErrNotExist if the epoch has no lock object.
+func (l *timeoutLeaser) ReadLease(ctx context.Context, epoch int64) (*litestream.Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	out, err := l.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(fmt.Sprintf("%s/%016x%s", l.path, epoch, lss3.LockFileExt)),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	var lease litestream.Lease
+	if err := json.NewDecoder(out.Body).Decode(&lease); err != nil {
+		return nil, fmt.Errorf("failed to decode lease %d: %w", epoch, err)
+	}
+	lease.ModTime = aws.TimeValue(out.LastModified)
+	return &lease, nil
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// StorageErrorCategory classifies why an object storage request failed, so callers can tell
+// wrong credentials from a network problem
+type StorageErrorCategory string
+
+const (
+	// StorageAuthFailed is a request rejected for its credentials or permissions; retrying cannot fix it
+	StorageAuthFailed StorageErrorCategory = "auth_failed"
+	// StorageNotFound is a missing bucket or object
+	StorageNotFound StorageErrorCategory = "not_found"
+	// StorageThrottled is a request rejected by rate limiting; retrying later usually succeeds
+	StorageThrottled StorageErrorCategory = "throttled"
+	// StorageNetwork is a request that never got an answer, e.g. a refused connection or a timeout
+	StorageNetwork StorageErrorCategory = "network"
+	// StorageOther is any other failure
+	StorageOther StorageErrorCategory = "other"
+)
+
+// storageErrorCodes maps S3 error codes to their category. The codes are also matched in the
+// output of tools that only report them as text, such as juicefs format.
+var storageErrorCodes = map[string]StorageErrorCategory{
+	"InvalidAccessKeyId":    StorageAuthFailed,
+	"SignatureDoesNotMatch": StorageAuthFailed,
+	"AccessDenied":          StorageAuthFailed,
+	"ExpiredToken":          StorageAuthFailed,
+	"InvalidToken":          StorageAuthFailed,
+	"AccountProblem":        StorageAuthFailed,
+	"NoSuchBucket":          StorageNotFound,
+	"InvalidBucketName":     StorageNotFound,
+	"NoSuchKey":             StorageNotFound,
+	"SlowDown":              StorageThrottled,
+	"Throttling":            StorageThrottled,
+	"ThrottlingException":   StorageThrottled,
+	"RequestLimitExceeded":  StorageThrottled,
+	"TooManyRequests":       StorageThrottled,
+}
+
+// Retryable reports whether a request failing this way may succeed when retried
+func (c StorageErrorCategory) Retryable() bool {
+	return c == StorageThrottled || c == StorageNetwork
+}
+
+// describe returns a human readable explanation of the category
+func (c StorageErrorCategory) describe() string {
+	switch c {
+	case StorageAuthFailed:
+		return "authentication failed, check the storage credentials"
+	case StorageNotFound:
+		return "not found, check the bucket name"
+	case StorageThrottled:
+		return "throttled by object storage"
+	case StorageNetwork:
+		return "object storage unreachable"
+	}
+	return "object storage request failed"
+}
+
+// StorageError is an object storage failure with its category
+type StorageError struct {
+	Category StorageErrorCategory
+	// Op describes what was attempted, e.g. "head bucket my-bucket"
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Op, e.Category.describe(), e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// newStorageError wraps a failed object storage operation with its category, or returns nil
+func newStorageError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	// An error classified further down keeps its category
+	var se *StorageError
+	if errors.As(err, &se) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return &StorageError{Category: ClassifyStorageError(err), Op: op, Err: err}
+}
+
+// ClassifyStorageError inspects an object storage error, from the AWS SDK, an HTTP client or a
+// tool's output, and returns its category
+func ClassifyStorageError(err error) StorageErrorCategory {
+	if err == nil {
+		return ""
+	}
+	var se *StorageError
+	if errors.As(err, &se) {
+		return se.Category
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		if category, ok := storageErrorCodes[reqErr.Code()]; ok {
+			return category
+		}
+		switch status := reqErr.StatusCode(); {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			return StorageAuthFailed
+		case status == http.StatusNotFound:
+			return StorageNotFound
+		case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+			return StorageThrottled
+		}
+		return StorageOther
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if category, ok := storageErrorCodes[aerr.Code()]; ok {
+			return category
+		}
+		// rule: the SDK reports a request that could not be sent at all as RequestError, with the cause wrapped
+		if aerr.Code() == request.ErrCodeRequestError || aerr.Code() == request.ErrCodeResponseTimeout {
+			return StorageNetwork
+		}
+		if cause := aerr.OrigErr(); cause != nil && ClassifyStorageError(cause) == StorageNetwork {
+			return StorageNetwork
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return StorageNetwork
+	}
+
+	// Tools such as juicefs only report the S3 error code in their output
+	msg := err.Error()
+	for code, category := range storageErrorCodes {
+		if strings.Contains(msg, code) {
+			return category
+		}
+	}
+	for _, text := range []string{"connection refused", "no such host", "i/o timeout", "connection reset"} {
+		if strings.Contains(msg, text) {
+			return StorageNetwork
+		}
+	}
+	return StorageOther
+}
+
+// classifyStorageFailure wraps the failure of a setup step talking to object storage with its
+// category when it is clearly a storage problem, leaving other failures, such as a timeout while
+// waiting for something else, as they are
+func classifyStorageFailure(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || ClassifyStorageError(err) == StorageOther {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return newStorageError(op, err)
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestClassifyStorageError(t *testing.T) {
+	s3Error := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "request-id")
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name string
+		err  error
+		want StorageErrorCategory
+	}{
+		{"invalid access key", s3Error("InvalidAccessKeyId", http.StatusForbidden), StorageAuthFailed},
+		{"bad signature", s3Error("SignatureDoesNotMatch", http.StatusForbidden), StorageAuthFailed},
+		{"access denied", s3Error("AccessDenied", http.StatusForbidden), StorageAuthFailed},
+		// HEAD responses carry no body, so only the status code is known
+		{"forbidden head", s3Error("Forbidden", http.StatusForbidden), StorageAuthFailed},
+		{"missing bucket", s3Error("NoSuchBucket", http.StatusNotFound), StorageNotFound},
+		{"not found head", s3Error("NotFound", http.StatusNotFound), StorageNotFound},
+		{"slow down", s3Error("SlowDown", http.StatusServiceUnavailable), StorageThrottled},
+		{"too many requests", s3Error("TooManyRequests", http.StatusTooManyRequests), StorageThrottled},
+		{"internal error", s3Error("InternalError", http.StatusInternalServerError), StorageOther},
+		{"connection refused", awserr.New(request.ErrCodeRequestError, "send request failed", refused), StorageNetwork},
+		{"unwrapped dial error", refused, StorageNetwork},
+		{"deadline", fmt.Errorf("list: %w", context.DeadlineExceeded), StorageNetwork},
+		{"juicefs output", errors.New("juicefs format failed: exit status 1: Storage ... SignatureDoesNotMatch: The request signature we calculated does not match"), StorageAuthFailed},
+		{"wrapped category", newStorageError("head bucket b", s3Error("NoSuchBucket", http.StatusNotFound)), StorageNotFound},
+		{"other", errors.New("disk full"), StorageOther},
+	}
+	for _, tt := range tests {
+		if got := ClassifyStorageError(tt.err); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// Categorized errors name the cause and keep the original error
+	err := newStorageError("head bucket b", s3Error("InvalidAccessKeyId", http.StatusForbidden))
+	var se *StorageError
+	if !errors.As(err, &se) || se.Category != StorageAuthFailed || se.Category.Retryable() {
+		t.Errorf("Expected a non-retryable auth failure, got %v", err)
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != "InvalidAccessKeyId" {
+		t.Errorf("Expected the S3 error to be unwrappable, got %v", err)
+	}
+	if got := classifyStorageFailure("restore", fmt.Errorf("wait: %w", context.Canceled)); errors.As(got, &se) {
+		t.Errorf("Expected a cancellation not to be categorized, got %v", got)
+	}
+}
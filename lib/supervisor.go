@@ -4,12 +4,15 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"math/rand/v2"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -17,14 +20,39 @@ import (
 // Supervisor manages a long-running process and provides status information.
 // It handles process lifecycle, output redirection, and automatic restart on failure.
 type Supervisor struct {
-	command []string
-	config  SupervisorConfig
+	command  []string
+	template *exec.Cmd // preconfigured command that restarts are copied from, nil for NewSupervisor
+	config   SupervisorConfig
+	events   *EventLog
+	preStart struct {
+		sync.Mutex
+		done bool
+	}
+	latency struct {
+		sync.Mutex
+		stats StartLatency
+	}
+	history struct {
+		sync.Mutex
+		events []LifecycleEvent // oldest first, at most config.HistorySize
+	}
 	process struct {
 		sync.RWMutex
+		ready   bool // set once the readiness probe passes for the current process
 		running bool
 		stopped bool // Flag to track if process was stopped intentionally
 		cmd     *exec.Cmd
 		pid     int
+		exited  chan struct{} // closed when the current process has been reaped
+	}
+	// noAutoRestart leaves the process stopped when it exits, for inspecting a crashing process
+	noAutoRestart atomic.Bool
+	// output keeps the recent output of the process, nil unless LogLines is set
+	output *logRing
+	// policy protects the restart settings of config, which can change at runtime
+	policy struct {
+		sync.Mutex
+		streak int // consecutive automatic restarts of processes that exited soon after starting
 	}
 }
 
@@ -37,6 +65,97 @@ type SupervisorConfig struct {
 	// RestartDelay is the time to wait before restarting a failed process.
 	// Defaults to 100ms if not set (matching systemd's default).
 	RestartDelay time.Duration
+
+	// RestartJitter randomizes each restart delay within RestartDelay ± this fraction of it, so
+	// machines whose shared dependency failed do not all restart in lockstep. Between 0 and 1;
+	// zero (the default) keeps the delay fixed.
+	RestartJitter float64
+
+	// MaxRestarts caps consecutive automatic restarts of a process that keeps exiting within a
+	// minute of starting, so a crash loop ends with the process left stopped. Zero (the default)
+	// restarts without limit.
+	MaxRestarts int
+
+	// PreStart, if set, runs once before the process is first started.
+	// It is not run again on automatic restarts. If it returns an error,
+	// StartProcess fails without starting the process.
+	PreStart func(ctx context.Context) error
+
+	// OnStop, if set, is called after the process exits, whether it was
+	// stopped intentionally or exited on its own. It runs without holding
+	// the process lock, before any automatic restart.
+	OnStop func(info ExitInfo)
+
+	// OnRestart, if set, is called with the new PID after each automatic
+	// restart. It runs without holding the process lock.
+	OnRestart func(pid int)
+
+	// ReadinessProbe, if set, is polled after each start until it returns nil,
+	// marking the process ready. Without a probe the process is ready once started.
+	ReadinessProbe func(ctx context.Context) error
+
+	// ReadinessInterval is the time between readiness probes.
+	// Defaults to 100ms if not set.
+	ReadinessInterval time.Duration
+
+	// Shell runs the command through "sh -c" with its arguments joined by spaces, so a single
+	// command line argument can use globs, pipes and redirects. Off by default: the command is
+	// executed directly, and with Shell set, any untrusted text in the arguments can inject
+	// shell commands.
+	Shell bool
+
+	// HistorySize is the number of lifecycle events kept for History.
+	// Defaults to DefaultHistorySize if not set.
+	HistorySize int
+
+	// LogLines is how many recent lines of the process's stdout and stderr are kept for
+	// RecentLogs. Zero (the default) keeps none and hands the process the parent's stdout and
+	// stderr directly; otherwise its output is copied through pipes.
+	LogLines int
+}
+
+// StartLatency summarizes how long the supervised process took from launch to ready, across restarts
+type StartLatency struct {
+	Count int           `json:"count"`
+	Last  time.Duration `json:"last_ns"`
+	Min   time.Duration `json:"min_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// record adds a start latency sample
+func (l *StartLatency) record(d time.Duration) {
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	if d > l.Max {
+		l.Max = d
+	}
+	l.Last = d
+	l.Count++
+}
+
+// restartDelay returns the wait before an automatic restart, jittered by RestartJitter
+func (s *Supervisor) restartDelay() time.Duration {
+	s.policy.Lock()
+	defer s.policy.Unlock()
+	jitter := min(max(s.config.RestartJitter, 0), 1)
+	if jitter == 0 {
+		return s.config.RestartDelay
+	}
+	spread := float64(s.config.RestartDelay) * jitter
+	return s.config.RestartDelay + time.Duration(spread*(2*rand.Float64()-1))
+}
+
+// ExitInfo describes how a supervised process exited.
+type ExitInfo struct {
+	// PID is the process ID of the exited process.
+	PID int
+	// ExitCode is the process exit code, or -1 if it was terminated by a signal.
+	ExitCode int
+	// Err is the error returned from waiting on the process, if any.
+	Err error
+	// Stopped is true if the process was stopped with StopProcess.
+	Stopped bool
 }
 
 // NewSupervisor creates a new supervisor instance for the given command.
@@ -50,10 +169,17 @@ func NewSupervisor(command []string, config SupervisorConfig) *Supervisor {
 	if config.RestartDelay == 0 {
 		config.RestartDelay = time.Second
 	}
+	if config.ReadinessInterval == 0 {
+		config.ReadinessInterval = 100 * time.Millisecond
+	}
+	if config.HistorySize == 0 {
+		config.HistorySize = DefaultHistorySize
+	}
 
 	return &Supervisor{
 		command: command,
 		config:  config,
+		output:  newLogRing(config.LogLines),
 	}
 }
 
@@ -68,22 +194,38 @@ func NewSupervisorCmd(cmd *exec.Cmd, config SupervisorConfig) *Supervisor {
 	if config.RestartDelay == 0 {
 		config.RestartDelay = time.Second
 	}
+	if config.ReadinessInterval == 0 {
+		config.ReadinessInterval = 100 * time.Millisecond
+	}
+	if config.HistorySize == 0 {
+		config.HistorySize = DefaultHistorySize
+	}
 
 	return &Supervisor{
-		command: cmd.Args,
-		config:  config,
+		command:  cmd.Args,
+		template: cmd,
+		config:   config,
+		output:   newLogRing(config.LogLines),
 		process: struct {
 			sync.RWMutex
+			ready   bool
 			running bool
 			stopped bool
 			cmd     *exec.Cmd
 			pid     int
+			exited  chan struct{}
 		}{
 			cmd: cmd,
 		},
 	}
 }
 
+// SetEventLog sets the event log that process lifecycle events are recorded to.
+// It must be called before the process is started.
+func (s *Supervisor) SetEventLog(events *EventLog) {
+	s.events = events
+}
+
 // IsRunning returns true if the supervised process is currently running.
 // This method is safe to call from multiple goroutines.
 func (s *Supervisor) IsRunning() bool {
@@ -105,65 +247,281 @@ func (s *Supervisor) IsRunning() bool {
 	return err == nil
 }
 
+// IsReady returns true if the supervised process is running and has passed its readiness probe.
+func (s *Supervisor) IsReady() bool {
+	s.process.RLock()
+	ready := s.process.ready
+	s.process.RUnlock()
+	return ready && s.IsRunning()
+}
+
+// StartLatency returns the launch-to-ready durations recorded so far
+func (s *Supervisor) StartLatency() StartLatency {
+	s.latency.Lock()
+	defer s.latency.Unlock()
+	return s.latency.stats
+}
+
+// awaitReady probes the process started at started until it is ready or exits,
+// then records its start latency
+func (s *Supervisor) awaitReady(pid int, started time.Time, exited <-chan struct{}) {
+	if probe := s.config.ReadinessProbe; probe != nil {
+		ticker := time.NewTicker(s.config.ReadinessInterval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), s.config.ReadinessInterval)
+			err := probe(ctx)
+			cancel()
+			if err == nil {
+				break
+			}
+			select {
+			case <-exited:
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	latency := time.Since(started)
+	s.process.Lock()
+	if s.process.pid != pid {
+		s.process.Unlock()
+		return
+	}
+	s.process.ready = true
+	s.process.Unlock()
+
+	s.latency.Lock()
+	s.latency.stats.record(latency)
+	s.latency.Unlock()
+	logInfof("Process %d ready after %v", pid, latency)
+}
+
 // StartProcess starts the supervised process and sets up output handling.
-// It returns an error if the process is already running or if starting fails.
+// It returns an error if the process is already running, if the pre-start
+// hook fails or if starting fails.
 // The process will be automatically restarted if it exits unexpectedly.
 func (s *Supervisor) StartProcess() error {
+	if err := s.runPreStart(context.Background()); err != nil {
+		return err
+	}
+	// rule: a deliberate start gives a process that hit MaxRestarts a fresh allowance
+	s.policy.Lock()
+	s.policy.streak = 0
+	s.policy.Unlock()
+	pid, err := s.startProcess()
+	if err == nil {
+		s.recordLifecycle(TransitionStarted, pid, nil)
+	}
+	return err
+}
+
+// runPreStart runs the pre-start hook unless it has already succeeded
+func (s *Supervisor) runPreStart(ctx context.Context) error {
+	s.preStart.Lock()
+	defer s.preStart.Unlock()
+
+	if s.preStart.done || s.config.PreStart == nil {
+		return nil
+	}
+	if err := s.config.PreStart(ctx); err != nil {
+		return fmt.Errorf("pre-start hook failed: %w", err)
+	}
+	s.preStart.done = true
+	return nil
+}
+
+// startProcess starts the process without running the pre-start hook
+// and returns the PID of the started process
+func (s *Supervisor) startProcess() (int, error) {
 	s.process.Lock()
 	defer s.process.Unlock()
 
 	if s.process.running {
-		return fmt.Errorf("process is already running")
+		return 0, fmt.Errorf("process is already running")
 	}
 
 	if len(s.command) == 0 && s.process.cmd == nil {
-		return fmt.Errorf("empty command")
+		return 0, fmt.Errorf("empty command")
 	}
 
-	var cmd *exec.Cmd
-	if s.process.cmd != nil {
-		cmd = s.process.cmd
-	} else {
-		cmd = exec.Command(s.command[0], s.command[1:]...)
-	}
+	cmd := s.nextCmd()
 
-	// Forward child process stdout to parent's stdout
-	cmd.Stdout = os.Stdout
+	// Forward child process output to the parent's, unless the command was wired up by the caller.
+	// rule: the parent's *os.File is passed as is, so the child gets its own copy of the descriptor
+	// and nothing ever closes the parent's stdout or stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = s.outputTo(os.Stdout)
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = s.outputTo(os.Stderr)
+	}
+	// rule: a copied stream is a pipe a lingering grandchild can hold open, which must not keep
+	// Wait from reaping the process
+	if s.output != nil {
+		cmd.WaitDelay = outputWaitDelay
+	}
 
+	started := time.Now()
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start process: %v", err)
+		return 0, fmt.Errorf("failed to start process: %v", err)
 	}
 
+	exited := make(chan struct{})
+	s.process.ready = false
 	s.process.running = true
 	s.process.stopped = false
 	s.process.cmd = cmd
 	s.process.pid = cmd.Process.Pid
-	log.Printf("Started process with PID %d: %v", s.process.pid, s.command)
+	s.process.exited = exited
+	logInfof("Started process with PID %d: %v", s.process.pid, s.command)
+	s.events.Record(EventProcessStarted, "supervisor", fmt.Sprintf("started process with PID %d", s.process.pid), nil)
+	go s.awaitReady(s.process.pid, started, exited)
 
+	// rule: only this goroutine calls cmd.Wait so the process is reaped exactly once
 	go func() {
+		defer RecoverPanic("process supervisor")
 		err := cmd.Wait()
 		s.process.Lock()
+		info := ExitInfo{
+			PID:      s.process.pid,
+			ExitCode: cmd.ProcessState.ExitCode(),
+			Err:      err,
+			Stopped:  s.process.stopped,
+		}
+		shouldRestart := !s.process.stopped && s.AutoRestart()
+		s.process.ready = false
 		s.process.running = false
 		s.process.stopped = false
 		s.process.cmd = nil
 		s.process.pid = 0
-		shouldRestart := !s.process.stopped
-		s.process.stopped = false
+		close(exited)
 		s.process.Unlock()
+		if info.Stopped {
+			s.recordLifecycle(TransitionStopped, info.PID, &info)
+		} else {
+			s.recordLifecycle(TransitionExited, info.PID, &info)
+		}
 		if err != nil {
-			log.Printf("Process exited with error: %v", err)
+			logWarnf("Process exited with error: %v", err)
+			s.events.Record(EventProcessExited, "supervisor", err.Error(), nil)
 		} else {
-			log.Printf("Process exited successfully")
+			logInfof("Process exited successfully")
+			s.events.Record(EventProcessExited, "supervisor", "exited successfully", nil)
+		}
+		if s.config.OnStop != nil {
+			s.config.OnStop(info)
+		}
+		if !s.AutoRestart() && !info.Stopped {
+			logWarnf("Automatic restart is disabled, leaving process %d stopped", info.PID)
 		}
 		if shouldRestart {
-			time.Sleep(s.config.RestartDelay)
-			if err := s.StartProcess(); err != nil {
-				log.Printf("Failed to restart process: %v", err)
+			if ok, limit := s.allowRestart(time.Since(started)); !ok {
+				logErrorf("Process %d exited %d times in a row soon after starting, leaving it stopped", info.PID, limit+1)
+				s.events.Record(EventProcessExited, "supervisor", "restart limit reached", nil)
+				return
+			}
+			time.Sleep(s.restartDelay())
+			// rule: disabling automatic restart also cancels a restart that is already pending
+			if !s.AutoRestart() {
+				logWarnf("Automatic restart was disabled, leaving process %d stopped", info.PID)
+				return
+			}
+			s.events.Record(EventProcessRestarted, "supervisor", "restarting after unexpected exit", nil)
+			pid, err := s.startProcess()
+			if err != nil {
+				logErrorf("Failed to restart process: %v", err)
+				return
+			}
+			s.recordLifecycle(TransitionRestarted, pid, nil)
+			if s.config.OnRestart != nil {
+				s.config.OnRestart(pid)
 			}
 		}
 	}()
 
-	return nil
+	return s.process.pid, nil
+}
+
+// outputWaitDelay bounds how long the output of an exited process is still copied into the log buffer
+const outputWaitDelay = 5 * time.Second
+
+// outputTo returns where one output stream of the process is written: the parent's file, copied
+// into the log buffer when one is kept
+func (s *Supervisor) outputTo(parent *os.File) io.Writer {
+	if s.output == nil {
+		return parent
+	}
+	return io.MultiWriter(parent, s.output.writer())
+}
+
+// RecentLogs returns the most recent lines of the process's output, oldest first, when LogLines is set
+func (s *Supervisor) RecentLogs() ([]string, bool) {
+	if s.output == nil {
+		return nil, false
+	}
+	return s.output.Lines(), true
+}
+
+// allowRestart counts an automatic restart after a process ran for the given time, reporting
+// whether it stays within MaxRestarts, and the limit
+func (s *Supervisor) allowRestart(ran time.Duration) (bool, int) {
+	s.policy.Lock()
+	defer s.policy.Unlock()
+	limit := s.config.MaxRestarts
+	if ran >= restartStreakReset {
+		s.policy.streak = 0
+	}
+	if limit > 0 && s.policy.streak >= limit {
+		return false, limit
+	}
+	s.policy.streak++
+	return true, limit
+}
+
+// nextCmd returns the command for the next start; the caller must hold s.process.
+// A preconfigured command is used as is for its first start only: an exec.Cmd cannot be started
+// twice, so later starts run a copy of it.
+func (s *Supervisor) nextCmd() *exec.Cmd {
+	switch {
+	case s.process.cmd != nil:
+		return s.process.cmd
+	case s.template != nil:
+		// rule: the copy gets fresh output wiring, since the caller's pipes belonged to the first
+		// process and Wait closed their read ends; a restarted child writing to them would die of SIGPIPE
+		cmd := &exec.Cmd{
+			Path:        s.template.Path,
+			Args:        s.template.Args,
+			Env:         s.template.Env,
+			Dir:         s.template.Dir,
+			SysProcAttr: s.template.SysProcAttr,
+		}
+		// A writer that is not a file is kept: exec copies into it through a new pipe for each start
+		if _, isFile := s.template.Stdout.(*os.File); !isFile {
+			cmd.Stdout = s.template.Stdout
+		}
+		if _, isFile := s.template.Stderr.(*os.File); !isFile {
+			cmd.Stderr = s.template.Stderr
+		}
+		return cmd
+	case s.config.Shell:
+		return exec.Command("sh", "-c", strings.Join(s.command, " "))
+	default:
+		return exec.Command(s.command[0], s.command[1:]...)
+	}
+}
+
+// SetAutoRestart enables or disables restarting the process when it exits on its own.
+// Disabling it leaves a crashed process stopped so the failure can be inspected.
+// Re-enabling it does not restart a process that already exited.
+func (s *Supervisor) SetAutoRestart(enabled bool) {
+	s.noAutoRestart.Store(!enabled)
+}
+
+// AutoRestart reports whether the process is restarted when it exits on its own
+func (s *Supervisor) AutoRestart() bool {
+	return !s.noAutoRestart.Load()
 }
 
 // StopProcess gracefully stops the supervised process.
@@ -172,68 +530,45 @@ func (s *Supervisor) StartProcess() error {
 // Returns an error if stopping the process fails.
 func (s *Supervisor) StopProcess() error {
 	s.process.Lock()
-	defer s.process.Unlock()
-
-	if !s.process.running {
+	if !s.process.running || s.process.cmd == nil || s.process.cmd.Process == nil {
+		s.process.Unlock()
 		return nil
 	}
 
 	// Mark that we're stopping the process intentionally
 	s.process.stopped = true
-
-	if s.process.cmd != nil && s.process.cmd.Process != nil {
-		// Create a channel to wait for process exit
-		done := make(chan error, 1)
-		go func() {
-			done <- s.process.cmd.Wait()
-		}()
-
-		// First try SIGTERM for graceful shutdown
-		log.Printf("Sending SIGTERM to process %d", s.process.pid)
-		if err := s.process.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-			return fmt.Errorf("failed to send SIGTERM: %v", err)
-		}
-
-		// Wait for process to exit or timeout
+	process := s.process.cmd.Process
+	pid := s.process.pid
+	exited := s.process.exited
+	s.process.Unlock()
+
+	// First try SIGTERM for graceful shutdown
+	logDebugf("Sending SIGTERM to process %d", pid)
+	if err := process.Signal(syscall.SIGTERM); err != nil {
 		select {
-		case err := <-done:
-			if err != nil {
-				log.Printf("Process %d exited with error: %v", s.process.pid, err)
-			} else {
-				log.Printf("Process %d exited successfully", s.process.pid)
-			}
-		case <-time.After(s.config.TimeoutStop):
-			// Process didn't exit in time, send SIGKILL
-			log.Printf("Process %d did not exit within %v, sending SIGKILL",
-				s.process.pid, s.config.TimeoutStop)
-			if err := s.process.cmd.Process.Kill(); err != nil {
-				return fmt.Errorf("failed to kill process: %v", err)
-			}
-			// Wait for the kill to take effect
-			<-done
-		}
-
-		// Ensure process is cleaned up
-		if s.process.cmd.Process != nil {
-			s.process.cmd.Process.Release()
+		case <-exited:
+			return nil
+		default:
+			return fmt.Errorf("failed to send SIGTERM: %v", err)
 		}
+	}
 
-		// Close any open pipes
-		if s.process.cmd.Stdout != nil {
-			if closer, ok := s.process.cmd.Stdout.(io.Closer); ok {
-				closer.Close()
-			}
-		}
-		if s.process.cmd.Stderr != nil {
-			if closer, ok := s.process.cmd.Stderr.(io.Closer); ok {
-				closer.Close()
-			}
+	// Wait for process to exit or timeout
+	select {
+	case <-exited:
+		logInfof("Process %d exited", pid)
+	case <-time.After(s.config.TimeoutStop):
+		// Process didn't exit in time, send SIGKILL
+		logWarnf("Process %d did not exit within %v, sending SIGKILL",
+			pid, s.config.TimeoutStop)
+		if err := process.Kill(); err != nil {
+			return fmt.Errorf("failed to kill process: %v", err)
 		}
+		// Wait for the kill to take effect
+		<-exited
 	}
 
-	s.process.running = false
-	s.process.cmd = nil
-	s.process.pid = 0
+	s.events.Record(EventProcessStopped, "supervisor", fmt.Sprintf("stopped process with PID %d", pid), nil)
 	return nil
 }
 
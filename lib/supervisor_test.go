@@ -1,6 +1,19 @@
 package lib
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -115,3 +128,558 @@ func TestSupervisorRestart(t *testing.T) {
 	}
 	t.Log("TestSupervisorRestart completed")
 }
+
+func TestSupervisorPreStart(t *testing.T) {
+	var calls atomic.Int32
+	s := NewSupervisor([]string{"sh", "-c", "sleep 0.1"}, SupervisorConfig{
+		TimeoutStop:  5 * time.Second,
+		RestartDelay: 50 * time.Millisecond,
+		PreStart: func(ctx context.Context) error {
+			calls.Add(1)
+			return nil
+		},
+	})
+	defer s.StopProcess()
+
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+
+	// Let the process exit and be restarted a few times
+	time.Sleep(700 * time.Millisecond)
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected pre-start hook to run once, ran %d times", got)
+	}
+}
+
+func TestSupervisorPreStartFailure(t *testing.T) {
+	hookErr := errors.New("seed failed")
+	s := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{
+		TimeoutStop: 5 * time.Second,
+		PreStart: func(ctx context.Context) error {
+			return hookErr
+		},
+	})
+	defer s.StopProcess()
+
+	err := s.StartProcess()
+	if !errors.Is(err, hookErr) {
+		t.Fatalf("Expected pre-start error, got %v", err)
+	}
+	if s.IsRunning() {
+		t.Error("Process should not be started when the pre-start hook fails")
+	}
+}
+
+func TestSupervisorOnStop(t *testing.T) {
+	stops := make(chan ExitInfo, 1)
+	s := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{
+		TimeoutStop: 5 * time.Second,
+		OnStop: func(info ExitInfo) {
+			stops <- info
+		},
+	})
+
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	s.process.RLock()
+	pid := s.process.pid
+	s.process.RUnlock()
+
+	if err := s.StopProcess(); err != nil {
+		t.Fatalf("Failed to stop process: %v", err)
+	}
+
+	select {
+	case info := <-stops:
+		if info.PID != pid {
+			t.Errorf("Expected PID %d, got %d", pid, info.PID)
+		}
+		if !info.Stopped {
+			t.Error("Expected Stopped to be true for an intentional stop")
+		}
+		if info.ExitCode != -1 {
+			t.Errorf("Expected exit code -1 for a signaled process, got %d", info.ExitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStop was not called")
+	}
+}
+
+func TestSupervisorOnRestart(t *testing.T) {
+	stops := make(chan ExitInfo, 1)
+	restarts := make(chan int, 1)
+	s := NewSupervisor([]string{"sh", "-c", "exit 3"}, SupervisorConfig{
+		TimeoutStop:  5 * time.Second,
+		RestartDelay: 50 * time.Millisecond,
+		OnStop: func(info ExitInfo) {
+			select {
+			case stops <- info:
+			default:
+			}
+		},
+		OnRestart: func(pid int) {
+			select {
+			case restarts <- pid:
+			default:
+			}
+		},
+	})
+	defer s.StopProcess()
+
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+
+	select {
+	case info := <-stops:
+		if info.Stopped {
+			t.Error("Expected Stopped to be false for an unexpected exit")
+		}
+		if info.ExitCode != 3 {
+			t.Errorf("Expected exit code 3, got %d", info.ExitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStop was not called")
+	}
+
+	select {
+	case pid := <-restarts:
+		if pid == 0 {
+			t.Error("Expected OnRestart to receive the new PID")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnRestart was not called")
+	}
+}
+
+func TestSupervisorStartLatency(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	s := NewSupervisor([]string{"sh", "-c", "sleep 0.3; touch " + ready + "; exec sleep 60"}, SupervisorConfig{
+		TimeoutStop: 5 * time.Second,
+		ReadinessProbe: func(ctx context.Context) error {
+			_, err := os.Stat(ready)
+			return err
+		},
+		ReadinessInterval: 20 * time.Millisecond,
+	})
+	defer s.StopProcess()
+
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	if s.IsReady() {
+		t.Error("Process should not be ready before its probe passes")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.IsReady() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !s.IsReady() {
+		t.Fatal("Process did not become ready")
+	}
+
+	latency := s.StartLatency()
+	if latency.Count != 1 {
+		t.Fatalf("Expected 1 recorded start, got %d", latency.Count)
+	}
+	if latency.Last < 300*time.Millisecond || latency.Last > 2*time.Second {
+		t.Errorf("Expected start latency of about 300ms, got %v", latency.Last)
+	}
+	if latency.Min != latency.Last || latency.Max != latency.Last {
+		t.Errorf("Expected min and max to equal the only sample, got %+v", latency)
+	}
+}
+
+func TestSupervisorAutoRestartToggle(t *testing.T) {
+	stops := make(chan ExitInfo, 1)
+	restarts := make(chan int, 1)
+	s := NewSupervisor([]string{"sh", "-c", "sleep 0.2; exit 3"}, SupervisorConfig{
+		TimeoutStop:  5 * time.Second,
+		RestartDelay: 20 * time.Millisecond,
+		OnStop: func(info ExitInfo) {
+			select {
+			case stops <- info:
+			default:
+			}
+		},
+		OnRestart: func(pid int) {
+			select {
+			case restarts <- pid:
+			default:
+			}
+		},
+	})
+	defer s.StopProcess()
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), s)
+	request := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/supervisor/autorestart", strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	if w := request("POST", `{"enabled": false}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":false`) {
+		t.Fatalf("Expected autorestart to be disabled, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("POST", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a request without enabled to be rejected, got %d", w.Code)
+	}
+
+	select {
+	case <-stops:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+	select {
+	case pid := <-restarts:
+		t.Fatalf("Expected the process to stay stopped, restarted as %d", pid)
+	case <-time.After(10 * s.config.RestartDelay):
+	}
+	if s.IsRunning() {
+		t.Error("Expected the process to stay stopped")
+	}
+	if status := control.Status(); status.Running || !status.AutoRestartDisabled {
+		t.Errorf("Expected status to report a stopped process with autorestart disabled, got %+v", status)
+	}
+
+	// Re-enabling restarts future exits, not the one already handled
+	if w := request("POST", `{"enabled": true}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected autorestart to be enabled, got %d", w.Code)
+	}
+	if s.IsRunning() || control.Status().AutoRestartDisabled {
+		t.Error("Expected the process to stay stopped with autorestart reported enabled")
+	}
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	select {
+	case <-restarts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the process to be restarted once autorestart is enabled again")
+	}
+
+	// The endpoint needs a supervised process
+	control = NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil)
+	if w := request("POST", `{"enabled": false}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a supervisor, got %d", w.Code)
+	}
+}
+
+func TestSupervisorRestartJitter(t *testing.T) {
+	fixed := NewSupervisor([]string{"true"}, SupervisorConfig{RestartDelay: 100 * time.Millisecond})
+	if d := fixed.restartDelay(); d != 100*time.Millisecond {
+		t.Errorf("Expected a fixed delay without jitter, got %v", d)
+	}
+
+	s := NewSupervisor([]string{"true"}, SupervisorConfig{RestartDelay: 100 * time.Millisecond, RestartJitter: 0.5})
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := s.restartDelay()
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("Expected delays within 50ms-150ms, got %v", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("Expected successive delays to vary")
+	}
+}
+
+func TestSupervisorRestartPolicy(t *testing.T) {
+	var restarts atomic.Int32
+	s := NewSupervisor([]string{"sh", "-c", "exit 3"}, SupervisorConfig{
+		TimeoutStop:  5 * time.Second,
+		RestartDelay: 10 * time.Millisecond,
+		OnRestart: func(pid int) {
+			restarts.Add(1)
+		},
+	})
+	defer s.StopProcess()
+
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), s)
+	request := func(method, body string) (*httptest.ResponseRecorder, RestartPolicy) {
+		req := httptest.NewRequest(method, "/supervisor/policy", strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		var policy RestartPolicy
+		json.Unmarshal(w.Body.Bytes(), &policy)
+		return w, policy
+	}
+	// runUntilSettled starts the process and waits until it has been left stopped, returning how
+	// many times it was restarted
+	runUntilSettled := func() int32 {
+		t.Helper()
+		restarts.Store(0)
+		if err := s.StartProcess(); err != nil {
+			t.Fatalf("Failed to start process: %v", err)
+		}
+		last, stable := int32(-1), 0
+		for deadline := time.Now().Add(5 * time.Second); stable < 10 && time.Now().Before(deadline); {
+			time.Sleep(20 * time.Millisecond)
+			if n := restarts.Load(); n == last && !s.IsRunning() {
+				stable++
+			} else {
+				last, stable = n, 0
+			}
+		}
+		if stable < 10 {
+			t.Fatal("Expected the process to be left stopped")
+		}
+		return last
+	}
+
+	if w, policy := request("GET", ""); w.Code != http.StatusOK || policy.Mode != RestartAlways || policy.DelayMillis != 10 || policy.MaxRestarts != 0 {
+		t.Fatalf("Expected the configured policy, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A crash loop ends once the restart limit is reached
+	if w, policy := request("PUT", `{"max_restarts": 2}`); w.Code != http.StatusOK || policy.MaxRestarts != 2 || policy.DelayMillis != 10 {
+		t.Fatalf("Expected max_restarts to be set and the rest kept, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := runUntilSettled(); n != 2 {
+		t.Errorf("Expected 2 restarts before the process was left stopped, got %d", n)
+	}
+
+	// With restarts switched off the process is left stopped at once
+	if w, _ := request("PUT", `{"mode": "never"}`); w.Code != http.StatusOK || s.AutoRestart() {
+		t.Fatalf("Expected restarts to be switched off, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := runUntilSettled(); n != 0 {
+		t.Errorf("Expected no restarts with mode never, got %d", n)
+	}
+
+	// And back on
+	if w, _ := request("PUT", `{"mode": "always", "max_restarts": 1}`); w.Code != http.StatusOK || !s.AutoRestart() {
+		t.Fatalf("Expected restarts to be switched on, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := runUntilSettled(); n != 1 {
+		t.Errorf("Expected 1 restart, got %d", n)
+	}
+
+	for _, body := range []string{`{"mode": "sometimes"}`, `{"jitter": 2}`, `{"delay_ms": 0}`, `{"max_restarts": -1}`, `{"retries": 1}`} {
+		if w, _ := request("PUT", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, w.Code)
+		}
+	}
+	if _, policy := request("GET", ""); policy.Mode != RestartAlways || policy.MaxRestarts != 1 {
+		t.Errorf("Expected rejected changes to leave the policy alone, got %+v", policy)
+	}
+}
+
+func TestSupervisorHistory(t *testing.T) {
+	// The first run crashes; the restarted one keeps running until stopped
+	marker := filepath.Join(t.TempDir(), "crashed")
+	restarts := make(chan int, 1)
+	s := NewSupervisor([]string{"sh", "-c", `if [ -e "$0" ]; then exec sleep 60; fi; touch "$0"; exit 3`, marker}, SupervisorConfig{
+		TimeoutStop:  5 * time.Second,
+		RestartDelay: 20 * time.Millisecond,
+		OnRestart: func(pid int) {
+			restarts <- pid
+		},
+	})
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), s)
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	var restarted int
+	select {
+	case restarted = <-restarts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process was not restarted")
+	}
+	if err := s.StopProcess(); err != nil {
+		t.Fatalf("Failed to stop process: %v", err)
+	}
+
+	history := s.History()
+	var transitions []LifecycleTransition
+	for _, e := range history {
+		transitions = append(transitions, e.Transition)
+	}
+	want := []LifecycleTransition{TransitionStarted, TransitionExited, TransitionRestarted, TransitionStopped}
+	if !slices.Equal(transitions, want) {
+		t.Fatalf("Expected transitions %v, got %v", want, transitions)
+	}
+	if history[0].PID != history[1].PID || history[2].PID != restarted || history[3].PID != restarted {
+		t.Errorf("Expected each transition to carry its process's PID, got %+v", history)
+	}
+	if exit := history[1].Exit; exit == nil || exit.ExitCode != 3 || exit.Error == "" {
+		t.Errorf("Expected the crash to record exit code 3, got %+v", exit)
+	}
+	if history[0].Exit != nil || history[3].Exit == nil {
+		t.Errorf("Expected exit info only for exits, got %+v", history)
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].Time.Before(history[i-1].Time) {
+			t.Errorf("Expected events in time order, got %+v", history)
+		}
+	}
+
+	// The history is served by the control endpoint
+	req := httptest.NewRequest("GET", "/supervisor/history", nil)
+	req.Host = "fly-app-controller"
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, req)
+	var resp struct {
+		Events []LifecycleEvent `json:"events"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.Events) != len(want) {
+		t.Errorf("Expected %d events from the endpoint, got %d: %s", len(want), w.Code, w.Body.String())
+	}
+
+	// Only the most recent events are kept
+	bounded := NewSupervisor([]string{"true"}, SupervisorConfig{HistorySize: 2})
+	for pid := 1; pid <= 3; pid++ {
+		bounded.recordLifecycle(TransitionStarted, pid, nil)
+	}
+	if h := bounded.History(); len(h) != 2 || h[0].PID != 2 || h[1].PID != 3 {
+		t.Errorf("Expected the 2 most recent events, got %+v", h)
+	}
+}
+
+func TestSupervisorShellMode(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	line := []string{"echo hello | tr a-z A-Z >", out}
+
+	// Executed directly, the whole line is not a program
+	direct := NewSupervisor(line, SupervisorConfig{})
+	if err := direct.StartProcess(); err == nil {
+		direct.StopProcess()
+		t.Fatal("Expected a shell line to fail without shell mode")
+	}
+
+	exits := make(chan ExitInfo, 1)
+	s := NewSupervisor(line, SupervisorConfig{
+		Shell: true,
+		OnStop: func(info ExitInfo) {
+			exits <- info
+		},
+	})
+	s.SetAutoRestart(false)
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start shell command: %v", err)
+	}
+	select {
+	case info := <-exits:
+		if info.ExitCode != 0 {
+			t.Fatalf("Expected the pipeline to succeed, got exit code %d", info.ExitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shell command did not exit")
+	}
+	if data, err := os.ReadFile(out); err != nil || string(data) != "HELLO\n" {
+		t.Errorf("Expected the pipeline output, got %q (%v)", data, err)
+	}
+}
+
+func TestSupervisorRestartRewiresOutput(t *testing.T) {
+	// A chatty child whose stderr is piped to the caller, as for the JuiceFS mount
+	marker := filepath.Join(t.TempDir(), "mark")
+	cmd := exec.Command("sh", "-c", `echo "$MARK" > "$0"; while :; do echo "out $MARK"; echo "err $MARK" >&2; sleep 0.01; done`, marker)
+	cmd.Env = append(os.Environ(), "MARK=kept")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exits := make(chan ExitInfo, 2)
+	s := NewSupervisorCmd(cmd, SupervisorConfig{
+		TimeoutStop: 5 * time.Second,
+		OnStop: func(info ExitInfo) {
+			exits <- info
+		},
+	})
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	line, err := bufio.NewReader(stderr).ReadString('\n')
+	if err != nil || line != "err kept\n" {
+		t.Fatalf("Expected output on the caller's pipe, got %q (%v)", line, err)
+	}
+	go io.Copy(io.Discard, stderr)
+
+	// Stopping closes the caller's pipe; the next start must not write to it
+	if err := s.StopProcess(); err != nil {
+		t.Fatalf("Failed to stop process: %v", err)
+	}
+	<-exits
+	os.Remove(marker)
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process again: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if !s.IsRunning() {
+		t.Fatal("Expected the restarted process to keep running while writing output")
+	}
+	if data, err := os.ReadFile(marker); err != nil || string(data) != "kept\n" {
+		t.Errorf("Expected the restarted process to keep the command's environment, got %q (%v)", data, err)
+	}
+	if err := s.StopProcess(); err != nil {
+		t.Fatalf("Failed to stop process: %v", err)
+	}
+	info := <-exits
+	if info.Err == nil || !strings.Contains(info.Err.Error(), "terminated") {
+		t.Errorf("Expected the restarted process to exit on SIGTERM rather than a broken pipe, got %v", info.Err)
+	}
+}
+
+func TestSupervisorSwapCommand(t *testing.T) {
+	s := NewSupervisor([]string{"sleep", "30"}, SupervisorConfig{TimeoutStop: 5 * time.Second})
+	defer s.StopProcess()
+	db := &cleanupComponent{namedHTTPComponent: namedHTTPComponent{name: "db"}}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), s, db)
+	if err := control.setupComponents(context.Background(), &SystemConfig{Stacks: []string{"db"}}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if err := s.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	pid := func() int {
+		s.process.RLock()
+		defer s.process.RUnlock()
+		return s.process.pid
+	}
+	oldPID := pid()
+
+	swap := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/supervisor/command", strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	// A missing executable is rejected without touching the running process
+	if w := swap(`{"command": ["/nonexistent/app", "serve"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing executable to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	if pid() != oldPID || !s.IsRunning() {
+		t.Fatal("Expected the old process to keep running after a rejected command")
+	}
+
+	if w := swap(`{"command": ["sh", "-c", "sleep 30"]}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the command to be swapped, got %d: %s", w.Code, w.Body.String())
+	}
+	if newPID := pid(); newPID == oldPID || !s.IsRunning() {
+		t.Errorf("Expected a new process to be running, got PID %d (old %d)", newPID, oldPID)
+	}
+	if got := s.Command(); !slices.Equal(got, []string{"sh", "-c", "sleep 30"}) {
+		t.Errorf("Expected the new command, got %v", got)
+	}
+	if !db.setup || db.cleaned {
+		t.Errorf("Expected the stacks to stay up, got setup=%v cleaned=%v", db.setup, db.cleaned)
+	}
+}
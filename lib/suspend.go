@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errNotSuspended is returned when resuming an environment that is not suspended
+var errNotSuspended = errors.New("not suspended")
+
+// errNoSupervisor is returned by operations on the supervised process when the control
+// runs without one (config-only mode)
+var errNoSupervisor = errors.New("no supervised process")
+
+// suspension records how the environment was suspended so it can be resumed
+type suspension struct {
+	Token    string `json:"token"`
+	Quiesced bool   `json:"quiesced"`
+}
+
+// Suspend prepares the environment for the machine to be suspended: it optionally pauses
+// the supervised process, checkpoints every checkpointable component and flushes replication.
+// It returns a token that Resume uses to restore the checkpointed state.
+func (c *Control) Suspend(ctx context.Context, quiesce bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config == nil {
+		return "", fmt.Errorf("not configured")
+	}
+	if c.suspension != nil {
+		return "", fmt.Errorf("already suspended with token %s", c.suspension.Token)
+	}
+
+	// rule: asking to quiesce without a process fails rather than silently suspending a running app
+	if quiesce && c.supervisor == nil {
+		return "", fmt.Errorf("cannot quiesce: %w", errNoSupervisor)
+	}
+
+	token := fmt.Sprintf("suspend-%d", time.Now().UnixNano())
+
+	// Quiesce the app so it does not write while state is checkpointed
+	if quiesce {
+		if err := c.supervisor.ForwardSignal(syscall.SIGSTOP); err != nil {
+			return "", fmt.Errorf("failed to quiesce process: %w", err)
+		}
+	}
+	fail := func(err error) (string, error) {
+		if quiesce {
+			if err := c.supervisor.ForwardSignal(syscall.SIGCONT); err != nil {
+				logErrorf("Failed to resume process after failed suspend: %v", err)
+			}
+		}
+		return "", err
+	}
+
+	// Checkpoint, undoing earlier checkpoints if a later one fails
+	ctx = withCheckpointTag(ctx)
+	var checkpointed []CheckpointableComponent
+	for _, comp := range c.components {
+		cc, ok := comp.(CheckpointableComponent)
+		if !ok {
+			continue
+		}
+		if _, err := cc.CreateCheckpoint(ctx, token); err != nil {
+			for i := len(checkpointed) - 1; i >= 0; i-- {
+				if err := checkpointed[i].RestoreToCheckpoint(ctx, token); err != nil {
+					logErrorf("Failed to undo suspend checkpoint of %s: %v", checkpointed[i].Name(), err)
+				}
+			}
+			return fail(fmt.Errorf("failed to checkpoint %s: %w", cc.Name(), err))
+		}
+		checkpointed = append(checkpointed, cc)
+	}
+
+	// Flush replication last so the checkpoints themselves are durable
+	for _, comp := range c.components {
+		if rs, ok := comp.(ReplicationSyncer); ok {
+			if err := rs.SyncReplication(ctx); err != nil {
+				return fail(fmt.Errorf("failed to flush replication of %s: %w", rs.Name(), err))
+			}
+		}
+	}
+
+	c.suspension = &suspension{Token: token, Quiesced: quiesce}
+	c.events.Record(EventSuspended, "control", "", map[string]string{"token": token})
+	return token, nil
+}
+
+// Resume restores the state checkpointed by Suspend and resumes a quiesced process
+func (c *Control) Resume(ctx context.Context, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.suspension == nil {
+		return errNotSuspended
+	}
+	if token != c.suspension.Token {
+		return fmt.Errorf("unknown suspend token %q", token)
+	}
+
+	var checkpointables []CheckpointableComponent
+	for _, comp := range c.components {
+		if cc, ok := comp.(CheckpointableComponent); ok {
+			checkpointables = append(checkpointables, cc)
+		}
+	}
+	if err := restoreAll(ctx, checkpointables, token); err != nil {
+		return err
+	}
+
+	if c.suspension.Quiesced && c.supervisor != nil {
+		if err := c.supervisor.ForwardSignal(syscall.SIGCONT); err != nil {
+			return fmt.Errorf("failed to resume process: %w", err)
+		}
+	}
+	c.suspension = nil
+	c.events.Record(EventResumed, "control", "", map[string]string{"token": token})
+	return nil
+}
+
+// handleSuspend checkpoints and flushes the environment ahead of a machine suspend
+func (c *Control) handleSuspend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Quiesce bool `json:"quiesce"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+	}
+
+	token, err := c.Suspend(r.Context(), req.Quiesce)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoSupervisor) {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "suspended",
+		"token":    token,
+		"quiesced": req.Quiesce,
+	})
+}
+
+// handleResume restores the environment from a suspend token
+func (c *Control) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid request body: %v", err)})
+		return
+	}
+	if strings.TrimSpace(req.Token) == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Suspend token is required"})
+		return
+	}
+
+	if err := c.Resume(r.Context(), req.Token); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotSuspended) {
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "resumed",
+		"token":  req.Token,
+	})
+}
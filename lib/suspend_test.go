@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memCheckpointComponent keeps its state and checkpoints in memory and records operations
+type memCheckpointComponent struct {
+	missingCheckpointComponent
+	active      string
+	checkpoints map[string]string
+	ops         *[]string
+}
+
+func (m *memCheckpointComponent) CreateCheckpoint(ctx context.Context, id string) (string, error) {
+	*m.ops = append(*m.ops, "checkpoint")
+	m.checkpoints[id] = m.active
+	m.active = ""
+	return id, nil
+}
+
+func (m *memCheckpointComponent) RestoreToCheckpoint(ctx context.Context, id string) error {
+	state, ok := m.checkpoints[id]
+	if !ok {
+		return fmt.Errorf("no checkpoint %s", id)
+	}
+	delete(m.checkpoints, id)
+	m.active = state
+	return nil
+}
+
+func (m *memCheckpointComponent) HasCheckpoint(ctx context.Context, id string) (bool, error) {
+	_, ok := m.checkpoints[id]
+	return ok, nil
+}
+
+func (m *memCheckpointComponent) ListCheckpoints(ctx context.Context) ([]string, error) {
+	var ids []string
+	for id := range m.checkpoints {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *memCheckpointComponent) DeleteCheckpoint(ctx context.Context, id string) error {
+	delete(m.checkpoints, id)
+	return nil
+}
+
+func (m *memCheckpointComponent) SyncReplication(ctx context.Context) error {
+	*m.ops = append(*m.ops, "sync")
+	return nil
+}
+
+// processStopped reports whether a process is stopped according to /proc, waiting briefly
+// for signal delivery to settle on the expected state
+func processStopped(t *testing.T, pid int, want bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			t.Skipf("Skipping process state check: %v", err)
+		}
+		fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+		stopped := fields[0] == "T"
+		if stopped == want || time.Now().After(deadline) {
+			return stopped
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	supervisor := NewSupervisor([]string{"tail", "-f", "/dev/null"}, SupervisorConfig{TimeoutStop: 5 * time.Second})
+	if err := supervisor.StartProcess(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	defer supervisor.StopProcess()
+	supervisor.process.RLock()
+	pid := supervisor.process.pid
+	supervisor.process.RUnlock()
+
+	var ops []string
+	first := &memCheckpointComponent{active: "db state", checkpoints: map[string]string{}, ops: &ops}
+	second := &memCheckpointComponent{active: "fs state", checkpoints: map[string]string{}, ops: &ops}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), supervisor, first, second)
+	control.config = &SystemConfig{}
+	control.setupRoutes()
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/suspend", `{"quiesce": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected suspend to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Token == "" {
+		t.Fatalf("Expected a suspend token, got %q (%v)", resp.Token, err)
+	}
+
+	// Components are checkpointed before replication is flushed
+	if strings.Join(ops, ",") != "checkpoint,checkpoint,sync,sync" {
+		t.Errorf("Unexpected suspend order: %v", ops)
+	}
+	if first.active != "" || second.active != "" {
+		t.Error("Expected state to be checkpointed")
+	}
+	if !processStopped(t, pid, true) {
+		t.Error("Expected process to be stopped while suspended")
+	}
+
+	if w := post("/suspend", `{}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a second suspend to fail, got %d", w.Code)
+	}
+	if w := post("/resume", `{"token": "bogus"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected resume with a wrong token to fail, got %d", w.Code)
+	}
+
+	if w := post("/resume", fmt.Sprintf(`{"token": %q}`, resp.Token)); w.Code != http.StatusOK {
+		t.Fatalf("Expected resume to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if first.active != "db state" || second.active != "fs state" {
+		t.Errorf("Expected state to be restored, got %q and %q", first.active, second.active)
+	}
+	if len(first.checkpoints) != 0 || len(second.checkpoints) != 0 {
+		t.Errorf("Expected no leftover checkpoints, got %v and %v", first.checkpoints, second.checkpoints)
+	}
+	if processStopped(t, pid, false) {
+		t.Error("Expected process to run again after resume")
+	}
+
+	if w := post("/resume", fmt.Sprintf(`{"token": %q}`, resp.Token)); w.Code != http.StatusConflict {
+		t.Errorf("Expected resume when not suspended to conflict, got %d", w.Code)
+	}
+}
+
+func TestControlWithoutSupervisor(t *testing.T) {
+	var ops []string
+	comp := &memCheckpointComponent{active: "state", checkpoints: map[string]string{}, ops: &ops}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, comp)
+	control.config = &SystemConfig{}
+	control.setupRoutes()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Host = "fly-app-controller"
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, req)
+		return w
+	}
+
+	var status SystemStatus
+	if err := json.NewDecoder(request("GET", "/status", "").Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if status.Running || status.StartLatency != nil {
+		t.Errorf("Expected no process to be reported, got %+v", status)
+	}
+
+	// Quiescing needs a process to pause
+	w := request("POST", "/suspend", `{"quiesce": true}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "no supervised process") {
+		t.Errorf("Expected quiesce without a supervisor to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(ops) != 0 {
+		t.Errorf("Expected nothing to be checkpointed by a rejected suspend, got %v", ops)
+	}
+
+	// Everything else works without one
+	w = request("POST", "/suspend", `{}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected suspend without quiesce to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w := request("POST", "/resume", fmt.Sprintf(`{"token": %q}`, resp.Token)); w.Code != http.StatusOK {
+		t.Errorf("Expected resume to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if err := control.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected shutdown to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTokenGrace is how long the previous controller token is still accepted after a reload
+const DefaultTokenGrace = 5 * time.Minute
+
+// tokenNow is the clock the token grace window is measured by, replaceable in tests
+var tokenNow = time.Now
+
+// controllerTokens holds the tokens the control interface accepts. After a reload the previous
+// token stays valid for a grace window, so controllers still using it are not locked out while
+// the new token is rolled out to them.
+type controllerTokens struct {
+	mu            sync.RWMutex // protects all fields below
+	current       string
+	previous      string
+	previousUntil time.Time
+	grace         time.Duration
+	source        func() (string, error)
+}
+
+// accepts reports whether the token is the current one or the previous one within its grace window
+func (t *controllerTokens) accepts(token string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if equalTokens(token, t.current) {
+		return true
+	}
+	return t.previous != "" && tokenNow().Before(t.previousUntil) && equalTokens(token, t.previous)
+}
+
+// equalTokens compares two tokens in constant time
+func equalTokens(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// SetTokenSource sets where ReloadToken reads the controller token from, e.g. the
+// CONTROLLER_TOKEN_FILE, and how long the previous token is still accepted after a reload. A zero
+// grace uses DefaultTokenGrace; a negative grace rejects the previous token at once.
+func (c *Control) SetTokenSource(source func() (string, error), grace time.Duration) {
+	if grace == 0 {
+		grace = DefaultTokenGrace
+	}
+	c.tokens.mu.Lock()
+	defer c.tokens.mu.Unlock()
+	c.tokens.source = source
+	c.tokens.grace = max(grace, 0)
+}
+
+// ReloadToken reads the controller token from its source again, for rotating it without a
+// restart. It reports whether the token changed; an unchanged token leaves any grace window alone.
+func (c *Control) ReloadToken() (bool, error) {
+	c.tokens.mu.RLock()
+	source := c.tokens.source
+	c.tokens.mu.RUnlock()
+	if source == nil {
+		return false, fmt.Errorf("controller token cannot be reloaded: no token source configured")
+	}
+	token, err := source()
+	if err != nil {
+		return false, fmt.Errorf("failed to reload controller token: %w", err)
+	}
+	// rule: an empty token would lock every controller out, so the current token is kept
+	if token == "" {
+		return false, fmt.Errorf("failed to reload controller token: token is empty")
+	}
+
+	c.tokens.mu.Lock()
+	if token == c.tokens.current {
+		c.tokens.mu.Unlock()
+		return false, nil
+	}
+	c.tokens.previous = c.tokens.current
+	c.tokens.previousUntil = tokenNow().Add(c.tokens.grace)
+	c.tokens.current = token
+	grace := c.tokens.grace
+	c.tokens.mu.Unlock()
+
+	logInfof("Reloaded controller token; the previous token is accepted for another %v", grace)
+	c.events.Record(EventTokenReloaded, "control", fmt.Sprintf("previous token accepted for %v", grace), nil)
+	return true, nil
+}
+
+// handleTokenReload reloads the controller token on request, e.g. right after the token file was
+// replaced. The request itself may still use the previous token.
+func (c *Control) handleTokenReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	changed, err := c.ReloadToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	c.tokens.mu.RLock()
+	grace := c.tokens.grace
+	c.tokens.mu.RUnlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changed":       changed,
+		"grace_seconds": int(grace.Seconds()),
+	})
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// DefaultUnavailableBody is the response body while the upstream process is not running
+	DefaultUnavailableBody = "Upstream service is not running\n"
+	// DefaultUnavailableRetryAfter is the Retry-After, in seconds, sent while the upstream is not running
+	DefaultUnavailableRetryAfter = 5
+)
+
+// UnavailableResponse is what the proxy answers while the upstream process is not running,
+// e.g. a branded "starting up" page or the JSON error shape the app's clients expect.
+// The zero value serves a plain-text 503 with DefaultUnavailableBody.
+type UnavailableResponse struct {
+	// StatusCode defaults to 503
+	StatusCode int
+	// ContentType defaults to text/plain
+	ContentType string
+	// Body defaults to DefaultUnavailableBody
+	Body string
+	// RetryAfter is the Retry-After header in seconds; zero uses DefaultUnavailableRetryAfter
+	// and a negative value omits the header
+	RetryAfter int
+	// Handler, if set, writes the response instead of StatusCode, ContentType and Body.
+	// It is called with Retry-After already set.
+	Handler http.Handler
+}
+
+// Validate checks the response settings
+func (u UnavailableResponse) Validate() error {
+	if u.StatusCode != 0 && (u.StatusCode < 200 || u.StatusCode > 599) {
+		return fmt.Errorf("unavailable response status %d must be between 200 and 599", u.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP writes the response
+func (u UnavailableResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	retryAfter := u.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = DefaultUnavailableRetryAfter
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	if u.Handler != nil {
+		u.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	status, contentType, body := u.StatusCode, u.ContentType, u.Body
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	if body == "" {
+		body = DefaultUnavailableBody
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+// SetUnavailableResponse sets the response served while the upstream process is not running.
+// It must be called before the proxy serves requests.
+func (p *Proxy) SetUnavailableResponse(resp UnavailableResponse) error {
+	if err := resp.Validate(); err != nil {
+		return err
+	}
+	p.unavailable = resp
+	return nil
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// storageValidationTimeout bounds the storage checks of a config validation
+const storageValidationTimeout = 30 * time.Second
+
+// StorageAccess reports what a config's storage credentials were confirmed to be allowed to do
+type StorageAccess struct {
+	Reachable bool   `json:"reachable"`
+	Writable  bool   `json:"writable"`
+	Error     string `json:"error,omitempty"`
+	// Category classifies the failure, e.g. auth_failed for wrong credentials
+	Category StorageErrorCategory `json:"category,omitempty"`
+}
+
+// fail records a failed storage check
+func (a *StorageAccess) fail(op string, err error) StorageAccess {
+	err = newStorageError(op, err)
+	a.Error = err.Error()
+	a.Category = ClassifyStorageError(err)
+	return *a
+}
+
+// ConfigValidation is the result of validating a config without applying it
+type ConfigValidation struct {
+	Valid   bool           `json:"valid"`
+	Error   string         `json:"error,omitempty"`
+	Storage *StorageAccess `json:"storage,omitempty"`
+}
+
+// checkStorageAccess confirms the bucket is reachable and that the credentials can write under
+// the key prefix, by writing and deleting a tiny object there
+func checkStorageAccess(ctx context.Context, cfg *ObjectStorageConfig) StorageAccess {
+	var access StorageAccess
+	sess, err := cfg.newSession()
+	if err != nil {
+		access.Error = err.Error()
+		return access
+	}
+	client := s3.New(sess)
+	if _, err := client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(cfg.Bucket)}); err != nil {
+		return access.fail("head bucket "+cfg.Bucket, err)
+	}
+	access.Reachable = true
+
+	// rule: read-only credentials pass a HEAD but fail replication, so write access is proven with a real write
+	key := path.Join(cfg.layout().scratch(), fmt.Sprintf(".write-test-%d", time.Now().UnixNano()))
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(cfg.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader([]byte("ok")),
+	}
+	if cfg.SSE != "" {
+		input.ServerSideEncryption = aws.String(cfg.SSE)
+		if cfg.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(cfg.SSEKMSKeyID)
+		}
+	}
+	if _, err := client.PutObjectWithContext(ctx, input); err != nil {
+		return access.fail("write test object "+key, err)
+	}
+	if _, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(cfg.Bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return access.fail("delete test object "+key, err)
+	}
+	access.Writable = true
+	return access
+}
+
+// ValidateConfig checks cfg as a POST of the config would, then confirms its storage is reachable
+// and writable, without applying anything
+func (c *Control) ValidateConfig(ctx context.Context, cfg *SystemConfig) ConfigValidation {
+	if err := cfg.validate(); err != nil {
+		return ConfigValidation{Error: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(ctx, storageValidationTimeout)
+	defer cancel()
+	access := checkStorageAccess(ctx, &cfg.Storage)
+	result := ConfigValidation{Valid: access.Reachable && access.Writable, Storage: &access}
+	if !result.Valid {
+		result.Error = "storage access check failed: " + access.Error
+	}
+	return result
+}
+
+// handleValidateConfig validates a config in dry-run mode, reporting 422 if it would not work
+func (c *Control) handleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := DefaultSystemConfig()
+	if err := decodeConfig(r.Body, &cfg); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result := c.ValidateConfig(r.Context(), &cfg)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,292 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultWarmerConcurrency is how many files are read at once when not configured
+const defaultWarmerConcurrency = 4
+
+// WarmerConfig holds settings for the warmer component
+type WarmerConfig struct {
+	// Dir is the directory whose files are read to warm the cache. Empty uses the JuiceFS active
+	// directory, active under juicefs.mount_dir, so reading fetches the files into the JuiceFS cache.
+	Dir string `json:"dir,omitempty"`
+	// Patterns lists the path.Match patterns, relative to Dir, of the files to warm, matched like
+	// sync.include. Required for the warmer stack.
+	Patterns []string `json:"patterns"`
+	// Concurrency is how many files are read at once. Zero uses the default of 4.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// validate checks the warmer settings
+func (cfg WarmerConfig) validate() error {
+	for _, pattern := range cfg.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid warmer pattern %q: %w", pattern, err)
+		}
+	}
+	if cfg.Concurrency < 0 {
+		return fmt.Errorf("warmer.concurrency must not be negative")
+	}
+	return nil
+}
+
+// concurrency returns how many files are read at once
+func (cfg WarmerConfig) concurrency() int {
+	if cfg.Concurrency == 0 {
+		return defaultWarmerConcurrency
+	}
+	return cfg.Concurrency
+}
+
+// readThrough reads a whole file and discards it, returning how many bytes were read
+func readThrough(p string) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, f)
+}
+
+// WarmerComponent implements StackComponent by reading a predictable working set once on setup,
+// so its data is fetched from object storage into the local cache before the app asks for it.
+// Warming runs in the background: setup does not wait for it and a failed read is only reported.
+type WarmerComponent struct {
+	mu       sync.Mutex // protects all fields below
+	settings WarmerConfig
+	juicefs  JuiceFSConfig // locates the JuiceFS active directory warmed by default
+	dir      string
+	total    int // files matching the patterns, known once the directory has been walked
+	warmed   int
+	bytes    int64
+	failed   int
+	started  time.Time
+	finished time.Time
+	lastErr  error
+	cancel   context.CancelFunc // cancels warming in progress
+	done     chan struct{}      // closed once warming has stopped
+	ops      *OperationRegistry // where warming in progress is listed, if set
+
+	// read reads a file through the cache, replaceable in tests
+	read func(path string) (int64, error)
+}
+
+// NewWarmerComponent creates a new warmer component
+func NewWarmerComponent() *WarmerComponent {
+	return &WarmerComponent{read: readThrough}
+}
+
+// Configure applies the warmer stack settings
+func (w *WarmerComponent) Configure(settings WarmerConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.settings = settings
+}
+
+// configureJuiceFS applies the juicefs stack settings, which locate the directory warmed by default
+func (w *WarmerComponent) configureJuiceFS(settings JuiceFSConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.juicefs = settings
+}
+
+// SetOperationRegistry sets the registry warming in progress is listed in, so it can be cancelled
+func (w *WarmerComponent) SetOperationRegistry(ops *OperationRegistry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ops = ops
+}
+
+// Name returns the stack name of the warmer component
+func (w *WarmerComponent) Name() string {
+	return "warmer"
+}
+
+// Setup starts warming the files matching the configured patterns in the background
+func (w *WarmerComponent) Setup(ctx context.Context, cfg *ObjectStorageConfig, juicefsPath string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.settings.Patterns) == 0 {
+		return fmt.Errorf("warmer.patterns is required for the warmer stack")
+	}
+	dir := w.settings.Dir
+	if dir == "" {
+		if cfg.EnvDir == "" {
+			return fmt.Errorf("warmer.dir or env_dir is required for the warmer stack")
+		}
+		dir = filepath.Join(w.juicefs.mountPath(cfg.EnvDir), "active")
+	}
+	// rule: the warmed directory must exist already, e.g. the juicefs stack is set up before the warmer
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("failed to open warmer directory: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("warmer directory %s is not a directory", dir)
+	}
+
+	w.dir = dir
+	w.total, w.warmed, w.bytes, w.failed = -1, 0, 0, 0
+	w.started, w.finished, w.lastErr = time.Now(), time.Time{}, nil
+	// Warming outlives the setup request, so it only stops on cleanup or when cancelled as an operation
+	warmCtx := context.Background()
+	var op *TrackedOperation
+	if w.ops != nil {
+		warmCtx, op = w.ops.Start(warmCtx, "warmup", "cache warmup of "+dir)
+	}
+	warmCtx, cancel := context.WithCancel(warmCtx)
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	go func() {
+		defer op.End()
+		w.warm(warmCtx, dir, w.settings, w.done)
+	}()
+	return nil
+}
+
+// warm reads every file under dir matching the patterns
+func (w *WarmerComponent) warm(ctx context.Context, dir string, settings WarmerConfig, done chan struct{}) {
+	defer RecoverPanic("cache warmer")
+	defer close(done)
+
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if matchesAny(settings.Patterns, filepath.ToSlash(rel)) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	w.mu.Lock()
+	w.total = len(files)
+	w.mu.Unlock()
+	if err != nil {
+		w.finish(fmt.Errorf("failed to list files to warm: %w", err))
+		return
+	}
+	logInfof("Warming %d files in %s", len(files), dir)
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for range min(settings.concurrency(), max(len(files), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				n, err := w.read(p)
+				w.mu.Lock()
+				w.bytes += n
+				if err != nil {
+					w.failed++
+					w.lastErr = fmt.Errorf("failed to warm %s: %w", p, err)
+				} else {
+					w.warmed++
+				}
+				setOperationProgress(ctx, "warmed %d of %d files", w.warmed, w.total)
+				w.mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, p := range files {
+		select {
+		case queue <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	w.finish(ctx.Err())
+}
+
+// finish records the end of warming
+func (w *WarmerComponent) finish(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.finished = time.Now()
+	if err != nil {
+		w.lastErr = err
+	}
+	if errors.Is(err, context.Canceled) {
+		logInfof("Cache warming stopped after %d of %d files", w.warmed, w.total)
+		return
+	}
+	logInfof("Warmed %d of %d files (%d bytes) in %v", w.warmed, w.total, w.bytes, w.finished.Sub(w.started))
+}
+
+// Cleanup stops warming in progress
+func (w *WarmerComponent) Cleanup(ctx context.Context) error {
+	w.mu.Lock()
+	cancel, done := w.cancel, w.done
+	w.cancel, w.done = nil, nil
+	w.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to stop cache warming: %w", ctx.Err())
+	}
+}
+
+// Status reports the progress of warming
+func (w *WarmerComponent) Status(ctx context.Context) map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := map[string]interface{}{
+		"dir":      w.dir,
+		"patterns": w.settings.Patterns,
+		"warmed":   w.warmed,
+		"failed":   w.failed,
+		"bytes":    w.bytes,
+	}
+	switch {
+	case w.started.IsZero():
+		status["state"] = "idle"
+	case w.finished.IsZero():
+		status["state"] = "warming"
+	case errors.Is(w.lastErr, context.Canceled):
+		status["state"] = "stopped"
+	default:
+		status["state"] = "done"
+	}
+	if w.total >= 0 && !w.started.IsZero() {
+		status["total"] = w.total
+	}
+	if !w.started.IsZero() {
+		status["started_at"] = w.started.UTC().Format(time.RFC3339)
+	}
+	if !w.finished.IsZero() {
+		status["finished_at"] = w.finished.UTC().Format(time.RFC3339)
+	}
+	if w.lastErr != nil {
+		status["last_error"] = w.lastErr.Error()
+	}
+	return status
+}
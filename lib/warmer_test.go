@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWarmerFetchesConfiguredPaths(t *testing.T) {
+	envDir := t.TempDir()
+	activeDir := filepath.Join(envDir, "juicefs", "active")
+	files := map[string]string{
+		"models/weights.bin": "0123456789",
+		"models/vocab.txt":   "abc",
+		"static/index.html":  "<html>",
+		"logs/app.log":       "noise",
+	}
+	for name, content := range files {
+		p := filepath.Join(activeDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	warmer := NewWarmerComponent()
+	var mu sync.Mutex
+	var read []string
+	warmer.read = func(p string) (int64, error) {
+		mu.Lock()
+		rel, _ := filepath.Rel(activeDir, p)
+		read = append(read, filepath.ToSlash(rel))
+		mu.Unlock()
+		return readThrough(p)
+	}
+	control := NewControl("localhost:8080", "fly-app-controller", "test-token", t.TempDir(), nil, warmer)
+	cfg := &SystemConfig{
+		Storage: ObjectStorageConfig{EnvDir: envDir},
+		Stacks:  []string{"warmer"},
+		Warmer:  WarmerConfig{Patterns: []string{"models", "*.html"}},
+	}
+	ctx := context.Background()
+	if err := control.setupComponents(ctx, cfg); err != nil {
+		t.Fatalf("Failed to set up warmer: %v", err)
+	}
+	defer warmer.Cleanup(ctx)
+
+	var status map[string]interface{}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if status = warmer.Status(ctx); status["state"] == "done" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for warming to finish, status %v", status)
+		}
+	}
+
+	slices.Sort(read)
+	if want := []string{"models/vocab.txt", "models/weights.bin", "static/index.html"}; !slices.Equal(read, want) {
+		t.Errorf("Expected the matching files %v to be warmed, got %v", want, read)
+	}
+	if status["total"] != 3 || status["warmed"] != 3 || status["failed"] != 0 {
+		t.Errorf("Expected 3 of 3 files warmed, got %v", status)
+	}
+	if status["bytes"] != int64(19) {
+		t.Errorf("Expected 19 bytes warmed, got %v", status["bytes"])
+	}
+	if _, ok := status["finished_at"]; !ok {
+		t.Errorf("Expected a completion time in status, got %v", status)
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 
 	"fly-user-env/cmd"
@@ -23,14 +23,23 @@ func main() {
 	switch args[0] {
 	case "server":
 		if err := cmd.RunServerAndWait(); err != nil {
-			log.Printf("Error: %v", err)
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	case "selftest":
+		ok, err := cmd.RunSelfTest(args[1:], os.Stdout)
+		if err != nil {
+			slog.Error("Self-test failed to run", "error", err)
+			os.Exit(2)
+		}
+		if !ok {
 			os.Exit(1)
 		}
 	case "version":
 		fmt.Println(String())
 
 	default:
-		log.Printf("Unknown command: %s", args[0])
+		slog.Error("Unknown command", "command", args[0])
 		os.Exit(1)
 	}
 }
@@ -70,4 +70,12 @@ func TestDBManagerIntegration(t *testing.T) {
 	// Test replication
 	require.NoError(t, dm.StartReplication())
 	require.NoError(t, dm.StopReplication())
+
+	// Test replication recovers after a credential refresh
+	require.NoError(t, dm.StartReplication())
+	refreshed := *config
+	require.NoError(t, dm.RefreshCredentials(&refreshed))
+	_, err = db.Exec("INSERT INTO test (value) VALUES (?)", "after-refresh")
+	require.NoError(t, err)
+	require.NoError(t, dm.StopReplication())
 }